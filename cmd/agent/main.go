@@ -6,20 +6,30 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/rayshoo/bakery/internal/agentapi"
+	"github.com/rayshoo/bakery/internal/delta"
+
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/klauspost/compress/zstd"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
@@ -53,6 +63,20 @@ type AgentResult struct {
 	ImageDigest string `json:"imageDigest"`
 	Success     bool   `json:"success"`
 	Error       string `json:"error,omitempty"`
+	Version     string `json:"version,omitempty"`
+
+	// Attempt echoes TASK_ATTEMPT so the controller can ignore results from
+	// agents that were replaced by a retry.
+	Attempt int `json:"attempt,omitempty"`
+
+	// PeakMemoryMiB and CPUSeconds are read from the container's cgroup, and are
+	// zero when the cgroup does not expose them.
+	PeakMemoryMiB int64   `json:"peakMemoryMiB,omitempty"`
+	CPUSeconds    float64 `json:"cpuSeconds,omitempty"`
+
+	// OCILayoutKey is the context bucket key of the tarred OCI layout, uploaded for
+	// no-push builds with KANIKO_OCI_LAYOUT_PATH set.
+	OCILayoutKey string `json:"ociLayoutKey,omitempty"`
 }
 
 func getenv(key, def string) string {
@@ -62,6 +86,218 @@ func getenv(key, def string) string {
 	return def
 }
 
+// keepaliveInterval returns AGENT_KEEPALIVE_INTERVAL, falling back to the default
+// for unset, invalid or non-positive values.
+func keepaliveInterval() time.Duration {
+	v := os.Getenv("AGENT_KEEPALIVE_INTERVAL")
+	if v == "" {
+		return agentapi.DefaultKeepaliveInterval
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("[agent] invalid AGENT_KEEPALIVE_INTERVAL %q, using %v\n", v, agentapi.DefaultKeepaliveInterval)
+		return agentapi.DefaultKeepaliveInterval
+	}
+	return d
+}
+
+// stepTimeoutEnv maps agent steps to the env var bounding how long they may run.
+// Steps without an entry are only bounded by the overall build context.
+var stepTimeoutEnv = map[string]string{
+	"download": "STEP_TIMEOUT_DOWNLOAD",
+	"extract":  "STEP_TIMEOUT_EXTRACT",
+	"pre":      "STEP_TIMEOUT_SCRIPT",
+	"kaniko":   "STEP_TIMEOUT_KANIKO",
+	"post":     "STEP_TIMEOUT_SCRIPT",
+}
+
+// errStepTimeout marks a step that was killed at its STEP_TIMEOUT_* deadline.
+var errStepTimeout = errors.New("timeout")
+
+// stepTimeout returns the configured timeout for step, or 0 when the step has none.
+func stepTimeout(step string) time.Duration {
+	key, ok := stepTimeoutEnv[step]
+	if !ok {
+		return 0
+	}
+	v := os.Getenv(key)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("[agent] invalid %s %q, ignoring\n", key, v)
+		return 0
+	}
+	return d
+}
+
+// keepalive calls beat every interval until stop is closed or ctx is done, keeping
+// the ingest connection busy behind load balancers with short idle timeouts.
+func keepalive(ctx context.Context, interval time.Duration, stop <-chan struct{}, beat func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			beat()
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// contextArchiveExt returns the archive extension of a context key.
+// Keys without a known extension are treated as gzip tarballs, as before compression was configurable.
+func contextArchiveExt(key string) string {
+	switch {
+	case strings.HasSuffix(key, ".tar.zst"):
+		return ".tar.zst"
+	case strings.HasSuffix(key, ".tar"):
+		return ".tar"
+	}
+	return ".tar.gz"
+}
+
+// extractArgs returns the tar arguments that unpack archive into dir. A zstd
+// archive is read from stdin, where extractContext streams it decompressed.
+func extractArgs(archive, dir string) []string {
+	switch {
+	case strings.HasSuffix(archive, ".tar.gz"):
+		return []string{"-xzf", archive, "-C", dir}
+	case strings.HasSuffix(archive, ".tar.zst"):
+		return []string{"-xf", "-", "-C", dir}
+	}
+	return []string{"-xf", archive, "-C", dir}
+}
+
+// extractContext unpacks archive into dir with tar. The busybox tar in the agent
+// image has no zstd support, so a zstd archive is decompressed in process and piped
+// to tar rather than written out as a second, uncompressed copy.
+func extractContext(ctx context.Context, archive, dir string, logf func(string)) error {
+	cmd := exec.CommandContext(ctx, "tar", extractArgs(archive, dir)...)
+	if strings.HasSuffix(archive, ".tar.zst") {
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("zstd reader: %w", err)
+		}
+		defer zr.Close()
+		cmd.Stdin = zr.IOReadCloser()
+	}
+	return attachStreaming(cmd, logf)
+}
+
+// restoreDeltaContext rebuilds the build context in workspace from a delta upload manifest
+// and the content-addressed blobs it references.
+func restoreDeltaContext(ctx context.Context, s3Client *minio.Client, bucket, manifestKey, workspace string, logf func(string)) error {
+	logf(fmt.Sprintf("downloading manifest s3://%s/%s", bucket, manifestKey))
+
+	obj, err := s3Client.GetObject(ctx, bucket, manifestKey, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("get manifest: %w", err)
+	}
+	defer obj.Close()
+
+	m, err := delta.Parse(obj)
+	if err != nil {
+		return err
+	}
+	logf(fmt.Sprintf("restoring context: %s", m))
+
+	if err := os.MkdirAll(workspace, 0755); err != nil {
+		return fmt.Errorf("create workspace dir: %w", err)
+	}
+
+	return delta.Restore(ctx, m, workspace, func(ctx context.Context, key string) (io.ReadCloser, error) {
+		return s3Client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	})
+}
+
+// inlineDockerfileName is the workspace file an inline or fetched Dockerfile is written to.
+const inlineDockerfileName = ".bakery.Dockerfile"
+
+// writeInlineDockerfile writes content into workspace and returns the path to pass to --dockerfile.
+func writeInlineDockerfile(workspace, content string) (string, error) {
+	path := filepath.Join(workspace, inlineDockerfileName)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return "", fmt.Errorf("write inline dockerfile: %w", err)
+	}
+	return path, nil
+}
+
+// maxDockerfileBytes caps the size of a Dockerfile fetched from dockerfile-url.
+const maxDockerfileBytes = 1 << 20
+
+// redactURL returns rawURL without its userinfo, query and fragment, which may carry
+// tokens, so it can be logged. An unparsable URL is replaced entirely.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid url>"
+	}
+	u.User = nil
+	if u.RawQuery != "" || u.ForceQuery {
+		u.RawQuery, u.ForceQuery = "REDACTED", false
+	}
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
+}
+
+// fetchDockerfile downloads the Dockerfile at rawURL into workspace and returns the
+// path to pass to --dockerfile. Only http and https URLs are accepted. Errors name
+// the URL only in its redacted form.
+func fetchDockerfile(ctx context.Context, rawURL, workspace string) (string, error) {
+	safeURL := redactURL(rawURL)
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid dockerfile url %q: want an http or https URL", safeURL)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("fetch dockerfile %s: invalid request", safeURL)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// A *url.Error repeats the full URL, so report only its cause.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("fetch dockerfile %s: %w", safeURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch dockerfile %s: %s", safeURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDockerfileBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("fetch dockerfile: %w", err)
+	}
+	if len(body) > maxDockerfileBytes {
+		return "", fmt.Errorf("fetch dockerfile %s: larger than %d bytes", safeURL, maxDockerfileBytes)
+	}
+
+	path := filepath.Join(workspace, inlineDockerfileName)
+	if err := os.WriteFile(path, body, 0644); err != nil {
+		return "", fmt.Errorf("write dockerfile: %w", err)
+	}
+	return path, nil
+}
+
 // getTaskColor returns the terminal color code for a task ID.
 func getTaskColor(taskID string) string {
 	if colorIdx := os.Getenv("TASK_COLOR_INDEX"); colorIdx != "" {
@@ -99,6 +335,8 @@ func main() {
 	if targetArch == "" {
 		targetArch = "unknown"
 	}
+	// TASK_ATTEMPT is unset when the controller predates attempts; 0 is sent as "current".
+	taskAttempt, _ := strconv.Atoi(os.Getenv("TASK_ATTEMPT"))
 
 	executorPlatform := getenv("EXECUTOR_PLATFORM", "ecs")
 
@@ -115,6 +353,7 @@ func main() {
 	req = req.WithContext(ctx)
 	req.TransferEncoding = []string{"chunked"}
 	req.ContentLength = -1
+	req.Header.Set("X-Agent-Version", version)
 
 	tr := &http.Transport{
 		TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
@@ -138,6 +377,10 @@ func main() {
 			errCh <- err
 			return
 		}
+		if resp.StatusCode == http.StatusConflict {
+			body, _ := io.ReadAll(resp.Body)
+			log.Fatalf("[agent] controller rejected agent: %s", strings.TrimSpace(string(body)))
+		}
 		log.Printf("[agent] ingest connected: %s\n", resp.Status)
 		respCh <- resp
 	}()
@@ -146,24 +389,15 @@ func main() {
 	stopKeepalive := make(chan struct{})
 	defer close(stopKeepalive)
 
-	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				logMu.Lock()
-				_, _ = w.WriteString("\n")
-				_ = w.Flush()
-				logMu.Unlock()
-			case <-stopKeepalive:
-				return
-			case <-ctx.Done():
-				return
-			}
+	go keepalive(ctx, keepaliveInterval(), stopKeepalive, func() {
+		logMu.Lock()
+		_, _ = w.WriteString(agentapi.HeartbeatLine + "\n")
+		err := w.Flush()
+		logMu.Unlock()
+		if err != nil {
+			log.Printf("[agent] heartbeat failed, controller unreachable: %v\n", err)
 		}
-	}()
+	})
 
 	taskColor := getTaskColor(taskID)
 
@@ -180,10 +414,14 @@ func main() {
 
 	exitCode := 0
 	var imageDigest string
+	var ociLayoutKey string
 
 	fail := func(step string, err error) {
 		logLine(step, "error", fmt.Sprintf("%serror:%s %s", colorRed, colorReset, err.Error()))
-		exitCode = 1
+		exitCode = stepExitCode(step)
+		if errors.Is(err, errStepTimeout) {
+			exitCode = agentapi.ExitTimeout
+		}
 	}
 
 	exitWithFlush := func() {
@@ -194,7 +432,10 @@ func main() {
 			Arch:        targetArch,
 			ImageDigest: imageDigest,
 			Success:     exitCode == 0,
+			Version:     version,
+			Attempt:     taskAttempt,
 		}
+		result.PeakMemoryMiB, result.CPUSeconds = cgroupUsage(cgroupRoot)
 		if exitCode != 0 {
 			result.Error = "build failed"
 		}
@@ -214,19 +455,21 @@ func main() {
 		exitWithFlush()
 	}
 
+	contextArchive := "/tmp/context" + contextArchiveExt(contextKey)
+
 	if err := os.MkdirAll("/tmp", 0755); err != nil {
 		fail("init", fmt.Errorf("create temporary dir: %w", err))
 		exitWithFlush()
 	}
 
 	if err := runStep(ctx, "download", logLine, func(ctx context.Context, logf func(string)) error {
-		endpoint := normalizeEndpoint(os.Getenv("STORAGE_ENDPOINT"))
-		region := getenv("STORAGE_REGION", "us-east-1")
-		useSSL := getenv("STORAGE_USE_SSL", "true") == "true"
-
-		s3Client, err := newS3Client(ctx, endpoint, region, useSSL)
+		s3Client, err := storageClient(ctx, logf)
 		if err != nil {
-			return fmt.Errorf("create s3 client: %w", err)
+			return err
+		}
+
+		if delta.IsManifestKey(contextKey) {
+			return restoreDeltaContext(ctx, s3Client, contextBucket, contextKey, "/workspace", logf)
 		}
 
 		logf(fmt.Sprintf("downloading s3://%s/%s", contextBucket, contextKey))
@@ -237,7 +480,7 @@ func main() {
 		}
 		defer obj.Close()
 
-		outFile, err := os.Create("/tmp/context.tar.gz")
+		outFile, err := os.Create(contextArchive)
 		if err != nil {
 			return fmt.Errorf("create file: %w", err)
 		}
@@ -256,11 +499,15 @@ func main() {
 	}
 
 	if err := runStep(ctx, "extract", logLine, func(ctx context.Context, logf func(string)) error {
+		if delta.IsManifestKey(contextKey) {
+			logf("context restored from manifest, nothing to extract")
+			return nil
+		}
 		if err := os.MkdirAll("/workspace", 0755); err != nil {
 			return fmt.Errorf("create workspace dir: %w", err)
 		}
-		logf("extracting /tmp/context.tar.gz to /workspace")
-		return runCmdStreaming(ctx, "tar", []string{"-xzf", "/tmp/context.tar.gz", "-C", "/workspace"}, logf)
+		logf(fmt.Sprintf("extracting %s to /workspace", contextArchive))
+		return extractContext(ctx, contextArchive, "/workspace", logf)
 	}); err != nil {
 		fail("extract", err)
 		exitWithFlush()
@@ -293,9 +540,18 @@ func main() {
 	preScript := os.Getenv("PRE_SCRIPT")
 	if preScript != "" {
 		if err := runStep(ctx, "pre", logLine, func(ctx context.Context, logf func(string)) error {
+			dir, err := scriptDir(os.Getenv("SCRIPT_WORKDIR"), "/workspace", getenv("KANIKO_CONTEXT", "."))
+			if err != nil {
+				return err
+			}
+			buildArgs, _, err := loadBuildArgs("/workspace", getenv("KANIKO_CONTEXT", "."))
+			if err != nil {
+				return err
+			}
 			logf(preScript)
 			cmd := exec.CommandContext(ctx, "sh", "-ce", preScript)
-			cmd.Dir = "/"
+			cmd.Dir = dir
+			cmd.Env = scriptEnv(os.Environ(), buildArgs)
 			return attachStreaming(cmd, logf)
 		}); err != nil {
 			fail("pre", err)
@@ -303,11 +559,45 @@ func main() {
 		}
 	}
 
+	// kaniko builds and pushes in one run; a failure after it starts pushing is
+	// reported as a push failure.
+	var pushing atomic.Bool
 	if err := runStep(ctx, "kaniko", logLine, func(ctx context.Context, logf func(string)) error {
+		executor, err := kanikoExecutor(getenv("KANIKO_EXECUTOR_PATH", defaultKanikoExecutor))
+		if err != nil {
+			return err
+		}
+
+		if extraHosts := os.Getenv("EXTRA_HOSTS"); extraHosts != "" {
+			added, err := addExtraHosts("/etc/hosts", extraHosts)
+			if err != nil {
+				return err
+			}
+			if len(added) > 0 {
+				logf(fmt.Sprintf("extra hosts: %s", strings.Join(added, ", ")))
+			}
+		}
+
 		kanikoContext := getenv("KANIKO_CONTEXT", ".")
 		kanikoDockerfile := getenv("KANIKO_DOCKERFILE", "Dockerfile")
 		kanikoDestination := os.Getenv("KANIKO_DESTINATION")
 
+		if inline := os.Getenv("KANIKO_DOCKERFILE_INLINE"); inline != "" {
+			path, err := writeInlineDockerfile("/workspace", inline)
+			if err != nil {
+				return err
+			}
+			logf(fmt.Sprintf("using inline Dockerfile (%d bytes): %s", len(inline), path))
+			kanikoDockerfile = path
+		} else if dockerfileURL := os.Getenv("KANIKO_DOCKERFILE_URL"); dockerfileURL != "" {
+			path, err := fetchDockerfile(ctx, dockerfileURL, "/workspace")
+			if err != nil {
+				return err
+			}
+			logf(fmt.Sprintf("using Dockerfile from %s: %s", redactURL(dockerfileURL), path))
+			kanikoDockerfile = path
+		}
+
 		if kanikoDestination == "" {
 			return fmt.Errorf("KANIKO_DESTINATION not set")
 		}
@@ -319,18 +609,22 @@ func main() {
 			"--digest-file=/tmp/image-digest",
 		}
 
-		customBuildArgs := make(map[string]string)
-		if customArgs := os.Getenv("KANIKO_BUILD_ARGS"); customArgs != "" {
-			for _, pair := range strings.Split(customArgs, ",") {
-				if pair != "" {
-					parts := strings.SplitN(pair, "=", 2)
-					if len(parts) == 2 {
-						customBuildArgs[parts[0]] = parts[1]
-					}
-				}
+		// Mirrors are pushed from the same build, so every destination gets the same digest.
+		for _, mirror := range strings.Split(os.Getenv("KANIKO_MIRRORS"), ",") {
+			if mirror = strings.TrimSpace(mirror); mirror != "" {
+				args = append(args, fmt.Sprintf("--destination=%s", mirror))
+				logf(fmt.Sprintf("also pushing to %s", mirror))
 			}
 		}
 
+		customBuildArgs, added, err := loadBuildArgs("/workspace", kanikoContext)
+		if err != nil {
+			return err
+		}
+		if file := os.Getenv("KANIKO_BUILD_ARGS_FILE"); file != "" {
+			logf(fmt.Sprintf("read %d build args from %s", added, file))
+		}
+
 		if _, exists := customBuildArgs["TARGETPLATFORM"]; !exists {
 			if v := os.Getenv("TARGETPLATFORM"); v != "" {
 				args = append(args, fmt.Sprintf("--build-arg=TARGETPLATFORM=%s", v))
@@ -363,10 +657,22 @@ func main() {
 			args = append(args, fmt.Sprintf("--build-arg=BUILDARCH=%s", runtime.GOARCH))
 		}
 
+		autoArgs, missing := autoBuildArgs(os.Getenv("KANIKO_AUTO_BUILD_ARGS"), customBuildArgs, buildID, time.Now())
+		args = append(args, autoArgs...)
+		for _, name := range missing {
+			logf(fmt.Sprintf("auto build arg %s skipped: kaniko.revision is not set", name))
+		}
+
 		for key, value := range customBuildArgs {
 			args = append(args, fmt.Sprintf("--build-arg=%s=%s", key, value))
 		}
 
+		labels, err := labelArgs(os.Getenv("KANIKO_LABELS"))
+		if err != nil {
+			return err
+		}
+		args = append(args, labels...)
+
 		if getenv("KANIKO_CACHE_ENABLE", "false") == "true" {
 			args = append(args, "--cache=true")
 			if repo := os.Getenv("KANIKO_CACHE_REPO"); repo != "" {
@@ -394,6 +700,10 @@ func main() {
 			args = append(args, "--use-new-run")
 		}
 
+		if skip := os.Getenv("KANIKO_SKIP_UNUSED_STAGES"); skip != "" {
+			args = append(args, fmt.Sprintf("--skip-unused-stages=%t", skip == "true"))
+		}
+
 		if getenv("KANIKO_CLEANUP", "false") == "true" {
 			args = append(args, "--cleanup")
 		}
@@ -402,28 +712,12 @@ func main() {
 			args = append(args, fmt.Sprintf("--custom-platform=%s", platform))
 		}
 
-		if getenv("KANIKO_NO_PUSH", "false") == "true" {
-			args = append(args, "--no-push")
-		}
+		noPush := getenv("KANIKO_NO_PUSH", "false") == "true"
+		ociLayoutPath := os.Getenv("KANIKO_OCI_LAYOUT_PATH")
+		args = append(args, kanikoOutputArgs(ociLayoutPath, noPush)...)
 
-		ignorePathsEnv := os.Getenv("KANIKO_IGNORE_PATH")
-		ignorePaths := make([]string, 0, 4)
-		seenIgnore := map[string]bool{}
-
-		for _, path := range strings.Split(ignorePathsEnv, ",") {
-			path = strings.TrimSpace(path)
-			if path == "" {
-				continue
-			}
-			if !seenIgnore[path] {
-				ignorePaths = append(ignorePaths, path)
-				seenIgnore[path] = true
-			}
-		}
-		if !seenIgnore["/workspace"] {
-			ignorePaths = append(ignorePaths, "/workspace")
-		}
-		for _, path := range ignorePaths {
+		ignoreWorkspace := getenv("KANIKO_IGNORE_WORKSPACE", "true") != "false"
+		for _, path := range kanikoIgnorePaths(os.Getenv("KANIKO_IGNORE_PATH"), ignoreWorkspace) {
 			args = append(args, fmt.Sprintf("--ignore-path=%s", path))
 		}
 
@@ -432,14 +726,36 @@ func main() {
 			args = append(args, extraArgs...)
 		}
 
-		logf(fmt.Sprintf("running: /kaniko/executor %s", strings.Join(args, " ")))
-		if err := runCmdStreaming(ctx, "/kaniko/executor", args, logf); err != nil {
+		logf(fmt.Sprintf("running: %s %s", executor, strings.Join(args, " ")))
+		stages := &stageAnnotator{total: countDockerfileStages(dockerfilePath(kanikoDockerfile, "/workspace", kanikoContext))}
+		kanikoLogf := func(line string) {
+			if strings.Contains(line, "Pushing image to") {
+				pushing.Store(true)
+			}
+			logf(stages.annotate(line))
+		}
+		if err := runCmdStreaming(ctx, executor, args, kanikoLogf); err != nil {
 			return err
 		}
 
-		if getenv("KANIKO_NO_PUSH", "false") == "true" {
+		if noPush {
 			logf("no-push mode: skipping digest read")
 			imageDigest = "no-push"
+			if ociLayoutPath == "" {
+				return nil
+			}
+			if contextBucket == "" {
+				return fmt.Errorf("CONTEXT_BUCKET not set, cannot upload the oci layout")
+			}
+			s3Client, err := storageClient(ctx, logf)
+			if err != nil {
+				return err
+			}
+			key := ociLayoutObjectKey(buildID, taskID)
+			if err := uploadOCILayout(ctx, s3Client, ociLayoutPath, contextBucket, key, logf); err != nil {
+				return err
+			}
+			ociLayoutKey = key
 			return nil
 		}
 
@@ -452,16 +768,29 @@ func main() {
 
 		return nil
 	}); err != nil {
-		fail("kaniko", err)
+		if pushing.Load() {
+			fail("push", err)
+		} else {
+			fail("kaniko", err)
+		}
 		exitWithFlush()
 	}
 
 	postScript := os.Getenv("POST_SCRIPT")
 	if postScript != "" {
 		if err := runStep(ctx, "post", logLine, func(ctx context.Context, logf func(string)) error {
+			dir, err := scriptDir(os.Getenv("SCRIPT_WORKDIR"), "/workspace", getenv("KANIKO_CONTEXT", "."))
+			if err != nil {
+				return err
+			}
+			buildArgs, _, err := loadBuildArgs("/workspace", getenv("KANIKO_CONTEXT", "."))
+			if err != nil {
+				return err
+			}
 			logf(postScript)
 			cmd := exec.CommandContext(ctx, "sh", "-ce", postScript)
-			cmd.Dir = "/"
+			cmd.Dir = dir
+			cmd.Env = scriptEnv(os.Environ(), buildArgs)
 			return attachStreaming(cmd, logf)
 		}); err != nil {
 			fail("post", err)
@@ -476,6 +805,14 @@ func main() {
 		Arch:        targetArch,
 		ImageDigest: imageDigest,
 		Success:     true,
+		Version:     version,
+		Attempt:     taskAttempt,
+
+		OCILayoutKey: ociLayoutKey,
+	}
+	result.PeakMemoryMiB, result.CPUSeconds = cgroupUsage(cgroupRoot)
+	if result.PeakMemoryMiB > 0 {
+		logLine("agent", "info", fmt.Sprintf("peak memory %d MiB, cpu time %.1fs", result.PeakMemoryMiB, result.CPUSeconds))
 	}
 	if err := sendResult(controllerURL, buildID, taskID, result); err != nil {
 		logLine("agent", "error", fmt.Sprintf("failed to send result: %v", err))
@@ -487,6 +824,396 @@ func main() {
 	}
 }
 
+// kanikoStagePattern matches the line kaniko logs when it starts a build stage, e.g.
+// "Building stage 'golang:1.22' [idx: '0', base-idx: '-1']".
+var kanikoStagePattern = regexp.MustCompile(`Building stage '[^']*' \[idx: '(\d+)'`)
+
+// stageAnnotator prefixes kaniko output with the build stage parsed from kaniko's own
+// "Building stage" lines, e.g. "[stage 2/3] RUN make". Lines before the first stage
+// are left as they are. kaniko writes to stdout and stderr concurrently, hence the lock.
+type stageAnnotator struct {
+	mu      sync.Mutex
+	total   int
+	current int
+}
+
+func (a *stageAnnotator) annotate(line string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if m := kanikoStagePattern.FindStringSubmatch(line); m != nil {
+		if idx, err := strconv.Atoi(m[1]); err == nil {
+			a.current = idx + 1
+		}
+	}
+	switch {
+	case a.current == 0:
+		return line
+	case a.total >= a.current:
+		return fmt.Sprintf("[stage %d/%d] %s", a.current, a.total, line)
+	default:
+		return fmt.Sprintf("[stage %d] %s", a.current, line)
+	}
+}
+
+// dockerfilePath resolves the --dockerfile value: absolute paths as they are,
+// relative ones inside the build context.
+func dockerfilePath(dockerfile, workspace, kanikoContext string) string {
+	if filepath.IsAbs(dockerfile) {
+		return dockerfile
+	}
+	return filepath.Join(workspace, kanikoContext, dockerfile)
+}
+
+// countDockerfileStages returns the number of FROM instructions in the Dockerfile at
+// path, or 0 if it cannot be read.
+func countDockerfileStages(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.EqualFold(fields[0], "FROM") {
+			n++
+		}
+	}
+	return n
+}
+
+// autoBuildArgs turns the comma-separated auto-build-args entries in spec into kaniko
+// --build-arg flags. Args already in explicit are left to it, and GIT_SHA is returned
+// in missing instead when the revision was not passed in the KANIKO_REVISION env var.
+func autoBuildArgs(spec string, explicit map[string]string, buildID string, now time.Time) (args, missing []string) {
+	for _, entry := range strings.Split(spec, ",") {
+		name, ok := agentapi.AutoBuildArgNames[strings.TrimSpace(entry)]
+		if !ok {
+			continue
+		}
+		if _, exists := explicit[name]; exists {
+			continue
+		}
+
+		var value string
+		switch name {
+		case "BUILD_ID":
+			value = buildID
+		case "BUILD_DATE":
+			value = now.UTC().Format(time.RFC3339)
+		case "GIT_SHA":
+			value = os.Getenv("KANIKO_REVISION")
+		}
+		if value == "" {
+			missing = append(missing, name)
+			continue
+		}
+		args = append(args, fmt.Sprintf("--build-arg=%s=%s", name, value))
+	}
+	return args, missing
+}
+
+// labelArgs turns the labels encoded in KANIKO_LABELS into kaniko --label flags,
+// sorted by name.
+func labelArgs(labels string) ([]string, error) {
+	m, err := agentapi.DecodeMap(labels)
+	if err != nil {
+		return nil, fmt.Errorf("parse KANIKO_LABELS: %w", err)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	args := make([]string, 0, len(keys))
+	for _, k := range keys {
+		args = append(args, fmt.Sprintf("--label=%s=%s", k, m[k]))
+	}
+	return args, nil
+}
+
+// kanikoOutputArgs returns the kaniko flags for where the image goes besides its
+// destinations: an OCI layout at ociLayoutPath, and no push with noPush.
+func kanikoOutputArgs(ociLayoutPath string, noPush bool) []string {
+	var args []string
+	if ociLayoutPath != "" {
+		args = append(args, fmt.Sprintf("--oci-layout-path=%s", ociLayoutPath))
+	}
+	if noPush {
+		args = append(args, "--no-push")
+	}
+	return args
+}
+
+// ociLayoutObjectKey is where the OCI layout of a task is uploaded in the context bucket.
+func ociLayoutObjectKey(buildID, taskID string) string {
+	return fmt.Sprintf("results/%s/%s/oci-layout.tar", buildID, taskID)
+}
+
+// objectUploader is the part of the storage client used to upload build results.
+type objectUploader interface {
+	FPutObject(ctx context.Context, bucket, object, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error)
+}
+
+// uploadOCILayout tars the OCI layout kaniko wrote at layoutPath and uploads it to
+// bucket under key.
+func uploadOCILayout(ctx context.Context, client objectUploader, layoutPath, bucket, key string, logf func(string)) error {
+	archive := filepath.Join(os.TempDir(), "oci-layout.tar")
+	if err := runCmdStreaming(ctx, "tar", []string{"-cf", archive, "-C", layoutPath, "."}, logf); err != nil {
+		return fmt.Errorf("tar oci layout: %w", err)
+	}
+	defer os.Remove(archive)
+
+	info, err := client.FPutObject(ctx, bucket, key, archive, minio.PutObjectOptions{ContentType: "application/x-tar"})
+	if err != nil {
+		return fmt.Errorf("upload oci layout: %w", err)
+	}
+	logf(fmt.Sprintf("uploaded oci layout to s3://%s/%s (%d bytes)", bucket, key, info.Size))
+	return nil
+}
+
+// kanikoIgnorePaths returns the deduplicated, comma-separated ignore paths from env.
+// /workspace, where the agent extracts the context, is appended unless ignoreWorkspace
+// is false, in which case only the explicit paths are kept.
+func kanikoIgnorePaths(env string, ignoreWorkspace bool) []string {
+	paths := make([]string, 0, 4)
+	seen := map[string]bool{}
+
+	for _, path := range strings.Split(env, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" || seen[path] {
+			continue
+		}
+		paths = append(paths, path)
+		seen[path] = true
+	}
+	if ignoreWorkspace && !seen["/workspace"] {
+		paths = append(paths, "/workspace")
+	}
+	return paths
+}
+
+// addExtraHosts appends the host=ip pairs of EXTRA_HOSTS to the hosts file at path,
+// which RUN instructions resolve names with, skipping entries already present. It
+// returns the entries it added.
+func addExtraHosts(path, extraHosts string) ([]string, error) {
+	existing, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("extra hosts: %w", err)
+	}
+	present := map[string]bool{}
+	for _, line := range strings.Split(string(existing), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		for _, host := range fields[1:] {
+			present[fields[0]+" "+host] = true
+		}
+	}
+
+	var added []string
+	var b strings.Builder
+	if len(existing) > 0 && !bytes.HasSuffix(existing, []byte("\n")) {
+		b.WriteString("\n")
+	}
+	for _, pair := range strings.Split(extraHosts, ",") {
+		host, ip, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || host == "" || ip == "" {
+			return nil, fmt.Errorf("extra hosts: invalid entry %q, want host=ip", pair)
+		}
+		if present[ip+" "+host] {
+			continue
+		}
+		fmt.Fprintf(&b, "%s\t%s\n", ip, host)
+		added = append(added, host+"="+ip)
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("extra hosts: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(b.String()); err != nil {
+		return nil, fmt.Errorf("extra hosts: %w", err)
+	}
+	return added, nil
+}
+
+// defaultKanikoExecutor is where the kaniko image ships its executor.
+const defaultKanikoExecutor = "/kaniko/executor"
+
+// kanikoExecutor checks that path, from KANIKO_EXECUTOR_PATH, is an executable
+// file, so an agent image with a misplaced executor or wrapper fails with a clear
+// error instead of a bare exec failure.
+func kanikoExecutor(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("kaniko executor: %w", err)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("kaniko executor: %s is a directory", path)
+	}
+	if info.Mode().Perm()&0o111 == 0 {
+		return "", fmt.Errorf("kaniko executor: %s is not executable", path)
+	}
+	return path, nil
+}
+
+// scriptDir returns the directory pre/post scripts run in for the given
+// SCRIPT_WORKDIR mode: / for "root" (or unset), or the kaniko context inside
+// workspace for "context", which must exist.
+func scriptDir(mode, workspace, kanikoContext string) (string, error) {
+	switch mode {
+	case "", "root":
+		return "/", nil
+	case "context":
+		dir := filepath.Join(workspace, kanikoContext)
+		info, err := os.Stat(dir)
+		if err != nil {
+			return "", fmt.Errorf("script workdir: %w", err)
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("script workdir: %s is not a directory", dir)
+		}
+		return dir, nil
+	default:
+		return "", fmt.Errorf("invalid SCRIPT_WORKDIR %q: want context or root", mode)
+	}
+}
+
+// stepExitCode returns the exit code for a failure in step, so the executors can
+// tell which phase of the task failed.
+func stepExitCode(step string) int {
+	switch step {
+	case "download":
+		return agentapi.ExitDownload
+	case "extract":
+		return agentapi.ExitExtract
+	case "kaniko":
+		return agentapi.ExitKaniko
+	case "push":
+		return agentapi.ExitPush
+	case "pre", "post":
+		return agentapi.ExitScript
+	default:
+		return agentapi.ExitUnknown
+	}
+}
+
+// loadBuildArgs returns the explicit build args from KANIKO_BUILD_ARGS merged with
+// KANIKO_BUILD_ARGS_FILE, read relative to the kaniko context in workspace. It also
+// returns the number of args taken from the file.
+func loadBuildArgs(workspace, kanikoContext string) (map[string]string, int, error) {
+	buildArgs, err := agentapi.DecodeMap(os.Getenv("KANIKO_BUILD_ARGS"))
+	if err != nil {
+		return nil, 0, fmt.Errorf("parse KANIKO_BUILD_ARGS: %w", err)
+	}
+
+	file := os.Getenv("KANIKO_BUILD_ARGS_FILE")
+	if file == "" {
+		return buildArgs, 0, nil
+	}
+	added, err := mergeBuildArgsFile(buildArgs, filepath.Join(workspace, kanikoContext, file))
+	if err != nil {
+		return nil, 0, err
+	}
+	return buildArgs, added, nil
+}
+
+// scriptEnv returns the environment for pre/post scripts: environ plus the build
+// platform vars and the build args, so scripts see the same values as the Dockerfile.
+// The TARGET* platform vars are already part of the agent's environment.
+func scriptEnv(environ []string, buildArgs map[string]string) []string {
+	env := append([]string{}, environ...)
+	env = append(env,
+		"BUILDPLATFORM="+runtime.GOOS+"/"+runtime.GOARCH,
+		"BUILDOS="+runtime.GOOS,
+		"BUILDARCH="+runtime.GOARCH,
+	)
+	keys := make([]string, 0, len(buildArgs))
+	for k := range buildArgs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+buildArgs[k])
+	}
+	return env
+}
+
+// mergeBuildArgsFile adds the KEY=VALUE lines of the file at path to args, keeping
+// entries already in args. Blank lines and lines starting with # are skipped, and
+// values may be wrapped in matching quotes. It returns the number of args added.
+func mergeBuildArgsFile(args map[string]string, path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("read build args file: %w", err)
+	}
+
+	added := 0
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return 0, fmt.Errorf("build args file %s line %d: want KEY=VALUE", path, i+1)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if _, exists := args[key]; !exists {
+			args[key] = value
+			added++
+		}
+	}
+	return added, nil
+}
+
+// cgroupRoot is where the container's cgroup filesystem is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupUsage returns the container's peak memory in MiB and its CPU time in seconds,
+// read from cgroup v2 (memory.peak, cpu.stat) or, failing that, cgroup v1 files.
+// Values the kernel does not expose are returned as zero.
+func cgroupUsage(root string) (peakMemoryMiB int64, cpuSeconds float64) {
+	readInt := func(name string) (int64, bool) {
+		b, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		return n, err == nil
+	}
+
+	if peak, ok := readInt("memory.peak"); ok {
+		peakMemoryMiB = peak >> 20
+	} else if peak, ok := readInt("memory/memory.max_usage_in_bytes"); ok {
+		peakMemoryMiB = peak >> 20
+	}
+
+	if b, err := os.ReadFile(filepath.Join(root, "cpu.stat")); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			if v, ok := strings.CutPrefix(line, "usage_usec "); ok {
+				if usec, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+					cpuSeconds = float64(usec) / 1e6
+				}
+			}
+		}
+	} else if nsec, ok := readInt("cpuacct/cpuacct.usage"); ok {
+		cpuSeconds = float64(nsec) / 1e9
+	}
+	return peakMemoryMiB, cpuSeconds
+}
+
 func sendResult(baseURL, buildID, taskID string, result AgentResult) error {
 	url := fmt.Sprintf("%s/build/%s/result?task=%s", baseURL, buildID, taskID)
 	body, _ := json.Marshal(result)
@@ -506,21 +1233,38 @@ func sendResult(baseURL, buildID, taskID string, result AgentResult) error {
 	return nil
 }
 
-func newS3Client(ctx context.Context, endpoint, region string, useSSL bool) (*minio.Client, error) {
-	if endpoint == "" {
-		endpoint = "s3.amazonaws.com"
-		useSSL = true
+// bucketLookup returns path-style addressing when STORAGE_USE_PATH_STYLE is true, as many
+// self-hosted object stores behind a single domain require, and auto detection otherwise.
+func bucketLookup() minio.BucketLookupType {
+	if getenv("STORAGE_USE_PATH_STYLE", "false") == "true" {
+		return minio.BucketLookupPath
 	}
+	return minio.BucketLookupAuto
+}
+
+// storageClient connects to STORAGE_ENDPOINT and logs how its SSL setting was chosen.
+func storageClient(ctx context.Context, logf func(string)) (*minio.Client, error) {
+	endpoint, useSSL, source := agentapi.StorageEndpoint(os.Getenv("STORAGE_ENDPOINT"), os.Getenv("STORAGE_USE_SSL"))
+	logf(fmt.Sprintf("storage ssl=%t (%s)", useSSL, source))
+
+	client, err := newS3Client(ctx, endpoint, getenv("STORAGE_REGION", "us-east-1"), useSSL)
+	if err != nil {
+		return nil, fmt.Errorf("create s3 client: %w", err)
+	}
+	return client, nil
+}
 
+func newS3Client(ctx context.Context, endpoint, region string, useSSL bool) (*minio.Client, error) {
 	accessKey := getenv("STORAGE_ACCESS_KEY", "")
 	secretKey := getenv("STORAGE_SECRET_KEY", "")
 	sessionToken := getenv("STORAGE_SESSION_TOKEN", "")
 
 	if accessKey != "" && secretKey != "" {
 		return minio.New(endpoint, &minio.Options{
-			Creds:  credentials.NewStaticV4(accessKey, secretKey, sessionToken),
-			Region: region,
-			Secure: useSSL,
+			Creds:        credentials.NewStaticV4(accessKey, secretKey, sessionToken),
+			Region:       region,
+			Secure:       useSSL,
+			BucketLookup: bucketLookup(),
 		})
 	}
 
@@ -535,9 +1279,10 @@ func newS3Client(ctx context.Context, endpoint, region string, useSSL bool) (*mi
 	}
 
 	return minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken),
-		Region: region,
-		Secure: useSSL,
+		Creds:        credentials.NewStaticV4(creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken),
+		Region:       region,
+		Secure:       useSSL,
+		BucketLookup: bucketLookup(),
 	})
 }
 
@@ -580,9 +1325,22 @@ func runStep(
 		logLine(step, "info", msg)
 	}
 
+	parent := ctx
+	timeout := stepTimeout(step)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, timeout)
+		defer cancel()
+	}
+
 	logF(fmt.Sprintf("%sstart%s", colorCyan, colorReset))
 	err := fn(ctx, logF)
 	if err != nil {
+		// Only the step's own deadline counts as a timeout; the overall build
+		// context expiring is reported as a failure of whatever step was running.
+		if timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) && parent.Err() == nil {
+			err = fmt.Errorf("%w: step exceeded %v: %v", errStepTimeout, timeout, err)
+		}
 		logLine(step, "error", err.Error())
 		return err
 	}
@@ -631,16 +1389,3 @@ func attachStreaming(cmd *exec.Cmd, logf func(string)) error {
 	wg.Wait()
 	return cmd.Wait()
 }
-
-func normalizeEndpoint(ep string) string {
-	ep = strings.TrimSpace(ep)
-	if ep == "" {
-		return ""
-	}
-	if ep == "s3.amazonaws.com" {
-		return ""
-	}
-	ep = strings.TrimPrefix(ep, "http://")
-	ep = strings.TrimPrefix(ep, "https://")
-	return ep
-}
@@ -13,25 +13,70 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/delta"
+	"github.com/rayshoo/bakery/internal/ignore"
+
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/compose-spec/compose-go/v2/interpolation"
 	"github.com/joho/godotenv"
+	"github.com/klauspost/compress/zstd"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 	"gopkg.in/yaml.v3"
 )
 
-func loadEnv() { _ = godotenv.Load(".env") }
+// loadEnv loads env files into the process environment without overriding variables
+// that are already set. With no files it loads .env when present; named files must
+// exist, and later files override earlier ones.
+func loadEnv(files []string) error {
+	if len(files) == 0 {
+		_ = godotenv.Load(".env")
+		return nil
+	}
+
+	merged := map[string]string{}
+	for _, file := range files {
+		vars, err := godotenv.Read(file)
+		if err != nil {
+			return fmt.Errorf("env file %s: %w", file, err)
+		}
+		for k, v := range vars {
+			merged[k] = v
+		}
+	}
+	for k, v := range merged {
+		if _, ok := os.LookupEnv(k); !ok {
+			_ = os.Setenv(k, v)
+		}
+	}
+	return nil
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
 
 func getenv(key, def string) string {
 	if v := os.Getenv(key); v != "" {
@@ -40,20 +85,160 @@ func getenv(key, def string) string {
 	return def
 }
 
+func getenvInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
 func randHex(n int) string {
 	b := make([]byte, n)
 	_, _ = rand.Read(b)
 	return hex.EncodeToString(b)
 }
 
-func tarGzDir(src string, w io.Writer) error {
-	gw := gzip.NewWriter(w)
-	defer gw.Close()
+// Defaults for CONTROLLER_CONNECT_TIMEOUT and CONTROLLER_REQUEST_TIMEOUT.
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultRequestTimeout = 60 * time.Second
+)
 
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+// apiClient sends the short controller requests (submit, status) and streamClient
+// reads log streams, which stay open for the whole build and so have no request
+// timeout. main replaces both with newControllerClients once the env is loaded.
+var (
+	apiClient    = http.DefaultClient
+	streamClient = http.DefaultClient
+)
 
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+// newControllerClients returns the controller clients described at apiClient. Both
+// share one pooled transport whose connect and TLS handshake are bounded by
+// CONTROLLER_CONNECT_TIMEOUT; apiClient requests are bounded by CONTROLLER_REQUEST_TIMEOUT.
+func newControllerClients() (*http.Client, *http.Client, error) {
+	connectTimeout, err := envDuration("CONTROLLER_CONNECT_TIMEOUT", defaultConnectTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	requestTimeout, err := envDuration("CONTROLLER_REQUEST_TIMEOUT", defaultRequestTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          32,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{Transport: transport, Timeout: requestTimeout}, &http.Client{Transport: transport}, nil
+}
+
+// envDuration parses the duration in env key, returning def when it is unset.
+// A zero duration disables the timeout.
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s %q: want a duration such as 30s", key, v)
+	}
+	return d, nil
+}
+
+// Context compression formats, negotiated with the agent through the object extension.
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionNone = "none"
+)
+
+// contextCompression selects how the build context tarball is compressed.
+type contextCompression struct {
+	format string
+	level  int
+}
+
+// parseCompression parses the -compression flag: a gzip level from 0 to 9, "zstd",
+// "none" for an uncompressed tarball, or empty for gzip's default level.
+func parseCompression(v string) (contextCompression, error) {
+	switch v = strings.TrimSpace(v); v {
+	case "", compressionGzip:
+		return contextCompression{format: compressionGzip, level: gzip.DefaultCompression}, nil
+	case compressionZstd:
+		return contextCompression{format: compressionZstd}, nil
+	case compressionNone:
+		return contextCompression{format: compressionNone}, nil
+	}
+
+	level, err := strconv.Atoi(v)
+	if err != nil || level < gzip.NoCompression || level > gzip.BestCompression {
+		return contextCompression{}, fmt.Errorf("invalid compression %q: want 0-9, zstd or none", v)
+	}
+	return contextCompression{format: compressionGzip, level: level}, nil
+}
+
+// ext returns the object extension the agent uses to pick the decompressor.
+func (c contextCompression) ext() string {
+	switch c.format {
+	case compressionZstd:
+		return ".tar.zst"
+	case compressionNone:
+		return ".tar"
+	default:
+		return ".tar.gz"
+	}
+}
+
+// writeContext writes src as a tarball to w, compressed according to c.
+func writeContext(src string, w io.Writer, c contextCompression) error {
+	var cw io.WriteCloser
+	switch c.format {
+	case compressionNone:
+		return tarDir(src, w)
+	case compressionZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		cw = zw
+	default:
+		gw, err := gzip.NewWriterLevel(w, c.level)
+		if err != nil {
+			return err
+		}
+		cw = gw
+	}
+
+	if err := tarDir(src, cw); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// tarDir writes src to w as a tar stream, leaving out .git directories and the
+// paths matched by .bakeryignore.
+func tarDir(src string, w io.Writer) error {
+	ignored, err := ignore.Load(src)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", ignore.FileName, err)
+	}
+
+	tw := tar.NewWriter(w)
+
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -67,6 +252,12 @@ func tarGzDir(src string, w io.Writer) error {
 		if rel == "." {
 			return nil
 		}
+		if ignored.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
 		hdr, err := tar.FileInfoHeader(info, "")
 		if err != nil {
@@ -90,6 +281,20 @@ func tarGzDir(src string, w io.Writer) error {
 		}
 		return nil
 	})
+	if err != nil {
+		tw.Close()
+		return err
+	}
+	return tw.Close()
+}
+
+// bucketLookup returns path-style addressing when S3_USE_PATH_STYLE is true, as many
+// self-hosted object stores behind a single domain require, and auto detection otherwise.
+func bucketLookup() minio.BucketLookupType {
+	if getenv("S3_USE_PATH_STYLE", "false") == "true" {
+		return minio.BucketLookupPath
+	}
+	return minio.BucketLookupAuto
 }
 
 func newS3Client(ctx context.Context) (*minio.Client, string, error) {
@@ -108,9 +313,10 @@ func newS3Client(ctx context.Context) (*minio.Client, string, error) {
 
 	if accessKey != "" && secretKey != "" {
 		cli, err := minio.New(endpoint, &minio.Options{
-			Creds:  credentials.NewStaticV4(accessKey, secretKey, sessionToken),
-			Region: region,
-			Secure: useSSL,
+			Creds:        credentials.NewStaticV4(accessKey, secretKey, sessionToken),
+			Region:       region,
+			Secure:       useSSL,
+			BucketLookup: bucketLookup(),
 		})
 		if err != nil {
 			return nil, "", err
@@ -128,9 +334,10 @@ func newS3Client(ctx context.Context) (*minio.Client, string, error) {
 	}
 
 	cli, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(v.AccessKeyID, v.SecretAccessKey, v.SessionToken),
-		Region: region,
-		Secure: useSSL,
+		Creds:        credentials.NewStaticV4(v.AccessKeyID, v.SecretAccessKey, v.SessionToken),
+		Region:       region,
+		Secure:       useSSL,
+		BucketLookup: bucketLookup(),
 	})
 	if err != nil {
 		return nil, "", err
@@ -150,14 +357,244 @@ func uploadToS3(ctx context.Context, cli *minio.Client, bucket, object, path str
 		return err
 	}
 
+	contentType := "application/gzip"
+	switch {
+	case strings.HasSuffix(object, ".tar.zst"):
+		contentType = "application/zstd"
+	case strings.HasSuffix(object, ".tar"):
+		contentType = "application/x-tar"
+	}
+
+	partSize, threads, err := uploadTuning()
+	if err != nil {
+		return err
+	}
+	class, err := storageClass()
+	if err != nil {
+		return err
+	}
+	sse, err := serverSideEncryption()
+	if err != nil {
+		return err
+	}
+
 	_, err = cli.PutObject(ctx, bucket, object, f, st.Size(), minio.PutObjectOptions{
-		ContentType: "application/gzip",
-		PartSize:    5 << 20,
-		NumThreads:  1,
+		ContentType:          contentType,
+		PartSize:             partSize,
+		NumThreads:           threads,
+		StorageClass:         class,
+		ServerSideEncryption: sse,
 	})
 	return err
 }
 
+// serverSideEncryption returns the encryption requested for uploads by S3_SSE:
+// "AES256" for SSE-S3, or "aws:kms" for SSE-KMS with the key in S3_SSE_KMS_KEY_ID
+// (the bucket's default KMS key when unset). It returns nil when S3_SSE is unset,
+// leaving encryption to the bucket default. The agent reads SSE-S3 and SSE-KMS
+// objects without extra headers, given kms:Decrypt on the key.
+func serverSideEncryption() (encrypt.ServerSide, error) {
+	mode := strings.TrimSpace(os.Getenv("S3_SSE"))
+	keyID := strings.TrimSpace(os.Getenv("S3_SSE_KMS_KEY_ID"))
+	switch mode {
+	case "":
+		if keyID != "" {
+			return nil, fmt.Errorf("S3_SSE_KMS_KEY_ID requires S3_SSE=aws:kms")
+		}
+		return nil, nil
+	case "AES256":
+		if keyID != "" {
+			return nil, fmt.Errorf("S3_SSE_KMS_KEY_ID requires S3_SSE=aws:kms, got %s", mode)
+		}
+		return encrypt.NewSSE(), nil
+	case "aws:kms":
+		return encrypt.NewSSEKMS(keyID, nil)
+	default:
+		return nil, fmt.Errorf("S3_SSE %q: want AES256 or aws:kms", mode)
+	}
+}
+
+// knownStorageClasses are the S3 storage classes S3_STORAGE_CLASS is checked against.
+// Other names are passed through with a warning, for S3-compatible stores with their own classes.
+var knownStorageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER_IR":          true,
+	"EXPRESS_ONEZONE":     true,
+}
+
+// storageClass returns the storage class for uploaded contexts from S3_STORAGE_CLASS,
+// or "" for the bucket default. Archive classes are rejected because the agent could
+// not download the context without restoring it first.
+func storageClass() (string, error) {
+	v := strings.ToUpper(strings.TrimSpace(os.Getenv("S3_STORAGE_CLASS")))
+	switch {
+	case v == "":
+		return "", nil
+	case v == "GLACIER" || v == "DEEP_ARCHIVE":
+		return "", fmt.Errorf("S3_STORAGE_CLASS %s: archived objects cannot be read by the agent", v)
+	case strings.Trim(v, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != "":
+		return "", fmt.Errorf("S3_STORAGE_CLASS %q: invalid storage class name", v)
+	case !knownStorageClasses[v]:
+		log.Printf("[WARN] S3_STORAGE_CLASS %s is not a known S3 storage class, passing it through", v)
+	}
+	return v, nil
+}
+
+// verifyUpload checks that the uploaded object has the size of the local file at path,
+// catching truncated uploads before the agent fails to extract them.
+func verifyUpload(ctx context.Context, cli *minio.Client, bucket, object, path string) error {
+	local, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	info, err := cli.StatObject(ctx, bucket, object, minio.StatObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("stat %s/%s: %w", bucket, object, err)
+	}
+	if info.Size != local.Size() {
+		return fmt.Errorf("uploaded object %s/%s is %d bytes, but the local context is %d bytes", bucket, object, info.Size, local.Size())
+	}
+	return nil
+}
+
+// Multipart upload limits: S3 rejects parts under 5 MiB (except the last) and over 5 GiB.
+const (
+	minPartSizeMB     = 5
+	maxPartSizeMB     = 5 * 1024
+	defaultPartSizeMB = 16
+	defaultThreads    = 4
+)
+
+// uploadTuning returns the multipart part size in bytes and the number of parts uploaded
+// in parallel, from S3_UPLOAD_PART_SIZE (e.g. "64Mi", plain numbers are MiB) and S3_UPLOAD_THREADS.
+func uploadTuning() (uint64, uint, error) {
+	partSizeMB := int64(defaultPartSizeMB)
+	if v := os.Getenv("S3_UPLOAD_PART_SIZE"); v != "" {
+		mb, err := config.ParseMemory(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("S3_UPLOAD_PART_SIZE: %w", err)
+		}
+		if mb < minPartSizeMB || mb > maxPartSizeMB {
+			return 0, 0, fmt.Errorf("S3_UPLOAD_PART_SIZE %q: must be between 5Mi and 5Gi", v)
+		}
+		partSizeMB = mb
+	}
+
+	threads := getenvInt("S3_UPLOAD_THREADS", defaultThreads)
+	if threads < 1 {
+		return 0, 0, fmt.Errorf("S3_UPLOAD_THREADS must be at least 1, got %d", threads)
+	}
+	return uint64(partSizeMB) << 20, uint(threads), nil
+}
+
+// uploadDelta uploads the files of repoPath as content-addressed blobs, skipping blobs
+// the bucket already holds, followed by the manifest the agent rebuilds the context from.
+// Blobs are shared between builds, so only the manifest gets S3_STORAGE_CLASS.
+// A held blob older than DELTA_BLOB_REFRESH is uploaded again, so a lifecycle rule
+// expiring blobs/ after a longer age never removes a blob a new manifest refers to.
+// It returns the manifest's object key, which is used as the context key.
+func uploadDelta(ctx context.Context, cli *minio.Client, bucket, repoPath string) (string, error) {
+	class, err := storageClass()
+	if err != nil {
+		return "", err
+	}
+	refresh, err := envDuration("DELTA_BLOB_REFRESH", 0)
+	if err != nil {
+		return "", err
+	}
+	sse, err := serverSideEncryption()
+	if err != nil {
+		return "", err
+	}
+
+	m, err := delta.Build(repoPath)
+	if err != nil {
+		return "", fmt.Errorf("build manifest: %w", err)
+	}
+	log.Printf("Context manifest: %s", m)
+
+	blobs := m.Blobs()
+	sums := make([]string, 0, len(blobs))
+	for sum := range blobs {
+		sums = append(sums, sum)
+	}
+
+	var (
+		mu       sync.Mutex
+		uploaded int
+		bytesUp  int64
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	sem := make(chan struct{}, getenvInt("DELTA_UPLOAD_CONCURRENCY", 16))
+
+	for _, sum := range sums {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(sum string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			key := delta.BlobKey(sum)
+			if info, err := cli.StatObject(ctx, bucket, key, minio.StatObjectOptions{}); err == nil {
+				if refresh == 0 || time.Since(info.LastModified) < refresh {
+					return
+				}
+			} else if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("stat %s: %w", key, err)
+				}
+				mu.Unlock()
+				return
+			}
+
+			path := filepath.Join(repoPath, filepath.FromSlash(blobs[sum]))
+			info, err := cli.FPutObject(ctx, bucket, key, path, minio.PutObjectOptions{
+				ContentType:          "application/octet-stream",
+				ServerSideEncryption: sse,
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("upload %s: %w", blobs[sum], err)
+				}
+				return
+			}
+			uploaded++
+			bytesUp += info.Size
+		}(sum)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return "", firstErr
+	}
+	log.Printf("Uploaded %d of %d blobs (%d bytes), %d already in bucket", uploaded, len(sums), bytesUp, len(sums)-uploaded)
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	object := fmt.Sprintf("repos/%d-%s/%s", time.Now().Unix(), randHex(4), delta.ManifestName)
+	log.Printf("Uploading manifest to s3: %s/%s", bucket, object)
+	if _, err = cli.PutObject(ctx, bucket, object, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:          "application/json",
+		StorageClass:         class,
+		ServerSideEncryption: sse,
+	}); err != nil {
+		return "", fmt.Errorf("upload manifest: %w", err)
+	}
+	return object, nil
+}
+
 type ComposeFile struct {
 	Services map[string]ComposeService `yaml:"services"`
 }
@@ -168,24 +605,106 @@ type ComposeService struct {
 }
 
 type ComposeBuild struct {
-	Context    string            `yaml:"context"`
-	Dockerfile string            `yaml:"dockerfile"`
-	Args       map[string]string `yaml:"args"`
-	XBake      *XBake            `yaml:"x-bake"`
+	Context          string            `yaml:"context"`
+	Dockerfile       string            `yaml:"dockerfile"`
+	DockerfileInline string            `yaml:"dockerfile_inline"`
+	Args             map[string]string `yaml:"args"`
+	XBake            *XBake            `yaml:"x-bake"`
 }
 
 type XBake struct {
 	Platforms []string `yaml:"platforms"`
+
+	// Cache is mapped onto the service's kaniko.cache. CacheFrom and CacheTo take
+	// buildx cache specs; only registry caches can be expressed in kaniko.
+	Cache     *XBakeCache `yaml:"cache"`
+	CacheFrom []string    `yaml:"cache-from"`
+	CacheTo   []string    `yaml:"cache-to"`
+}
+
+type XBakeCache struct {
+	Enable *bool  `yaml:"enable"`
+	Repo   string `yaml:"repo"`
+	TTL    string `yaml:"ttl"`
+}
+
+// kanikoCache returns the kaniko.cache settings x describes, or nil when it has none,
+// along with warnings for the cache specs kaniko cannot express.
+func (x *XBake) kanikoCache() (map[string]interface{}, []string, error) {
+	cache := map[string]interface{}{}
+	if x.Cache != nil {
+		if x.Cache.Enable != nil {
+			cache["enable"] = *x.Cache.Enable
+		}
+		if x.Cache.Repo != "" {
+			cache["repo"] = x.Cache.Repo
+		}
+		if x.Cache.TTL != "" {
+			if _, err := time.ParseDuration(x.Cache.TTL); err != nil {
+				return nil, nil, fmt.Errorf("x-bake cache.ttl %q: %w", x.Cache.TTL, err)
+			}
+			cache["ttl"] = x.Cache.TTL
+		}
+	}
+
+	var warnings []string
+	registryRefs := func(key string, specs []string) []string {
+		var refs []string
+		for _, spec := range specs {
+			ref, typ := parseBuildxCacheSpec(spec)
+			if typ != "registry" || ref == "" {
+				warnings = append(warnings, fmt.Sprintf("x-bake %s %q ignored: kaniko only supports registry caches", key, spec))
+				continue
+			}
+			refs = append(refs, config.ImageRepository(ref))
+		}
+		return refs
+	}
+	if from := registryRefs("cache-from", x.CacheFrom); len(from) > 0 {
+		cache["from"] = from
+	}
+	if to := registryRefs("cache-to", x.CacheTo); len(to) > 0 {
+		if len(to) > 1 {
+			warnings = append(warnings, fmt.Sprintf("x-bake cache-to lists %d registry caches; kaniko writes only to %s", len(to), to[0]))
+		}
+		cache["to"] = to[0]
+	}
+
+	if len(cache) == 0 {
+		return nil, warnings, nil
+	}
+	return cache, warnings, nil
+}
+
+// parseBuildxCacheSpec returns the ref and type of a buildx cache spec such as
+// "type=registry,ref=registry.example.com/app:cache". A bare ref is a registry cache.
+func parseBuildxCacheSpec(spec string) (ref, typ string) {
+	spec = strings.TrimSpace(spec)
+	if !strings.Contains(spec, "=") {
+		return spec, "registry"
+	}
+	for _, field := range strings.Split(spec, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch k {
+		case "type":
+			typ = v
+		case "ref":
+			ref = v
+		}
+	}
+	return ref, typ
 }
 
 type GlobalConfig struct {
 	Platform          string                 `yaml:"platform"`
 	Arch              string                 `yaml:"arch"`
 	Env               map[string]string      `yaml:"env"`
+	Labels            map[string]string      `yaml:"labels"`
 	CPU               string                 `yaml:"cpu"`
 	Memory            string                 `yaml:"memory"`
 	PreScript         *string                `yaml:"pre-script"`
 	PostScript        *string                `yaml:"post-script"`
+	ScriptWorkdir     string                 `yaml:"script-workdir,omitempty"`
 	KanikoCredentials []RegistryCredential   `yaml:"kaniko-credentials"`
 	Kaniko            map[string]interface{} `yaml:"kaniko"`
 }
@@ -194,18 +713,21 @@ type BakeConfig struct {
 	Platform          string                 `yaml:"platform"`
 	Arch              string                 `yaml:"arch"`
 	Env               map[string]string      `yaml:"env"`
+	Labels            map[string]string      `yaml:"labels"`
 	CPU               string                 `yaml:"cpu"`
 	Memory            string                 `yaml:"memory"`
 	PreScript         *string                `yaml:"pre-script"`
 	PostScript        *string                `yaml:"post-script"`
+	ScriptWorkdir     string                 `yaml:"script-workdir,omitempty"`
 	KanikoCredentials []RegistryCredential   `yaml:"kaniko-credentials"`
 	Kaniko            map[string]interface{} `yaml:"kaniko"`
 }
 
 type RegistryCredential struct {
-	Registry string `yaml:"registry"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Registry  string `yaml:"registry"`
+	Username  string `yaml:"username,omitempty"`
+	Password  string `yaml:"password,omitempty"`
+	SecretARN string `yaml:"secret-arn,omitempty"`
 }
 
 type BuildConfig struct {
@@ -218,6 +740,20 @@ type ServiceBuildConfig struct {
 	Config      BuildConfig
 }
 
+// setRevision sets kaniko.revision to revision in every config that does not set one.
+func setRevision(configs []ServiceBuildConfig, revision string) {
+	for i := range configs {
+		kaniko := configs[i].Config.Global.Kaniko
+		if kaniko == nil {
+			kaniko = map[string]interface{}{}
+			configs[i].Config.Global.Kaniko = kaniko
+		}
+		if v, ok := kaniko["revision"]; !ok || v == "" {
+			kaniko["revision"] = revision
+		}
+	}
+}
+
 // interpolateCompose applies environment variable interpolation to a compose file.
 func interpolateCompose(composeBytes []byte) ([]byte, error) {
 	var raw map[string]interface{}
@@ -303,6 +839,7 @@ func mergeComposeToConfig(baseConfig *BuildConfig, composePath string, services
 				Memory:            baseConfig.Global.Memory,
 				PreScript:         baseConfig.Global.PreScript,
 				PostScript:        baseConfig.Global.PostScript,
+				ScriptWorkdir:     baseConfig.Global.ScriptWorkdir,
 				KanikoCredentials: baseConfig.Global.KanikoCredentials,
 			},
 			Bake: []BakeConfig{},
@@ -315,6 +852,13 @@ func mergeComposeToConfig(baseConfig *BuildConfig, composePath string, services
 			}
 		}
 
+		if len(baseConfig.Global.Labels) > 0 {
+			serviceConfig.Global.Labels = make(map[string]string)
+			for k, v := range baseConfig.Global.Labels {
+				serviceConfig.Global.Labels[k] = v
+			}
+		}
+
 		serviceConfig.Global.Kaniko = make(map[string]interface{})
 		for k, v := range baseConfig.Global.Kaniko {
 			serviceConfig.Global.Kaniko[k] = v
@@ -332,6 +876,10 @@ func mergeComposeToConfig(baseConfig *BuildConfig, composePath string, services
 			serviceConfig.Global.Kaniko["dockerfile"] = "Dockerfile"
 		}
 
+		if svc.Build.DockerfileInline != "" {
+			serviceConfig.Global.Kaniko["dockerfile-inline"] = svc.Build.DockerfileInline
+		}
+
 		finalBuildArgs := make(map[string]string)
 		if globalArgs, ok := baseConfig.Global.Kaniko["build-args"].(map[string]interface{}); ok {
 			for k, v := range globalArgs {
@@ -352,6 +900,28 @@ func mergeComposeToConfig(baseConfig *BuildConfig, composePath string, services
 			serviceConfig.Global.Kaniko["destination"] = destination
 		}
 
+		if svc.Build.XBake != nil {
+			xcache, warnings, err := svc.Build.XBake.kanikoCache()
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %w", svcName, err)
+			}
+			for _, w := range warnings {
+				log.Printf("[WARN] service %s: %s", svcName, w)
+			}
+			if xcache != nil {
+				cache := make(map[string]interface{})
+				if base, ok := serviceConfig.Global.Kaniko["cache"].(map[string]interface{}); ok {
+					for k, v := range base {
+						cache[k] = v
+					}
+				}
+				for k, v := range xcache {
+					cache[k] = v
+				}
+				serviceConfig.Global.Kaniko["cache"] = cache
+			}
+		}
+
 		for _, platform := range platforms {
 			arch := strings.TrimPrefix(platform, "linux/")
 			bake := BakeConfig{
@@ -380,31 +950,100 @@ type logEntry struct {
 	TS      string `json:"ts"`
 	Level   string `json:"level"`
 	Message string `json:"message"`
+
+	// Event is set on structured lines; "build_result" carries the build's final Status and Error.
+	Event  string `json:"event"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
 }
 
-type buildResult struct {
-	ServiceName string
-	Error       error
+type batchService struct {
+	Name   string      `yaml:"name"`
+	Config BuildConfig `yaml:"config"`
+}
+
+type batchRequest struct {
+	Services []batchService `yaml:"services"`
+}
+
+type batchResponse struct {
+	BuildID string            `json:"buildID"`
+	Status  string            `json:"status"`
+	Builds  map[string]string `json:"builds"`
+}
+
+// serviceRun is a service build submitted by this client run.
+// Err is the error seen while following its log stream, if any.
+type serviceRun struct {
+	Service string
+	BuildID string
+	Err     error
+}
+
+// buildStatus is the response of GET /build/:id/status.
+type buildStatus struct {
+	BuildID        string     `json:"buildID"`
+	Status         string     `json:"status"`
+	StartedAt      time.Time  `json:"startedAt"`
+	FinishedAt     *time.Time `json:"finishedAt"`
+	ManifestDigest string     `json:"manifestDigest"`
+	Error          string     `json:"error"`
+	Tasks          map[string]struct {
+		Arch        string `json:"arch"`
+		ImageDigest string `json:"imageDigest"`
+		Success     bool   `json:"success"`
+	} `json:"tasks"`
+}
+
+// serviceSummary is one row of the end-of-run summary.
+type serviceSummary struct {
+	Service  string   `json:"service"`
+	BuildID  string   `json:"buildID"`
+	Arches   []string `json:"arches"`
+	Status   string   `json:"status"`
+	Duration string   `json:"duration,omitempty"`
+	Digest   string   `json:"digest,omitempty"`
+	Error    string   `json:"error,omitempty"`
 }
 
 var version = "dev"
 
 func main() {
-	loadEnv()
-
+	var envFiles stringList
+	flag.Var(&envFiles, "env-file", "env file to load instead of .env; repeatable, later files override earlier ones")
 	var configPath = flag.String("config", "", "path to build config yaml file (optional)")
 	var composePath = flag.String("compose", "", "path to docker-compose.yaml file (optional)")
 	var servicesFlag = flag.String("services", "", "comma-separated list of services to build (empty = all)")
 	var asyncMode = flag.Bool("async", false, "build services asynchronously")
+	var noWaitMode = flag.Bool("no-wait", false, "submit every service and exit without waiting for the builds")
+	var compressionFlag = flag.String("compression", "", "context compression: gzip level 0-9, zstd, or none (default: gzip default level)")
+	var verifyUploadFlag = flag.Bool("verify-upload", true, "check that the uploaded context matches the local file size before submitting")
+	var deltaMode = flag.Bool("delta", false, "upload only the files missing from the bucket instead of a full tarball")
+	var watchMode = flag.Bool("watch", false, "reconnect dropped log streams until the build finishes")
 	var repoPath = flag.String("repo", ".", "path to repository root")
+	var showSummary = flag.Bool("summary", true, "print a summary of every service when the run finishes")
+	var outputFormat = flag.String("output", "text", "summary format: text or json")
+	var digestOut = flag.String("digest-out", "", "write service=digest lines for the pushed images to this file")
+	var revisionFlag = flag.String("revision", "", "source revision (e.g. git SHA) for kaniko.revision, unless the config sets one")
+	var logsToStderr = flag.Bool("logs-to-stderr", false, "write streamed build logs to stderr so stdout carries only the summary")
 	var showVersion = flag.Bool("version", false, "print version and exit")
 	flag.Parse()
+	logOutput = logWriter(*logsToStderr)
 
 	if *showVersion {
 		fmt.Println(version)
 		os.Exit(0)
 	}
 
+	if err := loadEnv(envFiles); err != nil {
+		log.Fatal(err)
+	}
+
+	var err error
+	if apiClient, streamClient, err = newControllerClients(); err != nil {
+		log.Fatal(err)
+	}
+
 	if *configPath == "" && *composePath == "" {
 		*configPath = "config.yaml"
 	}
@@ -450,32 +1089,53 @@ func main() {
 	if len(serviceBuildConfigs) == 0 {
 		log.Fatal("No build configurations found")
 	}
+	if *revisionFlag != "" {
+		setRevision(serviceBuildConfigs, *revisionFlag)
+	}
 
 	s3Cli, bucket, err := newS3Client(ctx)
 	if err != nil {
 		log.Fatalf("newS3Client: %v", err)
 	}
 
-	tmpBase := getenv("TMPDIR", "/builds/tmp")
-	_ = os.MkdirAll(tmpBase, 0o755)
+	var object string
+	if *deltaMode {
+		object, err = uploadDelta(ctx, s3Cli, bucket, *repoPath)
+		if err != nil {
+			log.Fatalf("uploadDelta: %v", err)
+		}
+	} else {
+		compression, err := parseCompression(*compressionFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	tmp := filepath.Join(tmpBase, fmt.Sprintf("repo-%d-%s.tar.gz", time.Now().Unix(), randHex(4)))
-	f, err := os.Create(tmp)
-	if err != nil {
-		log.Fatalf("create temp: %v", err)
-	}
-	if err = tarGzDir(*repoPath, f); err != nil {
-		log.Fatalf("tarGzDir: %v", err)
-	}
-	f.Close()
-	defer os.Remove(tmp)
+		tmpBase := getenv("TMPDIR", "/builds/tmp")
+		_ = os.MkdirAll(tmpBase, 0o755)
 
-	object := fmt.Sprintf("repos/%d-%s/repo.tar.gz", time.Now().Unix(), randHex(4))
-	log.Printf("Uploading to s3: %s/%s", bucket, object)
-	if err = uploadToS3(ctx, s3Cli, bucket, object, tmp); err != nil {
-		log.Fatalf("uploadToS3: %v", err)
+		tmp := filepath.Join(tmpBase, fmt.Sprintf("repo-%d-%s%s", time.Now().Unix(), randHex(4), compression.ext()))
+		f, err := os.Create(tmp)
+		if err != nil {
+			log.Fatalf("create temp: %v", err)
+		}
+		if err = writeContext(*repoPath, f, compression); err != nil {
+			log.Fatalf("writeContext: %v", err)
+		}
+		f.Close()
+		defer os.Remove(tmp)
+
+		object = fmt.Sprintf("repos/%d-%s/repo%s", time.Now().Unix(), randHex(4), compression.ext())
+		log.Printf("Uploading to s3: %s/%s", bucket, object)
+		if err = uploadToS3(ctx, s3Cli, bucket, object, tmp); err != nil {
+			log.Fatalf("uploadToS3: %v", err)
+		}
+		if *verifyUploadFlag {
+			if err := verifyUpload(ctx, s3Cli, bucket, object, tmp); err != nil {
+				log.Fatalf("verifyUpload: %v", err)
+			}
+		}
+		log.Println("Upload complete")
 	}
-	log.Println("Upload complete")
 
 	controllerURL := getenv("CONTROLLER_URL", "")
 	if controllerURL == "" {
@@ -483,16 +1143,49 @@ func main() {
 	}
 	buildToken := os.Getenv("BUILD_CONTROLLER_TOKEN")
 
+	if *noWaitMode {
+		submitNoWait(controllerURL, buildToken, serviceBuildConfigs, object)
+		return
+	}
+
+	var runs []serviceRun
 	if *asyncMode {
-		buildAsync(ctx, controllerURL, buildToken, serviceBuildConfigs, object)
+		runs = buildAsync(ctx, controllerURL, buildToken, serviceBuildConfigs, object, *watchMode)
 	} else {
-		buildSync(ctx, controllerURL, buildToken, serviceBuildConfigs, object)
+		runs = buildSync(ctx, controllerURL, buildToken, serviceBuildConfigs, object, *watchMode)
+	}
+
+	summaries := summarizeRuns(controllerURL, buildToken, runs)
+	if *showSummary {
+		if err := printSummary(os.Stdout, summaries, *outputFormat); err != nil {
+			log.Printf("print summary: %v", err)
+		}
 	}
+
+	if *digestOut != "" {
+		if err := writeDigests(*digestOut, summaries); err != nil {
+			log.Fatalf("write digests: %v", err)
+		}
+	}
+
+	var failed []string
+	for _, s := range summaries {
+		if s.Status != "succeeded" {
+			failed = append(failed, s.Service)
+		}
+	}
+	if len(failed) > 0 {
+		log.Fatalf("\nFailed services: %s", strings.Join(failed, ", "))
+	}
+
+	log.Println("\nAll services completed successfully")
 }
 
-func buildSync(ctx context.Context, controllerURL, buildToken string, serviceBuildConfigs []ServiceBuildConfig, object string) {
+// buildSync builds services one after another and stops at the first failed service.
+func buildSync(ctx context.Context, controllerURL, buildToken string, serviceBuildConfigs []ServiceBuildConfig, object string, watch bool) []serviceRun {
 	log.Printf("Building %d services synchronously", len(serviceBuildConfigs))
 
+	runs := make([]serviceRun, 0, len(serviceBuildConfigs))
 	for i, sbc := range serviceBuildConfigs {
 		serviceName := sbc.ServiceName
 		if serviceName == "" {
@@ -507,99 +1200,107 @@ func buildSync(ctx context.Context, controllerURL, buildToken string, serviceBui
 			log.Fatalf("marshal config for %s: %v", serviceName, err)
 		}
 
-		buildID, err := submitBuild(controllerURL, buildToken, object, yamlBytes, sbc.ServiceName)
+		buildID, err := submitBuild(controllerURL, buildToken, object, yamlBytes, sbc.ServiceName, "")
 		if err != nil {
 			log.Fatalf("submit build for %s: %v", serviceName, err)
 		}
 
 		log.Printf("Build started for %s. ID=%s", serviceName, buildID)
 
-		if err = streamLogs(controllerURL, buildID, buildToken); err != nil {
-			log.Fatalf("Build failed for %s: %v", serviceName, err)
-			os.Exit(1)
+		err = streamLogs(controllerURL, buildID, buildToken, watch, nil)
+		runs = append(runs, serviceRun{Service: serviceName, BuildID: buildID, Err: err})
+		if err != nil {
+			log.Printf("Build failed for %s: %v", serviceName, err)
+			break
 		}
 
 		log.Printf("Service %s completed", serviceName)
 	}
 
-	log.Println("\nAll builds completed successfully")
+	return runs
 }
 
-func buildAsync(ctx context.Context, controllerURL, buildToken string, serviceBuildConfigs []ServiceBuildConfig, object string) {
-	log.Printf("Building %d services asynchronously", len(serviceBuildConfigs))
-
-	var wg sync.WaitGroup
-	results := make(chan buildResult, len(serviceBuildConfigs))
+// submitNoWait submits every service in async-no-wait mode and prints the build IDs
+// without following the builds; callers poll their status or rely on the post-build hook.
+func submitNoWait(controllerURL, buildToken string, serviceBuildConfigs []ServiceBuildConfig, object string) {
+	log.Printf("Submitting %d services without waiting", len(serviceBuildConfigs))
 
 	for _, sbc := range serviceBuildConfigs {
-		wg.Add(1)
-		go func(s ServiceBuildConfig) {
-			defer wg.Done()
+		serviceName := sbc.ServiceName
+		if serviceName == "" {
+			serviceName = "default"
+		}
 
-			serviceName := s.ServiceName
-			if serviceName == "" {
-				serviceName = "default"
-			}
+		yamlBytes, err := yaml.Marshal(sbc.Config)
+		if err != nil {
+			log.Fatalf("marshal config for %s: %v", serviceName, err)
+		}
 
-			log.Printf("[%s] Starting build (architectures: %d)", serviceName, len(s.Config.Bake))
+		buildID, err := submitBuild(controllerURL, buildToken, object, yamlBytes, sbc.ServiceName, "async-no-wait")
+		if err != nil {
+			log.Fatalf("submit build for %s: %v", serviceName, err)
+		}
 
-			yamlBytes, err := yaml.Marshal(s.Config)
-			if err != nil {
-				results <- buildResult{
-					ServiceName: serviceName,
-					Error:       fmt.Errorf("marshal config: %w", err),
-				}
-				return
-			}
+		log.Printf("[%s] Build accepted. ID=%s", serviceName, buildID)
+		fmt.Printf("%s=%s\n", serviceName, buildID)
+	}
+}
 
-			buildID, err := submitBuild(controllerURL, buildToken, object, yamlBytes, s.ServiceName)
-			if err != nil {
-				results <- buildResult{
-					ServiceName: serviceName,
-					Error:       fmt.Errorf("submit build: %w", err),
-				}
-				return
-			}
+func buildAsync(ctx context.Context, controllerURL, buildToken string, serviceBuildConfigs []ServiceBuildConfig, object string, watch bool) []serviceRun {
+	log.Printf("Building %d services asynchronously", len(serviceBuildConfigs))
 
-			log.Printf("[%s] Build started. ID=%s", serviceName, buildID)
+	var batch batchRequest
+	names := make([]string, 0, len(serviceBuildConfigs))
+	for _, sbc := range serviceBuildConfigs {
+		serviceName := sbc.ServiceName
+		if serviceName == "" {
+			serviceName = "default"
+		}
+		names = append(names, serviceName)
 
-			if err = streamLogs(controllerURL, buildID, buildToken); err != nil {
-				results <- buildResult{
-					ServiceName: serviceName,
-					Error:       fmt.Errorf("build failed: %w", err),
-				}
-				return
-			}
+		log.Printf("[%s] Queued build (architectures: %d)", serviceName, len(sbc.Config.Bake))
+		batch.Services = append(batch.Services, batchService{
+			Name:   serviceName,
+			Config: sbc.Config,
+		})
+	}
 
-			log.Printf("[%s] Build completed", serviceName)
-			results <- buildResult{ServiceName: serviceName}
-		}(sbc)
+	yamlBytes, err := yaml.Marshal(batch)
+	if err != nil {
+		log.Fatalf("marshal batch config: %v", err)
 	}
 
-	wg.Wait()
-	close(results)
+	batchID, builds, err := submitBatch(controllerURL, buildToken, object, yamlBytes)
+	if err != nil {
+		log.Fatalf("submit batch: %v", err)
+	}
 
-	var failed []buildResult
-	for r := range results {
-		if r.Error != nil {
-			failed = append(failed, r)
-			log.Printf("ERROR [%s]: %v", r.ServiceName, r.Error)
-		}
+	log.Printf("Batch started. ID=%s", batchID)
+	for _, name := range names {
+		log.Printf("[%s] Build ID=%s", name, builds[name])
 	}
 
-	if len(failed) > 0 {
-		log.Fatalf("\n%d/%d services failed", len(failed), len(serviceBuildConfigs))
+	err = streamLogs(controllerURL, batchID, buildToken, watch, newServicePrefixer(names))
+	if err != nil {
+		log.Printf("\nBatch build failed: %v", err)
 	}
 
-	log.Println("\nAll services completed successfully")
+	runs := make([]serviceRun, 0, len(names))
+	for _, name := range names {
+		runs = append(runs, serviceRun{Service: name, BuildID: builds[name], Err: err})
+	}
+	return runs
 }
 
-func submitBuild(controllerURL, buildToken, object string, yamlBytes []byte, serviceName string) (string, error) {
+func submitBuild(controllerURL, buildToken, object string, yamlBytes []byte, serviceName, mode string) (string, error) {
 	urlStr := fmt.Sprintf("%s/build?context_key=%s", controllerURL, url.QueryEscape(object))
 
 	if serviceName != "" {
 		urlStr += fmt.Sprintf("&service_name=%s", url.QueryEscape(serviceName))
 	}
+	if mode != "" {
+		urlStr += fmt.Sprintf("&mode=%s", url.QueryEscape(mode))
+	}
 
 	req, _ := http.NewRequest("POST", urlStr, bytes.NewReader(yamlBytes))
 	req.Header.Set("Content-Type", "application/x-yaml")
@@ -607,7 +1308,7 @@ func submitBuild(controllerURL, buildToken, object string, yamlBytes []byte, ser
 		req.Header.Set("X-Build-Token", buildToken)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := apiClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -626,12 +1327,282 @@ func submitBuild(controllerURL, buildToken, object string, yamlBytes []byte, ser
 	return br.BuildID, nil
 }
 
+func submitBatch(controllerURL, buildToken, object string, yamlBytes []byte) (string, map[string]string, error) {
+	urlStr := fmt.Sprintf("%s/build/batch?context_key=%s", controllerURL, url.QueryEscape(object))
+
+	req, _ := http.NewRequest("POST", urlStr, bytes.NewReader(yamlBytes))
+	req.Header.Set("Content-Type", "application/x-yaml")
+	if buildToken != "" {
+		req.Header.Set("X-Build-Token", buildToken)
+	}
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return "", nil, fmt.Errorf("status=%s body=%s", resp.Status, string(b))
+	}
+
+	var br batchResponse
+	if err = json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		return "", nil, err
+	}
+
+	return br.BuildID, br.Builds, nil
+}
+
 var ansiRegex = regexp.MustCompile(`\x1b\[[0-9;]*m`)
 
-func streamLogs(baseURL, buildID, token string) error {
+const colorReset = "\033[0m"
+
+// serviceColors is the palette used for [service] prefixes, shared with the agent's task colors.
+var serviceColors = []string{
+	"\033[34m",
+	"\033[35m",
+	"\033[36m",
+	"\033[33m",
+	"\033[32m",
+	"\033[91m",
+	"\033[92m",
+	"\033[93m",
+	"\033[94m",
+	"\033[95m",
+}
+
+// outputMu serializes log lines and the summary so concurrent streams never tear a line.
+var outputMu sync.Mutex
+
+// logOutput is where streamed build logs are written, see logWriter.
+var logOutput io.Writer = os.Stdout
+
+// logWriter returns the stream for build logs: stdout, or stderr with -logs-to-stderr
+// so stdout carries only the summary.
+func logWriter(toStderr bool) io.Writer {
+	if toStderr {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+func printLine(line string) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	fmt.Fprint(logOutput, line)
+}
+
+// servicePrefixer colors the "[service] " prefix the controller puts on batch log lines.
+// Each service keeps the color of its position in the batch, so output is stable across runs.
+type servicePrefixer map[string]string
+
+func newServicePrefixer(names []string) servicePrefixer {
+	p := make(servicePrefixer, len(names))
+	for i, name := range names {
+		p["["+name+"] "] = serviceColors[i%len(serviceColors)]
+	}
+	return p
+}
+
+func (p servicePrefixer) apply(msg string) string {
+	if len(p) == 0 || !strings.HasPrefix(msg, "[") {
+		return msg
+	}
+	end := strings.Index(msg, "] ")
+	if end == -1 {
+		return msg
+	}
+	prefix := msg[:end+2]
+	color, ok := p[prefix]
+	if !ok {
+		return msg
+	}
+	return color + prefix[:len(prefix)-1] + colorReset + " " + msg[end+2:]
+}
+
+// streamLogs prints the log stream of a build until it ends. With watch set, a stream
+// that drops before the build's terminal BUILD SUCCEEDED/FAILED line is reopened, up to
+// WATCH_MAX_RECONNECTS times in a row; the server resumes from the next undelivered line.
+func streamLogs(baseURL, buildID, token string, watch bool, prefixer servicePrefixer) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Minute)
 	defer cancel()
 
+	maxReconnects := 0
+	if watch {
+		maxReconnects = getenvInt("WATCH_MAX_RECONNECTS", 5)
+	}
+
+	ls := logStream{prefixer: prefixer}
+	reconnects := 0
+	for {
+		lines, err := ls.read(ctx, baseURL, buildID, token)
+		if err == nil || ls.finished {
+			break
+		}
+		if !watch {
+			return err
+		}
+		if lines > 0 {
+			reconnects = 0
+		}
+		if reconnects >= maxReconnects {
+			return fmt.Errorf("log stream dropped after %d reconnects: %w", reconnects, err)
+		}
+		reconnects++
+
+		log.Printf("Log stream dropped (%v), reconnecting (%d/%d)", err, reconnects, maxReconnects)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(reconnects) * reconnectDelay):
+		}
+	}
+
+	if ls.buildFailed {
+		return fmt.Errorf("build failed")
+	}
+
+	return nil
+}
+
+// summarizeRuns builds a summary row for each run from the controller's status endpoint.
+// When the status cannot be fetched, the row falls back to what the log stream reported.
+func summarizeRuns(controllerURL, buildToken string, runs []serviceRun) []serviceSummary {
+	summaries := make([]serviceSummary, 0, len(runs))
+	for _, run := range runs {
+		sum := serviceSummary{Service: run.Service, BuildID: run.BuildID, Arches: []string{}}
+
+		st, err := fetchStatus(controllerURL, buildToken, run.BuildID)
+		if err != nil {
+			log.Printf("[%s] fetch status: %v", run.Service, err)
+			sum.Status = "succeeded"
+			if run.Err != nil {
+				sum.Status = "failed"
+				sum.Error = run.Err.Error()
+			}
+			summaries = append(summaries, sum)
+			continue
+		}
+
+		sum.Status = st.Status
+		sum.Error = st.Error
+		if st.FinishedAt != nil {
+			sum.Duration = st.FinishedAt.Sub(st.StartedAt).Round(time.Second).String()
+		}
+
+		taskIDs := make([]string, 0, len(st.Tasks))
+		for taskID := range st.Tasks {
+			taskIDs = append(taskIDs, taskID)
+		}
+		sort.Strings(taskIDs)
+		for _, taskID := range taskIDs {
+			sum.Arches = append(sum.Arches, st.Tasks[taskID].Arch)
+		}
+
+		sum.Digest = st.ManifestDigest
+		if sum.Digest == "" && len(taskIDs) == 1 {
+			sum.Digest = st.Tasks[taskIDs[0]].ImageDigest
+		}
+
+		summaries = append(summaries, sum)
+	}
+	return summaries
+}
+
+func fetchStatus(controllerURL, buildToken, buildID string) (*buildStatus, error) {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/build/%s/status", controllerURL, buildID), nil)
+	if buildToken != "" {
+		req.Header.Set("X-Build-Token", buildToken)
+	}
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status=%s body=%s", resp.Status, string(b))
+	}
+
+	var st buildStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// printSummary writes the summary as a table, or as a single JSON object when format is "json".
+func printSummary(w io.Writer, summaries []serviceSummary, format string) error {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	if format == "json" {
+		return json.NewEncoder(w).Encode(struct {
+			Services []serviceSummary `json:"services"`
+		}{summaries})
+	}
+
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tARCHES\tSTATUS\tDURATION\tDIGEST")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			s.Service, orDash(strings.Join(s.Arches, ",")), s.Status, orDash(s.Duration), orDash(s.Digest))
+	}
+	return tw.Flush()
+}
+
+// writeDigests writes one service=digest line per succeeded service, for pipelines
+// that pin the result. The digest is the manifest list digest for multi-arch builds
+// and the image digest for single-arch builds. It returns an error naming the
+// succeeded services without a digest, such as those whose status could not be
+// fetched, after writing the lines of the others.
+func writeDigests(path string, summaries []serviceSummary) error {
+	var b strings.Builder
+	var missing []string
+	for _, s := range summaries {
+		switch {
+		case s.Status != "succeeded":
+		case s.Digest == "":
+			missing = append(missing, s.Service)
+		default:
+			fmt.Fprintf(&b, "%s=%s\n", s.Service, s.Digest)
+		}
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no image digest for %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// reconnectDelay is multiplied by the attempt number between log stream reconnects.
+var reconnectDelay = 2 * time.Second
+
+// logStream holds what has been seen of a build's log across reconnects.
+type logStream struct {
+	prefixer    servicePrefixer
+	buildFailed bool
+	finished    bool
+	sawResult   bool
+}
+
+// read opens /build/:id/logs and prints lines until the stream ends.
+// It returns the number of lines read and nil on a clean end of stream.
+func (ls *logStream) read(ctx context.Context, baseURL, buildID, token string) (int, error) {
 	req, _ := http.NewRequestWithContext(ctx, "GET",
 		fmt.Sprintf("%s/build/%s/logs", baseURL, buildID),
 		nil,
@@ -641,79 +1612,73 @@ func streamLogs(baseURL, buildID, token string) error {
 		req.Header.Set("X-Build-Token", token)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := streamClient.Do(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("status=%s body=%s", resp.Status, string(b))
+		return 0, fmt.Errorf("status=%s body=%s", resp.Status, string(b))
 	}
 
 	logFormat := getenv("LOG_FORMAT", "simple")
 	reader := bufio.NewReader(resp.Body)
-	buildFailed := false
+	lines := 0
 
 	for {
-		var line []byte
-		line, err = reader.ReadBytes('\n')
+		line, err := reader.ReadBytes('\n')
 		if err != nil {
 			if err == io.EOF {
-				break
+				return lines, nil
 			}
-			return fmt.Errorf("read error: %w", err)
+			return lines, fmt.Errorf("read error: %w", err)
+		}
+		lines++
+
+		var entry logEntry
+		isEntry := json.Unmarshal(line, &entry) == nil
+
+		if isEntry && entry.Event == "build_result" {
+			ls.sawResult = true
+			ls.finished = true
+			ls.buildFailed = entry.Status != "succeeded"
+			continue
 		}
 
 		switch logFormat {
 		case "simple":
-			var entry logEntry
-			if err = json.Unmarshal(line, &entry); err == nil {
-				fmt.Println(entry.Message)
-				if strings.Contains(entry.Message, "BUILD FAILED") {
-					buildFailed = true
-				}
-				if entry.Level == "error" && strings.Contains(entry.Message, "build failed:") {
-					buildFailed = true
-				}
+			if isEntry {
+				printLine(ls.prefixer.apply(entry.Message) + "\n")
 			} else {
-				fmt.Print(string(line))
+				printLine(string(line))
 			}
 
 		case "plain":
-			var entry logEntry
-			if err = json.Unmarshal(line, &entry); err == nil {
-				plainMsg := ansiRegex.ReplaceAllString(entry.Message, "")
-				fmt.Println(plainMsg)
-				if strings.Contains(entry.Message, "BUILD FAILED") {
-					buildFailed = true
-				}
-				if entry.Level == "error" && strings.Contains(entry.Message, "build failed:") {
-					buildFailed = true
-				}
+			if isEntry {
+				printLine(ansiRegex.ReplaceAllString(entry.Message, "") + "\n")
 			} else {
-				plainLine := ansiRegex.ReplaceAllString(string(line), "")
-				fmt.Print(plainLine)
+				printLine(ansiRegex.ReplaceAllString(string(line), ""))
 			}
 
 		default:
-			fmt.Print(string(line))
-			var entry logEntry
-			if err = json.Unmarshal(line, &entry); err == nil {
-				if strings.Contains(entry.Message, "BUILD FAILED") {
-					buildFailed = true
-				}
-				if entry.Level == "error" && strings.Contains(entry.Message, "build failed:") {
-					buildFailed = true
-				}
-			}
+			printLine(string(line))
 		}
-	}
 
-	if buildFailed {
-		return fmt.Errorf("build failed")
+		// Servers that send a build_result line are trusted over the text markers below,
+		// which older servers rely on. Agent output is ingested at info level, so only the
+		// controller's own error-level marker can fail the build, and the last marker wins.
+		if !isEntry || ls.sawResult {
+			continue
+		}
+		switch {
+		case entry.Message == "BUILD FAILED" && entry.Level == "error":
+			ls.buildFailed = true
+			ls.finished = true
+		case entry.Message == "BUILD SUCCEEDED" && entry.Level == "info":
+			ls.buildFailed = false
+			ls.finished = true
+		}
 	}
-
-	return nil
 }
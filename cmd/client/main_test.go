@@ -0,0 +1,816 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/delta"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// dropServer serves a log stream that aborts mid-stream for the first drops requests
+// and ends with the terminal line after that.
+func dropServer(t *testing.T, drops int32, terminal string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{\"level\":\"info\",\"message\":\"line %d\"}\n", n)
+		w.(http.Flusher).Flush()
+		if n <= drops {
+			panic(http.ErrAbortHandler)
+		}
+		level := "info"
+		if terminal == "BUILD FAILED" {
+			level = "error"
+		}
+		fmt.Fprintf(w, "{\"level\":%q,\"message\":%q}\n", level, terminal)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestStreamLogsWatch(t *testing.T) {
+	reconnectDelay = time.Millisecond
+	t.Setenv("LOG_FORMAT", "plain")
+
+	t.Run("reconnects until terminal line", func(t *testing.T) {
+		srv, requests := dropServer(t, 2, "BUILD SUCCEEDED")
+		if err := streamLogs(srv.URL, "b-test", "", true, nil); err != nil {
+			t.Fatalf("streamLogs: %v", err)
+		}
+		if got := requests.Load(); got != 3 {
+			t.Errorf("requests = %d, want 3", got)
+		}
+	})
+
+	t.Run("reports build failure after reconnect", func(t *testing.T) {
+		srv, _ := dropServer(t, 1, "BUILD FAILED")
+		if err := streamLogs(srv.URL, "b-test", "", true, nil); err == nil || err.Error() != "build failed" {
+			t.Errorf("streamLogs error = %v, want build failed", err)
+		}
+	})
+
+	t.Run("without watch a drop is an error", func(t *testing.T) {
+		srv, requests := dropServer(t, 1, "BUILD SUCCEEDED")
+		if err := streamLogs(srv.URL, "b-test", "", false, nil); err == nil {
+			t.Error("streamLogs succeeded, want read error")
+		}
+		if got := requests.Load(); got != 1 {
+			t.Errorf("requests = %d, want 1", got)
+		}
+	})
+
+	t.Run("reconnects are bounded", func(t *testing.T) {
+		t.Setenv("WATCH_MAX_RECONNECTS", "2")
+		srv, requests := dropServer(t, 100, "BUILD SUCCEEDED")
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			panic(http.ErrAbortHandler)
+		})
+		err := streamLogs(srv.URL, "b-test", "", true, nil)
+		if err == nil || !strings.Contains(err.Error(), "after 2 reconnects") {
+			t.Errorf("streamLogs error = %v, want bounded reconnects", err)
+		}
+		if got := requests.Load(); got != 3 {
+			t.Errorf("requests = %d, want 3", got)
+		}
+	})
+}
+
+func TestStreamLogsBuildResult(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "plain")
+
+	serve := func(lines ...string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			for _, l := range lines {
+				fmt.Fprintln(w, l)
+			}
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	t.Run("log text containing the marker is not a failure", func(t *testing.T) {
+		srv := serve(
+			`{"level":"info","message":"grep -q 'BUILD FAILED' ci.log"}`,
+			`{"level":"error","message":"build failed: retrying"}`,
+			`{"level":"info","message":"build result: succeeded","event":"build_result","status":"succeeded"}`,
+			`{"level":"info","message":"BUILD SUCCEEDED"}`,
+		)
+		if err := streamLogs(srv.URL, "b-test", "", false, nil); err != nil {
+			t.Errorf("streamLogs: %v", err)
+		}
+	})
+
+	t.Run("failed result", func(t *testing.T) {
+		srv := serve(
+			`{"level":"error","message":"build result: failed","event":"build_result","status":"failed","error":"exit=1"}`,
+			`{"level":"error","message":"BUILD FAILED"}`,
+		)
+		if err := streamLogs(srv.URL, "b-test", "", false, nil); err == nil || err.Error() != "build failed" {
+			t.Errorf("streamLogs error = %v, want build failed", err)
+		}
+	})
+}
+
+func TestStreamLogsLegacyMarkers(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "plain")
+
+	// A server without build_result lines; the build's own output prints the markers.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"level":"info","message":"BUILD FAILED"}`)
+		fmt.Fprintln(w, `{"level":"info","message":"[amd64] test output: BUILD FAILED (expected)"}`)
+		fmt.Fprintln(w, `{"level":"error","message":"build failed: flaky step, retrying"}`)
+		fmt.Fprintln(w, `{"level":"info","message":"BUILD SUCCEEDED"}`)
+	}))
+	defer srv.Close()
+
+	if err := streamLogs(srv.URL, "b-test", "", false, nil); err != nil {
+		t.Errorf("streamLogs: %v, want success", err)
+	}
+}
+
+func TestLogsToStderr(t *testing.T) {
+	if logWriter(true) != os.Stderr || logWriter(false) != os.Stdout {
+		t.Fatal("logWriter routes logs to the wrong stream")
+	}
+
+	t.Setenv("LOG_FORMAT", "plain")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"level":"info","message":"step 1/2"}`)
+		fmt.Fprintln(w, `{"level":"info","message":"BUILD SUCCEEDED"}`)
+	}))
+	defer srv.Close()
+
+	var logs, stdout bytes.Buffer
+	defer func(w io.Writer) { logOutput = w }(logOutput)
+	logOutput = &logs
+
+	if err := streamLogs(srv.URL, "b-test", "", false, nil); err != nil {
+		t.Fatalf("streamLogs: %v", err)
+	}
+	if err := printSummary(&stdout, []serviceSummary{{Service: "app", Status: "succeeded"}}, "json"); err != nil {
+		t.Fatalf("printSummary: %v", err)
+	}
+
+	if got := logs.String(); got != "step 1/2\nBUILD SUCCEEDED\n" {
+		t.Errorf("logs = %q, want the streamed lines", got)
+	}
+	var summary struct {
+		Services []serviceSummary `json:"services"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &summary); err != nil || len(summary.Services) != 1 {
+		t.Errorf("stdout = %q, want only the JSON summary (err %v)", stdout.String(), err)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	dir := t.TempDir()
+	ci := filepath.Join(dir, ".env.ci")
+	prod := filepath.Join(dir, ".env.prod")
+	if err := os.WriteFile(ci, []byte("BAKERY_TEST_A=ci\nBAKERY_TEST_B=ci\nBAKERY_TEST_SET=ci\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(prod, []byte("BAKERY_TEST_B=prod\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"BAKERY_TEST_A", "BAKERY_TEST_B"} {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+	t.Setenv("BAKERY_TEST_SET", "process")
+
+	if err := loadEnv([]string{ci, prod}); err != nil {
+		t.Fatalf("loadEnv: %v", err)
+	}
+	for k, want := range map[string]string{"BAKERY_TEST_A": "ci", "BAKERY_TEST_B": "prod", "BAKERY_TEST_SET": "process"} {
+		if got := os.Getenv(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+
+	if err := loadEnv([]string{filepath.Join(dir, ".env.missing")}); err == nil || !strings.Contains(err.Error(), ".env.missing") {
+		t.Errorf("loadEnv(missing) = %v, want error naming the file", err)
+	}
+
+	t.Chdir(dir)
+	if err := loadEnv(nil); err != nil {
+		t.Errorf("loadEnv(nil) without .env = %v, want nil", err)
+	}
+}
+
+func TestUploadTuning(t *testing.T) {
+	tests := []struct {
+		partSize, threads string
+		wantPart          uint64
+		wantThreads       uint
+		wantErr           bool
+	}{
+		{"", "", 16 << 20, 4, false},
+		{"64Mi", "8", 64 << 20, 8, false},
+		{"32", "", 32 << 20, 4, false},
+		{"1Gi", "1", 1 << 30, 1, false},
+		{"4Mi", "", 0, 0, true},
+		{"6Gi", "", 0, 0, true},
+		{"lots", "", 0, 0, true},
+		{"", "0", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("S3_UPLOAD_PART_SIZE", tt.partSize)
+		t.Setenv("S3_UPLOAD_THREADS", tt.threads)
+		part, threads, err := uploadTuning()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("uploadTuning(%q, %q) err = %v, wantErr %v", tt.partSize, tt.threads, err, tt.wantErr)
+			continue
+		}
+		if part != tt.wantPart || threads != tt.wantThreads {
+			t.Errorf("uploadTuning(%q, %q) = %d, %d, want %d, %d", tt.partSize, tt.threads, part, threads, tt.wantPart, tt.wantThreads)
+		}
+	}
+}
+
+func TestNewS3ClientPathStyle(t *testing.T) {
+	t.Setenv("S3_ENDPOINT", "s3.amazonaws.com")
+	t.Setenv("S3_BUCKET", "context-bucket")
+	t.Setenv("S3_ACCESS_KEY", "key")
+	t.Setenv("S3_SECRET_KEY", "secret")
+
+	for pathStyle, want := range map[string]string{
+		"":     "/ctx.tar.gz",
+		"true": "/context-bucket/ctx.tar.gz",
+	} {
+		t.Setenv("S3_USE_PATH_STYLE", pathStyle)
+		cli, bucket, err := newS3Client(context.Background())
+		if err != nil {
+			t.Fatalf("newS3Client: %v", err)
+		}
+		u, err := cli.PresignedGetObject(context.Background(), bucket, "ctx.tar.gz", time.Minute, nil)
+		if err != nil {
+			t.Fatalf("presign: %v", err)
+		}
+		if u.Path != want {
+			t.Errorf("S3_USE_PATH_STYLE=%q: url path = %s, want %s", pathStyle, u.Path, want)
+		}
+	}
+}
+
+func TestVerifyUpload(t *testing.T) {
+	var remoteSize atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/bucket/repo.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(remoteSize.Load(), 10))
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	}))
+	defer srv.Close()
+
+	cli, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:        credentials.NewStaticV4("key", "secret", ""),
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "repo.tar.gz")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	remoteSize.Store(100)
+	if err := verifyUpload(context.Background(), cli, "bucket", "repo.tar.gz", path); err != nil {
+		t.Errorf("verifyUpload with matching size: %v", err)
+	}
+
+	remoteSize.Store(0)
+	err = verifyUpload(context.Background(), cli, "bucket", "repo.tar.gz", path)
+	if err == nil || !strings.Contains(err.Error(), "is 0 bytes, but the local context is 100 bytes") {
+		t.Errorf("verifyUpload with truncated object = %v, want size mismatch", err)
+	}
+}
+
+func TestUploadDeltaRefreshesOldBlobs(t *testing.T) {
+	repo := t.TempDir()
+	for name, body := range map[string]string{"fresh": "fresh\n", "old": "old\n", "new": "new\n"} {
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blobPath := func(body string) string {
+		return "/bucket/" + delta.BlobKey(fmt.Sprintf("%x", sha256.Sum256([]byte(body))))
+	}
+	held := map[string]time.Time{
+		blobPath("fresh\n"): time.Now(),
+		blobPath("old\n"):   time.Now().Add(-48 * time.Hour),
+	}
+
+	var mu sync.Mutex
+	var puts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			modified, ok := held[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", "4")
+			w.Header().Set("ETag", `"abc"`)
+			w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		case http.MethodPut:
+			io.Copy(io.Discard, r.Body)
+			mu.Lock()
+			puts = append(puts, r.URL.Path)
+			mu.Unlock()
+			w.Header().Set("ETag", `"abc"`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	cli, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:        credentials.NewStaticV4("key", "secret", ""),
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		refresh string
+		want    []string
+	}{
+		{"", []string{blobPath("new\n")}},
+		{"24h", []string{blobPath("new\n"), blobPath("old\n")}},
+	} {
+		t.Setenv("DELTA_BLOB_REFRESH", tt.refresh)
+		puts = nil
+		object, err := uploadDelta(context.Background(), cli, "bucket", repo)
+		if err != nil {
+			t.Fatalf("DELTA_BLOB_REFRESH=%q: uploadDelta: %v", tt.refresh, err)
+		}
+
+		var blobs []string
+		for _, p := range puts {
+			if p != "/bucket/"+object {
+				blobs = append(blobs, p)
+			}
+		}
+		sort.Strings(blobs)
+		sort.Strings(tt.want)
+		if !reflect.DeepEqual(blobs, tt.want) {
+			t.Errorf("DELTA_BLOB_REFRESH=%q: uploaded blobs = %v, want %v", tt.refresh, blobs, tt.want)
+		}
+	}
+}
+
+func TestServicePrefixer(t *testing.T) {
+	p := newServicePrefixer([]string{"api", "worker"})
+
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"[api] step 1", serviceColors[0] + "[api]" + colorReset + " step 1"},
+		{"[worker] step 1", serviceColors[1] + "[worker]" + colorReset + " step 1"},
+		{"[other] step 1", "[other] step 1"},
+		{"BUILD SUCCEEDED", "BUILD SUCCEEDED"},
+	}
+	for _, tt := range tests {
+		if got := p.apply(tt.msg); got != tt.want {
+			t.Errorf("apply(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+
+	if got := servicePrefixer(nil).apply("[api] step 1"); got != "[api] step 1" {
+		t.Errorf("nil prefixer changed message: %q", got)
+	}
+}
+
+func TestSummarizeRuns(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/build/b-api/status":
+			fmt.Fprint(w, `{"buildID":"b-api","status":"succeeded","startedAt":"2024-01-01T00:00:00Z","finishedAt":"2024-01-01T00:01:30Z",
+				"manifestDigest":"sha256:index","tasks":{"amd64":{"arch":"amd64","success":true},"arm64":{"arch":"arm64","success":true}}}`)
+		case "/build/b-worker/status":
+			fmt.Fprint(w, `{"buildID":"b-worker","status":"failed","startedAt":"2024-01-01T00:00:00Z","finishedAt":"2024-01-01T00:00:10Z",
+				"error":"task amd64 failed: exit=1","tasks":{"amd64":{"arch":"amd64","imageDigest":"sha256:one","success":false}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	summaries := summarizeRuns(srv.URL, "", []serviceRun{
+		{Service: "api", BuildID: "b-api"},
+		{Service: "worker", BuildID: "b-worker"},
+		{Service: "gone", BuildID: "b-gone", Err: errors.New("build failed")},
+	})
+
+	want := []serviceSummary{
+		{Service: "api", BuildID: "b-api", Arches: []string{"amd64", "arm64"}, Status: "succeeded", Duration: "1m30s", Digest: "sha256:index"},
+		{Service: "worker", BuildID: "b-worker", Arches: []string{"amd64"}, Status: "failed", Duration: "10s", Digest: "sha256:one", Error: "task amd64 failed: exit=1"},
+		{Service: "gone", BuildID: "b-gone", Arches: []string{}, Status: "failed", Error: "build failed"},
+	}
+	got, _ := json.Marshal(summaries)
+	wantJSON, _ := json.Marshal(want)
+	if !bytes.Equal(got, wantJSON) {
+		t.Errorf("summaries =\n%s\nwant\n%s", got, wantJSON)
+	}
+
+	t.Run("text", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := printSummary(&buf, summaries, "text"); err != nil {
+			t.Fatalf("printSummary: %v", err)
+		}
+		for _, want := range []string{"SERVICE", "api      amd64,arm64  succeeded  1m30s", "gone     -            failed     -"} {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("summary missing %q:\n%s", want, buf.String())
+			}
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := printSummary(&buf, summaries, "json"); err != nil {
+			t.Fatalf("printSummary: %v", err)
+		}
+		var out struct {
+			Services []serviceSummary `json:"services"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+			t.Fatalf("summary is not JSON: %v\n%s", err, buf.String())
+		}
+		if len(out.Services) != 3 || out.Services[1].Status != "failed" {
+			t.Errorf("services = %+v", out.Services)
+		}
+	})
+}
+
+func TestWriteDigests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "digests.txt")
+	summaries := []serviceSummary{
+		{Service: "api", Status: "succeeded", Digest: "sha256:index"},
+		{Service: "worker", Status: "failed", Digest: "sha256:one"},
+		{Service: "web", Status: "succeeded", Digest: "sha256:two"},
+	}
+	if err := writeDigests(path, summaries); err != nil {
+		t.Fatalf("writeDigests: %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "api=sha256:index\nweb=sha256:two\n"; string(got) != want {
+		t.Errorf("digests = %q, want %q", got, want)
+	}
+
+	// A succeeded service without a digest, e.g. one whose status fetch failed, is an error.
+	summaries = append(summaries, serviceSummary{Service: "docs", Status: "succeeded"})
+	if err := writeDigests(path, summaries); err == nil || !strings.Contains(err.Error(), "docs") {
+		t.Errorf("writeDigests = %v, want an error naming docs", err)
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "Dockerfile"), []byte("FROM alpine\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flag := range []string{"", "1", "9", "zstd", "none"} {
+		t.Run("compression="+flag, func(t *testing.T) {
+			c, err := parseCompression(flag)
+			if err != nil {
+				t.Fatalf("parseCompression: %v", err)
+			}
+
+			var buf bytes.Buffer
+			if err := writeContext(src, &buf, c); err != nil {
+				t.Fatalf("writeContext: %v", err)
+			}
+
+			var r io.Reader = &buf
+			wantExt := ".tar.gz"
+			switch flag {
+			case "zstd":
+				zr, err := zstd.NewReader(r)
+				if err != nil {
+					t.Fatalf("zstd reader: %v", err)
+				}
+				defer zr.Close()
+				r = zr
+				wantExt = ".tar.zst"
+			case "none":
+				wantExt = ".tar"
+			default:
+				gr, err := gzip.NewReader(r)
+				if err != nil {
+					t.Fatalf("gzip reader: %v", err)
+				}
+				r = gr
+			}
+			if c.ext() != wantExt {
+				t.Errorf("ext = %q, want %q", c.ext(), wantExt)
+			}
+
+			tr := tar.NewReader(r)
+			hdr, err := tr.Next()
+			if err != nil {
+				t.Fatalf("read tar: %v", err)
+			}
+			data, _ := io.ReadAll(tr)
+			if hdr.Name != "Dockerfile" || string(data) != "FROM alpine\n" {
+				t.Errorf("entry = %s %q, want Dockerfile", hdr.Name, data)
+			}
+		})
+	}
+
+	for _, flag := range []string{"10", "-1", "fast"} {
+		if _, err := parseCompression(flag); err == nil {
+			t.Errorf("parseCompression(%q) succeeded, want error", flag)
+		}
+	}
+}
+
+func TestTarDirBakeryIgnore(t *testing.T) {
+	src := t.TempDir()
+	for name, data := range map[string]string{
+		"Dockerfile":               "FROM alpine\n",
+		".dockerignore":            "*.md\n",
+		".bakeryignore":            "/fixtures/\n*.log\n!keep.log\n",
+		"README.md":                "docs\n",
+		"app.log":                  "log\n",
+		"keep.log":                 "log\n",
+		"fixtures/large.bin":       "fixture\n",
+		"testdata/fixtures/a.json": "{}\n",
+	} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tarDir(src, &buf); err != nil {
+		t.Fatalf("tarDir: %v", err)
+	}
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read tar: %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+
+	// .dockerignore is left to kaniko, so README.md is still uploaded.
+	want := ".bakeryignore .dockerignore Dockerfile README.md keep.log testdata testdata/fixtures testdata/fixtures/a.json"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("tar entries = %q, want %q", got, want)
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"STANDARD_IA", "STANDARD_IA", false},
+		{" onezone_ia ", "ONEZONE_IA", false},
+		{"NEARLINE", "NEARLINE", false},
+		{"GLACIER", "", true},
+		{"deep_archive", "", true},
+		{"STANDARD-IA", "", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("S3_STORAGE_CLASS", tt.value)
+		got, err := storageClass()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("storageClass(%q) err = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("storageClass(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	t.Run("unset", func(t *testing.T) {
+		t.Setenv("S3_SSE", "")
+		t.Setenv("S3_SSE_KMS_KEY_ID", "")
+		sse, err := serverSideEncryption()
+		if err != nil || sse != nil {
+			t.Errorf("serverSideEncryption() = %v, %v, want nil", sse, err)
+		}
+	})
+
+	t.Run("kms key", func(t *testing.T) {
+		t.Setenv("S3_SSE", "aws:kms")
+		t.Setenv("S3_SSE_KMS_KEY_ID", "arn:aws:kms:us-east-1:123456789012:key/abcd")
+		sse, err := serverSideEncryption()
+		if err != nil {
+			t.Fatalf("serverSideEncryption: %v", err)
+		}
+		if sse.Type() != encrypt.KMS {
+			t.Errorf("type = %v, want KMS", sse.Type())
+		}
+		h := http.Header{}
+		sse.Marshal(h)
+		if got := h.Get("X-Amz-Server-Side-Encryption"); got != "aws:kms" {
+			t.Errorf("encryption header = %q, want aws:kms", got)
+		}
+		if got := h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); got != "arn:aws:kms:us-east-1:123456789012:key/abcd" {
+			t.Errorf("key id header = %q", got)
+		}
+	})
+
+	t.Run("sse-s3", func(t *testing.T) {
+		t.Setenv("S3_SSE", "AES256")
+		t.Setenv("S3_SSE_KMS_KEY_ID", "")
+		sse, err := serverSideEncryption()
+		if err != nil || sse == nil || sse.Type() != encrypt.S3 {
+			t.Errorf("serverSideEncryption() = %v, %v, want SSE-S3", sse, err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, env := range [][2]string{{"aws:kms:dsse", ""}, {"", "key"}, {"AES256", "key"}} {
+			t.Setenv("S3_SSE", env[0])
+			t.Setenv("S3_SSE_KMS_KEY_ID", env[1])
+			if _, err := serverSideEncryption(); err == nil {
+				t.Errorf("serverSideEncryption(%q, %q): want error", env[0], env[1])
+			}
+		}
+	})
+}
+
+func TestComposeXBakeCache(t *testing.T) {
+	compose := `services:
+  app:
+    build:
+      context: .
+      x-bake:
+        platforms: [linux/amd64]
+        cache:
+          enable: true
+          ttl: 48h
+        cache-from:
+        - type=registry,ref=registry.example.com/app-cache:buildcache
+        - type=gha
+        cache-to:
+        - type=registry,ref=registry.example.com/app-cache:buildcache,mode=max
+    image: registry.example.com/app:1.0
+`
+	path := filepath.Join(t.TempDir(), "compose.yaml")
+	if err := os.WriteFile(path, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	base := &BuildConfig{Global: GlobalConfig{Kaniko: map[string]interface{}{
+		"cache": map[string]interface{}{"copy-layers": true, "ttl": "1h"},
+	}}}
+	configs, err := mergeComposeToConfig(base, path, nil)
+	if err != nil {
+		t.Fatalf("mergeComposeToConfig: %v", err)
+	}
+
+	cache, ok := configs[0].Config.Global.Kaniko["cache"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("kaniko.cache = %#v, want a map", configs[0].Config.Global.Kaniko["cache"])
+	}
+	if cache["enable"] != true || cache["ttl"] != "48h" || cache["copy-layers"] != true {
+		t.Errorf("cache = %v, want enable, the x-bake ttl and the base copy-layers", cache)
+	}
+	if from, _ := cache["from"].([]string); len(from) != 1 || from[0] != "registry.example.com/app-cache" {
+		t.Errorf("cache.from = %v, want the registry cache without its tag", cache["from"])
+	}
+	if cache["to"] != "registry.example.com/app-cache" {
+		t.Errorf("cache.to = %v", cache["to"])
+	}
+	if _, ok := base.Global.Kaniko["cache"].(map[string]interface{})["from"]; ok {
+		t.Error("base config cache was modified")
+	}
+
+	t.Run("unsupported backends warn", func(t *testing.T) {
+		x := &XBake{CacheFrom: []string{"type=gha", "type=local,src=/tmp/cache"}, CacheTo: []string{"type=s3,region=us-east-1"}}
+		cache, warnings, err := x.kanikoCache()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cache != nil {
+			t.Errorf("cache = %v, want none", cache)
+		}
+		if len(warnings) != 3 || !strings.Contains(warnings[0], "type=gha") {
+			t.Errorf("warnings = %v, want one per unsupported spec", warnings)
+		}
+	})
+
+	t.Run("bare ref is a registry cache", func(t *testing.T) {
+		x := &XBake{CacheFrom: []string{"registry.example.com:5000/app-cache"}}
+		cache, warnings, err := x.kanikoCache()
+		if err != nil || len(warnings) != 0 {
+			t.Fatalf("kanikoCache: %v, %v", err, warnings)
+		}
+		if from, _ := cache["from"].([]string); len(from) != 1 || from[0] != "registry.example.com:5000/app-cache" {
+			t.Errorf("cache.from = %v", cache["from"])
+		}
+	})
+
+	t.Run("invalid ttl", func(t *testing.T) {
+		x := &XBake{Cache: &XBakeCache{TTL: "two days"}}
+		if _, _, err := x.kanikoCache(); err == nil {
+			t.Error("want error for invalid ttl")
+		}
+	})
+}
+
+func TestControllerClientTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	t.Setenv("CONTROLLER_REQUEST_TIMEOUT", "100ms")
+	api, stream, err := newControllerClients()
+	if err != nil {
+		t.Fatalf("newControllerClients: %v", err)
+	}
+	if stream.Timeout != 0 {
+		t.Errorf("stream client timeout = %s, want none", stream.Timeout)
+	}
+	if api.Transport != stream.Transport {
+		t.Error("api and stream clients do not share a transport")
+	}
+
+	saved := apiClient
+	apiClient = api
+	defer func() { apiClient = saved }()
+
+	start := time.Now()
+	_, err = submitBuild(srv.URL, "", "repos/ctx.tar.gz", []byte("bake: []"), "app", "")
+	if err == nil {
+		t.Fatal("submitBuild succeeded against a non-responding controller")
+	}
+	var netErr interface{ Timeout() bool }
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("submitBuild error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("submitBuild took %s, want it bounded by the request timeout", elapsed)
+	}
+
+	t.Setenv("CONTROLLER_CONNECT_TIMEOUT", "soon")
+	if _, _, err := newControllerClients(); err == nil || !strings.Contains(err.Error(), "CONTROLLER_CONNECT_TIMEOUT") {
+		t.Errorf("newControllerClients error = %v, want invalid CONTROLLER_CONNECT_TIMEOUT", err)
+	}
+}
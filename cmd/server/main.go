@@ -9,46 +9,134 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 
+	"github.com/rayshoo/bakery/internal/aci"
+	"github.com/rayshoo/bakery/internal/agentapi"
+	"github.com/rayshoo/bakery/internal/cloudrun"
 	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/credentials"
 	ecsExec "github.com/rayshoo/bakery/internal/ecs"
 	k8s2 "github.com/rayshoo/bakery/internal/k8s"
+	"github.com/rayshoo/bakery/internal/local"
 	"github.com/rayshoo/bakery/internal/orchestrator"
 	"github.com/rayshoo/bakery/internal/routes"
 	"github.com/rayshoo/bakery/internal/state"
 
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	smt "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/joho/godotenv"
+	"github.com/minio/minio-go/v7"
+	miniocreds "github.com/minio/minio-go/v7/pkg/credentials"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
-var version = "dev"
+// version, commit and buildDate are set at build time via -ldflags "-X main.version=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// readinessProbeTimeout bounds each executor probe; readinessRetryInterval is how
+// long the server waits before probing again while no executor is usable.
+const (
+	readinessProbeTimeout  = 10 * time.Second
+	readinessRetryInterval = 10 * time.Second
+)
+
+// executorProbe is a cheap API call showing that an executor's client is usable.
+type executorProbe func(ctx context.Context) error
 
 // ServerReadiness manages the server's readiness state.
 // Used by Kubernetes readiness probes.
 type ServerReadiness struct {
-	ready bool
+	mu     sync.RWMutex
+	ready  bool
+	reason string
 }
 
 func (s *ServerReadiness) SetReady() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.ready = true
+	s.reason = ""
 }
 
 func (s *ServerReadiness) IsReady() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.ready
 }
 
+// Reason returns why the server is not ready, or "" when it is ready or not yet checked.
+func (s *ServerReadiness) Reason() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reason
+}
+
+// Check runs every probe and marks the server ready once at least one executor is
+// usable. Otherwise the failures are kept as the not-ready reason.
+func (s *ServerReadiness) Check(ctx context.Context, probes map[string]executorProbe) bool {
+	names := make([]string, 0, len(probes))
+	for name := range probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	usable := 0
+	var failures []string
+	for _, name := range names {
+		pctx, cancel := context.WithTimeout(ctx, readinessProbeTimeout)
+		err := probes[name](pctx)
+		cancel()
+		if err != nil {
+			log.Printf("[WARN] executor %s is not usable: %v", name, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		usable++
+	}
+
+	if usable > 0 {
+		s.SetReady()
+		return true
+	}
+	if len(failures) == 0 {
+		failures = append(failures, "no executor configured")
+	}
+	s.mu.Lock()
+	s.reason = strings.Join(failures, "; ")
+	s.mu.Unlock()
+	return false
+}
+
+// WaitReady runs Check every interval until an executor is usable or ctx is done.
+func (s *ServerReadiness) WaitReady(ctx context.Context, probes map[string]executorProbe, interval time.Duration) {
+	for !s.Check(ctx, probes) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+	log.Println("[main] server is ready to accept requests")
+}
+
 var serverReadiness = &ServerReadiness{}
 
 func main() {
@@ -62,17 +150,19 @@ func main() {
 
 	_ = godotenv.Load(".env")
 
+	if err := checkKeepalive(); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
 	awsRegion := getenv("AWS_REGION", "ap-northeast-2")
 	clusterName := getenv("ECS_CLUSTER", "bakery-cluster")
 
-	log.Println("[main] starting build controller...")
+	log.Printf("[main] starting build controller %s (commit %s, built %s)...", version, commit, buildDate)
 	log.Println("[main] AWS_REGION =", awsRegion)
 	log.Println("[main] ECS_CLUSTER =", clusterName)
+	log.Println("[main] AGENT_IMAGE =", getenv("AGENT_IMAGE", ""))
 
-	awsCfg, err := awsconfig.LoadDefaultConfig(
-		context.Background(),
-		awsconfig.WithRegion(awsRegion),
-	)
+	awsCfg, err := loadAWSConfig(context.Background(), awsRegion)
 	if err != nil {
 		log.Fatalf("failed to load AWS config: %v", err)
 	}
@@ -91,7 +181,20 @@ func main() {
 		log.Fatalf("secret ensure failed: %v", err)
 	}
 
+	probes := map[string]executorProbe{}
+
 	ecsClient := ecs.NewFromConfig(awsCfg)
+	probes["ecs"] = func(ctx context.Context) error {
+		out, err := ecsClient.DescribeClusters(ctx, &ecs.DescribeClustersInput{Clusters: []string{clusterName}})
+		if err != nil {
+			return err
+		}
+		if len(out.Clusters) == 0 {
+			return fmt.Errorf("cluster %s not found", clusterName)
+		}
+		return nil
+	}
+	agentURL := agentControllerURL()
 	ecsExecutor := ecsExec.NewECSExecutor(
 		ecsClient,
 		clusterName,
@@ -102,7 +205,7 @@ func main() {
 		strings.Split(getenv("ECS_SECURITY_GROUPS", ""), ","),
 		awsRegion,
 		secretArn,
-		getenv("CONTROLLER_URL", ""),
+		agentURL,
 	)
 
 	var k8sExec orchestrator.Executor
@@ -128,27 +231,95 @@ func main() {
 				log.Println("[INFO] K8S_CONFIG_PATH not set, using default K8s settings")
 			}
 
+			probes["k8s"] = func(ctx context.Context) error {
+				return k8sClient.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+			}
 			k8sExec = k8s2.NewK8sExecutor(
 				k8sClient,
 				getenv("K8S_NAMESPACE", "default"),
 				getenv("AGENT_IMAGE", ""),
-				getenv("CONTROLLER_URL", ""),
+				agentURL,
 				k8sServerConfig,
 			)
 		}
 	}
 
+	executors := orchestrator.NewRegistry()
+	executors.Register("ecs", ecsExecutor)
+	executors.Register("k8s", k8sExec)
+
+	if project, region := getenv("GCP_PROJECT", ""), getenv("CLOUDRUN_REGION", ""); project != "" && region != "" {
+		cloudrunExec := cloudrun.NewCloudRunExecutor(
+			project,
+			region,
+			getenv("AGENT_IMAGE", ""),
+			getenv("CLOUDRUN_SERVICE_ACCOUNT", ""),
+			agentURL,
+		)
+		executors.Register("cloudrun", cloudrunExec)
+		probes["cloudrun"] = cloudrunExec.Probe
+		log.Printf("[INFO] Cloud Run executor enabled (project=%s region=%s)", project, region)
+	}
+
+	if subscription, group := getenv("AZURE_SUBSCRIPTION_ID", ""), getenv("ACI_RESOURCE_GROUP", ""); subscription != "" && group != "" {
+		location := getenv("ACI_LOCATION", "")
+		aciExec := aci.NewACIExecutor(
+			subscription,
+			group,
+			location,
+			getenv("AGENT_IMAGE", ""),
+			agentURL,
+		)
+		executors.Register("aci", aciExec)
+		probes["aci"] = aciExec.Probe
+		log.Printf("[INFO] ACI executor enabled (resource group=%s location=%s)", group, location)
+	}
+
+	// The local executor runs builds on the controller host, so it must be opted into explicitly.
+	if getenv("LOCAL_EXECUTOR_ENABLED", "false") == "true" {
+		localExec := local.NewLocalExecutor(
+			getenv("LOCAL_EXECUTOR_RUNTIME", "docker"),
+			getenv("AGENT_IMAGE", ""),
+			agentURL,
+			getenv("LOCAL_EXECUTOR_NETWORK", ""),
+		)
+		executors.Register("local", localExec)
+		probes["local"] = localExec.Probe
+		log.Println("[WARN] local executor enabled: builds run on this host; do not use in production")
+	}
+
 	store := state.NewStore()
 
+	var postBuildHook orchestrator.PostBuildHook
+	if url := getenv("POST_BUILD_HOOK_URL", ""); url != "" {
+		postBuildHook = &orchestrator.WebhookHook{URL: url}
+		log.Println("[INFO] post-build hook enabled")
+	}
+
+	var reports orchestrator.ReportStore
+	if getenv("WRITE_BUILD_REPORT", "false") == "true" {
+		reportStore, err := newReportStore(awsCfg, getenv("S3_REGION", awsRegion))
+		if err != nil {
+			log.Fatalf("[ERROR] WRITE_BUILD_REPORT: %v", err)
+		}
+		reports = reportStore
+		log.Println("[INFO] build reports enabled")
+	}
+
 	orch := orchestrator.New(orchestrator.Deps{
 		Store:         store,
-		ECS:           ecsExecutor,
-		K8S:           k8sExec,
-		ControllerURL: getenv("CONTROLLER_URL", ""),
+		Executors:     executors,
+		Credentials:   credentials.NewResolver(secrets, getenvDuration("SECRET_CACHE_TTL", 5*time.Minute)),
+		ControllerURL: agentURL,
 		S3Endpoint:    getenv("S3_ENDPOINT", ""),
 		S3Bucket:      getenv("S3_BUCKET", ""),
 		S3Region:      getenv("S3_REGION", awsRegion),
 		S3PathStyle:   getenv("S3_USE_PATH_STYLE", "false") == "true",
+
+		PostBuildHook:        postBuildHook,
+		PostBuildHookTimeout: getenvDuration("POST_BUILD_HOOK_TIMEOUT", 10*time.Second),
+
+		Reports: reports,
 	})
 
 	app := fiber.New(fiber.Config{
@@ -163,6 +334,13 @@ func main() {
 	routes.Setup(app, routes.Dependencies{
 		Orch:  orch,
 		Store: store,
+		Version: routes.VersionInfo{
+			Version:    version,
+			Commit:     commit,
+			BuildDate:  buildDate,
+			AgentImage: getenv("AGENT_IMAGE", ""),
+		},
+		AdminToken: getenv("ADMIN_TOKEN", ""),
 	})
 
 	app.Get("/health/live", func(c *fiber.Ctx) error {
@@ -171,6 +349,9 @@ func main() {
 
 	app.Get("/health/ready", func(c *fiber.Ctx) error {
 		if !serverReadiness.IsReady() {
+			if reason := serverReadiness.Reason(); reason != "" {
+				return c.Status(503).SendString("not ready: " + reason)
+			}
 			return c.Status(503).SendString("not ready")
 		}
 		return c.SendString("ready")
@@ -183,8 +364,11 @@ func main() {
 		return c.SendString("build controller is running")
 	})
 
-	serverReadiness.SetReady()
-	log.Println("[main] server is ready to accept requests")
+	// Readiness waits for an executor to answer, so traffic is not routed to a
+	// controller that cannot dispatch builds yet.
+	readyCtx, stopReadiness := context.WithCancel(context.Background())
+	defer stopReadiness()
+	go serverReadiness.WaitReady(readyCtx, probes, readinessRetryInterval)
 
 	port := getenv("PORT", "3000")
 
@@ -209,6 +393,100 @@ func main() {
 	log.Println("[main] server gracefully stopped")
 }
 
+// loadAWSConfig builds the controller's AWS config from the default credential chain
+// (which already honors AWS_PROFILE). AWS_ENDPOINT_URL overrides the endpoint of every
+// service, e.g. for LocalStack, and AWS_ASSUME_ROLE_ARN makes the controller assume
+// that role with the chain's credentials, for builds in another account.
+func loadAWSConfig(ctx context.Context, region string) (aws.Config, error) {
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(region),
+	}
+	if endpoint := getenv("AWS_ENDPOINT_URL", ""); endpoint != "" {
+		opts = append(opts, awsconfig.WithBaseEndpoint(endpoint))
+		log.Println("[main] AWS_ENDPOINT_URL =", endpoint)
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	if roleARN := getenv("AWS_ASSUME_ROLE_ARN", ""); roleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = getenv("AWS_ASSUME_ROLE_SESSION_NAME", "bakery-controller")
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+		log.Println("[main] AWS_ASSUME_ROLE_ARN =", roleARN)
+	}
+	return cfg, nil
+}
+
+// newReportStore returns the S3_ENDPOINT client build reports are written with. It
+// signs with S3_ACCESS_KEY/S3_SECRET_KEY when both are set, and with the Server's
+// AWS credentials otherwise.
+func newReportStore(awsCfg aws.Config, region string) (*minio.Client, error) {
+	if getenv("S3_BUCKET", "") == "" {
+		return nil, errors.New("S3_BUCKET is required")
+	}
+	endpoint, useSSL, _ := agentapi.StorageEndpoint(getenv("S3_ENDPOINT", ""), getenv("S3_SSL", ""))
+
+	creds := miniocreds.New(&awsCredentials{provider: awsCfg.Credentials})
+	if accessKey, secretKey := getenv("S3_ACCESS_KEY", ""), getenv("S3_SECRET_KEY", ""); accessKey != "" && secretKey != "" {
+		creds = miniocreds.NewStaticV4(accessKey, secretKey, getenv("S3_SESSION_TOKEN", ""))
+	}
+
+	lookup := minio.BucketLookupAuto
+	if getenv("S3_USE_PATH_STYLE", "false") == "true" {
+		lookup = minio.BucketLookupPath
+	}
+	return minio.New(endpoint, &minio.Options{
+		Creds:        creds,
+		Region:       region,
+		Secure:       useSSL,
+		BucketLookup: lookup,
+	})
+}
+
+// awsCredentials signs report uploads with the Server's AWS credentials, fetching
+// new ones once they expire.
+type awsCredentials struct {
+	provider aws.CredentialsProvider
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+func (c *awsCredentials) Retrieve() (miniocreds.Value, error) {
+	return c.RetrieveWithCredContext(nil)
+}
+
+func (c *awsCredentials) RetrieveWithCredContext(*miniocreds.CredContext) (miniocreds.Value, error) {
+	v, err := c.provider.Retrieve(context.Background())
+	if err != nil {
+		return miniocreds.Value{}, err
+	}
+	var expires time.Time
+	if v.CanExpire {
+		expires = v.Expires
+	}
+	c.mu.Lock()
+	c.expires = expires
+	c.mu.Unlock()
+	return miniocreds.Value{
+		AccessKeyID:     v.AccessKeyID,
+		SecretAccessKey: v.SecretAccessKey,
+		SessionToken:    v.SessionToken,
+		Expiration:      expires,
+		SignerType:      miniocreds.SignatureV4,
+	}, nil
+}
+
+func (c *awsCredentials) IsExpired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.expires.IsZero() && !time.Now().Before(c.expires)
+}
+
 // cleanupECSTaskDefinitions deregisters existing ECS task definitions at server startup
 // when CLEANUP_ECS_TASK_DEFINITIONS is set to "true".
 func cleanupECSTaskDefinitions(ctx context.Context, ecsClient *ecs.Client) error {
@@ -265,6 +543,32 @@ func cleanupECSTaskDefinitions(ctx context.Context, ecsClient *ecs.Client) error
 	return nil
 }
 
+// agentControllerURL returns the URL agents use to reach the Server: AGENT_CONTROLLER_URL
+// when the agents' network resolves the Server under another name than clients do,
+// and CONTROLLER_URL otherwise.
+func agentControllerURL() string {
+	return getenv("AGENT_CONTROLLER_URL", getenv("CONTROLLER_URL", ""))
+}
+
+// checkKeepalive reports an error when agents would write heartbeats too rarely for
+// HEARTBEAT_TIMEOUT: with an AGENT_KEEPALIVE_INTERVAL above half the timeout, one
+// late heartbeat fails a healthy task.
+func checkKeepalive() error {
+	timeout := getenvDuration("HEARTBEAT_TIMEOUT", 2*time.Minute)
+	if timeout <= 0 {
+		return nil
+	}
+	// Agents fall back to the default for non-positive intervals.
+	interval := getenvDuration("AGENT_KEEPALIVE_INTERVAL", agentapi.DefaultKeepaliveInterval)
+	if interval <= 0 {
+		interval = agentapi.DefaultKeepaliveInterval
+	}
+	if interval > timeout/2 {
+		return fmt.Errorf("AGENT_KEEPALIVE_INTERVAL (%v) must be at most half of HEARTBEAT_TIMEOUT (%v)", interval, timeout)
+	}
+	return nil
+}
+
 // getenv returns the value of an environment variable, or the default if not set.
 func getenv(k, def string) string {
 	v := os.Getenv(k)
@@ -274,6 +578,16 @@ func getenv(k, def string) string {
 	return v
 }
 
+// getenvDuration returns the duration value of an environment variable, or the default if unset or invalid.
+func getenvDuration(k string, def time.Duration) time.Duration {
+	if v := os.Getenv(k); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
 // RegistryAuth holds private registry authentication credentials.
 type RegistryAuth struct {
 	Username string `json:"username"`
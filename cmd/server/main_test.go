@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+func TestLoadAWSConfig(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", t.TempDir()+"/config")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", t.TempDir()+"/credentials")
+
+	t.Run("endpoint override", func(t *testing.T) {
+		t.Setenv("AWS_ENDPOINT_URL", "http://localhost:4566")
+		t.Setenv("AWS_ASSUME_ROLE_ARN", "")
+
+		cfg, err := loadAWSConfig(context.Background(), "us-east-1")
+		if err != nil {
+			t.Fatalf("loadAWSConfig: %v", err)
+		}
+		if cfg.Region != "us-east-1" {
+			t.Errorf("Region = %q, want us-east-1", cfg.Region)
+		}
+		if cfg.BaseEndpoint == nil || *cfg.BaseEndpoint != "http://localhost:4566" {
+			t.Errorf("BaseEndpoint = %v, want http://localhost:4566", cfg.BaseEndpoint)
+		}
+		if ep := secretsmanager.NewFromConfig(cfg).Options().BaseEndpoint; ep == nil || *ep != "http://localhost:4566" {
+			t.Errorf("secretsmanager BaseEndpoint = %v, want the override", ep)
+		}
+
+		creds, err := cfg.Credentials.Retrieve(context.Background())
+		if err != nil || creds.AccessKeyID != "test" {
+			t.Errorf("credentials = %+v, %v, want the static env credentials", creds, err)
+		}
+	})
+
+	t.Run("assume role", func(t *testing.T) {
+		t.Setenv("AWS_ENDPOINT_URL", "")
+		t.Setenv("AWS_ASSUME_ROLE_ARN", "arn:aws:iam::123456789012:role/bakery")
+
+		cfg, err := loadAWSConfig(context.Background(), "us-east-1")
+		if err != nil {
+			t.Fatalf("loadAWSConfig: %v", err)
+		}
+		if cfg.BaseEndpoint != nil {
+			t.Errorf("BaseEndpoint = %q, want unset", *cfg.BaseEndpoint)
+		}
+		if !aws.IsCredentialsProvider(cfg.Credentials, (*stscreds.AssumeRoleProvider)(nil)) {
+			t.Errorf("Credentials = %T, want the assume-role provider", cfg.Credentials)
+		}
+	})
+}
+
+func TestServerReadiness(t *testing.T) {
+	failing := func(context.Context) error { return errors.New("access denied") }
+
+	r := &ServerReadiness{}
+	if r.IsReady() {
+		t.Fatal("ready before any check")
+	}
+
+	if r.Check(context.Background(), map[string]executorProbe{}) {
+		t.Fatal("ready with no executor")
+	}
+	if got := r.Reason(); got != "no executor configured" {
+		t.Errorf("Reason = %q, want no executor configured", got)
+	}
+
+	if r.Check(context.Background(), map[string]executorProbe{"ecs": failing}) || r.IsReady() {
+		t.Fatal("ready with every executor failing")
+	}
+	if got := r.Reason(); !strings.Contains(got, "ecs: access denied") {
+		t.Errorf("Reason = %q, want the ecs failure", got)
+	}
+
+	if !r.Check(context.Background(), map[string]executorProbe{"ecs": failing, "k8s": func(context.Context) error { return nil }}) || !r.IsReady() {
+		t.Fatal("not ready with a usable executor")
+	}
+	if got := r.Reason(); got != "" {
+		t.Errorf("Reason = %q after becoming ready, want empty", got)
+	}
+
+	t.Run("wait retries until an executor is usable", func(t *testing.T) {
+		r := &ServerReadiness{}
+		var calls int
+		probe := func(context.Context) error {
+			calls++
+			if calls < 3 {
+				return errors.New("cluster not found")
+			}
+			return nil
+		}
+
+		done := make(chan struct{})
+		go func() {
+			r.WaitReady(context.Background(), map[string]executorProbe{"ecs": probe}, time.Millisecond)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("WaitReady did not return")
+		}
+		if !r.IsReady() || calls != 3 {
+			t.Errorf("ready = %t after %d probes, want ready after 3", r.IsReady(), calls)
+		}
+	})
+
+	t.Run("wait stops when canceled", func(t *testing.T) {
+		r := &ServerReadiness{}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r.WaitReady(ctx, map[string]executorProbe{"ecs": failing}, time.Hour)
+		if r.IsReady() {
+			t.Error("ready after canceled wait")
+		}
+	})
+}
+
+func TestAgentControllerURL(t *testing.T) {
+	t.Setenv("CONTROLLER_URL", "https://bakery.example.com")
+
+	t.Setenv("AGENT_CONTROLLER_URL", "")
+	if got := agentControllerURL(); got != "https://bakery.example.com" {
+		t.Errorf("agentControllerURL() = %q, want CONTROLLER_URL", got)
+	}
+
+	t.Setenv("AGENT_CONTROLLER_URL", "http://bakery.internal:8080")
+	if got := agentControllerURL(); got != "http://bakery.internal:8080" {
+		t.Errorf("agentControllerURL() = %q, want AGENT_CONTROLLER_URL", got)
+	}
+}
+
+func TestCheckKeepalive(t *testing.T) {
+	tests := []struct {
+		keepalive, heartbeat string
+		wantErr              bool
+	}{
+		{"", "", false},
+		{"1m", "2m", false},
+		{"61s", "2m", true},
+		{"", "45s", true},
+		{"0", "1m", false},
+		{"5m", "0", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("AGENT_KEEPALIVE_INTERVAL", tt.keepalive)
+		t.Setenv("HEARTBEAT_TIMEOUT", tt.heartbeat)
+		if err := checkKeepalive(); (err != nil) != tt.wantErr {
+			t.Errorf("checkKeepalive() with keepalive %q and timeout %q = %v, want error %t", tt.keepalive, tt.heartbeat, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package aci
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/agentapi"
+	"github.com/rayshoo/bakery/internal/agentenv"
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+const (
+	defaultBaseURL = "https://management.azure.com"
+	apiVersion     = "2023-05-01"
+	imdsTokenURL   = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fmanagement.azure.com%2F"
+
+	defaultCPU      = 1.0
+	defaultMemoryGB = 1.5
+)
+
+// ACIExecutor runs build tasks as Azure Container Instances container groups.
+type ACIExecutor struct {
+	HTTP           *http.Client
+	BaseURL        string
+	SubscriptionID string
+	ResourceGroup  string
+	Location       string
+	AgentImage     string
+	ControllerURL  string
+
+	// Token returns an access token for Azure Resource Manager.
+	// Defaults to the managed identity token from the instance metadata service.
+	Token func(ctx context.Context) (string, error)
+
+	PollInterval time.Duration
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewACIExecutor creates a new ACIExecutor instance.
+func NewACIExecutor(
+	subscriptionID string,
+	resourceGroup string,
+	location string,
+	agentImage string,
+	controllerURL string,
+) *ACIExecutor {
+	e := &ACIExecutor{
+		HTTP:           &http.Client{Timeout: 30 * time.Second},
+		BaseURL:        defaultBaseURL,
+		SubscriptionID: subscriptionID,
+		ResourceGroup:  resourceGroup,
+		Location:       location,
+		AgentImage:     agentImage,
+		ControllerURL:  controllerURL,
+		PollInterval:   3 * time.Second,
+	}
+	e.Token = e.managedIdentityToken
+	return e
+}
+
+type envVar struct {
+	Name        string `json:"name"`
+	Value       string `json:"value,omitempty"`
+	SecureValue string `json:"secureValue,omitempty"`
+}
+
+type containerGroup struct {
+	Properties struct {
+		ProvisioningState string `json:"provisioningState"`
+		InstanceView      struct {
+			State string `json:"state"`
+		} `json:"instanceView"`
+		Containers []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				InstanceView *struct {
+					CurrentState struct {
+						State        string `json:"state"`
+						ExitCode     *int   `json:"exitCode"`
+						DetailStatus string `json:"detailStatus"`
+					} `json:"currentState"`
+				} `json:"instanceView"`
+			} `json:"properties"`
+		} `json:"containers"`
+	} `json:"properties"`
+}
+
+// RunTask creates a container group running the agent and waits for the agent to terminate.
+// The container group is deleted once the agent has exited.
+func (e *ACIExecutor) RunTask(
+	ctx context.Context,
+	st *state.BuildState,
+	taskID string,
+	ef config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	ingestURL string,
+) error {
+	if ef.Arch != "amd64" {
+		return fmt.Errorf("aci: unsupported arch %q (only amd64 is available)", ef.Arch)
+	}
+
+	st.AppendLog("info", fmt.Sprintf("[aci][%s] dispatching container group", taskID))
+
+	env, err := e.agentEnv(st, taskID, ef, contextBucket, contextKey, ingestURL)
+	if err != nil {
+		return err
+	}
+
+	spec, err := e.containerGroupSpec(st, taskID, ef, env)
+	if err != nil {
+		return err
+	}
+
+	name := groupName(st.ID, taskID)
+	path := e.groupPath(name)
+
+	if err := e.do(ctx, http.MethodPut, path, spec, nil); err != nil {
+		return fmt.Errorf("[aci] create container group: %w", err)
+	}
+
+	st.Mu.Lock()
+	st.TaskArnByID[taskID] = name
+	st.IDByTaskArn[name] = taskID
+	st.Mu.Unlock()
+
+	defer func() {
+		// A canceled task's container group is deleted by CancelTask.
+		if ctx.Err() != nil {
+			return
+		}
+		if err := e.do(context.Background(), http.MethodDelete, path, nil, nil); err != nil {
+			st.AppendLog("warn", fmt.Sprintf("[aci][%s] delete container group: %v", taskID, err))
+		}
+	}()
+
+	st.AppendLog("info", fmt.Sprintf("[aci][%s] started container group: %s", taskID, name))
+
+	exitCode, err := e.waitContainerTerminated(ctx, st, taskID, path)
+	if err != nil {
+		return err
+	}
+
+	if exitCode != 0 {
+		err := fmt.Errorf("agent exit=%d (%s)", exitCode, agentapi.ExitPhase(exitCode))
+		st.SetTaskError(taskID, err)
+		st.AppendLog("error", fmt.Sprintf("[aci][%s] %v", taskID, err))
+		return err
+	}
+
+	st.AppendLog("info", fmt.Sprintf("[aci][%s] exit=0 success", taskID))
+	return nil
+}
+
+// CancelTask deletes the container group of taskID, if it was created, which stops the agent.
+func (e *ACIExecutor) CancelTask(ctx context.Context, st *state.BuildState, taskID string) error {
+	name := st.TaskArn(taskID)
+	if name == "" {
+		return nil
+	}
+	if err := e.do(ctx, http.MethodDelete, e.groupPath(name), nil, nil); err != nil {
+		return fmt.Errorf("[aci] delete container group: %w", err)
+	}
+	st.AppendLog("info", fmt.Sprintf("[aci][%s] deleted container group: %s", taskID, name))
+	return nil
+}
+
+// Probe lists the container groups of the resource group, showing that Azure
+// Resource Manager is reachable with the executor's credentials.
+func (e *ACIExecutor) Probe(ctx context.Context) error {
+	path := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.ContainerInstance/containerGroups?api-version=%s",
+		e.SubscriptionID, e.ResourceGroup, apiVersion)
+	return e.do(ctx, http.MethodGet, path, nil, nil)
+}
+
+func (e *ACIExecutor) groupPath(name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.ContainerInstance/containerGroups/%s?api-version=%s",
+		e.SubscriptionID, e.ResourceGroup, name, apiVersion)
+}
+
+func (e *ACIExecutor) containerGroupSpec(st *state.BuildState, taskID string, ef config.EffectiveConfig, env []envVar) (map[string]any, error) {
+	cpu := defaultCPU
+	if ef.CPU != "" {
+		units, err := config.ParseCPU(ef.CPU)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu=%s: %w", ef.CPU, err)
+		}
+		cpu = math.Ceil(float64(units)/1024*100) / 100
+	}
+
+	memoryGB := defaultMemoryGB
+	if ef.Memory != "" {
+		mb, err := config.ParseMemory(ef.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory=%s: %w", ef.Memory, err)
+		}
+		memoryGB = math.Ceil(float64(mb)/1024*10) / 10
+	}
+
+	st.AppendLog("info", fmt.Sprintf("[aci][%s] resources: cpu=%g memoryInGB=%g", taskID, cpu, memoryGB))
+
+	return map[string]any{
+		"location": e.Location,
+		"tags": map[string]string{
+			"build-id": st.ID,
+			"task-id":  taskID,
+			"arch":     ef.Arch,
+		},
+		"properties": map[string]any{
+			"osType":        "Linux",
+			"restartPolicy": "Never",
+			"sku":           "Standard",
+			"containers": []map[string]any{
+				{
+					"name": "agent",
+					"properties": map[string]any{
+						"image":                e.AgentImage,
+						"environmentVariables": env,
+						"resources": map[string]any{
+							"requests": map[string]any{
+								"cpu":        cpu,
+								"memoryInGB": memoryGB,
+							},
+						},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// waitContainerTerminated polls the container group instance view until the agent
+// container has terminated and returns its exit code. ACI only reports the exit
+// code once the container is terminated.
+func (e *ACIExecutor) waitContainerTerminated(
+	ctx context.Context,
+	st *state.BuildState,
+	taskID string,
+	path string,
+) (int, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("timeout waiting for ACI container group: %w", ctx.Err())
+
+		case <-time.After(e.PollInterval):
+			var cg containerGroup
+			if err := e.do(ctx, http.MethodGet, path, nil, &cg); err != nil {
+				st.AppendLog("error", fmt.Sprintf("[aci][%s] get container group error: %v", taskID, err))
+				continue
+			}
+
+			if cg.Properties.ProvisioningState == "Failed" {
+				err := fmt.Errorf("container group provisioning failed")
+				st.SetTaskError(taskID, err)
+				return 0, err
+			}
+
+			st.AppendLog("debug", fmt.Sprintf("[aci][%s] status=%s", taskID, cg.Properties.InstanceView.State))
+
+			for _, c := range cg.Properties.Containers {
+				if c.Name != "agent" || c.Properties.InstanceView == nil {
+					continue
+				}
+				cur := c.Properties.InstanceView.CurrentState
+				if cur.State != "Terminated" {
+					continue
+				}
+				if cur.ExitCode == nil {
+					err := fmt.Errorf("agent terminated without exit code: %s", cur.DetailStatus)
+					st.SetTaskError(taskID, err)
+					return 0, err
+				}
+				return *cur.ExitCode, nil
+			}
+		}
+	}
+}
+
+func (e *ACIExecutor) do(ctx context.Context, method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(e.BaseURL, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	token, err := e.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("get access token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := e.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: status %d: %s", method, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if out != nil && len(data) > 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// managedIdentityToken fetches and caches an ARM token for the managed identity.
+func (e *ACIExecutor) managedIdentityToken(ctx context.Context) (string, error) {
+	e.tokenMu.Lock()
+	defer e.tokenMu.Unlock()
+
+	if e.token != "" && time.Now().Before(e.tokenExpiry) {
+		return e.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imdsTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := e.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata service: status %d", resp.StatusCode)
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("decode managed identity token: %w", err)
+	}
+
+	expiresIn, _ := strconv.Atoi(tok.ExpiresIn)
+	e.token = tok.AccessToken
+	e.tokenExpiry = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	return e.token, nil
+}
+
+func (e *ACIExecutor) agentEnv(
+	st *state.BuildState,
+	taskID string,
+	ef config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	ingestURL string,
+) ([]envVar, error) {
+	vars, err := agentenv.Build(st, taskID, ef, agentenv.Task{
+		Platform:      "aci",
+		ControllerURL: e.ControllerURL,
+		IngestURL:     ingestURL,
+		ContextBucket: contextBucket,
+		ContextKey:    contextKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	env := make([]envVar, 0, len(vars))
+	for _, v := range vars {
+		if v.Secret {
+			env = append(env, envVar{Name: v.Name, SecureValue: v.Value})
+		} else {
+			env = append(env, envVar{Name: v.Name, Value: v.Value})
+		}
+	}
+	return env, nil
+}
+
+// groupName builds a container group name (lowercase letters, digits and hyphens,
+// at most 63 characters) with a random suffix.
+func groupName(buildID, taskID string) string {
+	var b strings.Builder
+	lastDash := false
+	for _, r := range strings.ToLower("build-" + buildID + "-" + taskID) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			lastDash = false
+		} else if !lastDash {
+			b.WriteByte('-')
+			lastDash = true
+		}
+	}
+
+	suffix := make([]byte, 3)
+	_, _ = rand.Read(suffix)
+
+	name := b.String()
+	if max := 63 - 7; len(name) > max {
+		name = name[:max]
+	}
+	return strings.TrimRight(name, "-") + "-" + hex.EncodeToString(suffix)
+}
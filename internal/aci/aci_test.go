@@ -0,0 +1,199 @@
+package aci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+type fakeACI struct {
+	mu       sync.Mutex
+	exitCode int
+	polls    int
+	spec     map[string]any
+	deleted  bool
+	listed   bool
+}
+
+func (f *fakeACI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	const groups = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ContainerInstance/containerGroups"
+	if !strings.HasPrefix(r.URL.Path, groups) || r.URL.Query().Get("api-version") != apiVersion {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == groups {
+		f.listed = r.Method == http.MethodGet
+		_, _ = w.Write([]byte(`{"value":[]}`))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		_ = json.NewDecoder(r.Body).Decode(&f.spec)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{}`))
+	case http.MethodGet:
+		f.polls++
+		if f.polls < 2 {
+			_, _ = w.Write([]byte(`{"properties":{"provisioningState":"Succeeded","instanceView":{"state":"Running"},"containers":[{"name":"agent","properties":{"instanceView":{"currentState":{"state":"Running"}}}}]}}`))
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"properties":{"provisioningState":"Succeeded","instanceView":{"state":"Stopped"},"containers":[{"name":"agent","properties":{"instanceView":{"currentState":{"state":"Terminated","exitCode":%d}}}}]}}`, f.exitCode)
+	case http.MethodDelete:
+		f.deleted = true
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestExecutor(srv *httptest.Server) *ACIExecutor {
+	e := NewACIExecutor("sub", "rg", "koreacentral", "agent:latest", "http://controller")
+	e.BaseURL = srv.URL
+	e.HTTP = srv.Client()
+	e.PollInterval = time.Millisecond
+	e.Token = func(context.Context) (string, error) { return "test-token", nil }
+	return e
+}
+
+func TestRunTask(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		fake := &fakeACI{}
+		srv := httptest.NewServer(fake)
+		defer srv.Close()
+
+		st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+		err := newTestExecutor(srv).RunTask(context.Background(), st, "amd64",
+			config.EffectiveConfig{Arch: "amd64", CPU: "2", Memory: "3Gi"}, "bucket", "key", "http://ingest")
+		if err != nil {
+			t.Fatalf("RunTask: %v", err)
+		}
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+
+		if !fake.deleted {
+			t.Error("container group was not deleted")
+		}
+		if fake.polls < 2 {
+			t.Errorf("polls = %d, want at least 2", fake.polls)
+		}
+
+		props := fake.spec["properties"].(map[string]any)
+		if props["restartPolicy"] != "Never" {
+			t.Errorf("restartPolicy = %v, want Never", props["restartPolicy"])
+		}
+		container := props["containers"].([]any)[0].(map[string]any)["properties"].(map[string]any)
+		requests := container["resources"].(map[string]any)["requests"].(map[string]any)
+		if requests["cpu"] != 2.0 || requests["memoryInGB"] != 3.0 {
+			t.Errorf("requests = %v, want cpu=2 memoryInGB=3", requests)
+		}
+
+		env := map[string]string{}
+		for _, v := range container["environmentVariables"].([]any) {
+			m := v.(map[string]any)
+			value, _ := m["value"].(string)
+			env[m["name"].(string)] = value
+		}
+		want := map[string]string{
+			"BUILD_ID":           "b-test",
+			"EXECUTOR_PLATFORM":  "aci",
+			"INGEST_URL":         "http://ingest",
+			"KANIKO_DESTINATION": "registry.example.com/app:1.0",
+		}
+		for k, v := range want {
+			if env[k] != v {
+				t.Errorf("env %s = %q, want %q", k, env[k], v)
+			}
+		}
+	})
+
+	t.Run("non-zero exit", func(t *testing.T) {
+		fake := &fakeACI{exitCode: 1}
+		srv := httptest.NewServer(fake)
+		defer srv.Close()
+
+		st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+		err := newTestExecutor(srv).RunTask(context.Background(), st, "amd64",
+			config.EffectiveConfig{Arch: "amd64"}, "bucket", "key", "http://ingest")
+		if err == nil || !strings.Contains(err.Error(), "exit=1") {
+			t.Errorf("RunTask error = %v, want exit=1", err)
+		}
+		if !st.HasError() {
+			t.Error("build state has no error")
+		}
+	})
+
+	t.Run("arm64 is rejected", func(t *testing.T) {
+		fake := &fakeACI{}
+		srv := httptest.NewServer(fake)
+		defer srv.Close()
+
+		st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+		ef := config.EffectiveConfig{Arch: "arm64"}
+
+		if err := newTestExecutor(srv).RunTask(context.Background(), st, "arm64", ef, "bucket", "key", ""); err == nil {
+			t.Error("expected error for arm64")
+		}
+		if fake.spec != nil {
+			t.Error("container group created for arm64")
+		}
+	})
+}
+
+func TestCancelTask(t *testing.T) {
+	fake := &fakeACI{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	e := newTestExecutor(srv)
+	st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+	if err := e.CancelTask(context.Background(), st, "amd64"); err != nil {
+		t.Fatalf("CancelTask before start: %v", err)
+	}
+
+	st.TaskArnByID["amd64"] = groupName(st.ID, "amd64")
+	if err := e.CancelTask(context.Background(), st, "amd64"); err != nil {
+		t.Fatalf("CancelTask: %v", err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if !fake.deleted {
+		t.Error("container group was not deleted")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	fake := &fakeACI{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	e := newTestExecutor(srv)
+	if err := e.Probe(context.Background()); err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+	if !fake.listed {
+		t.Error("Probe did not list the container groups")
+	}
+
+	e.Token = func(context.Context) (string, error) { return "expired", nil }
+	if err := e.Probe(context.Background()); err == nil {
+		t.Error("Probe with a rejected token: want error")
+	}
+}
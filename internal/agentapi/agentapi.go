@@ -0,0 +1,122 @@
+// Package agentapi holds the contract between the controller and the build agent:
+// the exit codes the agent reports phases with, the ingest heartbeat line and its
+// default interval, the build args the agent injects, the storage endpoint and the
+// encoding of map-valued env vars. It only uses the standard library, so the agent can import
+// it without pulling in the controller.
+package agentapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// HeartbeatLine is the sentinel line agents write to the ingest stream to signal liveness.
+// It is recorded as a heartbeat and never appended to the build log.
+const HeartbeatLine = "__bakery_heartbeat__"
+
+// DefaultKeepaliveInterval is how often agents write HeartbeatLine when
+// AGENT_KEEPALIVE_INTERVAL is not set.
+const DefaultKeepaliveInterval = 30 * time.Second
+
+// Exit codes the agent uses to report which phase of a task failed.
+// Any other failure exits with ExitUnknown.
+const (
+	ExitUnknown  = 1
+	ExitDownload = 10
+	ExitExtract  = 11
+	ExitKaniko   = 12
+	ExitPush     = 13
+	ExitScript   = 14
+	ExitTimeout  = 15
+)
+
+// ExitPhase returns the task phase an agent exit code stands for, or "unknown".
+func ExitPhase(code int) string {
+	switch code {
+	case ExitDownload:
+		return "download"
+	case ExitExtract:
+		return "extract"
+	case ExitKaniko:
+		return "kaniko"
+	case ExitPush:
+		return "push"
+	case ExitScript:
+		return "script"
+	case ExitTimeout:
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+// AutoBuildArgNames maps the auto-build-args entries to the build args the agent sets:
+// the build ID, the time kaniko starts in RFC 3339 UTC, and kaniko.revision.
+var AutoBuildArgNames = map[string]string{
+	"build-id":   "BUILD_ID",
+	"build-date": "BUILD_DATE",
+	"git-sha":    "GIT_SHA",
+}
+
+// EncodeMap encodes m for an agent env var that carries names and values, such as
+// KANIKO_BUILD_ARGS and KANIKO_LABELS, as a JSON object so values may hold commas.
+func EncodeMap(m map[string]string) string {
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+// DecodeMap decodes a value written by EncodeMap. It also accepts the comma-separated
+// KEY=VALUE pairs that older controllers send, skipping pairs without a =.
+func DecodeMap(s string) (map[string]string, error) {
+	m := map[string]string{}
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			m[key] = value
+		}
+	}
+	return m, nil
+}
+
+// StorageEndpoint resolves the object storage endpoint shared by the Server
+// (S3_ENDPOINT, S3_SSL) and agents (STORAGE_ENDPOINT, STORAGE_USE_SSL) into the
+// host to connect to and whether to use TLS. An http:// or https:// scheme on
+// endpoint decides TLS, so a plain-HTTP private endpoint works without also
+// setting the SSL variable; an explicit sslEnv still wins. An empty endpoint is
+// AWS S3, always over TLS. It also returns where the TLS setting came from, for logs.
+func StorageEndpoint(endpoint, sslEnv string) (host string, useSSL bool, source string) {
+	endpoint = strings.TrimSpace(endpoint)
+	if endpoint == "" || endpoint == "s3.amazonaws.com" {
+		return "s3.amazonaws.com", true, "AWS S3"
+	}
+
+	host = endpoint
+	var fromScheme, hasScheme bool
+	if rest, ok := strings.CutPrefix(endpoint, "http://"); ok {
+		host, fromScheme, hasScheme = rest, false, true
+	} else if rest, ok := strings.CutPrefix(endpoint, "https://"); ok {
+		host, fromScheme, hasScheme = rest, true, true
+	}
+	host = strings.TrimSuffix(host, "/")
+
+	switch {
+	case sslEnv != "":
+		useSSL = sslEnv == "true"
+		source = "from the SSL setting"
+		if hasScheme && useSSL != fromScheme {
+			source = fmt.Sprintf("from the SSL setting, overriding the %s endpoint scheme", strings.SplitN(endpoint, ":", 2)[0])
+		}
+	case hasScheme:
+		useSSL, source = fromScheme, "from endpoint scheme"
+	default:
+		useSSL, source = true, "default"
+	}
+	return host, useSSL, source
+}
@@ -0,0 +1,33 @@
+package agentapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStorageEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint, sslEnv string
+		host             string
+		ssl              bool
+	}{
+		{"", "", "s3.amazonaws.com", true},
+		{"s3.amazonaws.com", "false", "s3.amazonaws.com", true},
+		{"http://minio.internal:9000", "", "minio.internal:9000", false},
+		{"https://minio.internal:9000/", "", "minio.internal:9000", true},
+		{"minio.internal:9000", "", "minio.internal:9000", true},
+		{"minio.internal:9000", "false", "minio.internal:9000", false},
+		{"http://minio.internal:9000", "true", "minio.internal:9000", true},
+		{"https://minio.internal:9000", "false", "minio.internal:9000", false},
+	}
+	for _, tt := range tests {
+		host, ssl, source := StorageEndpoint(tt.endpoint, tt.sslEnv)
+		if host != tt.host || ssl != tt.ssl {
+			t.Errorf("StorageEndpoint(%q, %q) = %q, %t (%s), want %q, %t", tt.endpoint, tt.sslEnv, host, ssl, source, tt.host, tt.ssl)
+		}
+	}
+
+	if _, _, source := StorageEndpoint("http://minio.internal:9000", "true"); !strings.Contains(source, "overriding") {
+		t.Errorf("conflicting scheme and SSL setting not reported: %q", source)
+	}
+}
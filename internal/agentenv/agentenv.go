@@ -0,0 +1,253 @@
+// Package agentenv builds the environment a build agent is started with. Every
+// executor passes the same variables; only how they reach the container differs.
+package agentenv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rayshoo/bakery/internal/agentapi"
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+// Var is one environment variable of the agent. Secret marks credentials, which
+// executors deliver through their platform's secret mechanism where it has one
+// instead of as a plain value.
+type Var struct {
+	Name   string
+	Value  string
+	Secret bool
+}
+
+// Task holds the executor-specific inputs of a task's agent environment.
+type Task struct {
+	// Platform is reported to the agent as EXECUTOR_PLATFORM, e.g. "ecs".
+	Platform      string
+	ControllerURL string
+	IngestURL     string
+	ContextBucket string
+	ContextKey    string
+}
+
+// Build returns the agent environment of the task taskID of st, which runs with ef.
+func Build(st *state.BuildState, taskID string, ef config.EffectiveConfig, t Task) ([]Var, error) {
+	targetPlatform, targetOS, targetArch, targetVariant := TargetPlatform(ef)
+	kanikoDestination, mirrors := st.TaskDestinations(taskID, ef)
+
+	env := []Var{
+		{Name: "BUILD_ID", Value: st.ID},
+		{Name: "BUILD_TASK_ID", Value: taskID},
+		{Name: "TASK_COLOR_INDEX", Value: TaskColorIndex(taskID)},
+
+		{Name: "TARGETPLATFORM", Value: targetPlatform},
+		{Name: "TARGETOS", Value: targetOS},
+		{Name: "TARGETARCH", Value: targetArch},
+		{Name: "TARGETVARIANT", Value: targetVariant},
+
+		{Name: "EXECUTOR_PLATFORM", Value: t.Platform},
+
+		{Name: "STORAGE_ENDPOINT", Value: os.Getenv("S3_ENDPOINT")},
+		{Name: "STORAGE_REGION", Value: os.Getenv("S3_REGION")},
+		{Name: "STORAGE_USE_SSL", Value: os.Getenv("S3_SSL")},
+		{Name: "STORAGE_USE_PATH_STYLE", Value: os.Getenv("S3_USE_PATH_STYLE")},
+		{Name: "AGENT_KEEPALIVE_INTERVAL", Value: os.Getenv("AGENT_KEEPALIVE_INTERVAL")},
+		{Name: "KANIKO_EXECUTOR_PATH", Value: os.Getenv("KANIKO_EXECUTOR_PATH")},
+		{Name: "STEP_TIMEOUT_DOWNLOAD", Value: os.Getenv("STEP_TIMEOUT_DOWNLOAD")},
+		{Name: "STEP_TIMEOUT_EXTRACT", Value: os.Getenv("STEP_TIMEOUT_EXTRACT")},
+		{Name: "STEP_TIMEOUT_SCRIPT", Value: os.Getenv("STEP_TIMEOUT_SCRIPT")},
+		{Name: "STEP_TIMEOUT_KANIKO", Value: os.Getenv("STEP_TIMEOUT_KANIKO")},
+		{Name: "STORAGE_ACCESS_KEY", Value: os.Getenv("S3_ACCESS_KEY")},
+		{Name: "STORAGE_SECRET_KEY", Value: os.Getenv("S3_SECRET_KEY"), Secret: true},
+
+		{Name: "CONTEXT_BUCKET", Value: t.ContextBucket},
+		{Name: "CONTEXT_KEY", Value: t.ContextKey},
+
+		{Name: "CONTROLLER_URL", Value: t.ControllerURL},
+		{Name: "INGEST_URL", Value: t.IngestURL},
+		{Name: "TASK_ATTEMPT", Value: strconv.Itoa(st.TaskAttempt(taskID))},
+
+		{Name: "KANIKO_DESTINATION", Value: kanikoDestination},
+		{Name: "KANIKO_CONTEXT", Value: ef.ContextPath},
+		{Name: "KANIKO_DOCKERFILE", Value: ef.Dockerfile},
+	}
+	add := func(name, value string) {
+		env = append(env, Var{Name: name, Value: value})
+	}
+	addBool := func(name string, v *bool) {
+		if v != nil {
+			add(name, strconv.FormatBool(*v))
+		}
+	}
+
+	if ef.DockerfileInline != "" {
+		add("KANIKO_DOCKERFILE_INLINE", ef.DockerfileInline)
+	}
+	if ef.DockerfileURL != "" {
+		add("KANIKO_DOCKERFILE_URL", ef.DockerfileURL)
+	}
+	if ef.BuildArgsFile != "" {
+		add("KANIKO_BUILD_ARGS_FILE", ef.BuildArgsFile)
+	}
+	if len(ef.AutoBuildArgs) > 0 {
+		add("KANIKO_AUTO_BUILD_ARGS", strings.Join(ef.AutoBuildArgs, ","))
+		add("KANIKO_REVISION", ef.Revision)
+	}
+
+	if len(mirrors) > 0 {
+		add("KANIKO_MIRRORS", strings.Join(mirrors, ","))
+	}
+
+	if len(ef.BuildArgs) > 0 {
+		add("KANIKO_BUILD_ARGS", agentapi.EncodeMap(ef.BuildArgs))
+	}
+	if len(ef.Labels) > 0 {
+		add("KANIKO_LABELS", agentapi.EncodeMap(ef.Labels))
+	}
+
+	if len(ef.ExtraHosts) > 0 {
+		add("EXTRA_HOSTS", ef.ExtraHostsEnv())
+	}
+
+	creds := ef.DockerConfigJSON
+	if creds == "" && len(ef.KanikoCredentials) > 0 {
+		var err error
+		if creds, err = DockerConfigJSON(ef.KanikoCredentials); err != nil {
+			return nil, fmt.Errorf("create docker config: %w", err)
+		}
+	}
+	if creds != "" {
+		env = append(env, Var{Name: "KANIKO_CREDENTIALS_JSON", Value: creds, Secret: true})
+	}
+
+	addBool("KANIKO_CACHE_ENABLE", ef.CacheEnable)
+	if ef.CacheRepo != "" {
+		add("KANIKO_CACHE_REPO", ef.CacheRepo)
+	}
+	if ef.CacheTTL != "" {
+		add("KANIKO_CACHE_TTL", ef.CacheTTL)
+	}
+	addBool("KANIKO_CACHE_COPY_LAYERS", ef.CacheCopyLayers)
+	addBool("KANIKO_CACHE_RUN_LAYERS", ef.CacheRunLayers)
+	addBool("KANIKO_CACHE_COMPRESSED", ef.CacheCompressed)
+
+	if ef.SnapshotMode != nil {
+		add("KANIKO_SNAPSHOT_MODE", *ef.SnapshotMode)
+	}
+	if ef.OCILayoutPath != nil {
+		add("KANIKO_OCI_LAYOUT_PATH", *ef.OCILayoutPath)
+	}
+	addBool("KANIKO_USE_NEW_RUN", ef.UseNewRun)
+	addBool("KANIKO_SKIP_UNUSED_STAGES", ef.SkipUnusedStages)
+	addBool("KANIKO_CLEANUP", ef.Cleanup)
+	if ef.CustomPlatform != nil {
+		add("KANIKO_CUSTOM_PLATFORM", *ef.CustomPlatform)
+	}
+	addBool("KANIKO_NO_PUSH", ef.NoPush)
+
+	if len(ef.IgnorePath) > 0 {
+		add("KANIKO_IGNORE_PATH", strings.Join(ef.IgnorePath, ","))
+	}
+	addBool("KANIKO_IGNORE_WORKSPACE", ef.IgnoreWorkspace)
+
+	if ef.ExtraFlags != "" {
+		add("KANIKO_EXTRA_FLAGS", ef.ExtraFlags)
+	}
+
+	if ef.PreScript != nil {
+		add("PRE_SCRIPT", *ef.PreScript)
+	}
+	if ef.PostScript != nil {
+		add("POST_SCRIPT", *ef.PostScript)
+	}
+	if ef.ScriptWorkdir != "" {
+		add("SCRIPT_WORKDIR", ef.ScriptWorkdir)
+	}
+
+	for _, k := range sortedKeys(ef.Env) {
+		add(k, ef.Env[k])
+	}
+
+	return env, nil
+}
+
+// TargetPlatform returns the platform the task of ef builds for and its os, arch
+// and variant parts: the custom platform when set, otherwise linux/<arch>.
+func TargetPlatform(ef config.EffectiveConfig) (platform, goos, arch, variant string) {
+	if ef.CustomPlatform != nil && *ef.CustomPlatform != "" {
+		parts := strings.Split(*ef.CustomPlatform, "/")
+		if len(parts) < 2 {
+			return *ef.CustomPlatform, "linux", ef.Arch, ""
+		}
+		if len(parts) == 3 {
+			variant = parts[2]
+		}
+		return *ef.CustomPlatform, parts[0], parts[1], variant
+	}
+	if ef.Arch == "arm64" {
+		variant = "v8"
+	}
+	return "linux/" + ef.Arch, "linux", ef.Arch, variant
+}
+
+// TaskColorIndex returns the terminal color index for a task ID.
+// amd64 tasks use even indices, arm64 tasks use odd indices.
+func TaskColorIndex(taskID string) string {
+	if taskID == "amd64" {
+		return "0"
+	}
+	if taskID == "arm64" {
+		return "1"
+	}
+
+	arch, idx, ok := strings.Cut(taskID, "-")
+	if !ok || strings.Contains(idx, "-") {
+		return "0"
+	}
+	num, err := strconv.Atoi(idx)
+	if err != nil {
+		return "0"
+	}
+	switch arch {
+	case "amd64":
+		return strconv.Itoa(num * 2)
+	case "arm64":
+		return strconv.Itoa(num*2 + 1)
+	}
+	return "0"
+}
+
+// DockerConfigJSON returns a docker config.json that authenticates to each registry of creds.
+func DockerConfigJSON(creds []config.RegistryCredential) (string, error) {
+	type dockerAuth struct {
+		Auth string `json:"auth"`
+	}
+	cfg := struct {
+		Auths map[string]dockerAuth `json:"auths"`
+	}{Auths: make(map[string]dockerAuth, len(creds))}
+
+	for _, cred := range creds {
+		auth := base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password))
+		cfg.Auths[cred.Registry] = dockerAuth{Auth: auth}
+	}
+
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
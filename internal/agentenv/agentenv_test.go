@@ -0,0 +1,105 @@
+package agentenv
+
+import (
+	"testing"
+
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+func strP(v string) *string { return &v }
+
+func TestBuild(t *testing.T) {
+	t.Setenv("S3_SECRET_KEY", "storage-secret")
+
+	st := state.NewBuildState("b-1", 2, false, "registry.example.com/app:1.0")
+	ef := config.EffectiveConfig{
+		Arch:              "arm64",
+		Mirrors:           []string{"mirror.example.com/app:1.0"},
+		BuildArgs:         map[string]string{"NO_PROXY": "localhost,127.0.0.1,.svc", "A": "1"},
+		KanikoCredentials: []config.RegistryCredential{{Registry: "registry.example.com", Username: "u", Password: "p"}},
+		Env:               map[string]string{"FOO": "bar"},
+		AutoBuildArgs:     []string{"git-sha"},
+		Revision:          "1a2b3c4",
+	}
+
+	vars, err := Build(st, "arm64", ef, Task{Platform: "k8s", ControllerURL: "http://controller", ContextBucket: "bucket"})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	got := map[string]Var{}
+	for _, v := range vars {
+		if _, dup := got[v.Name]; dup {
+			t.Errorf("%s is set twice", v.Name)
+		}
+		got[v.Name] = v
+	}
+
+	want := map[string]string{
+		"BUILD_ID":                "b-1",
+		"EXECUTOR_PLATFORM":       "k8s",
+		"TARGETPLATFORM":          "linux/arm64",
+		"TARGETVARIANT":           "v8",
+		"TASK_COLOR_INDEX":        "1",
+		"CONTEXT_BUCKET":          "bucket",
+		"CONTROLLER_URL":          "http://controller",
+		"KANIKO_DESTINATION":      "registry.example.com/app:1.0_arm64",
+		"KANIKO_MIRRORS":          "mirror.example.com/app:1.0_arm64",
+		"KANIKO_BUILD_ARGS":       `{"A":"1","NO_PROXY":"localhost,127.0.0.1,.svc"}`,
+		"KANIKO_CREDENTIALS_JSON": `{"auths":{"registry.example.com":{"auth":"dTpw"}}}`,
+		"STORAGE_SECRET_KEY":      "storage-secret",
+		"FOO":                     "bar",
+		"KANIKO_AUTO_BUILD_ARGS":  "git-sha",
+		"KANIKO_REVISION":         "1a2b3c4",
+	}
+	for name, value := range want {
+		if got[name].Value != value {
+			t.Errorf("%s = %q, want %q", name, got[name].Value, value)
+		}
+	}
+
+	for name, v := range got {
+		secret := name == "STORAGE_SECRET_KEY" || name == "KANIKO_CREDENTIALS_JSON"
+		if v.Secret != secret {
+			t.Errorf("%s Secret = %t, want %t", name, v.Secret, secret)
+		}
+	}
+	if _, ok := got["KANIKO_LABELS"]; ok {
+		t.Error("KANIKO_LABELS is set without labels")
+	}
+}
+
+func TestTargetPlatform(t *testing.T) {
+	tests := []struct {
+		ef                            config.EffectiveConfig
+		platform, goos, arch, variant string
+	}{
+		{config.EffectiveConfig{Arch: "amd64"}, "linux/amd64", "linux", "amd64", ""},
+		{config.EffectiveConfig{Arch: "arm64"}, "linux/arm64", "linux", "arm64", "v8"},
+		{config.EffectiveConfig{Arch: "arm64", CustomPlatform: strP("linux/arm/v7")}, "linux/arm/v7", "linux", "arm", "v7"},
+		{config.EffectiveConfig{Arch: "amd64", CustomPlatform: strP("windows/amd64")}, "windows/amd64", "windows", "amd64", ""},
+	}
+	for _, tt := range tests {
+		platform, goos, arch, variant := TargetPlatform(tt.ef)
+		if platform != tt.platform || goos != tt.goos || arch != tt.arch || variant != tt.variant {
+			t.Errorf("TargetPlatform(%+v) = %s %s %s %s, want %s %s %s %s", tt.ef,
+				platform, goos, arch, variant, tt.platform, tt.goos, tt.arch, tt.variant)
+		}
+	}
+}
+
+func TestTaskColorIndex(t *testing.T) {
+	for taskID, want := range map[string]string{
+		"amd64":   "0",
+		"arm64":   "1",
+		"amd64-2": "4",
+		"arm64-2": "5",
+		"arm-1":   "0",
+		"amd64-x": "0",
+	} {
+		if got := TaskColorIndex(taskID); got != want {
+			t.Errorf("TaskColorIndex(%q) = %q, want %q", taskID, got, want)
+		}
+	}
+}
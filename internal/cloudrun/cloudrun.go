@@ -0,0 +1,509 @@
+package cloudrun
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/agentenv"
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+const (
+	defaultBaseURL        = "https://run.googleapis.com"
+	defaultSecretsBaseURL = "https://secretmanager.googleapis.com"
+	metadataURL           = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// CloudRunExecutor runs build tasks as GCP Cloud Run Jobs.
+type CloudRunExecutor struct {
+	HTTP    *http.Client
+	BaseURL string
+	// SecretsBaseURL is the Secret Manager API that the agent's credentials are stored in.
+	SecretsBaseURL string
+	Project        string
+	Region         string
+	AgentImage     string
+	ServiceAccount string
+	ControllerURL  string
+
+	// Token returns an OAuth2 access token for the Cloud Run API.
+	// Defaults to the GCE metadata server token of the attached service account.
+	Token func(ctx context.Context) (string, error)
+
+	PollInterval time.Duration
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewCloudRunExecutor creates a new CloudRunExecutor instance.
+func NewCloudRunExecutor(
+	project string,
+	region string,
+	agentImage string,
+	serviceAccount string,
+	controllerURL string,
+) *CloudRunExecutor {
+	e := &CloudRunExecutor{
+		HTTP:           &http.Client{Timeout: 30 * time.Second},
+		BaseURL:        defaultBaseURL,
+		SecretsBaseURL: defaultSecretsBaseURL,
+		Project:        project,
+		Region:         region,
+		AgentImage:     agentImage,
+		ServiceAccount: serviceAccount,
+		ControllerURL:  controllerURL,
+		PollInterval:   3 * time.Second,
+	}
+	e.Token = e.metadataToken
+	return e
+}
+
+type envVar struct {
+	Name        string       `json:"name"`
+	Value       string       `json:"value,omitempty"`
+	ValueSource *valueSource `json:"valueSource,omitempty"`
+}
+
+type valueSource struct {
+	SecretKeyRef secretKeyRef `json:"secretKeyRef"`
+}
+
+type secretKeyRef struct {
+	Secret  string `json:"secret"`
+	Version string `json:"version"`
+}
+
+type operation struct {
+	Name     string          `json:"name"`
+	Done     bool            `json:"done"`
+	Error    *operationError `json:"error,omitempty"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+type operationError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type execution struct {
+	Name           string      `json:"name"`
+	CompletionTime string      `json:"completionTime"`
+	RunningCount   int         `json:"runningCount"`
+	SucceededCount int         `json:"succeededCount"`
+	FailedCount    int         `json:"failedCount"`
+	CancelledCount int         `json:"cancelledCount"`
+	Conditions     []condition `json:"conditions"`
+}
+
+type condition struct {
+	Type    string `json:"type"`
+	State   string `json:"state"`
+	Message string `json:"message"`
+}
+
+// RunTask creates a Cloud Run Job for the build task, executes it and waits for completion.
+// The job is deleted once the execution has finished.
+func (e *CloudRunExecutor) RunTask(
+	ctx context.Context,
+	st *state.BuildState,
+	taskID string,
+	ef config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	ingestURL string,
+) error {
+	if ef.Arch != "amd64" {
+		return fmt.Errorf("cloudrun: unsupported arch %q (only amd64 is available)", ef.Arch)
+	}
+
+	st.AppendLog("info", fmt.Sprintf("[cloudrun][%s] dispatching job", taskID))
+
+	jobID := jobName(st.ID, taskID)
+	env, secrets, err := e.agentEnv(st, taskID, ef, contextBucket, contextKey, ingestURL, jobID)
+	if err != nil {
+		return err
+	}
+
+	defer e.deleteSecrets(st, taskID, secrets)
+	if err := e.createSecrets(ctx, st, taskID, secrets); err != nil {
+		return fmt.Errorf("[cloudrun] create secret: %w", err)
+	}
+
+	parent := fmt.Sprintf("projects/%s/locations/%s", e.Project, e.Region)
+
+	op, err := e.call(ctx, http.MethodPost, "/v2/"+parent+"/jobs?jobId="+url.QueryEscape(jobID), e.jobSpec(st, taskID, ef, env))
+	if err != nil {
+		return fmt.Errorf("[cloudrun] create job: %w", err)
+	}
+	if _, err := e.waitOperation(ctx, op); err != nil {
+		return fmt.Errorf("[cloudrun] create job: %w", err)
+	}
+
+	jobPath := parent + "/jobs/" + jobID
+	defer func() {
+		// A canceled task's job is deleted by CancelTask, once its execution is canceled.
+		if ctx.Err() != nil && st.TaskArn(taskID) != "" {
+			return
+		}
+		if _, err := e.call(context.Background(), http.MethodDelete, "/v2/"+jobPath, nil); err != nil {
+			st.AppendLog("warn", fmt.Sprintf("[cloudrun][%s] delete job: %v", taskID, err))
+		}
+	}()
+
+	op, err = e.call(ctx, http.MethodPost, "/v2/"+jobPath+":run", map[string]any{})
+	if err != nil {
+		return fmt.Errorf("[cloudrun] run job: %w", err)
+	}
+
+	var meta execution
+	if len(op.Metadata) > 0 {
+		_ = json.Unmarshal(op.Metadata, &meta)
+	}
+	if meta.Name == "" {
+		return fmt.Errorf("[cloudrun] run job: no execution in operation %s", op.Name)
+	}
+
+	st.Mu.Lock()
+	st.TaskArnByID[taskID] = meta.Name
+	st.IDByTaskArn[meta.Name] = taskID
+	st.Mu.Unlock()
+
+	st.AppendLog("info", fmt.Sprintf("[cloudrun][%s] started execution: %s", taskID, meta.Name))
+
+	return e.waitExecution(ctx, st, taskID, meta.Name)
+}
+
+// CancelTask cancels the job execution of taskID, if it was started, and deletes the job.
+func (e *CloudRunExecutor) CancelTask(ctx context.Context, st *state.BuildState, taskID string) error {
+	name := st.TaskArn(taskID)
+	if name == "" {
+		return nil
+	}
+	jobPath, _, _ := strings.Cut(name, "/executions/")
+
+	op, err := e.call(ctx, http.MethodPost, "/v2/"+name+":cancel", map[string]any{})
+	if err == nil {
+		_, err = e.waitOperation(ctx, op)
+	}
+	if err != nil {
+		st.AppendLog("warn", fmt.Sprintf("[cloudrun][%s] cancel execution: %v", taskID, err))
+	} else {
+		st.AppendLog("info", fmt.Sprintf("[cloudrun][%s] canceled execution: %s", taskID, name))
+	}
+
+	if _, err := e.call(ctx, http.MethodDelete, "/v2/"+jobPath, nil); err != nil {
+		return fmt.Errorf("[cloudrun] delete job: %w", err)
+	}
+	return nil
+}
+
+// Probe lists at most one job of the project and region, showing that the Cloud Run
+// API is reachable with the executor's credentials.
+func (e *CloudRunExecutor) Probe(ctx context.Context) error {
+	return e.do(ctx, http.MethodGet, fmt.Sprintf("/v2/projects/%s/locations/%s/jobs?pageSize=1", e.Project, e.Region), nil, nil)
+}
+
+func (e *CloudRunExecutor) jobSpec(st *state.BuildState, taskID string, ef config.EffectiveConfig, env []envVar) map[string]any {
+	limits := map[string]string{}
+	if ef.CPU != "" {
+		limits["cpu"] = config.FormatK8sResource(ef.CPU, "cpu")
+	}
+	if ef.Memory != "" {
+		limits["memory"] = config.FormatK8sResource(ef.Memory, "memory")
+	}
+
+	task := map[string]any{
+		"containers": []map[string]any{
+			{
+				"name":      "agent",
+				"image":     e.AgentImage,
+				"env":       env,
+				"resources": map[string]any{"limits": limits},
+			},
+		},
+		"maxRetries": 0,
+		"timeout":    "1800s",
+	}
+	if e.ServiceAccount != "" {
+		task["serviceAccount"] = e.ServiceAccount
+	}
+
+	return map[string]any{
+		"labels": map[string]string{
+			"build-id": st.ID,
+			"task-id":  taskID,
+			"arch":     ef.Arch,
+		},
+		"template": map[string]any{
+			"taskCount": 1,
+			"template":  task,
+		},
+	}
+}
+
+func (e *CloudRunExecutor) waitOperation(ctx context.Context, op *operation) (*operation, error) {
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timeout waiting for operation %s: %w", op.Name, ctx.Err())
+		case <-time.After(e.PollInterval):
+		}
+
+		next, err := e.call(ctx, http.MethodGet, "/v2/"+op.Name, nil)
+		if err != nil {
+			return nil, err
+		}
+		op = next
+	}
+
+	if op.Error != nil {
+		return nil, fmt.Errorf("operation %s failed: %s", op.Name, op.Error.Message)
+	}
+	return op, nil
+}
+
+func (e *CloudRunExecutor) waitExecution(
+	ctx context.Context,
+	st *state.BuildState,
+	taskID string,
+	name string,
+) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timeout waiting for Cloud Run execution: %w", ctx.Err())
+
+		case <-time.After(e.PollInterval):
+			var ex execution
+			if err := e.do(ctx, http.MethodGet, "/v2/"+name, nil, &ex); err != nil {
+				st.AppendLog("error", fmt.Sprintf("[cloudrun][%s] get execution error: %v", taskID, err))
+				continue
+			}
+
+			st.AppendLog("debug", fmt.Sprintf("[cloudrun][%s] running=%d succeeded=%d failed=%d",
+				taskID, ex.RunningCount, ex.SucceededCount, ex.FailedCount))
+
+			if ex.CompletionTime == "" {
+				continue
+			}
+
+			if ex.SucceededCount > 0 {
+				st.AppendLog("info", fmt.Sprintf("[cloudrun][%s] execution succeeded", taskID))
+				return nil
+			}
+
+			err := fmt.Errorf("cloud run execution failed (failed=%d cancelled=%d)", ex.FailedCount, ex.CancelledCount)
+			for _, c := range ex.Conditions {
+				if c.Type == "Completed" && c.Message != "" {
+					err = fmt.Errorf("cloud run execution failed: %s", c.Message)
+				}
+			}
+			st.AppendLog("error", fmt.Sprintf("[cloudrun][%s] %v", taskID, err))
+			st.SetTaskError(taskID, err)
+			return err
+		}
+	}
+}
+
+// call performs an API request that returns a long-running operation.
+func (e *CloudRunExecutor) call(ctx context.Context, method, path string, body any) (*operation, error) {
+	var op operation
+	if err := e.do(ctx, method, path, body, &op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+func (e *CloudRunExecutor) do(ctx context.Context, method, path string, body any, out any) error {
+	return e.doURL(ctx, method, e.BaseURL, path, body, out)
+}
+
+// doURL performs an authenticated JSON request against the Google API at baseURL.
+func (e *CloudRunExecutor) doURL(ctx context.Context, method, baseURL, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(baseURL, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	token, err := e.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("get access token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := e.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if out != nil && len(data) > 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// metadataToken fetches and caches the access token of the attached service account.
+func (e *CloudRunExecutor) metadataToken(ctx context.Context) (string, error) {
+	e.tokenMu.Lock()
+	defer e.tokenMu.Unlock()
+
+	if e.token != "" && time.Now().Before(e.tokenExpiry) {
+		return e.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := e.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server: status %d", resp.StatusCode)
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("decode metadata token: %w", err)
+	}
+
+	e.token = tok.AccessToken
+	e.tokenExpiry = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return e.token, nil
+}
+
+// agentEnv returns the agent environment of the job jobID. Secret values are
+// referenced from Secret Manager secrets named after the job instead of being set
+// in the job spec; the returned map holds the value of each such secret by ID.
+func (e *CloudRunExecutor) agentEnv(
+	st *state.BuildState,
+	taskID string,
+	ef config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	ingestURL string,
+	jobID string,
+) ([]envVar, map[string]string, error) {
+	vars, err := agentenv.Build(st, taskID, ef, agentenv.Task{
+		Platform:      "cloudrun",
+		ControllerURL: e.ControllerURL,
+		IngestURL:     ingestURL,
+		ContextBucket: contextBucket,
+		ContextKey:    contextKey,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	env := make([]envVar, 0, len(vars))
+	secrets := map[string]string{}
+	for _, v := range vars {
+		if !v.Secret {
+			env = append(env, envVar{Name: v.Name, Value: v.Value})
+			continue
+		}
+		if v.Value == "" {
+			continue
+		}
+		id := jobID + "-" + strings.ToLower(strings.ReplaceAll(v.Name, "_", "-"))
+		secrets[id] = v.Value
+		env = append(env, envVar{Name: v.Name, ValueSource: &valueSource{
+			SecretKeyRef: secretKeyRef{Secret: id, Version: "latest"},
+		}})
+	}
+	return env, secrets, nil
+}
+
+// createSecrets stores each of secrets, keyed by secret ID, in Secret Manager.
+func (e *CloudRunExecutor) createSecrets(ctx context.Context, st *state.BuildState, taskID string, secrets map[string]string) error {
+	parent := "/v1/projects/" + e.Project + "/secrets"
+	for id, value := range secrets {
+		secret := map[string]any{
+			"replication": map[string]any{"automatic": map[string]any{}},
+			"labels":      map[string]string{"build-id": st.ID, "task-id": taskID},
+		}
+		if err := e.doURL(ctx, http.MethodPost, e.SecretsBaseURL, parent+"?secretId="+url.QueryEscape(id), secret, nil); err != nil {
+			return err
+		}
+		version := map[string]any{"payload": map[string]string{"data": base64.StdEncoding.EncodeToString([]byte(value))}}
+		if err := e.doURL(ctx, http.MethodPost, e.SecretsBaseURL, parent+"/"+id+":addVersion", version, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSecrets deletes the Secret Manager secrets created for a job.
+func (e *CloudRunExecutor) deleteSecrets(st *state.BuildState, taskID string, secrets map[string]string) {
+	for id := range secrets {
+		path := "/v1/projects/" + e.Project + "/secrets/" + id
+		if err := e.doURL(context.Background(), http.MethodDelete, e.SecretsBaseURL, path, nil, nil); err != nil {
+			st.AppendLog("warn", fmt.Sprintf("[cloudrun][%s] delete secret %s: %v", taskID, id, err))
+		}
+	}
+}
+
+// jobName builds a Cloud Run job ID (lowercase letters, digits and hyphens,
+// starting with a letter, at most 63 characters) with a random suffix.
+func jobName(buildID, taskID string) string {
+	var b strings.Builder
+	lastDash := false
+	for _, r := range strings.ToLower("build-" + buildID + "-" + taskID) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			lastDash = false
+		} else if !lastDash {
+			b.WriteByte('-')
+			lastDash = true
+		}
+	}
+
+	suffix := make([]byte, 3)
+	_, _ = rand.Read(suffix)
+
+	name := b.String()
+	if max := 63 - 7; len(name) > max {
+		name = name[:max]
+	}
+	return strings.TrimRight(name, "-") + "-" + hex.EncodeToString(suffix)
+}
@@ -0,0 +1,266 @@
+package cloudrun
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+type fakeCloudRun struct {
+	mu        sync.Mutex
+	jobBody   map[string]any
+	deleted   bool
+	canceled  bool
+	listed    bool
+	succeeded int
+
+	// secrets holds the payload of each Secret Manager secret that is not deleted.
+	secrets        map[string]string
+	deletedSecrets []string
+}
+
+func (f *fakeCloudRun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	const parent = "/v2/projects/proj/locations/us-central1/jobs"
+	const secrets = "/v1/projects/proj/secrets"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == secrets:
+		if f.secrets == nil {
+			f.secrets = map[string]string{}
+		}
+		f.secrets[r.URL.Query().Get("secretId")] = ""
+		_, _ = w.Write([]byte(`{}`))
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":addVersion"):
+		var body struct {
+			Payload struct {
+				Data []byte `json:"data"`
+			} `json:"payload"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, secrets+"/"), ":addVersion")
+		f.secrets[id] = string(body.Payload.Data)
+		_, _ = w.Write([]byte(`{}`))
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, secrets+"/"):
+		f.deletedSecrets = append(f.deletedSecrets, strings.TrimPrefix(r.URL.Path, secrets+"/"))
+		_, _ = w.Write([]byte(`{}`))
+	case r.Method == http.MethodGet && r.URL.Path == parent:
+		f.listed = r.URL.Query().Get("pageSize") == "1"
+		_, _ = w.Write([]byte(`{"jobs":[]}`))
+	case r.Method == http.MethodPost && r.URL.Path == parent:
+		_ = json.NewDecoder(r.Body).Decode(&f.jobBody)
+		_, _ = w.Write([]byte(`{"name":"projects/proj/locations/us-central1/operations/create","done":false}`))
+	case r.Method == http.MethodGet && r.URL.Path == "/v2/projects/proj/locations/us-central1/operations/create":
+		_, _ = w.Write([]byte(`{"name":"projects/proj/locations/us-central1/operations/create","done":true}`))
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":run"):
+		_, _ = w.Write([]byte(`{"name":"projects/proj/locations/us-central1/operations/run","metadata":{"name":"projects/proj/locations/us-central1/jobs/j/executions/e1"}}`))
+	case r.Method == http.MethodPost && r.URL.Path == "/v2/projects/proj/locations/us-central1/jobs/j/executions/e1:cancel":
+		f.canceled = true
+		_, _ = w.Write([]byte(`{"name":"projects/proj/locations/us-central1/operations/cancel","done":true}`))
+	case r.Method == http.MethodGet && r.URL.Path == "/v2/projects/proj/locations/us-central1/jobs/j/executions/e1":
+		_, _ = w.Write([]byte(`{"name":"e1","completionTime":"2024-01-01T00:00:00Z","succeededCount":` + strconv.Itoa(f.succeeded) + `,"failedCount":1,"conditions":[{"type":"Completed","message":"Task failed"}]}`))
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, parent+"/"):
+		f.deleted = true
+		_, _ = w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestExecutor(srv *httptest.Server) *CloudRunExecutor {
+	e := NewCloudRunExecutor("proj", "us-central1", "agent:latest", "builder@proj.iam.gserviceaccount.com", "http://controller")
+	e.BaseURL = srv.URL
+	e.SecretsBaseURL = srv.URL
+	e.HTTP = srv.Client()
+	e.PollInterval = time.Millisecond
+	e.Token = func(context.Context) (string, error) { return "test-token", nil }
+	return e
+}
+
+func TestRunTask(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		fake := &fakeCloudRun{succeeded: 1}
+		srv := httptest.NewServer(fake)
+		defer srv.Close()
+
+		t.Setenv("S3_SECRET_KEY", "storage-secret")
+
+		st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+		err := newTestExecutor(srv).RunTask(context.Background(), st, "amd64",
+			config.EffectiveConfig{Arch: "amd64", CPU: "1024", Memory: "2048", DockerConfigJSON: `{"auths":{}}`}, "bucket", "key", "http://ingest")
+		if err != nil {
+			t.Fatalf("RunTask: %v", err)
+		}
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+
+		if !fake.deleted {
+			t.Error("job was not deleted")
+		}
+		if st.TaskArnByID["amd64"] != "projects/proj/locations/us-central1/jobs/j/executions/e1" {
+			t.Errorf("TaskArnByID[amd64] = %q", st.TaskArnByID["amd64"])
+		}
+
+		task := fake.jobBody["template"].(map[string]any)["template"].(map[string]any)
+		if task["serviceAccount"] != "builder@proj.iam.gserviceaccount.com" {
+			t.Errorf("serviceAccount = %v", task["serviceAccount"])
+		}
+		container := task["containers"].([]any)[0].(map[string]any)
+		limits := container["resources"].(map[string]any)["limits"].(map[string]any)
+		if limits["cpu"] != "1" || limits["memory"] != "2048Mi" {
+			t.Errorf("limits = %v, want cpu=1 memory=2048Mi", limits)
+		}
+
+		env := map[string]string{}
+		secretRefs := map[string]string{}
+		for _, v := range container["env"].([]any) {
+			m := v.(map[string]any)
+			if src, ok := m["valueSource"].(map[string]any); ok {
+				secretRefs[m["name"].(string)] = src["secretKeyRef"].(map[string]any)["secret"].(string)
+				continue
+			}
+			value, _ := m["value"].(string)
+			env[m["name"].(string)] = value
+		}
+		want := map[string]string{
+			"BUILD_ID":           "b-test",
+			"BUILD_TASK_ID":      "amd64",
+			"EXECUTOR_PLATFORM":  "cloudrun",
+			"CONTEXT_BUCKET":     "bucket",
+			"CONTEXT_KEY":        "key",
+			"INGEST_URL":         "http://ingest",
+			"KANIKO_DESTINATION": "registry.example.com/app:1.0",
+		}
+		for k, v := range want {
+			if env[k] != v {
+				t.Errorf("env %s = %q, want %q", k, env[k], v)
+			}
+		}
+
+		// Credentials are referenced from Secret Manager instead of set in the job spec.
+		wantSecrets := map[string]string{
+			"STORAGE_SECRET_KEY":      "storage-secret",
+			"KANIKO_CREDENTIALS_JSON": `{"auths":{}}`,
+		}
+		for name, value := range wantSecrets {
+			if _, ok := env[name]; ok {
+				t.Errorf("env %s is set as a plain value", name)
+			}
+			id, ok := secretRefs[name]
+			if !ok {
+				t.Errorf("env %s has no secret reference", name)
+				continue
+			}
+			if fake.secrets[id] != value {
+				t.Errorf("secret %s = %q, want %q", id, fake.secrets[id], value)
+			}
+		}
+		if len(fake.deletedSecrets) != len(wantSecrets) {
+			t.Errorf("deleted secrets = %v, want %d", fake.deletedSecrets, len(wantSecrets))
+		}
+	})
+
+	t.Run("failed execution", func(t *testing.T) {
+		fake := &fakeCloudRun{succeeded: 0}
+		srv := httptest.NewServer(fake)
+		defer srv.Close()
+
+		st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+		err := newTestExecutor(srv).RunTask(context.Background(), st, "amd64",
+			config.EffectiveConfig{Arch: "amd64"}, "bucket", "key", "http://ingest")
+		if err == nil || !strings.Contains(err.Error(), "Task failed") {
+			t.Errorf("RunTask error = %v, want execution failure", err)
+		}
+		if !st.HasError() {
+			t.Error("build state has no error")
+		}
+	})
+
+	t.Run("arm64 is rejected", func(t *testing.T) {
+		st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+		e := NewCloudRunExecutor("proj", "us-central1", "agent:latest", "", "http://controller")
+		if err := e.RunTask(context.Background(), st, "arm64", config.EffectiveConfig{Arch: "arm64"}, "bucket", "key", ""); err == nil {
+			t.Error("expected error for arm64")
+		}
+	})
+}
+
+func TestCancelTask(t *testing.T) {
+	fake := &fakeCloudRun{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	e := newTestExecutor(srv)
+	st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+	if err := e.CancelTask(context.Background(), st, "amd64"); err != nil {
+		t.Fatalf("CancelTask before start: %v", err)
+	}
+
+	st.TaskArnByID["amd64"] = "projects/proj/locations/us-central1/jobs/j/executions/e1"
+	if err := e.CancelTask(context.Background(), st, "amd64"); err != nil {
+		t.Fatalf("CancelTask: %v", err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if !fake.canceled {
+		t.Error("execution was not canceled")
+	}
+	if !fake.deleted {
+		t.Error("job was not deleted")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	fake := &fakeCloudRun{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	e := newTestExecutor(srv)
+	if err := e.Probe(context.Background()); err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+	if !fake.listed {
+		t.Error("Probe did not list the jobs")
+	}
+
+	e.Token = func(context.Context) (string, error) { return "expired", nil }
+	if err := e.Probe(context.Background()); err == nil {
+		t.Error("Probe with a rejected token: want error")
+	}
+}
+
+func TestJobName(t *testing.T) {
+	valid := regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+	for _, tc := range [][2]string{
+		{"b-20240101-120000-abcd", "amd64"},
+		{"b-" + strings.Repeat("x", 80), "amd64-1"},
+		{"B_Upper.Case", "amd64"},
+	} {
+		name := jobName(tc[0], tc[1])
+		if len(name) > 63 {
+			t.Errorf("jobName(%q, %q) length = %d, want <= 63", tc[0], tc[1], len(name))
+		}
+		if !valid.MatchString(name) {
+			t.Errorf("jobName(%q, %q) = %q is not a valid job ID", tc[0], tc[1], name)
+		}
+	}
+}
@@ -1,23 +1,51 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/rayshoo/bakery/internal/agentapi"
 )
 
 type GlobalConfig struct {
 	Platform string            `yaml:"platform"`
 	Arch     string            `yaml:"arch"`
 	Env      map[string]string `yaml:"env"`
+	Labels   map[string]string `yaml:"labels"`
 	CPU      string            `yaml:"cpu"`
 	Memory   string            `yaml:"memory"`
 
+	// ExtraHosts maps hostnames to IP addresses the build resolves them to, for
+	// internal names missing from the DNS the build runs with.
+	ExtraHosts map[string]string `yaml:"extra-hosts"`
+
+	// ContainerCPU and ContainerMemoryReservation reserve part of the task size for the
+	// agent container on ECS, leaving the rest to other containers in the task.
+	ContainerCPU               string `yaml:"container-cpu"`
+	ContainerMemoryReservation string `yaml:"container-memory-reservation"`
+
 	PreScript  *string `yaml:"pre-script"`
 	PostScript *string `yaml:"post-script"`
 
+	// ScriptWorkdir is where pre/post scripts run: "root" (/, the default) or
+	// "context" (the kaniko context directory inside /workspace).
+	ScriptWorkdir string `yaml:"script-workdir"`
+
+	// Strict turns configuration warnings, such as incoherent cache settings, into errors.
+	Strict bool `yaml:"strict"`
+
+	// DockerConfigJSON is a complete docker config.json, passed to kaniko verbatim
+	// instead of one generated from KanikoCredentials, e.g. for credHelpers.
+	DockerConfigJSON string `yaml:"docker-config-json"`
+
 	KanikoCredentials []RegistryCredential `yaml:"kaniko-credentials"`
 	Kaniko            KanikoConfig         `yaml:"kaniko"`
 }
@@ -26,27 +54,58 @@ type BakeConfig struct {
 	Platform string            `yaml:"platform"`
 	Arch     string            `yaml:"arch"`
 	Env      map[string]string `yaml:"env"`
+	Labels   map[string]string `yaml:"labels"`
 	CPU      string            `yaml:"cpu"`
 	Memory   string            `yaml:"memory"`
 
-	PreScript  *string `yaml:"pre-script"`
-	PostScript *string `yaml:"post-script"`
+	// ExtraHosts maps hostnames to IP addresses the build resolves them to, for
+	// internal names missing from the DNS the build runs with.
+	ExtraHosts map[string]string `yaml:"extra-hosts"`
+
+	// ContainerCPU and ContainerMemoryReservation reserve part of the task size for the
+	// agent container on ECS, leaving the rest to other containers in the task.
+	ContainerCPU               string `yaml:"container-cpu"`
+	ContainerMemoryReservation string `yaml:"container-memory-reservation"`
+
+	PreScript     *string `yaml:"pre-script"`
+	PostScript    *string `yaml:"post-script"`
+	ScriptWorkdir string  `yaml:"script-workdir"`
+
+	// DockerConfigJSON is a complete docker config.json, passed to kaniko verbatim
+	// instead of one generated from KanikoCredentials, e.g. for credHelpers.
+	DockerConfigJSON string `yaml:"docker-config-json"`
 
 	KanikoCredentials []RegistryCredential `yaml:"kaniko-credentials"`
 	Kaniko            KanikoOverride       `yaml:"kaniko"`
 }
 
 type RegistryCredential struct {
-	Registry string `yaml:"registry"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Registry string `yaml:"registry" json:"registry"`
+	Username string `yaml:"username" json:"username,omitempty"`
+	Password string `yaml:"password" json:"password,omitempty"`
+
+	// SecretARN references a Secrets Manager secret holding the username and password.
+	// The controller resolves it before dispatch.
+	SecretARN string `yaml:"secret-arn" json:"secretArn,omitempty"`
 }
 
 // KanikoConfig holds Kaniko settings for the global section.
 type KanikoConfig struct {
-	ContextPath string            `yaml:"context-path"`
-	Dockerfile  string            `yaml:"dockerfile"`
-	BuildArgs   map[string]string `yaml:"build-args"`
+	ContextPath      string            `yaml:"context-path"`
+	Dockerfile       string            `yaml:"dockerfile"`
+	DockerfileInline string            `yaml:"dockerfile-inline,omitempty"`
+	BuildArgs        map[string]string `yaml:"build-args"`
+
+	// DockerfileURL is an http(s) URL the agent fetches the Dockerfile from.
+	// dockerfile-inline takes precedence over it, and it over dockerfile.
+	DockerfileURL string `yaml:"dockerfile-url,omitempty"`
+
+	// BuildArgsFile is a KEY=VALUE file relative to the context; build-args win over its entries.
+	BuildArgsFile string `yaml:"build-args-file,omitempty"`
+
+	// AutoBuildArgs lists build metadata the agent injects as build args, see
+	// agentapi.AutoBuildArgNames. build-args with the same name win.
+	AutoBuildArgs []string `yaml:"auto-build-args,omitempty"`
 
 	Cache struct {
 		Enable     *bool  `yaml:"enable,omitempty"`
@@ -55,43 +114,108 @@ type KanikoConfig struct {
 		CopyLayers *bool  `yaml:"copy-layers,omitempty"`
 		RunLayers  *bool  `yaml:"run-layers,omitempty"`
 		Compressed *bool  `yaml:"compressed,omitempty"`
+
+		// Auto derives repo from the destination when repo is empty: the destination
+		// without its tag, plus AutoSuffix (default "-cache").
+		Auto       *bool  `yaml:"auto,omitempty"`
+		AutoSuffix string `yaml:"auto-suffix,omitempty"`
+
+		// From and To mirror buildx cache-from/cache-to; both map onto kaniko's single cache repo.
+		From []string `yaml:"from,omitempty"`
+		To   string   `yaml:"to,omitempty"`
 	} `yaml:"cache"`
 
-	SnapshotMode   *string `yaml:"snapshot-mode,omitempty"`
-	UseNewRun      *bool   `yaml:"use-new-run,omitempty"`
-	Cleanup        *bool   `yaml:"cleanup,omitempty"`
-	CustomPlatform *string `yaml:"custom-platform,omitempty"`
-	Destination    string  `yaml:"destination"`
+	SnapshotMode     *string `yaml:"snapshot-mode,omitempty"`
+	UseNewRun        *bool   `yaml:"use-new-run,omitempty"`
+	SkipUnusedStages *bool   `yaml:"skip-unused-stages,omitempty"`
+	Cleanup          *bool   `yaml:"cleanup,omitempty"`
+	CustomPlatform   *string `yaml:"custom-platform,omitempty"`
+	Destination      string  `yaml:"destination"`
+
+	// OCILayoutPath makes kaniko also write the image as an OCI layout at this path
+	// in the agent container. With no-push the layout is uploaded to storage.
+	OCILayoutPath *string `yaml:"oci-layout-path,omitempty"`
+
+	// Destinations pushes the same image to several registries in one kaniko run.
+	// The first entry (or Destination, when set) is canonical; the rest are mirrors.
+	Destinations []string `yaml:"destinations,omitempty"`
+
+	// ManifestTags are extra tags written to the canonical destination's repository,
+	// all pointing at the same multi-arch manifest digest as the destination itself.
+	ManifestTags []string `yaml:"manifest-tags,omitempty"`
+
+	// ManifestArchOrder lists the arches whose entries come first in the multi-arch
+	// manifest, for clients that take the first entry as the default.
+	ManifestArchOrder []string `yaml:"manifest-arch-order,omitempty"`
+
+	// Manifest selects how the build's images are published: ManifestAuto (the
+	// default) creates a multi-arch manifest when several tasks push, ManifestNone
+	// pushes every task to its destination as-is with no arch suffix or manifest.
+	Manifest string `yaml:"manifest,omitempty"`
+
+	// ArchTagSeparator joins the tag and the arch (or task) in the per-arch tags of
+	// multi-arch builds, e.g. "-" for app:1.0-amd64. Defaults to "_".
+	ArchTagSeparator string `yaml:"arch-tag-separator,omitempty"`
+
+	// AutoLabelBuildID labels every image with the ID of the build that produced it
+	// and, when Revision is set, the source revision it was built from.
+	AutoLabelBuildID bool `yaml:"auto-label-build-id,omitempty"`
+
+	// Revision is the source revision, such as a git SHA, the images are built from.
+	Revision string `yaml:"revision,omitempty"`
 
 	NoPush     *bool    `yaml:"no-push,omitempty"`
 	IgnorePath []string `yaml:"ignore-path,omitempty"`
-	ExtraFlags string   `yaml:"extra-flags,omitempty"`
+
+	// AddHosts lists docker-style host:ip entries. kaniko has no --add-host flag, so
+	// they are resolved through /etc/hosts together with ExtraHosts.
+	AddHosts []string `yaml:"add-hosts,omitempty"`
+
+	// IgnoreWorkspace controls the /workspace ignore path the agent always adds.
+	// Defaults to true; disabling it can snapshot the build context into the image.
+	IgnoreWorkspace *bool `yaml:"ignore-workspace,omitempty"`
+
+	ExtraFlags string `yaml:"extra-flags,omitempty"`
 }
 
 // KanikoOverride holds per-bake overrides for global Kaniko settings.
 type KanikoOverride struct {
-	ContextPath *string           `yaml:"context-path"`
-	Dockerfile  *string           `yaml:"dockerfile"`
-	BuildArgs   map[string]string `yaml:"build-args"`
+	ContextPath      *string           `yaml:"context-path"`
+	Dockerfile       *string           `yaml:"dockerfile"`
+	DockerfileInline *string           `yaml:"dockerfile-inline"`
+	DockerfileURL    *string           `yaml:"dockerfile-url"`
+	BuildArgs        map[string]string `yaml:"build-args"`
+	BuildArgsFile    *string           `yaml:"build-args-file"`
+	AutoBuildArgs    []string          `yaml:"auto-build-args"`
 
 	Cache *struct {
-		Enable     *bool   `yaml:"enable"`
-		Repo       *string `yaml:"repo"`
-		TTL        *string `yaml:"ttl"`
-		CopyLayers *bool   `yaml:"copy-layers"`
-		RunLayers  *bool   `yaml:"run-layers"`
-		Compressed *bool   `yaml:"compressed"`
+		Enable     *bool    `yaml:"enable"`
+		Repo       *string  `yaml:"repo"`
+		TTL        *string  `yaml:"ttl"`
+		CopyLayers *bool    `yaml:"copy-layers"`
+		RunLayers  *bool    `yaml:"run-layers"`
+		Compressed *bool    `yaml:"compressed"`
+		Auto       *bool    `yaml:"auto"`
+		AutoSuffix *string  `yaml:"auto-suffix"`
+		From       []string `yaml:"from"`
+		To         *string  `yaml:"to"`
 	} `yaml:"cache"`
 
-	SnapshotMode   *string `yaml:"snapshot-mode"`
-	UseNewRun      *bool   `yaml:"use-new-run"`
-	Cleanup        *bool   `yaml:"cleanup"`
-	CustomPlatform *string `yaml:"custom-platform"`
-	Destination    *string `yaml:"destination"`
-
-	NoPush     *bool    `yaml:"no-push"`
-	IgnorePath []string `yaml:"ignore-path"`
-	ExtraFlags *string  `yaml:"extra-flags"`
+	SnapshotMode     *string `yaml:"snapshot-mode"`
+	UseNewRun        *bool   `yaml:"use-new-run"`
+	SkipUnusedStages *bool   `yaml:"skip-unused-stages"`
+	Cleanup          *bool   `yaml:"cleanup"`
+	CustomPlatform   *string `yaml:"custom-platform"`
+	Destination      *string `yaml:"destination"`
+	OCILayoutPath    *string `yaml:"oci-layout-path"`
+
+	Destinations []string `yaml:"destinations"`
+
+	NoPush          *bool    `yaml:"no-push"`
+	IgnorePath      []string `yaml:"ignore-path"`
+	AddHosts        []string `yaml:"add-hosts"`
+	IgnoreWorkspace *bool    `yaml:"ignore-workspace"`
+	ExtraFlags      *string  `yaml:"extra-flags"`
 }
 
 type LocalSecretRef struct {
@@ -110,40 +234,119 @@ type BuildConfig struct {
 	Bake   []BakeConfig `yaml:"bake"`
 }
 
+// BatchConfig holds per-service build configs that share a single build context.
+type BatchConfig struct {
+	Services []BatchService `yaml:"services"`
+}
+
+// BatchService is a named build config within a batch.
+type BatchService struct {
+	Name   string      `yaml:"name"`
+	Config BuildConfig `yaml:"config"`
+}
+
 // EffectiveConfig is the final merged configuration from global and bake sections.
 type EffectiveConfig struct {
-	Platform string
-	Arch     string
-
-	Env    map[string]string
-	CPU    string
-	Memory string
-
-	PreScript  *string
-	PostScript *string
-
-	KanikoCredentials []RegistryCredential
-
-	ContextPath string
-	Dockerfile  string
-	BuildArgs   map[string]string
-	Destination string
-
-	CacheEnable     *bool
-	CacheRepo       string
-	CacheTTL        string
-	CacheCopyLayers *bool
-	CacheRunLayers  *bool
-	CacheCompressed *bool
-
-	SnapshotMode   *string
-	UseNewRun      *bool
-	Cleanup        *bool
-	CustomPlatform *string
-
-	NoPush     *bool
-	IgnorePath []string
-	ExtraFlags string
+	Platform string `json:"platform,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+
+	Env    map[string]string `json:"env,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	CPU    string            `json:"cpu,omitempty"`
+	Memory string            `json:"memory,omitempty"`
+
+	ExtraHosts map[string]string `json:"extraHosts,omitempty"`
+
+	ContainerCPU               string `json:"containerCPU,omitempty"`
+	ContainerMemoryReservation string `json:"containerMemoryReservation,omitempty"`
+
+	PreScript     *string `json:"preScript,omitempty"`
+	PostScript    *string `json:"postScript,omitempty"`
+	ScriptWorkdir string  `json:"scriptWorkdir,omitempty"`
+
+	KanikoCredentials []RegistryCredential `json:"kanikoCredentials,omitempty"`
+	DockerConfigJSON  string               `json:"dockerConfigJSON,omitempty"`
+
+	ContextPath      string            `json:"contextPath,omitempty"`
+	Dockerfile       string            `json:"dockerfile,omitempty"`
+	DockerfileInline string            `json:"dockerfileInline,omitempty"`
+	DockerfileURL    string            `json:"dockerfileURL,omitempty"`
+	BuildArgs        map[string]string `json:"buildArgs,omitempty"`
+	BuildArgsFile    string            `json:"buildArgsFile,omitempty"`
+	AutoBuildArgs    []string          `json:"autoBuildArgs,omitempty"`
+	Revision         string            `json:"revision,omitempty"`
+	Destination      string            `json:"destination,omitempty"`
+	Mirrors          []string          `json:"mirrors,omitempty"`
+
+	CacheEnable     *bool  `json:"cacheEnable,omitempty"`
+	CacheRepo       string `json:"cacheRepo,omitempty"`
+	CacheTTL        string `json:"cacheTTL,omitempty"`
+	CacheCopyLayers *bool  `json:"cacheCopyLayers,omitempty"`
+	CacheRunLayers  *bool  `json:"cacheRunLayers,omitempty"`
+	CacheCompressed *bool  `json:"cacheCompressed,omitempty"`
+
+	SnapshotMode     *string `json:"snapshotMode,omitempty"`
+	UseNewRun        *bool   `json:"useNewRun,omitempty"`
+	SkipUnusedStages *bool   `json:"skipUnusedStages,omitempty"`
+	Cleanup          *bool   `json:"cleanup,omitempty"`
+	CustomPlatform   *string `json:"customPlatform,omitempty"`
+	OCILayoutPath    *string `json:"ociLayoutPath,omitempty"`
+	ArchTagSeparator string  `json:"archTagSeparator,omitempty"`
+
+	NoPush          *bool    `json:"noPush,omitempty"`
+	IgnorePath      []string `json:"ignorePath,omitempty"`
+	IgnoreWorkspace *bool    `json:"ignoreWorkspace,omitempty"`
+	ExtraFlags      string   `json:"extraFlags,omitempty"`
+
+	// Warnings lists settings that are valid but probably not what the user meant.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// ExtraHostsEnv returns ExtraHosts as sorted host=ip pairs joined by commas, the
+// EXTRA_HOSTS value passed to the agent, or "" when there are none.
+func (ef EffectiveConfig) ExtraHostsEnv() string {
+	pairs := make([]string, 0, len(ef.ExtraHosts))
+	for host, ip := range ef.ExtraHosts {
+		pairs = append(pairs, host+"="+ip)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Redacted returns a copy of ef with registry passwords, the docker config and the
+// values of build args and env vars masked, safe to expose for debugging. Build args
+// and env vars keep their names, since their values often carry tokens or proxy
+// credentials.
+func (ef EffectiveConfig) Redacted() EffectiveConfig {
+	if ef.DockerConfigJSON != "" {
+		ef.DockerConfigJSON = "***"
+	}
+	ef.BuildArgs = redactValues(ef.BuildArgs)
+	ef.Env = redactValues(ef.Env)
+	if len(ef.KanikoCredentials) == 0 {
+		return ef
+	}
+	creds := make([]RegistryCredential, len(ef.KanikoCredentials))
+	for i, cred := range ef.KanikoCredentials {
+		if cred.Password != "" {
+			cred.Password = "***"
+		}
+		creds[i] = cred
+	}
+	ef.KanikoCredentials = creds
+	return ef
+}
+
+// redactValues returns a copy of m with every value replaced by ***.
+func redactValues(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(m))
+	for k := range m {
+		redacted[k] = "***"
+	}
+	return redacted
 }
 
 func UnmarshalYAML(b []byte, out *BuildConfig) error {
@@ -153,6 +356,62 @@ func UnmarshalYAML(b []byte, out *BuildConfig) error {
 	return nil
 }
 
+// UnmarshalBatchYAML parses a batch request and checks that service names are non-empty and unique.
+func UnmarshalBatchYAML(b []byte, out *BatchConfig) error {
+	if err := yaml.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("invalid yaml: %w", err)
+	}
+	if len(out.Services) == 0 {
+		return fmt.Errorf("batch has no services")
+	}
+
+	seen := make(map[string]bool, len(out.Services))
+	for _, svc := range out.Services {
+		name := strings.TrimSpace(svc.Name)
+		if name == "" {
+			return fmt.Errorf("batch service name is empty")
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate batch service name: %s", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// Values of KanikoConfig.Manifest.
+const (
+	ManifestAuto = "auto"
+	ManifestNone = "none"
+)
+
+// ManifestDisabled reports whether manifest: none turns off arch suffixing and
+// multi-arch manifest creation.
+func (k KanikoConfig) ManifestDisabled() bool {
+	return k.Manifest == ManifestNone
+}
+
+// DefaultArchTagSeparator is the arch-tag-separator used when none is configured.
+const DefaultArchTagSeparator = "_"
+
+// AppendTagSuffix appends sep and suffix (an arch or task ID) to the tag of the image
+// reference destination, defaulting the tag to latest and sep to DefaultArchTagSeparator,
+// e.g. registry.example.com:5000/app:1.0 with suffix amd64 becomes
+// registry.example.com:5000/app:1.0_amd64.
+func AppendTagSuffix(destination, suffix, sep string) string {
+	if sep == "" {
+		sep = DefaultArchTagSeparator
+	}
+	tag := "latest"
+	if i := strings.LastIndexByte(destination, ':'); i > strings.LastIndexByte(destination, '/') {
+		destination, tag = destination[:i], destination[i+1:]
+	}
+	return destination + ":" + tag + sep + suffix
+}
+
+// archTagSeparatorPattern limits arch-tag-separator to characters valid in an image tag.
+var archTagSeparatorPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,8}$`)
+
 // BuildEffectiveList parses a BuildConfig and produces an EffectiveConfig for each bake entry.
 func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 	if cfg == nil {
@@ -162,8 +421,29 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 	var list []EffectiveConfig
 	global := cfg.Global
 
+	switch global.Kaniko.Manifest {
+	case "", ManifestAuto:
+	case ManifestNone:
+		if len(global.Kaniko.ManifestTags) > 0 {
+			return nil, fmt.Errorf("manifest-tags cannot be used with manifest: none")
+		}
+	default:
+		return nil, fmt.Errorf("invalid manifest %q: want auto or none", global.Kaniko.Manifest)
+	}
+
+	archTagSeparator := global.Kaniko.ArchTagSeparator
+	if archTagSeparator == "" {
+		archTagSeparator = DefaultArchTagSeparator
+	} else if !archTagSeparatorPattern.MatchString(archTagSeparator) {
+		return nil, fmt.Errorf("invalid arch-tag-separator %q: want up to 8 characters valid in an image tag, such as _ or -", archTagSeparator)
+	}
+
 	defaultCPU := os.Getenv("DEFAULT_BUILD_CPU")
 	defaultMemory := os.Getenv("DEFAULT_BUILD_MEMORY")
+	defaultPlatform := os.Getenv("DEFAULT_BUILD_PLATFORM")
+	if defaultPlatform == "" {
+		defaultPlatform = "ecs"
+	}
 
 	for _, b := range cfg.Bake {
 
@@ -174,7 +454,7 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 		} else if global.Platform != "" {
 			ef.Platform = global.Platform
 		} else {
-			ef.Platform = "ecs"
+			ef.Platform = defaultPlatform
 		}
 
 		if b.Arch != "" {
@@ -184,10 +464,23 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 		} else {
 			return nil, fmt.Errorf("arch not specified in either global or bake section")
 		}
+		// The arch is part of task IDs and image tags, so a variant belongs in custom-platform.
+		if _, err := ParsePlatform(ef.Arch); err != nil || strings.Contains(ef.Arch, "/") {
+			return nil, fmt.Errorf("invalid arch %q: want a single arch such as arm64, with any variant in kaniko.custom-platform", ef.Arch)
+		}
 
 		ef.CPU = coalesceStr(b.CPU, global.CPU, defaultCPU)
 		ef.Memory = coalesceStr(b.Memory, global.Memory, defaultMemory)
 
+		ef.ContainerCPU = coalesceStr(b.ContainerCPU, global.ContainerCPU, "")
+		if _, err := ParseCPU(ef.ContainerCPU); err != nil {
+			return nil, fmt.Errorf("container-cpu: %w", err)
+		}
+		ef.ContainerMemoryReservation = coalesceStr(b.ContainerMemoryReservation, global.ContainerMemoryReservation, "")
+		if _, err := ParseMemory(ef.ContainerMemoryReservation); err != nil {
+			return nil, fmt.Errorf("container-memory-reservation: %w", err)
+		}
+
 		ef.Env = map[string]string{}
 		for k, v := range global.Env {
 			ef.Env[k] = v
@@ -196,6 +489,28 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 			ef.Env[k] = v
 		}
 
+		ef.Labels = map[string]string{}
+		for k, v := range global.Labels {
+			ef.Labels[k] = v
+		}
+		for k, v := range b.Labels {
+			ef.Labels[k] = v
+		}
+
+		globalAdd, err := parseAddHosts(global.Kaniko.AddHosts)
+		if err != nil {
+			return nil, err
+		}
+		bakeAdd, err := parseAddHosts(b.Kaniko.AddHosts)
+		if err != nil {
+			return nil, err
+		}
+		extraHosts, err := mergeExtraHosts(global.ExtraHosts, globalAdd, b.ExtraHosts, bakeAdd)
+		if err != nil {
+			return nil, err
+		}
+		ef.ExtraHosts = extraHosts
+
 		if b.PreScript != nil {
 			ef.PreScript = b.PreScript
 		} else {
@@ -208,12 +523,33 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 			ef.PostScript = global.PostScript
 		}
 
+		ef.ScriptWorkdir = coalesceStr(b.ScriptWorkdir, global.ScriptWorkdir, "")
+		if ef.ScriptWorkdir != "" && ef.ScriptWorkdir != "root" && ef.ScriptWorkdir != "context" {
+			return nil, fmt.Errorf("invalid script-workdir %q: want context or root", ef.ScriptWorkdir)
+		}
+
 		if len(b.KanikoCredentials) > 0 {
 			ef.KanikoCredentials = b.KanikoCredentials
 		} else {
 			ef.KanikoCredentials = global.KanikoCredentials
 		}
 
+		ef.DockerConfigJSON = global.DockerConfigJSON
+		if strings.TrimSpace(b.DockerConfigJSON) != "" {
+			ef.DockerConfigJSON = b.DockerConfigJSON
+		}
+		if strings.TrimSpace(ef.DockerConfigJSON) == "" {
+			ef.DockerConfigJSON = ""
+		} else {
+			if len(ef.KanikoCredentials) > 0 {
+				return nil, fmt.Errorf("docker-config-json cannot be combined with kaniko-credentials")
+			}
+			var doc map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(ef.DockerConfigJSON), &doc); err != nil {
+				return nil, fmt.Errorf("docker-config-json: invalid JSON object: %w", err)
+			}
+		}
+
 		if b.Kaniko.ContextPath != nil {
 			ef.ContextPath = *b.Kaniko.ContextPath
 		} else {
@@ -226,6 +562,23 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 			ef.Dockerfile = global.Kaniko.Dockerfile
 		}
 
+		if b.Kaniko.DockerfileInline != nil {
+			ef.DockerfileInline = *b.Kaniko.DockerfileInline
+		} else {
+			ef.DockerfileInline = global.Kaniko.DockerfileInline
+		}
+
+		if b.Kaniko.DockerfileURL != nil {
+			ef.DockerfileURL = *b.Kaniko.DockerfileURL
+		} else {
+			ef.DockerfileURL = global.Kaniko.DockerfileURL
+		}
+		if ef.DockerfileURL != "" {
+			if u, err := url.Parse(ef.DockerfileURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid dockerfile-url %q: want an http or https URL", ef.DockerfileURL)
+			}
+		}
+
 		ef.BuildArgs = map[string]string{}
 		for k, v := range global.Kaniko.BuildArgs {
 			ef.BuildArgs[k] = v
@@ -234,6 +587,28 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 			ef.BuildArgs[k] = v
 		}
 
+		if b.Kaniko.BuildArgsFile != nil {
+			ef.BuildArgsFile = *b.Kaniko.BuildArgsFile
+		} else {
+			ef.BuildArgsFile = global.Kaniko.BuildArgsFile
+		}
+
+		if b.Kaniko.AutoBuildArgs != nil {
+			ef.AutoBuildArgs = b.Kaniko.AutoBuildArgs
+		} else {
+			ef.AutoBuildArgs = global.Kaniko.AutoBuildArgs
+		}
+		for _, name := range ef.AutoBuildArgs {
+			if _, ok := agentapi.AutoBuildArgNames[name]; !ok {
+				return nil, fmt.Errorf("invalid auto-build-args entry %q: want build-id, build-date or git-sha", name)
+			}
+		}
+		ef.Revision = global.Kaniko.Revision
+
+		var cacheFrom []string
+		var cacheTo string
+		cacheAuto := global.Kaniko.Cache.Auto
+		cacheAutoSuffix := global.Kaniko.Cache.AutoSuffix
 		if b.Kaniko.Cache != nil {
 			ef.CacheEnable = boolPtr(b.Kaniko.Cache.Enable, global.Kaniko.Cache.Enable)
 
@@ -252,6 +627,19 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 			ef.CacheCopyLayers = boolPtr(b.Kaniko.Cache.CopyLayers, global.Kaniko.Cache.CopyLayers)
 			ef.CacheRunLayers = boolPtr(b.Kaniko.Cache.RunLayers, global.Kaniko.Cache.RunLayers)
 			ef.CacheCompressed = boolPtr(b.Kaniko.Cache.Compressed, global.Kaniko.Cache.Compressed)
+
+			cacheFrom = global.Kaniko.Cache.From
+			if b.Kaniko.Cache.From != nil {
+				cacheFrom = b.Kaniko.Cache.From
+			}
+			cacheTo = global.Kaniko.Cache.To
+			if b.Kaniko.Cache.To != nil {
+				cacheTo = *b.Kaniko.Cache.To
+			}
+			cacheAuto = boolPtr(b.Kaniko.Cache.Auto, global.Kaniko.Cache.Auto)
+			if b.Kaniko.Cache.AutoSuffix != nil {
+				cacheAutoSuffix = *b.Kaniko.Cache.AutoSuffix
+			}
 		} else {
 			ef.CacheEnable = global.Kaniko.Cache.Enable
 			ef.CacheRepo = global.Kaniko.Cache.Repo
@@ -259,12 +647,26 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 			ef.CacheCopyLayers = global.Kaniko.Cache.CopyLayers
 			ef.CacheRunLayers = global.Kaniko.Cache.RunLayers
 			ef.CacheCompressed = global.Kaniko.Cache.Compressed
+			cacheFrom = global.Kaniko.Cache.From
+			cacheTo = global.Kaniko.Cache.To
+		}
+
+		if err := applyCacheRefs(&ef, cacheFrom, cacheTo); err != nil {
+			return nil, err
 		}
 
 		ef.SnapshotMode = strPtr(b.Kaniko.SnapshotMode, global.Kaniko.SnapshotMode)
 		ef.UseNewRun = boolPtr(b.Kaniko.UseNewRun, global.Kaniko.UseNewRun)
+		ef.SkipUnusedStages = boolPtr(b.Kaniko.SkipUnusedStages, global.Kaniko.SkipUnusedStages)
 		ef.Cleanup = boolPtr(b.Kaniko.Cleanup, global.Kaniko.Cleanup)
+		ef.OCILayoutPath = strPtr(b.Kaniko.OCILayoutPath, global.Kaniko.OCILayoutPath)
+		ef.ArchTagSeparator = archTagSeparator
 		ef.CustomPlatform = strPtr(b.Kaniko.CustomPlatform, global.Kaniko.CustomPlatform)
+		if ef.CustomPlatform != nil && *ef.CustomPlatform != "" {
+			if _, err := ParsePlatform(*ef.CustomPlatform); err != nil {
+				return nil, fmt.Errorf("kaniko.custom-platform: %w", err)
+			}
+		}
 
 		ef.NoPush = boolPtr(b.Kaniko.NoPush, global.Kaniko.NoPush)
 
@@ -273,6 +675,7 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 		} else {
 			ef.IgnorePath = global.Kaniko.IgnorePath
 		}
+		ef.IgnoreWorkspace = boolPtr(b.Kaniko.IgnoreWorkspace, global.Kaniko.IgnoreWorkspace)
 
 		if b.Kaniko.ExtraFlags != nil {
 			ef.ExtraFlags = *b.Kaniko.ExtraFlags
@@ -280,10 +683,34 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 			ef.ExtraFlags = global.Kaniko.ExtraFlags
 		}
 
-		if b.Kaniko.Destination != nil {
-			ef.Destination = *b.Kaniko.Destination
+		if b.Kaniko.Destination != nil || len(b.Kaniko.Destinations) > 0 {
+			var dest string
+			if b.Kaniko.Destination != nil {
+				dest = *b.Kaniko.Destination
+			}
+			ef.Destination, ef.Mirrors = splitDestinations(dest, b.Kaniko.Destinations)
 		} else {
 			ef.Destination = ""
+			_, ef.Mirrors = splitDestinations(global.Kaniko.Destination, global.Kaniko.Destinations)
+		}
+
+		if cacheAuto != nil && *cacheAuto && ef.CacheRepo == "" && (ef.CacheEnable == nil || *ef.CacheEnable) {
+			dest := ef.Destination
+			if dest == "" {
+				dest = global.Kaniko.CanonicalDestination()
+			}
+			if dest != "" {
+				ef.CacheRepo = deriveCacheRepo(dest, cacheAutoSuffix)
+				if ef.CacheEnable == nil {
+					enable := true
+					ef.CacheEnable = &enable
+				}
+			}
+		}
+
+		ef.Warnings = cacheWarnings(ef)
+		if global.Strict && len(ef.Warnings) > 0 {
+			return nil, fmt.Errorf("%s: %s (strict)", ef.Arch, ef.Warnings[0])
 		}
 
 		list = append(list, ef)
@@ -292,6 +719,115 @@ func BuildEffectiveList(cfg *BuildConfig) ([]EffectiveConfig, error) {
 	return list, nil
 }
 
+// CanonicalDestination returns the destination that multi-arch manifests are created at.
+func (k KanikoConfig) CanonicalDestination() string {
+	dest, _ := splitDestinations(k.Destination, k.Destinations)
+	return dest
+}
+
+// MirrorDestinations returns the destinations pushed alongside the canonical one,
+// which receive the same multi-arch manifest.
+func (k KanikoConfig) MirrorDestinations() []string {
+	_, mirrors := splitDestinations(k.Destination, k.Destinations)
+	return mirrors
+}
+
+// splitDestinations returns the canonical destination and the remaining mirror destinations.
+// dest wins when set, otherwise the first of dests is canonical; duplicates are dropped.
+func splitDestinations(dest string, dests []string) (string, []string) {
+	var all []string
+	seen := map[string]bool{}
+	for _, d := range append([]string{dest}, dests...) {
+		if d = strings.TrimSpace(d); d != "" && !seen[d] {
+			seen[d] = true
+			all = append(all, d)
+		}
+	}
+	if len(all) == 0 {
+		return "", nil
+	}
+	return all[0], all[1:]
+}
+
+// deriveCacheRepo returns the cache repo for destination: the image reference without its
+// tag or digest, followed by suffix ("-cache" when empty).
+// For example registry.example.com:5000/team/app:1.0 becomes registry.example.com:5000/team/app-cache.
+func deriveCacheRepo(destination, suffix string) string {
+	if suffix == "" {
+		suffix = "-cache"
+	}
+	return ImageRepository(destination) + suffix
+}
+
+// cacheWarnings reports cache settings in ef that are valid but incoherent.
+func cacheWarnings(ef EffectiveConfig) []string {
+	var warnings []string
+	enabled := ef.CacheEnable != nil && *ef.CacheEnable
+
+	if enabled && ef.CacheRepo == "" {
+		warnings = append(warnings, "cache.enable is set without cache.repo or cache.auto; kaniko falls back to <destination>/cache")
+	}
+	if !enabled {
+		if ef.CacheRunLayers != nil && *ef.CacheRunLayers {
+			warnings = append(warnings, "cache.run-layers is set but cache is not enabled")
+		}
+		if ef.CacheCopyLayers != nil && *ef.CacheCopyLayers {
+			warnings = append(warnings, "cache.copy-layers is set but cache is not enabled")
+		}
+	}
+	if enabled && ef.CacheRepo != "" && ef.NoPush != nil && *ef.NoPush {
+		host := RegistryHost(ef.CacheRepo)
+		found := false
+		for _, cred := range ef.KanikoCredentials {
+			if CredentialHost(cred.Registry) == host {
+				found = true
+				break
+			}
+		}
+		if !found && ef.DockerConfigJSON == "" {
+			warnings = append(warnings, fmt.Sprintf("no-push is set, but kaniko still pushes cache layers to %s and no kaniko credential covers it", host))
+		}
+	}
+	return warnings
+}
+
+// applyCacheRefs maps buildx-style cache.from/cache.to refs onto kaniko's --cache-repo.
+// Kaniko reads and writes a single cache repo, so every ref given must be the same.
+func applyCacheRefs(ef *EffectiveConfig, from []string, to string) error {
+	refs := make([]string, 0, len(from)+1)
+	for _, ref := range from {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	if len(refs) > 1 {
+		return fmt.Errorf("cache.from lists %d refs, but kaniko supports a single cache repo", len(refs))
+	}
+	if to = strings.TrimSpace(to); to != "" {
+		refs = append(refs, to)
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	repo := refs[0]
+	for _, ref := range refs[1:] {
+		if ref != repo {
+			return fmt.Errorf("cache.from (%s) and cache.to (%s) differ, but kaniko supports a single cache repo", repo, ref)
+		}
+	}
+	if ef.CacheRepo != "" && ef.CacheRepo != repo {
+		return fmt.Errorf("cache.repo (%s) conflicts with cache.from/cache.to (%s)", ef.CacheRepo, repo)
+	}
+
+	ef.CacheRepo = repo
+	if ef.CacheEnable == nil {
+		enable := true
+		ef.CacheEnable = &enable
+	}
+	return nil
+}
+
 func coalesceStr(values ...string) string {
 	for _, v := range values {
 		if strings.TrimSpace(v) != "" {
@@ -314,3 +850,42 @@ func strPtr(override *string, global *string) *string {
 	}
 	return global
 }
+
+// mergeExtraHosts merges host entries, later layers overriding earlier ones for the
+// same host, and checks that every entry maps a hostname to an IP address.
+func mergeExtraHosts(layers ...map[string]string) (map[string]string, error) {
+	hosts := map[string]string{}
+	for _, m := range layers {
+		for host, ip := range m {
+			host, ip = strings.TrimSpace(host), strings.TrimSpace(ip)
+			if host == "" || strings.ContainsAny(host, " \t,=") {
+				return nil, fmt.Errorf("extra-hosts: invalid hostname %q", host)
+			}
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("extra-hosts: %s: invalid IP address %q", host, ip)
+			}
+			hosts[host] = ip
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	return hosts, nil
+}
+
+// parseAddHosts parses docker-style add-hosts entries, "host:ip", into a host to IP
+// map. The IP is everything after the first colon, so IPv6 addresses work as is.
+func parseAddHosts(entries []string) (map[string]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	hosts := make(map[string]string, len(entries))
+	for _, e := range entries {
+		host, ip, ok := strings.Cut(strings.TrimSpace(e), ":")
+		if !ok || host == "" || net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("add-hosts: invalid entry %q, want host:ip", e)
+		}
+		hosts[host] = ip
+	}
+	return hosts, nil
+}
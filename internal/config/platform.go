@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Platform is an OCI image platform such as linux/arm/v6.
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// String returns the platform in os/arch[/variant] form.
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+// knownArches are the architectures a platform may name, each with the variant
+// assumed when the arch is given without one.
+var knownArches = map[string]string{
+	"386":      "",
+	"amd64":    "",
+	"arm":      "v7",
+	"arm64":    "v8",
+	"loong64":  "",
+	"mips64le": "",
+	"ppc64le":  "",
+	"riscv64":  "",
+	"s390x":    "",
+}
+
+var platformPart = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// ParsePlatform parses an arch ("arm64"), an arch with variant ("arm/v6") or a full
+// os/arch[/variant] string ("linux/arm/v6"). The OS defaults to linux, and arm and arm64
+// default to the v7 and v8 variants.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+
+	var p Platform
+	switch len(parts) {
+	case 1:
+		p = Platform{OS: "linux", Architecture: parts[0]}
+	case 2:
+		if isVariant(parts[1]) {
+			p = Platform{OS: "linux", Architecture: parts[0], Variant: parts[1]}
+		} else {
+			p = Platform{OS: parts[0], Architecture: parts[1]}
+		}
+	case 3:
+		p = Platform{OS: parts[0], Architecture: parts[1], Variant: parts[2]}
+	default:
+		return Platform{}, fmt.Errorf("invalid platform %q: want arch or os/arch[/variant]", s)
+	}
+
+	for _, part := range []string{p.OS, p.Architecture} {
+		if !platformPart.MatchString(part) {
+			return Platform{}, fmt.Errorf("invalid platform %q: want arch or os/arch[/variant]", s)
+		}
+	}
+	defaultVariant, ok := knownArches[p.Architecture]
+	if !ok {
+		return Platform{}, fmt.Errorf("invalid platform %q: unknown arch %q", s, p.Architecture)
+	}
+	if p.Variant == "" {
+		p.Variant = defaultVariant
+	} else if !platformPart.MatchString(p.Variant) {
+		return Platform{}, fmt.Errorf("invalid platform %q: bad variant %q", s, p.Variant)
+	}
+	return p, nil
+}
+
+// isVariant reports whether s looks like a CPU variant such as v6 or v8.
+func isVariant(s string) bool {
+	return len(s) > 1 && s[0] == 'v' && s[1] >= '0' && s[1] <= '9'
+}
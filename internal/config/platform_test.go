@@ -0,0 +1,65 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"amd64", "linux/amd64"},
+		{"arm", "linux/arm/v7"},
+		{"arm/v6", "linux/arm/v6"},
+		{"riscv64", "linux/riscv64"},
+		{"linux/arm/v6", "linux/arm/v6"},
+		{"linux/arm64", "linux/arm64/v8"},
+	}
+	for _, tt := range tests {
+		p, err := ParsePlatform(tt.in)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.in, err)
+			continue
+		}
+		if p.String() != tt.want {
+			t.Errorf("%s = %s, want %s", tt.in, p, tt.want)
+		}
+	}
+}
+
+func TestPlatformValidation(t *testing.T) {
+	build := func(src string) error {
+		var cfg BuildConfig
+		if err := UnmarshalYAML([]byte(src), &cfg); err != nil {
+			t.Fatalf("UnmarshalYAML: %v", err)
+		}
+		_, err := BuildEffectiveList(&cfg)
+		return err
+	}
+
+	if err := build(`
+global:
+  arch: riscv64
+bake:
+- {}
+- arch: arm
+  kaniko:
+    custom-platform: linux/arm/v6
+`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for name, src := range map[string]string{
+		"arch with variant": "global: {arch: arm/v6}\nbake: [{}]",
+		"bad arch":          "global: {arch: ARM64}\nbake: [{}]",
+		"unknown arch":      "global: {arch: amd46}\nbake: [{}]",
+		"unknown custom":    "global: {arch: arm64, kaniko: {custom-platform: linux/aarch64}}\nbake: [{}]",
+		"bad custom":        "global: {arch: arm, kaniko: {custom-platform: linux/arm/v6/x}}\nbake: [{}]",
+	} {
+		if err := build(src); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("%s: error = %v, want invalid platform", name, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package config
+
+import "strings"
+
+// ImageRepository returns the image reference ref without its tag or digest, keeping
+// any registry port, e.g. registry.example.com:5000/team/app:1.0 becomes
+// registry.example.com:5000/team/app.
+func ImageRepository(ref string) string {
+	repo, _, _ := strings.Cut(ref, "@")
+	if i := strings.LastIndexByte(repo, ':'); i > strings.LastIndexByte(repo, '/') {
+		repo = repo[:i]
+	}
+	return repo
+}
+
+// RegistryHost returns the registry host of an image reference. References without
+// a registry host, like "library/alpine", are on Docker Hub and return docker.io.
+func RegistryHost(ref string) string {
+	host, _, hasPath := strings.Cut(trimScheme(ref), "/")
+	if !hasPath || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return "docker.io"
+	}
+	return canonicalHost(host)
+}
+
+// CredentialHost returns the registry host of a kaniko credential entry, which may
+// be written as a URL such as "https://index.docker.io/v1/".
+func CredentialHost(registry string) string {
+	host, _, _ := strings.Cut(trimScheme(registry), "/")
+	return canonicalHost(host)
+}
+
+func trimScheme(s string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://")
+}
+
+// canonicalHost returns docker.io for the other host names of Docker Hub.
+func canonicalHost(host string) string {
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return host
+}
@@ -0,0 +1,36 @@
+package config
+
+import "testing"
+
+func TestReference(t *testing.T) {
+	tests := []struct {
+		ref, repo, host string
+	}{
+		{"registry.example.com:5000/team/app:1.0", "registry.example.com:5000/team/app", "registry.example.com:5000"},
+		{"ghcr.io/org/app@sha256:abc", "ghcr.io/org/app", "ghcr.io"},
+		{"localhost/app", "localhost/app", "localhost"},
+		{"library/alpine:3", "library/alpine", "docker.io"},
+		{"alpine", "alpine", "docker.io"},
+		{"index.docker.io/library/alpine", "index.docker.io/library/alpine", "docker.io"},
+	}
+	for _, tt := range tests {
+		if got := ImageRepository(tt.ref); got != tt.repo {
+			t.Errorf("ImageRepository(%q) = %q, want %q", tt.ref, got, tt.repo)
+		}
+		if got := RegistryHost(tt.ref); got != tt.host {
+			t.Errorf("RegistryHost(%q) = %q, want %q", tt.ref, got, tt.host)
+		}
+	}
+
+	for reg, want := range map[string]string{
+		"https://index.docker.io/v1/": "docker.io",
+		"registry-1.docker.io":        "docker.io",
+		"ghcr.io":                     "ghcr.io",
+		"http://localhost:5000":       "localhost:5000",
+		"myregistry":                  "myregistry",
+	} {
+		if got := CredentialHost(reg); got != want {
+			t.Errorf("CredentialHost(%q) = %q, want %q", reg, got, want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"slices"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,6 +13,14 @@ type K8sServerConfig struct {
 	ServiceAccountName *string           `yaml:"serviceAccountName"`
 	NodeSelector       map[string]string `yaml:"nodeSelector"`
 	Tolerations        []TolerationItem  `yaml:"tolerations"`
+	DownwardAPIEnv     *bool             `yaml:"downwardAPIEnv"`
+	PodFailurePolicy   *PodFailurePolicy `yaml:"podFailurePolicy"`
+}
+
+// PodFailurePolicy maps common rules onto the Job podFailurePolicy.
+type PodFailurePolicy struct {
+	IgnoreDisruption *bool   `yaml:"ignoreDisruption"`
+	FailOnExitCodes  []int32 `yaml:"failOnExitCodes"`
 }
 
 // LoadK8sServerConfig loads the server-side K8s configuration file.
@@ -33,5 +42,26 @@ func LoadK8sServerConfig(path string) (*K8sServerConfig, error) {
 		return nil, fmt.Errorf("parse k8s config: %w", err)
 	}
 
+	if p := cfg.K8s.PodFailurePolicy; p != nil {
+		codes, err := normalizeExitCodes(p.FailOnExitCodes)
+		if err != nil {
+			return nil, fmt.Errorf("k8s podFailurePolicy: %w", err)
+		}
+		p.FailOnExitCodes = codes
+	}
+
 	return &cfg.K8s, nil
 }
+
+// normalizeExitCodes sorts and dedupes failOnExitCodes. Exit code 0 is rejected:
+// Kubernetes refuses it in an In rule, and a successful agent must never fail the Job.
+func normalizeExitCodes(codes []int32) ([]int32, error) {
+	for _, c := range codes {
+		if c == 0 {
+			return nil, fmt.Errorf("failOnExitCodes: exit code 0 is not allowed")
+		}
+	}
+	codes = slices.Clone(codes)
+	slices.Sort(codes)
+	return slices.Compact(codes), nil
+}
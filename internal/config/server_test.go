@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -65,6 +66,28 @@ k8s:
 		}
 	})
 
+	t.Run("fail on exit codes", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "k8s.yaml")
+		if err := os.WriteFile(path, []byte("k8s:\n  podFailurePolicy:\n    failOnExitCodes: [13, 2, 13]\n"), 0644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+		cfg, err := LoadK8sServerConfig(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := cfg.PodFailurePolicy.FailOnExitCodes; len(got) != 2 || got[0] != 2 || got[1] != 13 {
+			t.Errorf("FailOnExitCodes = %v, want [2 13]", got)
+		}
+
+		if err := os.WriteFile(path, []byte("k8s:\n  podFailurePolicy:\n    failOnExitCodes: [0, 13]\n"), 0644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+		if _, err := LoadK8sServerConfig(path); err == nil || !strings.Contains(err.Error(), "exit code 0") {
+			t.Errorf("err = %v, want exit code 0 rejected", err)
+		}
+	})
+
 	t.Run("invalid yaml returns error", func(t *testing.T) {
 		dir := t.TempDir()
 		path := filepath.Join(dir, "bad.yaml")
@@ -0,0 +1,120 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// SecretsManagerAPI is the subset of the Secrets Manager client used by Resolver.
+type SecretsManagerAPI interface {
+	GetSecretValue(
+		ctx context.Context,
+		params *secretsmanager.GetSecretValueInput,
+		optFns ...func(*secretsmanager.Options),
+	) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// registrySecret is the JSON payload expected in a registry credential secret.
+type registrySecret struct {
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type cachedSecret struct {
+	value     registrySecret
+	expiresAt time.Time
+}
+
+// Resolver resolves kaniko credentials that reference a Secrets Manager ARN.
+// Resolved secrets are cached for ttl.
+type Resolver struct {
+	client SecretsManagerAPI
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+// NewResolver creates a new Resolver instance.
+func NewResolver(client SecretsManagerAPI, ttl time.Duration) *Resolver {
+	return &Resolver{
+		client: client,
+		ttl:    ttl,
+		cache:  make(map[string]cachedSecret),
+	}
+}
+
+// ResolveCredentials returns creds with every secret-arn entry replaced by the
+// username/password stored in the secret. Inline entries are returned unchanged.
+func (r *Resolver) ResolveCredentials(ctx context.Context, creds []config.RegistryCredential) ([]config.RegistryCredential, error) {
+	out := make([]config.RegistryCredential, 0, len(creds))
+
+	for _, cred := range creds {
+		arn := strings.TrimSpace(cred.SecretARN)
+		if arn == "" {
+			out = append(out, cred)
+			continue
+		}
+
+		secret, err := r.get(ctx, arn)
+		if err != nil {
+			return nil, err
+		}
+
+		registry := cred.Registry
+		if registry == "" {
+			registry = secret.Registry
+		}
+		if registry == "" {
+			return nil, fmt.Errorf("secret %s: registry not set in config or secret", arn)
+		}
+
+		out = append(out, config.RegistryCredential{
+			Registry: registry,
+			Username: secret.Username,
+			Password: secret.Password,
+		})
+	}
+
+	return out, nil
+}
+
+func (r *Resolver) get(ctx context.Context, arn string) (registrySecret, error) {
+	r.mu.Lock()
+	if c, ok := r.cache[arn]; ok && time.Now().Before(c.expiresAt) {
+		r.mu.Unlock()
+		return c.value, nil
+	}
+	r.mu.Unlock()
+
+	res, err := r.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(arn),
+	})
+	if err != nil {
+		return registrySecret{}, fmt.Errorf("get secret %s: %w", arn, err)
+	}
+
+	var secret registrySecret
+	if err := json.Unmarshal([]byte(aws.ToString(res.SecretString)), &secret); err != nil {
+		return registrySecret{}, fmt.Errorf("parse secret %s: %w", arn, err)
+	}
+	if secret.Username == "" || secret.Password == "" {
+		return registrySecret{}, fmt.Errorf("secret %s: username and password are required", arn)
+	}
+
+	r.mu.Lock()
+	r.cache[arn] = cachedSecret{value: secret, expiresAt: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+
+	return secret, nil
+}
@@ -0,0 +1,119 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+type fakeSecretsManager struct {
+	secrets map[string]string
+	calls   int
+}
+
+func (f *fakeSecretsManager) GetSecretValue(
+	ctx context.Context,
+	params *secretsmanager.GetSecretValueInput,
+	optFns ...func(*secretsmanager.Options),
+) (*secretsmanager.GetSecretValueOutput, error) {
+	f.calls++
+	v, ok := f.secrets[aws.ToString(params.SecretId)]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(v)}, nil
+}
+
+func TestResolveCredentials(t *testing.T) {
+	const arn = "arn:aws:secretsmanager:ap-northeast-2:123456789012:secret:registry"
+
+	t.Run("mixed inline and arn entries", func(t *testing.T) {
+		sm := &fakeSecretsManager{secrets: map[string]string{
+			arn: `{"username":"robot","password":"s3cret"}`,
+		}}
+		r := NewResolver(sm, time.Minute)
+
+		creds, err := r.ResolveCredentials(context.Background(), []config.RegistryCredential{
+			{Registry: "gcr.io", Username: "u1", Password: "p1"},
+			{Registry: "registry.example.com", SecretARN: arn},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(creds) != 2 {
+			t.Fatalf("len(creds) = %d, want 2", len(creds))
+		}
+		if creds[0].Username != "u1" || creds[0].Password != "p1" {
+			t.Errorf("creds[0] = %+v, want inline credentials unchanged", creds[0])
+		}
+		if creds[1].Registry != "registry.example.com" || creds[1].Username != "robot" || creds[1].Password != "s3cret" {
+			t.Errorf("creds[1] = %+v, want resolved secret", creds[1])
+		}
+		if creds[1].SecretARN != "" {
+			t.Errorf("creds[1].SecretARN = %q, want empty after resolution", creds[1].SecretARN)
+		}
+	})
+
+	t.Run("registry from secret", func(t *testing.T) {
+		sm := &fakeSecretsManager{secrets: map[string]string{
+			arn: `{"registry":"ecr.example.com","username":"robot","password":"s3cret"}`,
+		}}
+		r := NewResolver(sm, time.Minute)
+
+		creds, err := r.ResolveCredentials(context.Background(), []config.RegistryCredential{{SecretARN: arn}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if creds[0].Registry != "ecr.example.com" {
+			t.Errorf("Registry = %q, want %q", creds[0].Registry, "ecr.example.com")
+		}
+	})
+
+	t.Run("cached within ttl", func(t *testing.T) {
+		sm := &fakeSecretsManager{secrets: map[string]string{
+			arn: `{"username":"robot","password":"s3cret"}`,
+		}}
+		r := NewResolver(sm, time.Minute)
+
+		in := []config.RegistryCredential{{Registry: "registry.example.com", SecretARN: arn}}
+		for i := 0; i < 3; i++ {
+			if _, err := r.ResolveCredentials(context.Background(), in); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if sm.calls != 1 {
+			t.Errorf("GetSecretValue calls = %d, want 1", sm.calls)
+		}
+	})
+
+	t.Run("missing secret returns error", func(t *testing.T) {
+		r := NewResolver(&fakeSecretsManager{}, time.Minute)
+
+		_, err := r.ResolveCredentials(context.Background(), []config.RegistryCredential{
+			{Registry: "registry.example.com", SecretARN: arn},
+		})
+		if err == nil {
+			t.Fatal("expected error for missing secret")
+		}
+	})
+
+	t.Run("secret without password returns error", func(t *testing.T) {
+		sm := &fakeSecretsManager{secrets: map[string]string{
+			arn: `{"username":"robot"}`,
+		}}
+		r := NewResolver(sm, time.Minute)
+
+		_, err := r.ResolveCredentials(context.Background(), []config.RegistryCredential{
+			{Registry: "registry.example.com", SecretARN: arn},
+		})
+		if err == nil {
+			t.Fatal("expected error for incomplete secret")
+		}
+	})
+}
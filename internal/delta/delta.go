@@ -0,0 +1,258 @@
+// Package delta implements incremental build context uploads.
+//
+// Instead of a single tarball, the client uploads each file of the context as a
+// content-addressed blob under BlobPrefix, skipping blobs the bucket already holds,
+// and then uploads a Manifest that lists every entry of the context. The agent
+// rebuilds the context from the manifest and the blobs it references.
+package delta
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/rayshoo/bakery/internal/ignore"
+)
+
+const (
+	// ManifestName is the object name of a context manifest; a context key ending in it is a delta upload.
+	ManifestName = "manifest.json"
+
+	// BlobPrefix is the key prefix of content-addressed file blobs.
+	BlobPrefix = "blobs/sha256/"
+
+	manifestVersion = 1
+)
+
+// Entry types.
+const (
+	TypeFile    = "file"
+	TypeDir     = "dir"
+	TypeSymlink = "symlink"
+)
+
+// Manifest lists the entries of a build context.
+type Manifest struct {
+	Version int     `json:"version"`
+	Entries []Entry `json:"entries"`
+}
+
+// Entry is a single file, directory or symlink of a build context.
+// Path is slash-separated and relative to the context root.
+type Entry struct {
+	Path   string      `json:"path"`
+	Type   string      `json:"type"`
+	Mode   os.FileMode `json:"mode"`
+	Size   int64       `json:"size,omitempty"`
+	SHA256 string      `json:"sha256,omitempty"`
+	Target string      `json:"target,omitempty"`
+}
+
+// IsManifestKey reports whether the context key points at a delta manifest rather than a tarball.
+func IsManifestKey(key string) bool {
+	return path.Base(key) == ManifestName
+}
+
+// BlobKey returns the object key of the blob with the given sha256 hex digest.
+func BlobKey(sum string) string {
+	return BlobPrefix + sum
+}
+
+// Build walks root and returns its manifest. Like the tarball upload, .git directories
+// and the paths matched by .bakeryignore are skipped.
+func Build(root string) (*Manifest, error) {
+	ignored, err := ignore.Load(root)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", ignore.FileName, err)
+	}
+
+	m := &Manifest{Version: manifestVersion}
+
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && filepath.Base(p) == ".git" {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if ignored.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		e := Entry{Path: filepath.ToSlash(rel), Mode: info.Mode().Perm()}
+		switch {
+		case info.IsDir():
+			e.Type = TypeDir
+		case info.Mode()&os.ModeSymlink != 0:
+			e.Type = TypeSymlink
+			if e.Target, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			e.Type = TypeFile
+			e.Size = info.Size()
+			if e.SHA256, err = hashFile(p); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Blobs returns the distinct blob digests referenced by m, with the path of one file holding each.
+func (m *Manifest) Blobs() map[string]string {
+	blobs := make(map[string]string)
+	for _, e := range m.Entries {
+		if e.Type == TypeFile {
+			if _, ok := blobs[e.SHA256]; !ok {
+				blobs[e.SHA256] = e.Path
+			}
+		}
+	}
+	return blobs
+}
+
+// Parse decodes a manifest and validates its entries.
+func Parse(r io.Reader) (*Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	for _, e := range m.Entries {
+		if !filepath.IsLocal(filepath.FromSlash(e.Path)) {
+			return nil, fmt.Errorf("manifest entry escapes context: %s", e.Path)
+		}
+	}
+	return &m, nil
+}
+
+// Restore recreates the context described by m under dest, reading file contents through fetch.
+// Each blob is checked against its digest.
+func Restore(ctx context.Context, m *Manifest, dest string, fetch func(ctx context.Context, key string) (io.ReadCloser, error)) error {
+	symlinks := make(map[string]bool)
+	for _, e := range m.Entries {
+		if !filepath.IsLocal(filepath.FromSlash(e.Path)) {
+			return fmt.Errorf("manifest entry escapes context: %s", e.Path)
+		}
+		for dir := path.Dir(e.Path); dir != "."; dir = path.Dir(dir) {
+			if symlinks[dir] {
+				return fmt.Errorf("manifest entry %s is inside symlink %s", e.Path, dir)
+			}
+		}
+		if e.Type == TypeSymlink {
+			symlinks[e.Path] = true
+		}
+		target := filepath.Join(dest, filepath.FromSlash(e.Path))
+
+		switch e.Type {
+		case TypeDir:
+			if err := os.MkdirAll(target, e.Mode|0700); err != nil {
+				return err
+			}
+		case TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(e.Target, target); err != nil {
+				return err
+			}
+		case TypeFile:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := restoreFile(ctx, e, target, fetch); err != nil {
+				return fmt.Errorf("restore %s: %w", e.Path, err)
+			}
+		default:
+			return fmt.Errorf("unknown manifest entry type %q for %s", e.Type, e.Path)
+		}
+	}
+	return nil
+}
+
+func restoreFile(ctx context.Context, e Entry, target string, fetch func(ctx context.Context, key string) (io.ReadCloser, error)) error {
+	rc, err := fetch(ctx, BlobKey(e.SHA256))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, e.Mode)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), rc)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != e.SHA256 {
+		return fmt.Errorf("blob digest mismatch: got %s, want %s", sum, e.SHA256)
+	}
+	return nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TotalSize returns the summed size of the files in m.
+func (m *Manifest) TotalSize() int64 {
+	var n int64
+	for _, e := range m.Entries {
+		n += e.Size
+	}
+	return n
+}
+
+// String summarizes the manifest for logs.
+func (m *Manifest) String() string {
+	files := 0
+	for _, e := range m.Entries {
+		if e.Type == TypeFile {
+			files++
+		}
+	}
+	return fmt.Sprintf("%d entries, %d files, %d bytes", len(m.Entries), files, m.TotalSize())
+}
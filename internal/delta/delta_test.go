@@ -0,0 +1,155 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blobStore serves blobs from a map, as the bucket would.
+type blobStore map[string][]byte
+
+func (b blobStore) fetch(ctx context.Context, key string) (io.ReadCloser, error) {
+	data, ok := b[key]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", key)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestBuildBakeryIgnore(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "Dockerfile"), "FROM alpine\n", 0644)
+	writeFile(t, filepath.Join(src, ".bakeryignore"), "fixtures/\n", 0644)
+	writeFile(t, filepath.Join(src, "fixtures", "large.bin"), "fixture\n", 0644)
+
+	m, err := Build(src)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	for _, e := range m.Entries {
+		if strings.HasPrefix(e.Path, "fixtures") {
+			t.Errorf("manifest includes ignored %s", e.Path)
+		}
+	}
+	if len(m.Entries) != 2 {
+		t.Errorf("entries = %+v, want Dockerfile and .bakeryignore", m.Entries)
+	}
+}
+
+func TestBuildRestore(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "Dockerfile"), "FROM alpine\n", 0644)
+	writeFile(t, filepath.Join(src, "bin", "run.sh"), "#!/bin/sh\n", 0755)
+	writeFile(t, filepath.Join(src, "copy", "Dockerfile"), "FROM alpine\n", 0644)
+	writeFile(t, filepath.Join(src, ".git", "HEAD"), "ref: main\n", 0644)
+	if err := os.MkdirAll(filepath.Join(src, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("Dockerfile", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Build(src)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	blobs := m.Blobs()
+	if len(blobs) != 2 {
+		t.Errorf("Blobs() = %v, want 2 distinct blobs", blobs)
+	}
+	for _, e := range m.Entries {
+		if strings.HasPrefix(e.Path, ".git") {
+			t.Errorf("manifest includes %s", e.Path)
+		}
+	}
+
+	store := blobStore{}
+	for sum, p := range blobs {
+		data, err := os.ReadFile(filepath.Join(src, filepath.FromSlash(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store[BlobKey(sum)] = data
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse(&buf)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	dest := t.TempDir()
+	if err := Restore(context.Background(), parsed, dest, store.fetch); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dest, "copy", "Dockerfile")); err != nil || string(data) != "FROM alpine\n" {
+		t.Errorf("copy/Dockerfile = %q, %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "bin", "run.sh")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("bin/run.sh mode = %v, %v, want 0755", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "empty")); err != nil || !info.IsDir() {
+		t.Errorf("empty dir not restored: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "link")); err != nil || target != "Dockerfile" {
+		t.Errorf("link = %q, %v, want Dockerfile", target, err)
+	}
+}
+
+func TestRestoreRejects(t *testing.T) {
+	sum := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // sha256 of ""
+	store := blobStore{BlobKey(sum): nil}
+
+	tests := map[string]Manifest{
+		"escaping path": {Version: 1, Entries: []Entry{
+			{Path: "../evil", Type: TypeFile, Mode: 0644, SHA256: sum},
+		}},
+		"path through symlink": {Version: 1, Entries: []Entry{
+			{Path: "etc", Type: TypeSymlink, Target: "/etc"},
+			{Path: "etc/passwd", Type: TypeFile, Mode: 0644, SHA256: sum},
+		}},
+		"digest mismatch": {Version: 1, Entries: []Entry{
+			{Path: "a", Type: TypeFile, Mode: 0644, SHA256: strings.Repeat("0", 64)},
+		}},
+	}
+	store[BlobKey(strings.Repeat("0", 64))] = []byte("tampered")
+
+	for name, m := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := Restore(context.Background(), &m, t.TempDir(), store.fetch); err == nil {
+				t.Error("Restore succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestIsManifestKey(t *testing.T) {
+	if !IsManifestKey("repos/1-abcd/manifest.json") {
+		t.Error("manifest key not detected")
+	}
+	if IsManifestKey("repos/1-abcd/repo.tar.gz") {
+		t.Error("tarball key detected as manifest")
+	}
+}
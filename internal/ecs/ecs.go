@@ -1,9 +1,8 @@
 package ecs
 
 import (
+	"container/list"
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -13,6 +12,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/rayshoo/bakery/internal/agentapi"
+	"github.com/rayshoo/bakery/internal/agentenv"
 	"github.com/rayshoo/bakery/internal/config"
 	"github.com/rayshoo/bakery/internal/state"
 
@@ -21,9 +22,18 @@ import (
 	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
 )
 
+// API is the subset of the ECS client used by ECSExecutor.
+type API interface {
+	DescribeTaskDefinition(ctx context.Context, params *awsecs.DescribeTaskDefinitionInput, optFns ...func(*awsecs.Options)) (*awsecs.DescribeTaskDefinitionOutput, error)
+	RegisterTaskDefinition(ctx context.Context, params *awsecs.RegisterTaskDefinitionInput, optFns ...func(*awsecs.Options)) (*awsecs.RegisterTaskDefinitionOutput, error)
+	RunTask(ctx context.Context, params *awsecs.RunTaskInput, optFns ...func(*awsecs.Options)) (*awsecs.RunTaskOutput, error)
+	DescribeTasks(ctx context.Context, params *awsecs.DescribeTasksInput, optFns ...func(*awsecs.Options)) (*awsecs.DescribeTasksOutput, error)
+	StopTask(ctx context.Context, params *awsecs.StopTaskInput, optFns ...func(*awsecs.Options)) (*awsecs.StopTaskOutput, error)
+}
+
 // ECSExecutor runs build tasks on AWS ECS Fargate.
 type ECSExecutor struct {
-	Client            *awsecs.Client
+	Client            API
 	ClusterName       string
 	AWSRegion         string
 	AgentImage        string
@@ -34,13 +44,41 @@ type ECSExecutor struct {
 	RegistrySecretARN string
 	ControllerURL     string
 
-	taskDefMu    sync.Mutex
-	taskDefCache map[string]bool
+	// PollInterval is the first delay between DescribeTasks calls while waiting for tasks to stop.
+	// The delay doubles after every poll, up to PollMaxInterval, and resets when a new task starts.
+	PollInterval    time.Duration
+	PollMaxInterval time.Duration
+
+	// ResourceOverrides runs every task from one base task definition per arch and sets
+	// cpu/memory as RunTask overrides, instead of registering a family per resource size.
+	ResourceOverrides bool
+
+	// EnableExecuteCommand starts tasks with ECS Exec enabled, so operators can run
+	// `aws ecs execute-command` against a running agent. Its task definitions are
+	// registered under a separate "-exec" family with the init process enabled.
+	EnableExecuteCommand bool
+
+	taskDefMu sync.Mutex
+	// taskDefARNs caches the revision ARN each family resolved to, so every task runs
+	// a pinned revision rather than whatever revision the family name resolves to later.
+	// It holds at most taskDefCacheSize families, evicting the least recently used
+	// one first; an evicted family is described again on its next use.
+	taskDefARNs      map[string]*list.Element
+	taskDefLRU       *list.List
+	taskDefCacheSize int
+	// familyMu serializes resolving each family, so concurrent tasks register it once.
+	// An entry lives only while a task holds or waits for it.
+	familyMu map[string]*familyLock
+	// registerSlots caps concurrent RegisterTaskDefinition calls across all families,
+	// so a burst of cold builds does not run into API throttling.
+	registerSlots chan struct{}
+
+	poller *taskPoller
 }
 
 // NewECSExecutor creates a new ECSExecutor instance.
 func NewECSExecutor(
-	client *awsecs.Client,
+	client API,
 	cluster string,
 	agentImage string,
 	execRole string,
@@ -51,7 +89,7 @@ func NewECSExecutor(
 	registrySecretArn string,
 	controllerURL string,
 ) *ECSExecutor {
-	return &ECSExecutor{
+	e := &ECSExecutor{
 		Client:            client,
 		ClusterName:       cluster,
 		AgentImage:        agentImage,
@@ -62,27 +100,19 @@ func NewECSExecutor(
 		AWSRegion:         region,
 		RegistrySecretARN: registrySecretArn,
 		ControllerURL:     controllerURL,
-		taskDefCache:      make(map[string]bool),
-	}
-}
-
-// RunTask runs an ECS task for the specified architecture.
-func (e *ECSExecutor) RunTask(
-	ctx context.Context,
-	st *state.BuildState,
-	taskID string,
-	ef config.EffectiveConfig,
-	bucket string,
-	key string,
-	ingestURL string,
-) error {
-	if ef.Arch == "" {
-		return errors.New("ECSExecutor.RunTask: missing arch")
-	}
-
-	st.AppendLog("info", fmt.Sprintf("[task %s] dispatch arch=%s", taskID, ef.Arch))
-
-	return e.RunTaskForArch(ctx, st, taskID, ef, bucket, key, ingestURL, st.IsSingleArch, st.GlobalDestination)
+		PollInterval:      getenvDuration("ECS_POLL_INTERVAL", 1*time.Second),
+		PollMaxInterval:   getenvDuration("ECS_POLL_MAX_INTERVAL", 15*time.Second),
+		ResourceOverrides: getenv("ECS_RESOURCE_OVERRIDES", "false") == "true",
+		taskDefARNs:       make(map[string]*list.Element),
+		taskDefLRU:        list.New(),
+		taskDefCacheSize:  taskDefCacheSize(),
+		familyMu:          make(map[string]*familyLock),
+		registerSlots:     make(chan struct{}, registerConcurrency()),
+
+		EnableExecuteCommand: getenv("ECS_ENABLE_EXECUTE_COMMAND", "false") == "true",
+	}
+	e.poller = newTaskPoller(e)
+	return e
 }
 
 func validateECSResources(cpu, memory string) error {
@@ -110,9 +140,9 @@ func validateECSResources(cpu, memory string) error {
 	return fmt.Errorf("invalid ECS CPU/Memory combination: CPU=%s Memory=%s", cpu, memory)
 }
 
-// EnsureTaskDefinitionForArch checks if a Task Definition exists for the given architecture
-// and resource settings, creating one if needed. Uses a mutex to prevent concurrent creation.
-func (e *ECSExecutor) EnsureTaskDefinitionForArch(ctx context.Context, arch string, cpu string, memory string) (string, error) {
+// resolveECSResources applies the default Fargate size and returns cpu and memory
+// normalized to ECS units, rejecting combinations Fargate does not support.
+func resolveECSResources(cpu, memory string) (string, string, error) {
 	if cpu == "" {
 		cpu = "256"
 	}
@@ -122,28 +152,181 @@ func (e *ECSExecutor) EnsureTaskDefinitionForArch(ctx context.Context, arch stri
 
 	cpuNorm, memNorm, err := config.NormalizeECSResources(cpu, memory)
 	if err != nil {
-		return "", fmt.Errorf("normalize resources: %w", err)
+		return "", "", fmt.Errorf("normalize resources: %w", err)
 	}
 
 	if err := validateECSResources(cpuNorm, memNorm); err != nil {
+		return "", "", err
+	}
+	return cpuNorm, memNorm, nil
+}
+
+// EnsureTaskDefinitionForArch checks if a Task Definition exists for the given architecture
+// and resource settings, creating one if needed, and returns its revision ARN.
+// Uses a mutex to prevent concurrent creation.
+func (e *ECSExecutor) EnsureTaskDefinitionForArch(ctx context.Context, arch string, cpu string, memory string) (string, error) {
+	cpuNorm, memNorm, err := resolveECSResources(cpu, memory)
+	if err != nil {
 		return "", err
 	}
 
-	family := fmt.Sprintf("%s-%s-%s-%s", getenv("AGENT_TASK_FAMILY", "bakery-agent"), arch, cpuNorm, memNorm)
+	family := e.taskFamily(fmt.Sprintf("%s-%s-%s", arch, cpuNorm, memNorm))
+	return e.ensureTaskDefinition(ctx, family, arch, cpuNorm, memNorm)
+}
+
+// EnsureBaseTaskDefinition returns the revision ARN of the single per-arch family used in
+// resource override mode, creating it with the smallest Fargate size if needed. Tasks set
+// their size on RunTask.
+func (e *ECSExecutor) EnsureBaseTaskDefinition(ctx context.Context, arch string) (string, error) {
+	family := e.taskFamily(arch)
+	return e.ensureTaskDefinition(ctx, family, arch, "256", "512")
+}
+
+// taskFamily returns the task definition family for suffix, keeping ECS Exec enabled
+// definitions apart from the plain ones.
+func (e *ECSExecutor) taskFamily(suffix string) string {
+	family := fmt.Sprintf("%s-%s", getenv("AGENT_TASK_FAMILY", "bakery-agent"), suffix)
+	if e.EnableExecuteCommand {
+		family += "-exec"
+	}
+	return family
+}
+
+// prepareTaskDefinition returns the task definition revision ARN to run a task with. In
+// resource override mode it also returns the cpu and memory to set on the RunTask task override.
+func (e *ECSExecutor) prepareTaskDefinition(ctx context.Context, arch, cpu, memory string) (taskDefARN, cpuOverride, memOverride string, err error) {
+	if !e.ResourceOverrides {
+		taskDefARN, err = e.EnsureTaskDefinitionForArch(ctx, arch, cpu, memory)
+		return taskDefARN, "", "", err
+	}
+
+	cpuOverride, memOverride, err = resolveECSResources(cpu, memory)
+	if err != nil {
+		return "", "", "", err
+	}
+	taskDefARN, err = e.EnsureBaseTaskDefinition(ctx, arch)
+	if err != nil {
+		return "", "", "", err
+	}
+	return taskDefARN, cpuOverride, memOverride, nil
+}
+
+// defaultRegisterConcurrency is the number of RegisterTaskDefinition calls allowed in
+// flight at once when ECS_TASKDEF_REGISTER_CONCURRENCY is not set.
+const defaultRegisterConcurrency = 2
+
+func registerConcurrency() int {
+	n, err := strconv.Atoi(os.Getenv("ECS_TASKDEF_REGISTER_CONCURRENCY"))
+	if err != nil || n < 1 {
+		return defaultRegisterConcurrency
+	}
+	return n
+}
+
+// defaultTaskDefCacheSize is the number of task definition families cached when
+// ECS_TASKDEF_CACHE_SIZE is not set.
+const defaultTaskDefCacheSize = 256
+
+func taskDefCacheSize() int {
+	n, err := strconv.Atoi(os.Getenv("ECS_TASKDEF_CACHE_SIZE"))
+	if err != nil || n < 1 {
+		return defaultTaskDefCacheSize
+	}
+	return n
+}
+
+// taskDefEntry is an element of ECSExecutor.taskDefLRU.
+type taskDefEntry struct {
+	family string
+	arn    string
+}
+
+// familyLock is an element of ECSExecutor.familyMu. users counts the tasks
+// holding or waiting for mu.
+type familyLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+// lockFamily locks the resolution of family and returns the function unlocking it.
+func (e *ECSExecutor) lockFamily(family string) func() {
+	e.taskDefMu.Lock()
+	l, ok := e.familyMu[family]
+	if !ok {
+		l = &familyLock{}
+		e.familyMu[family] = l
+	}
+	l.users++
+	e.taskDefMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		e.taskDefMu.Lock()
+		if l.users--; l.users == 0 {
+			delete(e.familyMu, family)
+		}
+		e.taskDefMu.Unlock()
+	}
+}
+
+func (e *ECSExecutor) cachedTaskDefinition(family string) (string, bool) {
+	e.taskDefMu.Lock()
+	defer e.taskDefMu.Unlock()
+	el, ok := e.taskDefARNs[family]
+	if !ok {
+		return "", false
+	}
+	e.taskDefLRU.MoveToFront(el)
+	return el.Value.(*taskDefEntry).arn, true
+}
 
+func (e *ECSExecutor) cacheTaskDefinition(family, arn string) {
 	e.taskDefMu.Lock()
 	defer e.taskDefMu.Unlock()
+	if el, ok := e.taskDefARNs[family]; ok {
+		el.Value.(*taskDefEntry).arn = arn
+		e.taskDefLRU.MoveToFront(el)
+		return
+	}
+	e.taskDefARNs[family] = e.taskDefLRU.PushFront(&taskDefEntry{family: family, arn: arn})
+	for e.taskDefLRU.Len() > e.taskDefCacheSize {
+		oldest := e.taskDefLRU.Back()
+		e.taskDefLRU.Remove(oldest)
+		delete(e.taskDefARNs, oldest.Value.(*taskDefEntry).family)
+	}
+}
 
-	if e.taskDefCache[family] {
-		return family, nil
+// forgetTaskDefinition drops the cache entry resolving to arn, so its family is
+// described again on its next use.
+func (e *ECSExecutor) forgetTaskDefinition(arn string) {
+	e.taskDefMu.Lock()
+	defer e.taskDefMu.Unlock()
+	for family, el := range e.taskDefARNs {
+		if el.Value.(*taskDefEntry).arn == arn {
+			e.taskDefLRU.Remove(el)
+			delete(e.taskDefARNs, family)
+		}
 	}
+}
 
-	_, err = e.Client.DescribeTaskDefinition(ctx, &awsecs.DescribeTaskDefinitionInput{
-		TaskDefinition: aws.String(family),
-	})
-	if err == nil {
-		e.taskDefCache[family] = true
-		return family, nil
+// isInactiveTaskDefinition reports whether err is RunTask rejecting a task
+// definition revision that was deregistered.
+func isInactiveTaskDefinition(err error) bool {
+	return strings.Contains(err.Error(), "TaskDefinition is inactive")
+}
+
+func (e *ECSExecutor) ensureTaskDefinition(ctx context.Context, family, arch, cpuNorm, memNorm string) (string, error) {
+	unlock := e.lockFamily(family)
+	defer unlock()
+
+	if arn, ok := e.cachedTaskDefinition(family); ok {
+		return arn, nil
+	}
+
+	if arn, err := e.describeTaskDefinition(ctx, family); err == nil {
+		e.cacheTaskDefinition(family, arn)
+		return arn, nil
 	}
 
 	var cpuArch ecstypes.CPUArchitecture
@@ -172,6 +355,11 @@ func (e *ECSExecutor) EnsureTaskDefinitionForArch(ctx context.Context, arch stri
 
 	e.applyLogConfig(&container)
 
+	// The init process reaps the SSM agent's child processes started by ECS Exec sessions.
+	if e.EnableExecuteCommand {
+		container.LinuxParameters = &ecstypes.LinuxParameters{InitProcessEnabled: aws.Bool(true)}
+	}
+
 	input := &awsecs.RegisterTaskDefinitionInput{
 		Family:                  aws.String(family),
 		Cpu:                     aws.String(cpuNorm),
@@ -187,7 +375,13 @@ func (e *ECSExecutor) EnsureTaskDefinitionForArch(ctx context.Context, arch stri
 		ContainerDefinitions: []ecstypes.ContainerDefinition{container},
 	}
 
+	select {
+	case e.registerSlots <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
 	out, err := e.Client.RegisterTaskDefinition(ctx, input)
+	<-e.registerSlots
 	if err != nil {
 		if strings.Contains(err.Error(), "Too many concurrent attempts") ||
 			strings.Contains(err.Error(), "ResourceInUseException") {
@@ -195,13 +389,12 @@ func (e *ECSExecutor) EnsureTaskDefinitionForArch(ctx context.Context, arch stri
 
 			time.Sleep(500 * time.Millisecond)
 
-			_, err = e.Client.DescribeTaskDefinition(ctx, &awsecs.DescribeTaskDefinitionInput{
-				TaskDefinition: aws.String(family),
-			})
+			var arn string
+			arn, err = e.describeTaskDefinition(ctx, family)
 			if err == nil {
-				e.taskDefCache[family] = true
-				log.Printf("[ECS] Task definition %s confirmed to exist", family)
-				return family, nil
+				e.cacheTaskDefinition(family, arn)
+				log.Printf("[ECS] Task definition %s confirmed to exist: %s", family, arn)
+				return arn, nil
 			}
 		}
 		return "", fmt.Errorf("register taskdef: %w", err)
@@ -210,13 +403,28 @@ func (e *ECSExecutor) EnsureTaskDefinitionForArch(ctx context.Context, arch stri
 	arn := aws.ToString(out.TaskDefinition.TaskDefinitionArn)
 	log.Printf("[ECS] Created TaskDefinition arch=%s cpu=%s memory=%s arn=%s", arch, cpuNorm, memNorm, arn)
 
-	e.taskDefCache[family] = true
+	e.cacheTaskDefinition(family, arn)
 
-	return family, nil
+	return arn, nil
+}
+
+// describeTaskDefinition returns the ARN of the latest active revision of family.
+func (e *ECSExecutor) describeTaskDefinition(ctx context.Context, family string) (string, error) {
+	out, err := e.Client.DescribeTaskDefinition(ctx, &awsecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(family),
+	})
+	if err != nil {
+		return "", err
+	}
+	if out.TaskDefinition == nil || out.TaskDefinition.TaskDefinitionArn == nil {
+		return "", fmt.Errorf("describe taskdef %s: no ARN returned", family)
+	}
+	return aws.ToString(out.TaskDefinition.TaskDefinitionArn), nil
 }
 
-// RunTaskForArch runs an ECS task for a specific architecture and waits for completion.
-func (e *ECSExecutor) RunTaskForArch(
+// RunTask runs an ECS task for the task's architecture and waits for completion.
+// Destination handling follows st.IsSingleArch and st.GlobalDestination.
+func (e *ECSExecutor) RunTask(
 	ctx context.Context,
 	st *state.BuildState,
 	taskID string,
@@ -224,170 +432,51 @@ func (e *ECSExecutor) RunTaskForArch(
 	bucket string,
 	key string,
 	ingestURL string,
-	isSingleArch bool,
-	globalDestination string,
 ) error {
-	arch := ef.Arch
-
-	tdFamily, err := e.EnsureTaskDefinitionForArch(ctx, arch, ef.CPU, ef.Memory)
-	if err != nil {
-		return err
-	}
-
-	st.AppendLog("info", fmt.Sprintf("[ecs][%s] task definition = %s (cpu=%s memory=%s)", taskID, tdFamily, ef.CPU, ef.Memory))
-
-	var targetPlatform, targetOS, targetArch, targetVariant string
-
-	if ef.CustomPlatform != nil && *ef.CustomPlatform != "" {
-		targetPlatform = *ef.CustomPlatform
-		parts := strings.Split(*ef.CustomPlatform, "/")
-		if len(parts) >= 2 {
-			targetOS = parts[0]
-			targetArch = parts[1]
-			if len(parts) == 3 {
-				targetVariant = parts[2]
-			}
-		} else {
-			targetOS = "linux"
-			targetArch = arch
-		}
-	} else {
-		targetPlatform = fmt.Sprintf("linux/%s", arch)
-		targetOS = "linux"
-		targetArch = arch
-		if arch == "arm64" {
-			targetVariant = "v8"
-		}
-	}
-
-	var kanikoDestination string
-
-	if isSingleArch {
-		if ef.Destination != "" {
-			kanikoDestination = ef.Destination
-		} else {
-			kanikoDestination = globalDestination
-		}
-	} else {
-		if ef.Destination != "" && ef.Destination != globalDestination {
-			kanikoDestination = ef.Destination
-		} else {
-			if st.HasDuplicateArch {
-				kanikoDestination = appendTaskSuffix(globalDestination, taskID)
-			} else {
-				kanikoDestination = appendArchSuffix(globalDestination, arch)
-			}
-		}
-	}
-
-	var kanikoCredsJSON string
-	if len(ef.KanikoCredentials) > 0 {
-		creds, err := createDockerConfigJSON(ef.KanikoCredentials)
-		if err != nil {
-			return fmt.Errorf("create docker config: %w", err)
-		}
-		kanikoCredsJSON = creds
-	}
-
-	var buildArgsStr string
-	if len(ef.BuildArgs) > 0 {
-		var pairs []string
-		for k, v := range ef.BuildArgs {
-			pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
-		}
-		buildArgsStr = strings.Join(pairs, ",")
+	if ef.Arch == "" {
+		return errors.New("ECSExecutor.RunTask: missing arch")
 	}
 
-	env := []ecstypes.KeyValuePair{
-		kv("BUILD_ID", st.ID),
-		kv("BUILD_TASK_ID", taskID),
-		kv("TASK_COLOR_INDEX", getTaskColorIndex(taskID)),
-
-		kv("TARGETPLATFORM", targetPlatform),
-		kv("TARGETOS", targetOS),
-		kv("TARGETARCH", targetArch),
-		kv("TARGETVARIANT", targetVariant),
-
-		kv("EXECUTOR_PLATFORM", "ecs"),
-
-		kv("STORAGE_ENDPOINT", os.Getenv("S3_ENDPOINT")),
-		kv("STORAGE_REGION", os.Getenv("S3_REGION")),
-		kv("STORAGE_USE_SSL", os.Getenv("S3_SSL")),
-		kv("STORAGE_ACCESS_KEY", os.Getenv("S3_ACCESS_KEY")),
-		kv("STORAGE_SECRET_KEY", os.Getenv("S3_SECRET_KEY")),
-
-		kv("CONTEXT_BUCKET", bucket),
-		kv("CONTEXT_KEY", key),
-
-		kv("CONTROLLER_URL", e.ControllerURL),
-		kv("INGEST_URL", ingestURL),
-
-		kv("KANIKO_DESTINATION", kanikoDestination),
-		kv("KANIKO_CONTEXT", ef.ContextPath),
-		kv("KANIKO_DOCKERFILE", ef.Dockerfile),
-		kv("KANIKO_BUILD_ARGS", buildArgsStr),
-		kv("KANIKO_CREDENTIALS_JSON", kanikoCredsJSON),
-	}
+	st.AppendLog("info", fmt.Sprintf("[task %s] dispatch arch=%s", taskID, ef.Arch))
 
-	if ef.CacheEnable != nil {
-		env = append(env, kv("KANIKO_CACHE_ENABLE", fmt.Sprintf("%t", *ef.CacheEnable)))
-	}
-	if ef.CacheRepo != "" {
-		env = append(env, kv("KANIKO_CACHE_REPO", ef.CacheRepo))
-	}
-	if ef.CacheTTL != "" {
-		env = append(env, kv("KANIKO_CACHE_TTL", ef.CacheTTL))
-	}
-	if ef.CacheCopyLayers != nil {
-		env = append(env, kv("KANIKO_CACHE_COPY_LAYERS", fmt.Sprintf("%t", *ef.CacheCopyLayers)))
-	}
-	if ef.CacheRunLayers != nil {
-		env = append(env, kv("KANIKO_CACHE_RUN_LAYERS", fmt.Sprintf("%t", *ef.CacheRunLayers)))
-	}
-	if ef.CacheCompressed != nil {
-		env = append(env, kv("KANIKO_CACHE_COMPRESSED", fmt.Sprintf("%t", *ef.CacheCompressed)))
-	}
+	arch := ef.Arch
 
-	if ef.SnapshotMode != nil {
-		env = append(env, kv("KANIKO_SNAPSHOT_MODE", *ef.SnapshotMode))
-	}
-	if ef.UseNewRun != nil {
-		env = append(env, kv("KANIKO_USE_NEW_RUN", fmt.Sprintf("%t", *ef.UseNewRun)))
-	}
-	if ef.Cleanup != nil {
-		env = append(env, kv("KANIKO_CLEANUP", fmt.Sprintf("%t", *ef.Cleanup)))
-	}
-	if ef.CustomPlatform != nil {
-		env = append(env, kv("KANIKO_CUSTOM_PLATFORM", *ef.CustomPlatform))
-	}
-	if ef.NoPush != nil {
-		env = append(env, kv("KANIKO_NO_PUSH", fmt.Sprintf("%t", *ef.NoPush)))
+	taskDefARN, cpuOverride, memOverride, err := e.prepareTaskDefinition(ctx, arch, ef.CPU, ef.Memory)
+	if err != nil {
+		return err
 	}
 
-	if len(ef.IgnorePath) > 0 {
-		env = append(env, kv("KANIKO_IGNORE_PATH", strings.Join(ef.IgnorePath, ",")))
+	containerCPU, containerMemory, err := containerResources(ef)
+	if err != nil {
+		return err
 	}
 
-	if ef.ExtraFlags != "" {
-		env = append(env, kv("KANIKO_EXTRA_FLAGS", ef.ExtraFlags))
-	}
+	st.AppendLog("info", fmt.Sprintf("[ecs][%s] task definition = %s (cpu=%s memory=%s)", taskID, taskDefARN, ef.CPU, ef.Memory))
 
-	if ef.PreScript != nil {
-		env = append(env, kv("PRE_SCRIPT", *ef.PreScript))
-	}
-	if ef.PostScript != nil {
-		env = append(env, kv("POST_SCRIPT", *ef.PostScript))
+	vars, err := agentenv.Build(st, taskID, ef, agentenv.Task{
+		Platform:      "ecs",
+		ControllerURL: e.ControllerURL,
+		IngestURL:     ingestURL,
+		ContextBucket: bucket,
+		ContextKey:    key,
+	})
+	if err != nil {
+		return err
 	}
 
-	for k, v := range ef.Env {
-		env = append(env, kv(k, v))
+	// Container overrides cannot reference secrets, so credentials are passed as values.
+	env := make([]ecstypes.KeyValuePair, 0, len(vars))
+	for _, v := range vars {
+		env = append(env, kv(v.Name, v.Value))
 	}
 
-	runOut, err := e.Client.RunTask(ctx, &awsecs.RunTaskInput{
+	input := &awsecs.RunTaskInput{
 		Cluster:        aws.String(e.ClusterName),
-		TaskDefinition: aws.String(tdFamily),
+		TaskDefinition: aws.String(taskDefARN),
 		LaunchType:     ecstypes.LaunchTypeFargate,
 		Count:          aws.Int32(1),
+
+		EnableExecuteCommand: e.EnableExecuteCommand,
 		NetworkConfiguration: &ecstypes.NetworkConfiguration{
 			AwsvpcConfiguration: &ecstypes.AwsVpcConfiguration{
 				Subnets:        e.SubnetIDs,
@@ -395,14 +484,30 @@ func (e *ECSExecutor) RunTaskForArch(
 			},
 		},
 		Overrides: &ecstypes.TaskOverride{
+			Cpu:    optString(cpuOverride),
+			Memory: optString(memOverride),
 			ContainerOverrides: []ecstypes.ContainerOverride{
 				{
-					Name:        aws.String("agent"),
-					Environment: env,
+					Name:              aws.String("agent"),
+					Environment:       env,
+					Cpu:               containerCPU,
+					MemoryReservation: containerMemory,
 				},
 			},
 		},
-	})
+	}
+	runOut, err := e.Client.RunTask(ctx, input)
+	if err != nil && isInactiveTaskDefinition(err) {
+		// The cached revision was deregistered outside bakery; resolve the family
+		// again and retry once.
+		st.AppendLog("warn", fmt.Sprintf("[ecs][%s] task definition %s is inactive, resolving it again", taskID, taskDefARN))
+		e.forgetTaskDefinition(taskDefARN)
+		if taskDefARN, _, _, err = e.prepareTaskDefinition(ctx, arch, ef.CPU, ef.Memory); err != nil {
+			return err
+		}
+		input.TaskDefinition = aws.String(taskDefARN)
+		runOut, err = e.Client.RunTask(ctx, input)
+	}
 	if err != nil {
 		return fmt.Errorf("RunTask: %w", err)
 	}
@@ -418,6 +523,10 @@ func (e *ECSExecutor) RunTaskForArch(
 	st.Mu.Unlock()
 
 	st.AppendLog("info", fmt.Sprintf("[ecs][%s] started task: %s", taskID, taskArn))
+	if e.EnableExecuteCommand {
+		st.AppendLog("info", fmt.Sprintf("[ecs][%s] ECS Exec enabled: aws ecs execute-command --cluster %s --task %s --container agent --interactive --command /busybox/sh",
+			taskID, e.ClusterName, taskArn))
+	}
 
 	go e.StreamTaskLogs(ctx, st, taskArn, taskID)
 
@@ -428,6 +537,69 @@ func (e *ECSExecutor) RunTaskForArch(
 	return e.checkTaskExitCode(st, taskArn)
 }
 
+// CancelTask stops the ECS task of taskID, if it was started.
+func (e *ECSExecutor) CancelTask(ctx context.Context, st *state.BuildState, taskID string) error {
+	taskArn := st.TaskArn(taskID)
+	if taskArn == "" {
+		return nil
+	}
+	if _, err := e.Client.StopTask(ctx, &awsecs.StopTaskInput{
+		Cluster: aws.String(e.ClusterName),
+		Task:    aws.String(taskArn),
+		Reason:  aws.String("build task canceled"),
+	}); err != nil {
+		return fmt.Errorf("StopTask %s: %w", taskArn, err)
+	}
+	st.AppendLog("info", fmt.Sprintf("[ecs][%s] stopped task: %s", taskID, taskArn))
+	return nil
+}
+
+// containerResources maps the container-level cpu and memory reservation of ef onto the
+// agent container override, rejecting reservations larger than the task size.
+// Unset values return nil, leaving the container to share the whole task.
+func containerResources(ef config.EffectiveConfig) (cpu, memoryReservation *int32, err error) {
+	if ef.ContainerCPU == "" && ef.ContainerMemoryReservation == "" {
+		return nil, nil, nil
+	}
+
+	taskCPU, taskMemory, err := resolveECSResources(ef.CPU, ef.Memory)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ef.ContainerCPU != "" {
+		units, err := config.ParseCPU(ef.ContainerCPU)
+		if err != nil {
+			return nil, nil, fmt.Errorf("container cpu: %w", err)
+		}
+		if limit, _ := strconv.ParseInt(taskCPU, 10, 64); units > limit {
+			return nil, nil, fmt.Errorf("container cpu %d exceeds task cpu %s", units, taskCPU)
+		}
+		cpu = aws.Int32(int32(units))
+	}
+
+	if ef.ContainerMemoryReservation != "" {
+		mb, err := config.ParseMemory(ef.ContainerMemoryReservation)
+		if err != nil {
+			return nil, nil, fmt.Errorf("container memory reservation: %w", err)
+		}
+		if limit, _ := strconv.ParseInt(taskMemory, 10, 64); mb > limit {
+			return nil, nil, fmt.Errorf("container memory reservation %dMiB exceeds task memory %sMiB", mb, taskMemory)
+		}
+		memoryReservation = aws.Int32(int32(mb))
+	}
+
+	return cpu, memoryReservation, nil
+}
+
+// optString returns nil for an empty string, leaving the field unset in the request.
+func optString(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return aws.String(v)
+}
+
 func kv(k, v string) ecstypes.KeyValuePair {
 	return ecstypes.KeyValuePair{
 		Name:  aws.String(k),
@@ -455,38 +627,26 @@ func (e *ECSExecutor) applyLogConfig(c *ecstypes.ContainerDefinition) {
 	}
 }
 
+// waitTaskStopped waits until the task is STOPPED, logging each status transition.
+// Status is polled by the executor's shared poller so concurrent tasks share DescribeTasks calls.
 func (e *ECSExecutor) waitTaskStopped(
 	ctx context.Context,
 	st *state.BuildState,
 	taskID string,
 	taskArn string,
 ) error {
+	updates, stop := e.poller.watch(st, taskID, taskArn)
+	defer stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return fmt.Errorf("timeout waiting for ECS task: %w", ctx.Err())
 
-		case <-time.After(3 * time.Second):
-			out, err := e.Client.DescribeTasks(ctx, &awsecs.DescribeTasksInput{
-				Cluster: aws.String(e.ClusterName),
-				Tasks:   []string{taskArn},
-			})
-			if err != nil {
-				st.AppendLog("error", fmt.Sprintf("[ecs][%s] describe error: %v", taskID, err))
-				continue
-			}
+		case status := <-updates:
+			st.AppendLog("debug", fmt.Sprintf("[ecs][%s] status=%s", taskID, status))
 
-			if len(out.Tasks) == 0 {
-				continue
-			}
-
-			t := out.Tasks[0]
-
-			if t.LastStatus != nil {
-				st.AppendLog("debug", fmt.Sprintf("[ecs][%s] status=%s", taskID, *t.LastStatus))
-			}
-
-			if t.LastStatus != nil && *t.LastStatus == "STOPPED" {
+			if status == "STOPPED" {
 				return nil
 			}
 		}
@@ -514,13 +674,13 @@ func (e *ECSExecutor) checkTaskExitCode(
 
 	if err != nil {
 		st.AppendLog("error", fmt.Sprintf("[ecs][%s] DescribeTasks error: %v", taskID, err))
-		st.SetError(err)
+		st.SetTaskError(taskID, err)
 		return err
 	}
 
 	if len(out.Tasks) == 0 {
 		err := fmt.Errorf("no task info")
-		st.SetError(err)
+		st.SetTaskError(taskID, err)
 		return err
 	}
 
@@ -532,9 +692,9 @@ func (e *ECSExecutor) checkTaskExitCode(
 
 			var taskErr error
 			if exit != 0 {
-				taskErr = fmt.Errorf("agent exit=%d", exit)
-				st.SetError(taskErr)
-				st.AppendLog("error", fmt.Sprintf("[ecs][%s] exit=%d", taskID, exit))
+				taskErr = fmt.Errorf("agent exit=%d (%s)", exit, agentapi.ExitPhase(int(exit)))
+				st.SetTaskError(taskID, taskErr)
+				st.AppendLog("error", fmt.Sprintf("[ecs][%s] %v", taskID, taskErr))
 			} else {
 				st.AppendLog("info", fmt.Sprintf("[ecs][%s] exit=0 success", taskID))
 			}
@@ -544,7 +704,7 @@ func (e *ECSExecutor) checkTaskExitCode(
 	}
 
 	err = fmt.Errorf("agent container not found")
-	st.SetError(err)
+	st.SetTaskError(taskID, err)
 	return err
 }
 
@@ -558,60 +718,6 @@ func (e *ECSExecutor) StreamTaskLogs(
 ) {
 }
 
-func appendArchSuffix(destination, arch string) string {
-	if idx := lastIndexByte(destination, ':'); idx != -1 {
-		base := destination[:idx]
-		tag := destination[idx+1:]
-		return fmt.Sprintf("%s:%s_%s", base, tag, arch)
-	}
-	return fmt.Sprintf("%s:latest_%s", destination, arch)
-}
-
-func appendTaskSuffix(destination, taskID string) string {
-	if idx := lastIndexByte(destination, ':'); idx != -1 {
-		base := destination[:idx]
-		tag := destination[idx+1:]
-		return fmt.Sprintf("%s:%s_%s", base, tag, taskID)
-	}
-	return fmt.Sprintf("%s:latest_%s", destination, taskID)
-}
-
-func lastIndexByte(s string, c byte) int {
-	for i := len(s) - 1; i >= 0; i-- {
-		if s[i] == c {
-			return i
-		}
-	}
-	return -1
-}
-
-// DockerConfig holds Docker registry auth configuration for kaniko.
-type DockerConfig struct {
-	Auths map[string]DockerAuth `json:"auths"`
-}
-
-// DockerAuth holds Docker registry authentication credentials.
-type DockerAuth struct {
-	Auth string `json:"auth"`
-}
-
-func createDockerConfigJSON(creds []config.RegistryCredential) (string, error) {
-	cfg := DockerConfig{
-		Auths: make(map[string]DockerAuth),
-	}
-
-	for _, cred := range creds {
-		auth := base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password))
-		cfg.Auths[cred.Registry] = DockerAuth{Auth: auth}
-	}
-
-	b, err := json.Marshal(cfg)
-	if err != nil {
-		return "", err
-	}
-	return string(b), nil
-}
-
 func getenv(k, def string) string {
 	v := os.Getenv(k)
 	if v == "" {
@@ -620,34 +726,11 @@ func getenv(k, def string) string {
 	return v
 }
 
-// getTaskColorIndex returns the terminal color index for a task ID.
-// amd64 tasks use even indices, arm64 tasks use odd indices.
-func getTaskColorIndex(taskID string) string {
-	if taskID == "amd64" {
-		return "0"
-	}
-	if taskID == "arm64" {
-		return "1"
-	}
-
-	if strings.Contains(taskID, "-") {
-		parts := strings.Split(taskID, "-")
-		if len(parts) == 2 {
-			arch := parts[0]
-			idx := parts[1]
-
-			num, err := strconv.Atoi(idx)
-			if err != nil {
-				return "0"
-			}
-
-			if arch == "amd64" {
-				return strconv.Itoa(num * 2)
-			} else if arch == "arm64" {
-				return strconv.Itoa(num*2 + 1)
-			}
+func getenvDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
 		}
 	}
-
-	return "0"
+	return def
 }
@@ -0,0 +1,648 @@
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsecs "github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// fakeAPI reports the next status in statuses on every DescribeTasks call,
+// repeating the last one once they run out.
+type fakeAPI struct {
+	API
+	statuses []string
+	calls    int
+}
+
+func (f *fakeAPI) DescribeTasks(ctx context.Context, params *awsecs.DescribeTasksInput, optFns ...func(*awsecs.Options)) (*awsecs.DescribeTasksOutput, error) {
+	status := f.statuses[min(f.calls, len(f.statuses)-1)]
+	f.calls++
+	return &awsecs.DescribeTasksOutput{
+		Tasks: []ecstypes.Task{{TaskArn: aws.String(params.Tasks[0]), LastStatus: aws.String(status)}},
+	}, nil
+}
+
+func TestWaitTaskStopped(t *testing.T) {
+	api := &fakeAPI{statuses: []string{"PROVISIONING", "PROVISIONING", "RUNNING", "RUNNING", "STOPPED"}}
+
+	e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+	e.PollInterval = time.Millisecond
+	e.PollMaxInterval = 4 * time.Millisecond
+
+	st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+
+	var logs []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for entry := range st.Logs {
+			logs = append(logs, entry.Message)
+		}
+	}()
+
+	if err := e.waitTaskStopped(context.Background(), st, "amd64", "arn:task"); err != nil {
+		t.Fatalf("waitTaskStopped: %v", err)
+	}
+	st.Finish(nil)
+	<-done
+
+	if api.calls != 5 {
+		t.Errorf("DescribeTasks called %d times, want 5", api.calls)
+	}
+
+	var transitions []string
+	for _, msg := range logs {
+		if _, status, ok := strings.Cut(msg, "[ecs][amd64] status="); ok {
+			transitions = append(transitions, status)
+		}
+	}
+	if got, want := strings.Join(transitions, ","), "PROVISIONING,RUNNING,STOPPED"; got != want {
+		t.Errorf("status transitions = %s, want %s", got, want)
+	}
+}
+
+func TestWaitTaskStoppedCanceled(t *testing.T) {
+	api := &fakeAPI{statuses: []string{"RUNNING"}}
+
+	e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+	e.PollInterval = time.Millisecond
+	e.PollMaxInterval = time.Millisecond
+
+	st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := e.waitTaskStopped(ctx, st, "amd64", "arn:task"); err == nil || !strings.Contains(err.Error(), "timeout waiting for ECS task") {
+		t.Errorf("waitTaskStopped error = %v, want timeout", err)
+	}
+}
+
+// batchAPI reports every task as RUNNING the first time it is described and STOPPED
+// afterwards, recording how many ARNs each DescribeTasks call carried.
+type batchAPI struct {
+	API
+	mu      sync.Mutex
+	seen    map[string]bool
+	batches []int
+}
+
+func (f *batchAPI) DescribeTasks(ctx context.Context, params *awsecs.DescribeTasksInput, optFns ...func(*awsecs.Options)) (*awsecs.DescribeTasksOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.batches = append(f.batches, len(params.Tasks))
+
+	out := &awsecs.DescribeTasksOutput{}
+	for _, arn := range params.Tasks {
+		status := "RUNNING"
+		if f.seen[arn] {
+			status = "STOPPED"
+		}
+		f.seen[arn] = true
+		out.Tasks = append(out.Tasks, ecstypes.Task{TaskArn: aws.String(arn), LastStatus: aws.String(status)})
+	}
+	return out, nil
+}
+
+func TestWaitTaskStoppedBatchesDescribeTasks(t *testing.T) {
+	const tasks = 150
+
+	api := &batchAPI{seen: make(map[string]bool)}
+
+	e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+	e.PollInterval = 50 * time.Millisecond
+	e.PollMaxInterval = 50 * time.Millisecond
+
+	st := state.NewBuildState("b-test", tasks, false, "registry.example.com/app:1.0")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, tasks)
+	for i := 0; i < tasks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			taskID := fmt.Sprintf("task-%d", i)
+			if err := e.waitTaskStopped(context.Background(), st, taskID, "arn:"+taskID); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("waitTaskStopped: %v", err)
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	total := 0
+	for _, n := range api.batches {
+		if n > maxDescribeTasks {
+			t.Errorf("DescribeTasks called with %d ARNs, want <= %d", n, maxDescribeTasks)
+		}
+		total += n
+	}
+	if total != 2*tasks {
+		t.Errorf("described %d task ARNs in total, want %d", total, 2*tasks)
+	}
+	if len(api.batches) > 4 {
+		t.Errorf("DescribeTasks called %d times (%v), want at most 4 for %d tasks", len(api.batches), api.batches, tasks)
+	}
+}
+
+// taskDefAPI records registered task definition families. Every registration
+// creates revision 1 of its family, or revision when set, and takes delay.
+type taskDefAPI struct {
+	API
+	mu         sync.Mutex
+	registered map[string]string
+	revision   int
+
+	delay         time.Duration
+	calls         int
+	inFlight      int
+	maxInFlight   int
+	registrations map[string]int
+	describes     map[string]int
+}
+
+func taskDefARN(family string, revision int) string {
+	return fmt.Sprintf("arn:aws:ecs:us-east-1:123456789012:task-definition/%s:%d", family, revision)
+}
+
+func (f *taskDefAPI) DescribeTaskDefinition(ctx context.Context, params *awsecs.DescribeTaskDefinitionInput, optFns ...func(*awsecs.Options)) (*awsecs.DescribeTaskDefinitionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	family := aws.ToString(params.TaskDefinition)
+	if f.describes != nil {
+		f.describes[family]++
+	}
+	if _, ok := f.registered[family]; !ok {
+		return nil, fmt.Errorf("ClientException: Unable to describe task definition")
+	}
+	return &awsecs.DescribeTaskDefinitionOutput{
+		TaskDefinition: &ecstypes.TaskDefinition{TaskDefinitionArn: aws.String(taskDefARN(family, max(f.revision, 1)))},
+	}, nil
+}
+
+func (f *taskDefAPI) RegisterTaskDefinition(ctx context.Context, params *awsecs.RegisterTaskDefinitionInput, optFns ...func(*awsecs.Options)) (*awsecs.RegisterTaskDefinitionOutput, error) {
+	f.mu.Lock()
+	f.inFlight++
+	f.maxInFlight = max(f.maxInFlight, f.inFlight)
+	f.mu.Unlock()
+
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight--
+	f.calls++
+	family := aws.ToString(params.Family)
+	if f.registrations != nil {
+		f.registrations[family]++
+	}
+	f.registered[family] = aws.ToString(params.Cpu) + "/" + aws.ToString(params.Memory)
+	return &awsecs.RegisterTaskDefinitionOutput{
+		TaskDefinition: &ecstypes.TaskDefinition{TaskDefinitionArn: aws.String(taskDefARN(family, max(f.revision, 1)))},
+	}, nil
+}
+
+func TestPrepareTaskDefinition(t *testing.T) {
+	sizes := [][2]string{{"1", "2G"}, {"0.5", "1G"}, {"0.25", "512"}}
+
+	t.Run("family per size", func(t *testing.T) {
+		api := &taskDefAPI{registered: map[string]string{}}
+		e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+
+		for _, size := range sizes {
+			_, cpu, mem, err := e.prepareTaskDefinition(context.Background(), "amd64", size[0], size[1])
+			if err != nil {
+				t.Fatalf("prepareTaskDefinition(%v): %v", size, err)
+			}
+			if cpu != "" || mem != "" {
+				t.Errorf("overrides = %q/%q, want none", cpu, mem)
+			}
+		}
+
+		want := map[string]string{
+			"bakery-agent-amd64-1024-2048": "1024/2048",
+			"bakery-agent-amd64-512-1024":  "512/1024",
+			"bakery-agent-amd64-256-512":   "256/512",
+		}
+		if fmt.Sprint(api.registered) != fmt.Sprint(want) {
+			t.Errorf("registered = %v, want %v", api.registered, want)
+		}
+	})
+
+	t.Run("resource overrides", func(t *testing.T) {
+		t.Setenv("ECS_RESOURCE_OVERRIDES", "true")
+		api := &taskDefAPI{registered: map[string]string{}}
+		e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+
+		wantOverrides := [][2]string{{"1024", "2048"}, {"512", "1024"}, {"256", "512"}}
+		for i, size := range sizes {
+			arn, cpu, mem, err := e.prepareTaskDefinition(context.Background(), "amd64", size[0], size[1])
+			if err != nil {
+				t.Fatalf("prepareTaskDefinition(%v): %v", size, err)
+			}
+			if want := taskDefARN("bakery-agent-amd64", 1); arn != want {
+				t.Errorf("task definition = %q, want %q", arn, want)
+			}
+			if cpu != wantOverrides[i][0] || mem != wantOverrides[i][1] {
+				t.Errorf("overrides = %s/%s, want %s/%s", cpu, mem, wantOverrides[i][0], wantOverrides[i][1])
+			}
+		}
+
+		if len(api.registered) != 1 || api.registered["bakery-agent-amd64"] != "256/512" {
+			t.Errorf("registered = %v, want only the base family", api.registered)
+		}
+	})
+
+	for _, overrides := range []string{"false", "true"} {
+		t.Run("invalid size with overrides="+overrides, func(t *testing.T) {
+			t.Setenv("ECS_RESOURCE_OVERRIDES", overrides)
+			api := &taskDefAPI{registered: map[string]string{}}
+			e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+
+			if _, _, _, err := e.prepareTaskDefinition(context.Background(), "amd64", "lots", "4G"); err == nil || !strings.Contains(err.Error(), "normalize resources") {
+				t.Errorf("error = %v, want invalid resources", err)
+			}
+			if len(api.registered) != 0 {
+				t.Errorf("registered = %v, want none", api.registered)
+			}
+		})
+	}
+}
+
+func TestRegisterTaskDefinitionConcurrency(t *testing.T) {
+	t.Setenv("ECS_TASKDEF_REGISTER_CONCURRENCY", "2")
+	api := &taskDefAPI{registered: map[string]string{}, registrations: map[string]int{}, delay: 20 * time.Millisecond}
+	e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+
+	// Three tasks per size: each family is registered once, and no more than two
+	// registrations of different families run at the same time.
+	sizes := [][2]string{{"0.25", "512"}, {"0.5", "1G"}, {"1", "2G"}, {"2", "4G"}, {"4", "8G"}, {"0.25", "1G"}}
+	var wg sync.WaitGroup
+	for _, size := range sizes {
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(cpu, mem string) {
+				defer wg.Done()
+				if _, _, _, err := e.prepareTaskDefinition(context.Background(), "amd64", cpu, mem); err != nil {
+					t.Errorf("prepareTaskDefinition(%s, %s): %v", cpu, mem, err)
+				}
+			}(size[0], size[1])
+		}
+	}
+	wg.Wait()
+
+	if api.maxInFlight != 2 {
+		t.Errorf("max concurrent registrations = %d, want 2", api.maxInFlight)
+	}
+	if api.calls != len(sizes) {
+		t.Errorf("RegisterTaskDefinition called %d times, want %d", api.calls, len(sizes))
+	}
+	for family, n := range api.registrations {
+		if n != 1 {
+			t.Errorf("family %s registered %d times, want once", family, n)
+		}
+	}
+	if len(e.familyMu) != 0 {
+		t.Errorf("familyMu holds %d families, want none once every task resolved its family", len(e.familyMu))
+	}
+
+	if got := registerConcurrency(); got != 2 {
+		t.Errorf("registerConcurrency() = %d, want 2", got)
+	}
+	for _, v := range []string{"", "0", "many"} {
+		t.Setenv("ECS_TASKDEF_REGISTER_CONCURRENCY", v)
+		if got := registerConcurrency(); got != defaultRegisterConcurrency {
+			t.Errorf("registerConcurrency() with %q = %d, want the default", v, got)
+		}
+	}
+}
+
+func TestTaskDefinitionCacheEviction(t *testing.T) {
+	t.Setenv("ECS_TASKDEF_CACHE_SIZE", "2")
+	api := &taskDefAPI{registered: map[string]string{}, describes: map[string]int{}}
+	e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+
+	prepare := func(cpu, mem string) {
+		t.Helper()
+		if _, _, _, err := e.prepareTaskDefinition(context.Background(), "amd64", cpu, mem); err != nil {
+			t.Fatalf("prepareTaskDefinition(%s, %s): %v", cpu, mem, err)
+		}
+	}
+	const (
+		small  = "bakery-agent-amd64-256-512"
+		medium = "bakery-agent-amd64-512-1024"
+		large  = "bakery-agent-amd64-1024-2048"
+	)
+
+	prepare("0.25", "512")
+	prepare("0.5", "1G")
+	prepare("0.25", "512") // small is now the most recently used
+	if api.describes[small] != 1 {
+		t.Errorf("%s described %d times, want a cache hit", small, api.describes[small])
+	}
+
+	// A third family evicts medium, the least recently used one.
+	prepare("1", "2G")
+	if len(e.taskDefARNs) != 2 || e.taskDefLRU.Len() != 2 {
+		t.Errorf("cache holds %d families (%d in LRU), want 2", len(e.taskDefARNs), e.taskDefLRU.Len())
+	}
+	if _, ok := e.cachedTaskDefinition(medium); ok {
+		t.Errorf("%s still cached, want it evicted", medium)
+	}
+	if len(e.familyMu) != 0 {
+		t.Errorf("familyMu holds %d families, want none once every resolution returned", len(e.familyMu))
+	}
+
+	// The evicted family is verified again through DescribeTaskDefinition, not registered again.
+	prepare("0.5", "1G")
+	if api.describes[medium] != 2 {
+		t.Errorf("%s described %d times, want 2 after eviction", medium, api.describes[medium])
+	}
+	if api.calls != 3 {
+		t.Errorf("RegisterTaskDefinition called %d times, want 3", api.calls)
+	}
+	if _, ok := e.cachedTaskDefinition(large); !ok {
+		t.Errorf("%s not cached", large)
+	}
+
+	for _, v := range []string{"", "0", "many"} {
+		t.Setenv("ECS_TASKDEF_CACHE_SIZE", v)
+		if got := taskDefCacheSize(); got != defaultTaskDefCacheSize {
+			t.Errorf("taskDefCacheSize() with %q = %d, want the default", v, got)
+		}
+	}
+}
+
+func TestContainerResources(t *testing.T) {
+	tests := []struct {
+		name       string
+		ef         config.EffectiveConfig
+		wantCPU    int32
+		wantMemory int32
+		wantErr    string
+	}{
+		{name: "unset", ef: config.EffectiveConfig{CPU: "1", Memory: "2G"}},
+		{
+			name:       "reservations within task",
+			ef:         config.EffectiveConfig{CPU: "1", Memory: "4G", ContainerCPU: "0.75", ContainerMemoryReservation: "3G"},
+			wantCPU:    768,
+			wantMemory: 3072,
+		},
+		{
+			name:       "memory only",
+			ef:         config.EffectiveConfig{CPU: "1", Memory: "2G", ContainerMemoryReservation: "1536"},
+			wantMemory: 1536,
+		},
+		{
+			name:    "cpu exceeds task",
+			ef:      config.EffectiveConfig{CPU: "1", Memory: "2G", ContainerCPU: "2"},
+			wantErr: "exceeds task cpu",
+		},
+		{
+			name:    "memory exceeds task",
+			ef:      config.EffectiveConfig{CPU: "1", Memory: "2G", ContainerMemoryReservation: "3G"},
+			wantErr: "exceeds task memory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu, mem, err := containerResources(tt.ef)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := aws.ToInt32(cpu); got != tt.wantCPU || (cpu == nil) != (tt.wantCPU == 0) {
+				t.Errorf("cpu = %v, want %d", got, tt.wantCPU)
+			}
+			if got := aws.ToInt32(mem); got != tt.wantMemory || (mem == nil) != (tt.wantMemory == 0) {
+				t.Errorf("memoryReservation = %v, want %d", got, tt.wantMemory)
+			}
+		})
+	}
+}
+
+// runTaskAPI records the RunTask input and the registered container, then fails the
+// RunTask call so the executor returns before waiting on the task. A task
+// definition in inactive is rejected as deregistered.
+type runTaskAPI struct {
+	taskDefAPI
+	container ecstypes.ContainerDefinition
+	input     *awsecs.RunTaskInput
+	inputs    []string
+	inactive  string
+}
+
+func (f *runTaskAPI) RegisterTaskDefinition(ctx context.Context, params *awsecs.RegisterTaskDefinitionInput, optFns ...func(*awsecs.Options)) (*awsecs.RegisterTaskDefinitionOutput, error) {
+	f.container = params.ContainerDefinitions[0]
+	return f.taskDefAPI.RegisterTaskDefinition(ctx, params, optFns...)
+}
+
+func (f *runTaskAPI) RunTask(ctx context.Context, params *awsecs.RunTaskInput, optFns ...func(*awsecs.Options)) (*awsecs.RunTaskOutput, error) {
+	f.input = params
+	f.inputs = append(f.inputs, aws.ToString(params.TaskDefinition))
+	if aws.ToString(params.TaskDefinition) == f.inactive {
+		return nil, fmt.Errorf("operation error ECS: RunTask, ClientException: TaskDefinition is inactive")
+	}
+	return nil, fmt.Errorf("RunTask disabled in test")
+}
+
+func TestEnableExecuteCommand(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%t", enabled), func(t *testing.T) {
+			t.Setenv("ECS_ENABLE_EXECUTE_COMMAND", fmt.Sprint(enabled))
+			api := &runTaskAPI{taskDefAPI: taskDefAPI{registered: map[string]string{}}}
+			e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+
+			st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+			ef := config.EffectiveConfig{Arch: "amd64", CPU: "1", Memory: "2G"}
+			if err := e.RunTask(context.Background(), st, "amd64", ef, "bucket", "key", "http://controller/ingest"); err == nil {
+				t.Fatal("RunTask: want the fake RunTask error")
+			}
+
+			if api.input == nil {
+				t.Fatal("RunTask was not called")
+			}
+			if api.input.EnableExecuteCommand != enabled {
+				t.Errorf("EnableExecuteCommand = %t, want %t", api.input.EnableExecuteCommand, enabled)
+			}
+			initEnabled := api.container.LinuxParameters != nil && aws.ToBool(api.container.LinuxParameters.InitProcessEnabled)
+			if initEnabled != enabled {
+				t.Errorf("InitProcessEnabled = %t, want %t", initEnabled, enabled)
+			}
+			wantFamily := "bakery-agent-amd64-1024-2048"
+			if enabled {
+				wantFamily += "-exec"
+			}
+			if got, want := aws.ToString(api.input.TaskDefinition), taskDefARN(wantFamily, 1); got != want {
+				t.Errorf("TaskDefinition = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRunTaskPinsTaskDefinitionRevision(t *testing.T) {
+	api := &runTaskAPI{taskDefAPI: taskDefAPI{registered: map[string]string{}}}
+	e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+	st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+	ef := config.EffectiveConfig{Arch: "arm64", CPU: "1", Memory: "2G"}
+
+	_ = e.RunTask(context.Background(), st, "arm64", ef, "bucket", "key", "http://controller/ingest")
+	want := taskDefARN("bakery-agent-arm64-1024-2048", 1)
+	if got := aws.ToString(api.input.TaskDefinition); got != want {
+		t.Fatalf("TaskDefinition = %q, want the registered revision %q", got, want)
+	}
+
+	// The cached ARN is reused without describing or registering the family again.
+	api.mu.Lock()
+	api.registered = map[string]string{}
+	api.mu.Unlock()
+	_ = e.RunTask(context.Background(), st, "arm64", ef, "bucket", "key", "http://controller/ingest")
+	if got := aws.ToString(api.input.TaskDefinition); got != want {
+		t.Errorf("TaskDefinition = %q, want the cached revision %q", got, want)
+	}
+	if len(api.registered) != 0 {
+		t.Errorf("registered = %v, want the cached ARN to be reused", api.registered)
+	}
+
+	t.Run("existing family", func(t *testing.T) {
+		api := &runTaskAPI{taskDefAPI: taskDefAPI{registered: map[string]string{"bakery-agent-arm64-1024-2048": "1024/2048"}}}
+		e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+
+		_ = e.RunTask(context.Background(), st, "arm64", ef, "bucket", "key", "http://controller/ingest")
+		if got := aws.ToString(api.input.TaskDefinition); got != want {
+			t.Errorf("TaskDefinition = %q, want the described revision %q", got, want)
+		}
+	})
+}
+
+func TestRunTaskInactiveTaskDefinition(t *testing.T) {
+	api := &runTaskAPI{taskDefAPI: taskDefAPI{registered: map[string]string{}}}
+	e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+	st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+	ef := config.EffectiveConfig{Arch: "arm64", CPU: "1", Memory: "2G"}
+	family := "bakery-agent-arm64-1024-2048"
+
+	_ = e.RunTask(context.Background(), st, "arm64", ef, "bucket", "key", "http://controller/ingest")
+
+	// Revision 1 is deregistered outside bakery and revision 2 becomes the latest.
+	api.mu.Lock()
+	api.inactive = taskDefARN(family, 1)
+	api.revision = 2
+	api.inputs = nil
+	api.mu.Unlock()
+
+	err := e.RunTask(context.Background(), st, "arm64", ef, "bucket", "key", "http://controller/ingest")
+	if err == nil || strings.Contains(err.Error(), "inactive") {
+		t.Fatalf("RunTask: %v, want the fake RunTask error of the retry", err)
+	}
+	want := []string{taskDefARN(family, 1), taskDefARN(family, 2)}
+	if !slices.Equal(api.inputs, want) {
+		t.Errorf("RunTask task definitions = %v, want %v", api.inputs, want)
+	}
+
+	// The retried revision replaced the inactive one in the cache.
+	api.inputs = nil
+	_ = e.RunTask(context.Background(), st, "arm64", ef, "bucket", "key", "http://controller/ingest")
+	if want := []string{taskDefARN(family, 2)}; !slices.Equal(api.inputs, want) {
+		t.Errorf("RunTask task definitions = %v, want %v", api.inputs, want)
+	}
+}
+
+// stopTaskAPI records the StopTask input.
+type stopTaskAPI struct {
+	API
+	input *awsecs.StopTaskInput
+}
+
+func (f *stopTaskAPI) StopTask(ctx context.Context, params *awsecs.StopTaskInput, optFns ...func(*awsecs.Options)) (*awsecs.StopTaskOutput, error) {
+	f.input = params
+	return &awsecs.StopTaskOutput{}, nil
+}
+
+func TestCancelTask(t *testing.T) {
+	api := &stopTaskAPI{}
+	e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+	st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+
+	if err := e.CancelTask(context.Background(), st, "amd64"); err != nil || api.input != nil {
+		t.Fatalf("CancelTask before start = %v (StopTask %+v), want a no-op", err, api.input)
+	}
+
+	st.TaskArnByID["amd64"] = "arn:aws:ecs:us-east-1:123:task/cluster/abc"
+	if err := e.CancelTask(context.Background(), st, "amd64"); err != nil {
+		t.Fatalf("CancelTask: %v", err)
+	}
+	if api.input == nil || aws.ToString(api.input.Cluster) != "cluster" || aws.ToString(api.input.Task) != "arn:aws:ecs:us-east-1:123:task/cluster/abc" {
+		t.Errorf("StopTask input = %+v, want the task in cluster", api.input)
+	}
+}
+
+func TestPollerWakeDoesNotStarve(t *testing.T) {
+	api := &batchAPI{seen: make(map[string]bool)}
+	e := NewECSExecutor(api, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller")
+	e.PollInterval = 20 * time.Millisecond
+	e.PollMaxInterval = 20 * time.Millisecond
+	st := state.NewBuildState("b-test", 1, false, "registry.example.com/app:1.0")
+
+	// New tasks keep joining more often than the poll interval.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			_, stop := e.poller.watch(st, fmt.Sprintf("task-%d", i), fmt.Sprintf("arn:task-%d", i))
+			defer stop()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := e.waitTaskStopped(ctx, st, "amd64", "arn:amd64"); err != nil {
+		t.Fatalf("waitTaskStopped: %v", err)
+	}
+}
+
+func TestTaskWaiterKeepsLatestStatus(t *testing.T) {
+	w := &taskWaiter{updates: make(chan string, 2)}
+	for _, status := range []string{"PROVISIONING", "PENDING", "RUNNING", "STOPPED"} {
+		w.send(status)
+	}
+	close(w.updates)
+
+	var got []string
+	for status := range w.updates {
+		got = append(got, status)
+	}
+	if strings.Join(got, ",") != "RUNNING,STOPPED" {
+		t.Errorf("delivered = %v, want the latest statuses ending in STOPPED", got)
+	}
+}
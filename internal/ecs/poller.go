@@ -0,0 +1,184 @@
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/state"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsecs "github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// maxDescribeTasks is the most task ARNs DescribeTasks accepts per call.
+const maxDescribeTasks = 100
+
+// taskPoller shares DescribeTasks calls across every task an ECSExecutor is waiting on.
+// Each poll describes all watched tasks in batches of up to maxDescribeTasks ARNs and
+// fans status changes back to the waiters. It runs only while there are waiters.
+type taskPoller struct {
+	e *ECSExecutor
+
+	mu      sync.Mutex
+	waiters map[string]*taskWaiter
+	running bool
+	wake    chan struct{}
+}
+
+type taskWaiter struct {
+	st         *state.BuildState
+	taskID     string
+	lastStatus string
+	updates    chan string
+}
+
+func newTaskPoller(e *ECSExecutor) *taskPoller {
+	return &taskPoller{
+		e:       e,
+		waiters: make(map[string]*taskWaiter),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// watch registers taskArn and returns a channel that receives each new status of the task.
+// The channel stops receiving once the task is STOPPED; stop unregisters the task early.
+func (p *taskPoller) watch(st *state.BuildState, taskID, taskArn string) (<-chan string, func()) {
+	w := &taskWaiter{
+		st:      st,
+		taskID:  taskID,
+		updates: make(chan string, 16),
+	}
+
+	p.mu.Lock()
+	p.waiters[taskArn] = w
+	if !p.running {
+		p.running = true
+		go p.run()
+	} else {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+	p.mu.Unlock()
+
+	stop := func() {
+		p.mu.Lock()
+		if p.waiters[taskArn] == w {
+			delete(p.waiters, taskArn)
+		}
+		p.mu.Unlock()
+	}
+	return w.updates, stop
+}
+
+func (p *taskPoller) run() {
+	delay := p.e.PollInterval
+	if delay <= 0 {
+		delay = 1 * time.Second
+	}
+	minDelay := delay
+	maxDelay := max(p.e.PollMaxInterval, minDelay)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	next := time.Now().Add(delay)
+	// The first poll waits one interval, so tasks started together share it.
+	lastPoll := time.Now()
+
+	for {
+		select {
+		case <-timer.C:
+			delay = min(delay*2, maxDelay)
+		case <-p.wake:
+			// A new task joined; poll it promptly instead of waiting out the backoff, but
+			// at most once per base interval, so tasks started in a burst share a poll.
+			// A wake never postpones a scheduled poll.
+			delay = minDelay
+			if wait := time.Until(lastPoll.Add(minDelay)); wait > 0 {
+				if time.Until(next) > wait {
+					next = time.Now().Add(wait)
+					timer.Reset(wait)
+				}
+				continue
+			}
+		}
+
+		p.mu.Lock()
+		arns := make([]string, 0, len(p.waiters))
+		for arn := range p.waiters {
+			arns = append(arns, arn)
+		}
+		if len(arns) == 0 {
+			p.running = false
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+
+		for start := 0; start < len(arns); start += maxDescribeTasks {
+			p.poll(arns[start:min(start+maxDescribeTasks, len(arns))])
+		}
+
+		lastPoll = time.Now()
+		next = lastPoll.Add(delay)
+		timer.Reset(delay)
+	}
+}
+
+func (p *taskPoller) poll(arns []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out, err := p.e.Client.DescribeTasks(ctx, &awsecs.DescribeTasksInput{
+		Cluster: aws.String(p.e.ClusterName),
+		Tasks:   arns,
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		for _, arn := range arns {
+			if w, ok := p.waiters[arn]; ok {
+				w.st.AppendLog("error", fmt.Sprintf("[ecs][%s] describe error: %v", w.taskID, err))
+			}
+		}
+		return
+	}
+
+	for _, t := range out.Tasks {
+		if t.TaskArn == nil || t.LastStatus == nil {
+			continue
+		}
+		w, ok := p.waiters[*t.TaskArn]
+		if !ok || *t.LastStatus == w.lastStatus {
+			continue
+		}
+
+		w.lastStatus = *t.LastStatus
+		w.send(w.lastStatus)
+		if w.lastStatus == "STOPPED" {
+			delete(p.waiters, *t.TaskArn)
+		}
+	}
+}
+
+// send delivers status to the waiter. When the waiter has fallen behind, its oldest
+// status is dropped to make room, so the latest one, such as STOPPED, always arrives.
+// Only the poller sends, so the loop ends once there is room.
+func (w *taskWaiter) send(status string) {
+	for {
+		select {
+		case w.updates <- status:
+			return
+		default:
+		}
+		select {
+		case <-w.updates:
+		default:
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Package fakeexec provides an in-memory executor for integration tests.
+// It never starts an agent; each task reports its result straight into the
+// build state, the same way the /result and /logs/ingest routes would.
+package fakeexec
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+// Executor simulates agent tasks without touching any cloud.
+// The zero value succeeds immediately with a digest derived from the task ID.
+type Executor struct {
+	// Delay is how long each task runs before reporting its result.
+	Delay time.Duration
+	// TaskDelay, when set, returns the delay of each task instead of Delay.
+	TaskDelay func(taskID string) time.Duration
+	// Fail returns a non-nil error to make a task fail.
+	// The error is reported as the task result, like a failed kaniko build.
+	Fail func(taskID string, ef config.EffectiveConfig) error
+	// SkipResult reports whether a task should finish without sending a result,
+	// like an agent that exited before calling back to the controller.
+	SkipResult func(taskID string) bool
+
+	mu       sync.Mutex
+	tasks    []string
+	configs  map[string]config.EffectiveConfig
+	canceled []string
+}
+
+// New creates a new Executor that succeeds for every task.
+func New() *Executor {
+	return &Executor{}
+}
+
+func (e *Executor) RunTask(
+	ctx context.Context,
+	st *state.BuildState,
+	taskID string,
+	ef config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	ingestURL string,
+) error {
+	e.mu.Lock()
+	e.tasks = append(e.tasks, taskID)
+	if e.configs == nil {
+		e.configs = make(map[string]config.EffectiveConfig)
+	}
+	e.configs[taskID] = ef
+	e.mu.Unlock()
+
+	st.MarkIngestStarted(taskID)
+	st.MarkHeartbeat(taskID)
+	defer st.MarkIngestDone(taskID)
+
+	delay := e.Delay
+	if e.TaskDelay != nil {
+		delay = e.TaskDelay(taskID)
+	}
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	st.AppendLog("info", fmt.Sprintf("[fake %s] building %s (%s)", taskID, ef.Destination, ef.Arch))
+
+	if e.SkipResult != nil && e.SkipResult(taskID) {
+		st.AppendLog("warn", fmt.Sprintf("[fake %s] exiting without result", taskID))
+		return nil
+	}
+
+	if e.Fail != nil {
+		if err := e.Fail(taskID, ef); err != nil {
+			st.SetResult(taskID, ef.Arch, "", false, err.Error())
+			return fmt.Errorf("agent failed: %w", err)
+		}
+	}
+
+	st.SetResult(taskID, ef.Arch, Digest(taskID), true, "")
+	return nil
+}
+
+// CancelTask records that taskID was canceled.
+func (e *Executor) CancelTask(ctx context.Context, st *state.BuildState, taskID string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.canceled = append(e.canceled, taskID)
+	return nil
+}
+
+// Canceled returns the task IDs canceled so far, in cancel order.
+func (e *Executor) Canceled() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.canceled...)
+}
+
+// Tasks returns the task IDs run so far, in start order.
+func (e *Executor) Tasks() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.tasks...)
+}
+
+// Config returns the effective config taskID was last run with, and whether it ran.
+func (e *Executor) Config(taskID string) (config.EffectiveConfig, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ef, ok := e.configs[taskID]
+	return ef, ok
+}
+
+// Digest returns the image digest reported for a successful task.
+func Digest(taskID string) string {
+	sum := sha256.Sum256([]byte(taskID))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,86 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	m, err := Parse(strings.NewReader(`
+# large fixtures kaniko never reads
+testdata/
+*.log
+!keep.log
+/build
+docs/**/*.png
+**/tmp/**
+fixtures/*
+!fixtures/small.json
+cache/
+!cache/keep.txt
+\#notes
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"testdata", true, true},
+		{"pkg/testdata", true, true},
+		{"testdata", false, false},
+		{"pkg/testdata/big.bin", false, true},
+		{"app.log", false, true},
+		{"logs/app.log", false, true},
+		{"keep.log", false, false},
+		{"logs/keep.log", false, false},
+		{"build", true, true},
+		{"build/out.bin", false, true},
+		{"pkg/build", true, false},
+		{"docs/a.png", false, true},
+		{"docs/img/b/c.png", false, true},
+		{"docs/a.jpg", false, false},
+		{"src/tmp/x", false, true},
+		{"src/tmp", true, false},
+		{"fixtures/large.json", false, true},
+		{"fixtures/small.json", false, false},
+		{"fixtures/sub/deep.json", false, true},
+		// A file inside an ignored directory cannot be re-included.
+		{"cache/keep.txt", false, true},
+		{"#notes", false, true},
+		{"Dockerfile", false, false},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Match(%q, dir=%t) = %t, want %t", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := Load(dir)
+	if err != nil || m != nil {
+		t.Fatalf("Load without %s = %v, %v; want nil, nil", FileName, m, err)
+	}
+	if m.Match("anything", false) {
+		t.Error("nil Matcher ignores a path")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, FileName), []byte("fixtures/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err = Load(dir)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !m.Match(filepath.Join("fixtures", "big.bin"), false) {
+		t.Error("fixtures/big.bin not ignored")
+	}
+}
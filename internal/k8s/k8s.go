@@ -2,20 +2,23 @@ package k8s
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"crypto/rand"
 	"fmt"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/rayshoo/bakery/internal/agentapi"
+	"github.com/rayshoo/bakery/internal/agentenv"
 	"github.com/rayshoo/bakery/internal/config"
 	"github.com/rayshoo/bakery/internal/state"
 
 	batchv1 "k8s.io/api/batch/v1"
 	apiv1 "k8s.io/api/core/v1"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
@@ -25,16 +28,20 @@ import (
 
 // K8sExecutor runs build jobs on Kubernetes.
 type K8sExecutor struct {
-	Client        *kubernetes.Clientset
+	Client        kubernetes.Interface
 	Namespace     string
 	AgentImage    string
 	ControllerURL string
 	K8sConfig     *config.K8sServerConfig
+
+	pfpMu        sync.Mutex
+	pfpChecked   bool
+	pfpSupported bool
 }
 
 // NewK8sExecutor creates a new K8sExecutor instance.
 func NewK8sExecutor(
-	client *kubernetes.Clientset,
+	client kubernetes.Interface,
 	namespace string,
 	agentImage string,
 	controllerURL string,
@@ -60,157 +67,153 @@ func (k *K8sExecutor) RunTask(
 	ingestURL string,
 ) error {
 
-	arch := ef.Arch
-
-	jobName := fmt.Sprintf("build-%s-%s-", st.ID, taskID)
 	st.AppendLog("info", fmt.Sprintf("[k8s][%s] dispatching job", taskID))
 
-	var targetPlatform, targetOS, targetArch, targetVariant string
+	job, secret, err := k.buildJob(st, taskID, ef, contextBucket, contextKey, ingestURL)
+	if err != nil {
+		return err
+	}
 
-	if ef.CustomPlatform != nil && *ef.CustomPlatform != "" {
-		targetPlatform = *ef.CustomPlatform
-		parts := strings.Split(*ef.CustomPlatform, "/")
-		if len(parts) >= 2 {
-			targetOS = parts[0]
-			targetArch = parts[1]
-			if len(parts) == 3 {
-				targetVariant = parts[2]
-			}
-		} else {
-			targetOS = "linux"
-			targetArch = arch
-		}
-	} else {
-		targetPlatform = fmt.Sprintf("linux/%s", arch)
-		targetOS = "linux"
-		targetArch = arch
-		if arch == "arm64" {
-			targetVariant = "v8"
+	if secret != nil {
+		if secret, err = k.Client.CoreV1().Secrets(k.Namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("[k8s] create secret: %w", err)
 		}
 	}
 
-	envVars := []apiv1.EnvVar{
-		{Name: "BUILD_ID", Value: st.ID},
-		{Name: "BUILD_TASK_ID", Value: taskID},
-		{Name: "TASK_COLOR_INDEX", Value: getTaskColorIndex(taskID)},
-
-		{Name: "TARGETPLATFORM", Value: targetPlatform},
-		{Name: "TARGETOS", Value: targetOS},
-		{Name: "TARGETARCH", Value: targetArch},
-		{Name: "TARGETVARIANT", Value: targetVariant},
-
-		{Name: "BUILDPLATFORM", Value: targetPlatform},
-		{Name: "BUILDOS", Value: targetOS},
-		{Name: "BUILDARCH", Value: targetArch},
-		{Name: "BUILDVARIANT", Value: targetVariant},
+	created, err := k.Client.BatchV1().Jobs(k.Namespace).Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		if secret != nil {
+			_ = k.Client.CoreV1().Secrets(k.Namespace).Delete(context.Background(), secret.Name, metav1.DeleteOptions{})
+		}
+		return fmt.Errorf("[k8s] create job: %w", err)
+	}
 
-		{Name: "EXECUTOR_PLATFORM", Value: "k8s"},
+	// The job owns its secret, so the secret is garbage collected with the job.
+	if secret != nil {
+		secret.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+			Name:       created.Name,
+			UID:        created.UID,
+		}}
+		if _, err := k.Client.CoreV1().Secrets(k.Namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			st.AppendLog("warn", fmt.Sprintf("[k8s][%s] set owner of secret %s: %v", taskID, secret.Name, err))
+		}
+	}
 
-		{Name: "STORAGE_ENDPOINT", Value: os.Getenv("S3_ENDPOINT")},
-		{Name: "STORAGE_REGION", Value: os.Getenv("S3_REGION")},
-		{Name: "STORAGE_USE_SSL", Value: os.Getenv("S3_SSL")},
-		{Name: "STORAGE_ACCESS_KEY", Value: os.Getenv("S3_ACCESS_KEY")},
-		{Name: "STORAGE_SECRET_KEY", Value: os.Getenv("S3_SECRET_KEY")},
+	jobName := created.Name
 
-		{Name: "CONTEXT_BUCKET", Value: contextBucket},
-		{Name: "CONTEXT_KEY", Value: contextKey},
+	st.Mu.Lock()
+	st.TaskArnByID[taskID] = jobName
+	st.IDByTaskArn[jobName] = taskID
+	st.Mu.Unlock()
 
-		{Name: "CONTROLLER_URL", Value: k.ControllerURL},
-		{Name: "INGEST_URL", Value: ingestURL},
-	}
+	st.AppendLog("info", fmt.Sprintf("[k8s][%s] started job: %s", taskID, jobName))
 
-	var kanikoDestination string
-	if st.IsSingleArch {
-		if ef.Destination != "" {
-			kanikoDestination = ef.Destination
-		} else {
-			kanikoDestination = st.GlobalDestination
-		}
-	} else {
-		if ef.Destination != "" && ef.Destination != st.GlobalDestination {
-			kanikoDestination = ef.Destination
-		} else {
-			if st.HasDuplicateArch {
-				kanikoDestination = appendTaskSuffix(st.GlobalDestination, taskID)
-			} else {
-				kanikoDestination = appendArchSuffix(st.GlobalDestination, arch)
-			}
-		}
-	}
+	done := make(chan struct{})
+	watchCtx, watchCancel := context.WithTimeout(ctx, 30*time.Minute)
+	defer watchCancel()
 
-	envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_DESTINATION", Value: kanikoDestination})
-	envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_CONTEXT", Value: ef.ContextPath})
-	envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_DOCKERFILE", Value: ef.Dockerfile})
+	go func() {
+		defer close(done)
+		k.waitJobCompletion(watchCtx, st, taskID, jobName)
+	}()
 
-	if len(ef.BuildArgs) > 0 {
-		var pairs []string
-		for k, v := range ef.BuildArgs {
-			pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	select {
+	case <-done:
+		if st.HasError() {
+			return st.GetError()
 		}
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_BUILD_ARGS", Value: strings.Join(pairs, ",")})
-	}
+		return nil
 
-	if len(ef.KanikoCredentials) > 0 {
-		creds, err := createDockerConfigJSON(ef.KanikoCredentials)
-		if err != nil {
-			return fmt.Errorf("create docker config: %w", err)
-		}
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_CREDENTIALS_JSON", Value: creds})
+	case <-ctx.Done():
+		return fmt.Errorf("k8s job wait cancelled: %w", ctx.Err())
 	}
+}
 
-	if ef.CacheEnable != nil {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_CACHE_ENABLE", Value: fmt.Sprintf("%t", *ef.CacheEnable)})
-	}
-	if ef.CacheRepo != "" {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_CACHE_REPO", Value: ef.CacheRepo})
-	}
-	if ef.CacheTTL != "" {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_CACHE_TTL", Value: ef.CacheTTL})
-	}
-	if ef.CacheCopyLayers != nil {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_CACHE_COPY_LAYERS", Value: fmt.Sprintf("%t", *ef.CacheCopyLayers)})
-	}
-	if ef.CacheRunLayers != nil {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_CACHE_RUN_LAYERS", Value: fmt.Sprintf("%t", *ef.CacheRunLayers)})
+// CancelTask deletes the Job of taskID, if it was created, along with its pods and
+// credentials Secret.
+func (k *K8sExecutor) CancelTask(ctx context.Context, st *state.BuildState, taskID string) error {
+	jobName := st.TaskArn(taskID)
+	if jobName == "" {
+		return nil
 	}
-	if ef.CacheCompressed != nil {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_CACHE_COMPRESSED", Value: fmt.Sprintf("%t", *ef.CacheCompressed)})
+	propagation := metav1.DeletePropagationBackground
+	err := k.Client.BatchV1().Jobs(k.Namespace).Delete(ctx, jobName, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("[k8s] delete job %s: %w", jobName, err)
 	}
+	st.AppendLog("info", fmt.Sprintf("[k8s][%s] deleted job: %s", taskID, jobName))
+	return nil
+}
 
-	if ef.SnapshotMode != nil {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_SNAPSHOT_MODE", Value: *ef.SnapshotMode})
-	}
-	if ef.UseNewRun != nil {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_USE_NEW_RUN", Value: fmt.Sprintf("%t", *ef.UseNewRun)})
-	}
-	if ef.Cleanup != nil {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_CLEANUP", Value: fmt.Sprintf("%t", *ef.Cleanup)})
-	}
-	if ef.CustomPlatform != nil {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_CUSTOM_PLATFORM", Value: *ef.CustomPlatform})
-	}
-	if ef.NoPush != nil {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_NO_PUSH", Value: fmt.Sprintf("%t", *ef.NoPush)})
-	}
+// buildJob assembles the Job that runs the agent for a build task, and the Secret
+// holding its credentials, which is nil when the task has none.
+func (k *K8sExecutor) buildJob(
+	st *state.BuildState,
+	taskID string,
+	ef config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	ingestURL string,
+) (*batchv1.Job, *apiv1.Secret, error) {
+
+	arch := ef.Arch
+
+	jobName := fmt.Sprintf("build-%s-%s-", st.ID, taskID)
 
-	if len(ef.IgnorePath) > 0 {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_IGNORE_PATH", Value: strings.Join(ef.IgnorePath, ",")})
+	vars, err := agentenv.Build(st, taskID, ef, agentenv.Task{
+		Platform:      "k8s",
+		ControllerURL: k.ControllerURL,
+		IngestURL:     ingestURL,
+		ContextBucket: contextBucket,
+		ContextKey:    contextKey,
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if ef.ExtraFlags != "" {
-		envVars = append(envVars, apiv1.EnvVar{Name: "KANIKO_EXTRA_FLAGS", Value: ef.ExtraFlags})
+	// Credentials go into a Secret of the job instead of the pod spec.
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName + randomSuffix(),
+			Namespace: k.Namespace,
+			Labels: map[string]string{
+				"build-id": st.ID,
+				"task-id":  taskID,
+			},
+		},
+		StringData: map[string]string{},
 	}
 
-	if ef.PreScript != nil {
-		envVars = append(envVars, apiv1.EnvVar{Name: "PRE_SCRIPT", Value: *ef.PreScript})
+	envVars := make([]apiv1.EnvVar, 0, len(vars)+4)
+	for _, v := range vars {
+		if !v.Secret {
+			envVars = append(envVars, apiv1.EnvVar{Name: v.Name, Value: v.Value})
+			continue
+		}
+		if v.Value == "" {
+			continue
+		}
+		secret.StringData[v.Name] = v.Value
+		envVars = append(envVars, apiv1.EnvVar{Name: v.Name, ValueFrom: &apiv1.EnvVarSource{
+			SecretKeyRef: &apiv1.SecretKeySelector{
+				LocalObjectReference: apiv1.LocalObjectReference{Name: secret.Name},
+				Key:                  v.Name,
+			},
+		}})
 	}
-	if ef.PostScript != nil {
-		envVars = append(envVars, apiv1.EnvVar{Name: "POST_SCRIPT", Value: *ef.PostScript})
+	if len(secret.StringData) == 0 {
+		secret = nil
 	}
 
-	for key, value := range ef.Env {
-		envVars = append(envVars, apiv1.EnvVar{Name: key, Value: value})
-	}
+	targetPlatform, targetOS, targetArch, targetVariant := agentenv.TargetPlatform(ef)
+	envVars = append(envVars,
+		apiv1.EnvVar{Name: "BUILDPLATFORM", Value: targetPlatform},
+		apiv1.EnvVar{Name: "BUILDOS", Value: targetOS},
+		apiv1.EnvVar{Name: "BUILDARCH", Value: targetArch},
+		apiv1.EnvVar{Name: "BUILDVARIANT", Value: targetVariant},
+	)
 
 	resourceLimits := apiv1.ResourceList{}
 
@@ -218,7 +221,7 @@ func (k *K8sExecutor) RunTask(
 		cpuFormatted := config.FormatK8sResource(ef.CPU, "cpu")
 		q, err := resource.ParseQuantity(cpuFormatted)
 		if err != nil {
-			return fmt.Errorf("invalid cpu=%s (formatted=%s): %w", ef.CPU, cpuFormatted, err)
+			return nil, nil, fmt.Errorf("invalid cpu=%s (formatted=%s): %w", ef.CPU, cpuFormatted, err)
 		}
 		resourceLimits[apiv1.ResourceCPU] = q
 		st.AppendLog("info", fmt.Sprintf("[k8s][%s] cpu limit: %s", taskID, cpuFormatted))
@@ -228,7 +231,7 @@ func (k *K8sExecutor) RunTask(
 		memFormatted := config.FormatK8sResource(ef.Memory, "memory")
 		q, err := resource.ParseQuantity(memFormatted)
 		if err != nil {
-			return fmt.Errorf("invalid memory=%s (formatted=%s): %w", ef.Memory, memFormatted, err)
+			return nil, nil, fmt.Errorf("invalid memory=%s (formatted=%s): %w", ef.Memory, memFormatted, err)
 		}
 		resourceLimits[apiv1.ResourceMemory] = q
 		st.AppendLog("info", fmt.Sprintf("[k8s][%s] memory limit: %s", taskID, memFormatted))
@@ -245,6 +248,7 @@ func (k *K8sExecutor) RunTask(
 		NodeSelector:       nodeSelector,
 		Tolerations:        tolerations,
 		ImagePullSecrets:   imagePullSecrets,
+		HostAliases:        hostAliases(ef.ExtraHosts),
 
 		Containers: []apiv1.Container{
 			{
@@ -279,39 +283,15 @@ func (k *K8sExecutor) RunTask(
 		},
 	}
 
-	created, err := k.Client.BatchV1().Jobs(k.Namespace).Create(ctx, job, metav1.CreateOptions{})
-	if err != nil {
-		return fmt.Errorf("[k8s] create job: %w", err)
-	}
-
-	jobName = created.Name
-
-	st.Mu.Lock()
-	st.TaskArnByID[taskID] = jobName
-	st.IDByTaskArn[jobName] = taskID
-	st.Mu.Unlock()
-
-	st.AppendLog("info", fmt.Sprintf("[k8s][%s] started job: %s", taskID, jobName))
-
-	done := make(chan struct{})
-	watchCtx, watchCancel := context.WithTimeout(ctx, 30*time.Minute)
-	defer watchCancel()
-
-	go func() {
-		defer close(done)
-		k.waitJobCompletion(watchCtx, st, taskID, jobName)
-	}()
-
-	select {
-	case <-done:
-		if st.HasError() {
-			return st.GetError()
+	if k.K8sConfig != nil && k.K8sConfig.PodFailurePolicy != nil {
+		if k.podFailurePolicySupported() {
+			job.Spec.PodFailurePolicy = podFailurePolicy(k.K8sConfig.PodFailurePolicy)
+		} else {
+			st.AppendLog("warn", fmt.Sprintf("[k8s][%s] podFailurePolicy not supported by cluster, skipping", taskID))
 		}
-		return nil
-
-	case <-ctx.Done():
-		return fmt.Errorf("k8s job wait cancelled: %w", ctx.Err())
 	}
+
+	return job, secret, nil
 }
 
 func (k *K8sExecutor) waitJobCompletion(
@@ -325,7 +305,7 @@ func (k *K8sExecutor) waitJobCompletion(
 	})
 	if err != nil {
 		st.AppendLog("error", fmt.Sprintf("[k8s][%s] watch error: %v", taskID, err))
-		st.SetError(err)
+		st.SetTaskError(taskID, err)
 		return
 	}
 	defer watcher.Stop()
@@ -337,7 +317,7 @@ func (k *K8sExecutor) waitJobCompletion(
 		select {
 		case <-ctx.Done():
 			st.AppendLog("error", fmt.Sprintf("[k8s][%s] context cancelled: %v", taskID, ctx.Err()))
-			st.SetError(fmt.Errorf("job timeout: %w", ctx.Err()))
+			st.SetTaskError(taskID, fmt.Errorf("job timeout: %w", ctx.Err()))
 			k.checkPodExitCode(context.Background(), st, taskID, jobName, ctx.Err())
 			return
 
@@ -378,38 +358,6 @@ func (k *K8sExecutor) waitJobCompletion(
 	}
 }
 
-// getTaskColorIndex returns the terminal color index for a task ID.
-// amd64 tasks use even indices, arm64 tasks use odd indices.
-func getTaskColorIndex(taskID string) string {
-	if taskID == "amd64" {
-		return "0"
-	}
-	if taskID == "arm64" {
-		return "1"
-	}
-
-	if strings.Contains(taskID, "-") {
-		parts := strings.Split(taskID, "-")
-		if len(parts) == 2 {
-			arch := parts[0]
-			idx := parts[1]
-
-			num, err := strconv.Atoi(idx)
-			if err != nil {
-				return "0"
-			}
-
-			if arch == "amd64" {
-				return strconv.Itoa(num * 2)
-			} else if arch == "arm64" {
-				return strconv.Itoa(num*2 + 1)
-			}
-		}
-	}
-
-	return "0"
-}
-
 func (k *K8sExecutor) checkJobStatus(
 	ctx context.Context,
 	st *state.BuildState,
@@ -418,7 +366,7 @@ func (k *K8sExecutor) checkJobStatus(
 ) {
 	job, err := k.Client.BatchV1().Jobs(k.Namespace).Get(ctx, jobName, metav1.GetOptions{})
 	if err != nil {
-		st.SetError(err)
+		st.SetTaskError(taskID, err)
 		k.checkPodExitCode(ctx, st, taskID, jobName, err)
 		return
 	}
@@ -451,14 +399,14 @@ func (k *K8sExecutor) checkPodExitCode(
 
 	if err != nil {
 		st.AppendLog("error", fmt.Sprintf("[k8s][%s] failed to list pods: %v", taskID, err))
-		st.SetError(err)
+		st.SetTaskError(taskID, err)
 		return
 	}
 
 	if len(pods.Items) == 0 {
 		err := fmt.Errorf("no pods found for job %s", jobName)
 		st.AppendLog("error", fmt.Sprintf("[k8s][%s] %v", taskID, err))
-		st.SetError(err)
+		st.SetTaskError(taskID, err)
 		return
 	}
 
@@ -467,7 +415,7 @@ func (k *K8sExecutor) checkPodExitCode(
 	if pod.Status.Phase == apiv1.PodPending || pod.Status.Phase == apiv1.PodUnknown {
 		err := fmt.Errorf("pod never started: phase=%s", pod.Status.Phase)
 		st.AppendLog("error", fmt.Sprintf("[k8s][%s] %v", taskID, err))
-		st.SetError(err)
+		st.SetTaskError(taskID, err)
 		return
 	}
 
@@ -482,9 +430,9 @@ func (k *K8sExecutor) checkPodExitCode(
 				exitCode := cs.State.Terminated.ExitCode
 
 				if exitCode != 0 {
-					taskErr = fmt.Errorf("agent exit=%d: %s", exitCode, cs.State.Terminated.Reason)
+					taskErr = fmt.Errorf("agent exit=%d (%s): %s", exitCode, agentapi.ExitPhase(int(exitCode)), cs.State.Terminated.Reason)
 					st.AppendLog("error", fmt.Sprintf("[k8s][%s] %v", taskID, taskErr))
-					st.SetError(taskErr)
+					st.SetTaskError(taskID, taskErr)
 				} else {
 					st.AppendLog("info", fmt.Sprintf("[k8s][%s] exit=0 success", taskID))
 				}
@@ -564,68 +512,30 @@ func (k *K8sExecutor) checkPodExitCode(
 	if !foundAgent {
 		err := fmt.Errorf("agent container not found in pod")
 		st.AppendLog("error", fmt.Sprintf("[k8s][%s] %v", taskID, err))
-		st.SetError(err)
+		st.SetTaskError(taskID, err)
 		return
 	}
 
 	if jobErr != nil {
 		st.AppendLog("error", fmt.Sprintf("[k8s][%s] job error: %v", taskID, jobErr))
-		st.SetError(jobErr)
+		st.SetTaskError(taskID, jobErr)
 	}
 }
 
 func int32Ptr(v int32) *int32 { return &v }
 
-func appendArchSuffix(destination, arch string) string {
-	if idx := lastIndexByte(destination, ':'); idx != -1 {
-		base := destination[:idx]
-		tag := destination[idx+1:]
-		return fmt.Sprintf("%s:%s_%s", base, tag, arch)
+// randomSuffix returns 5 random lowercase characters to make an object name unique,
+// like the suffix the API server appends to a generateName.
+func randomSuffix() string {
+	const chars = "bcdfghjklmnpqrstvwxz2456789"
+	b := make([]byte, 5)
+	_, _ = rand.Read(b)
+	for i := range b {
+		b[i] = chars[int(b[i])%len(chars)]
 	}
-	return fmt.Sprintf("%s:latest_%s", destination, arch)
-}
-
-func appendTaskSuffix(destination, taskID string) string {
-	if idx := lastIndexByte(destination, ':'); idx != -1 {
-		base := destination[:idx]
-		tag := destination[idx+1:]
-		return fmt.Sprintf("%s:%s_%s", base, tag, taskID)
-	}
-	return fmt.Sprintf("%s:latest_%s", destination, taskID)
-}
-
-func lastIndexByte(s string, c byte) int {
-	for i := len(s) - 1; i >= 0; i-- {
-		if s[i] == c {
-			return i
-		}
-	}
-	return -1
-}
-
-func createDockerConfigJSON(creds []config.RegistryCredential) (string, error) {
-	type DockerAuth struct {
-		Auth string `json:"auth"`
-	}
-	type DockerConfig struct {
-		Auths map[string]DockerAuth `json:"auths"`
-	}
-
-	cfg := DockerConfig{
-		Auths: make(map[string]DockerAuth),
-	}
-
-	for _, cred := range creds {
-		auth := base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password))
-		cfg.Auths[cred.Registry] = DockerAuth{Auth: auth}
-	}
-
-	b, err := json.Marshal(cfg)
-	if err != nil {
-		return "", err
-	}
-	return string(b), nil
+	return string(b)
 }
+func strPtr(v string) *string { return &v }
 
 func (k *K8sExecutor) applyServerPodSpec(podSpec *apiv1.PodSpec, arch string) {
 	serviceAccount := "default"
@@ -692,4 +602,103 @@ func (k *K8sExecutor) applyServerPodSpec(podSpec *apiv1.PodSpec, arch string) {
 			podSpec.ImagePullSecrets = ips
 		}
 	}
+
+	if cfg.DownwardAPIEnv != nil && *cfg.DownwardAPIEnv {
+		for i := range podSpec.Containers {
+			podSpec.Containers[i].Env = append(podSpec.Containers[i].Env, downwardAPIEnvVars()...)
+		}
+	}
+}
+
+// podFailurePolicy translates the server config rules into a Job podFailurePolicy.
+// Returns nil when no rule is configured.
+func podFailurePolicy(cfg *config.PodFailurePolicy) *batchv1.PodFailurePolicy {
+	var rules []batchv1.PodFailurePolicyRule
+
+	if cfg.IgnoreDisruption != nil && *cfg.IgnoreDisruption {
+		rules = append(rules, batchv1.PodFailurePolicyRule{
+			Action: batchv1.PodFailurePolicyActionIgnore,
+			OnPodConditions: []batchv1.PodFailurePolicyOnPodConditionsPattern{
+				{Type: apiv1.DisruptionTarget, Status: apiv1.ConditionTrue},
+			},
+		})
+	}
+
+	if len(cfg.FailOnExitCodes) > 0 {
+		codes := append([]int32(nil), cfg.FailOnExitCodes...)
+		sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+		rules = append(rules, batchv1.PodFailurePolicyRule{
+			Action: batchv1.PodFailurePolicyActionFailJob,
+			OnExitCodes: &batchv1.PodFailurePolicyOnExitCodesRequirement{
+				ContainerName: strPtr("agent"),
+				Operator:      batchv1.PodFailurePolicyOnExitCodesOpIn,
+				Values:        codes,
+			},
+		})
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+	return &batchv1.PodFailurePolicy{Rules: rules}
+}
+
+// podFailurePolicySupported reports whether the cluster accepts Job podFailurePolicy
+// (enabled by default since Kubernetes 1.26). The result is cached after the first
+// successful check; a failed version request reports false and is retried on the next call.
+func (k *K8sExecutor) podFailurePolicySupported() bool {
+	k.pfpMu.Lock()
+	defer k.pfpMu.Unlock()
+
+	if k.pfpChecked {
+		return k.pfpSupported
+	}
+	info, err := k.Client.Discovery().ServerVersion()
+	if err != nil {
+		return false
+	}
+	k.pfpChecked = true
+	major, err1 := strconv.Atoi(strings.TrimRight(info.Major, "+"))
+	minor, err2 := strconv.Atoi(strings.TrimRight(info.Minor, "+"))
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	k.pfpSupported = major > 1 || (major == 1 && minor >= 26)
+	return k.pfpSupported
+}
+
+// downwardAPIEnvVars returns env vars populated from the pod's own metadata.
+func downwardAPIEnvVars() []apiv1.EnvVar {
+	fieldRef := func(name, path string) apiv1.EnvVar {
+		return apiv1.EnvVar{
+			Name: name,
+			ValueFrom: &apiv1.EnvVarSource{
+				FieldRef: &apiv1.ObjectFieldSelector{FieldPath: path},
+			},
+		}
+	}
+	return []apiv1.EnvVar{
+		fieldRef("POD_NAME", "metadata.name"),
+		fieldRef("POD_NAMESPACE", "metadata.namespace"),
+		fieldRef("NODE_NAME", "spec.nodeName"),
+	}
+}
+
+// hostAliases turns extra-hosts into pod host aliases, one per IP address, so the
+// kubelet writes them to the pod's /etc/hosts.
+func hostAliases(hosts map[string]string) []apiv1.HostAlias {
+	if len(hosts) == 0 {
+		return nil
+	}
+	byIP := map[string][]string{}
+	for host, ip := range hosts {
+		byIP[ip] = append(byIP[ip], host)
+	}
+	aliases := make([]apiv1.HostAlias, 0, len(byIP))
+	for ip, names := range byIP {
+		sort.Strings(names)
+		aliases = append(aliases, apiv1.HostAlias{IP: ip, Hostnames: names})
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].IP < aliases[j].IP })
+	return aliases
 }
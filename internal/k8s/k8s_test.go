@@ -0,0 +1,314 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func boolP(v bool) *bool { return &v }
+
+func TestDownwardAPIEnv(t *testing.T) {
+	want := map[string]string{
+		"POD_NAME":      "metadata.name",
+		"POD_NAMESPACE": "metadata.namespace",
+		"NODE_NAME":     "spec.nodeName",
+	}
+
+	tests := []struct {
+		name    string
+		cfg     *config.K8sServerConfig
+		enabled bool
+	}{
+		{"no server config", nil, false},
+		{"disabled", &config.K8sServerConfig{DownwardAPIEnv: boolP(false)}, false},
+		{"enabled", &config.K8sServerConfig{DownwardAPIEnv: boolP(true)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			k := NewK8sExecutor(client, "builds", "agent:latest", "http://controller", tt.cfg)
+			st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+
+			job, _, err := k.buildJob(st, "amd64", config.EffectiveConfig{Arch: "amd64"}, "bucket", "key", "http://ingest")
+			if err != nil {
+				t.Fatalf("buildJob: %v", err)
+			}
+			if _, err := client.BatchV1().Jobs("builds").Create(context.Background(), job, metav1.CreateOptions{}); err != nil {
+				t.Fatalf("create job: %v", err)
+			}
+
+			jobs, err := client.BatchV1().Jobs("builds").List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("list jobs: %v", err)
+			}
+			if len(jobs.Items) != 1 {
+				t.Fatalf("len(jobs) = %d, want 1", len(jobs.Items))
+			}
+
+			got := map[string]*apiv1.EnvVarSource{}
+			for _, env := range jobs.Items[0].Spec.Template.Spec.Containers[0].Env {
+				if env.ValueFrom != nil {
+					got[env.Name] = env.ValueFrom
+				}
+			}
+
+			for name, path := range want {
+				src, ok := got[name]
+				if ok != tt.enabled {
+					t.Errorf("%s present = %v, want %v", name, ok, tt.enabled)
+					continue
+				}
+				if ok && (src.FieldRef == nil || src.FieldRef.FieldPath != path) {
+					t.Errorf("%s fieldRef = %+v, want fieldPath %q", name, src.FieldRef, path)
+				}
+			}
+		})
+	}
+}
+
+func TestPodFailurePolicy(t *testing.T) {
+	t.Run("no rules", func(t *testing.T) {
+		if got := podFailurePolicy(&config.PodFailurePolicy{IgnoreDisruption: boolP(false)}); got != nil {
+			t.Errorf("podFailurePolicy = %+v, want nil", got)
+		}
+	})
+
+	t.Run("ignore disruption and fail on exit codes", func(t *testing.T) {
+		got := podFailurePolicy(&config.PodFailurePolicy{
+			IgnoreDisruption: boolP(true),
+			FailOnExitCodes:  []int32{2, 1},
+		})
+		if got == nil || len(got.Rules) != 2 {
+			t.Fatalf("rules = %+v, want 2 rules", got)
+		}
+
+		ignore := got.Rules[0]
+		if ignore.Action != batchv1.PodFailurePolicyActionIgnore {
+			t.Errorf("rules[0].Action = %q, want Ignore", ignore.Action)
+		}
+		if len(ignore.OnPodConditions) != 1 ||
+			ignore.OnPodConditions[0].Type != apiv1.DisruptionTarget ||
+			ignore.OnPodConditions[0].Status != apiv1.ConditionTrue {
+			t.Errorf("rules[0].OnPodConditions = %+v, want DisruptionTarget=True", ignore.OnPodConditions)
+		}
+
+		fail := got.Rules[1]
+		if fail.Action != batchv1.PodFailurePolicyActionFailJob {
+			t.Errorf("rules[1].Action = %q, want FailJob", fail.Action)
+		}
+		if fail.OnExitCodes == nil {
+			t.Fatal("rules[1].OnExitCodes = nil")
+		}
+		if fail.OnExitCodes.Operator != batchv1.PodFailurePolicyOnExitCodesOpIn {
+			t.Errorf("operator = %q, want In", fail.OnExitCodes.Operator)
+		}
+		if fail.OnExitCodes.ContainerName == nil || *fail.OnExitCodes.ContainerName != "agent" {
+			t.Errorf("containerName = %v, want agent", fail.OnExitCodes.ContainerName)
+		}
+		if len(fail.OnExitCodes.Values) != 2 || fail.OnExitCodes.Values[0] != 1 || fail.OnExitCodes.Values[1] != 2 {
+			t.Errorf("values = %v, want [1 2]", fail.OnExitCodes.Values)
+		}
+	})
+}
+
+func TestPodFailurePolicySupportedRetriesOnError(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	disco := client.Discovery().(*fakediscovery.FakeDiscovery)
+	disco.FakedServerVersion = &version.Info{Major: "1", Minor: "29"}
+	fail := true
+	client.PrependReactor("get", "version", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if fail {
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+
+	k := NewK8sExecutor(client, "builds", "agent:latest", "http://controller", nil)
+	if k.podFailurePolicySupported() {
+		t.Fatal("supported after a failed version request")
+	}
+	fail = false
+	if !k.podFailurePolicySupported() {
+		t.Fatal("not supported on 1.29 after the version request recovered")
+	}
+	fail = true
+	if !k.podFailurePolicySupported() {
+		t.Error("a later failure discarded the cached result")
+	}
+}
+
+func TestMirrorDestinations(t *testing.T) {
+	tests := []struct {
+		name         string
+		isSingleArch bool
+		sep          string
+		wantDest     string
+		wantMirrors  string
+	}{
+		{"single arch", true, "", "registry.example.com/app:1.0", "mirror.example.com/app:1.0,mirror2.example.com/app"},
+		{"multi arch", false, "", "registry.example.com/app:1.0_arm64", "mirror.example.com/app:1.0_arm64,mirror2.example.com/app:latest_arm64"},
+		{"multi arch with separator", false, "-", "registry.example.com/app:1.0-arm64", "mirror.example.com/app:1.0-arm64,mirror2.example.com/app:latest-arm64"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ef := config.EffectiveConfig{
+				Arch:             "arm64",
+				Mirrors:          []string{"mirror.example.com/app:1.0", "mirror2.example.com/app"},
+				ArchTagSeparator: tt.sep,
+			}
+			k := NewK8sExecutor(fake.NewSimpleClientset(), "builds", "agent:latest", "http://controller", nil)
+			st := state.NewBuildState("b-test", 2, tt.isSingleArch, "registry.example.com/app:1.0")
+
+			job, _, err := k.buildJob(st, "arm64", ef, "bucket", "key", "http://ingest")
+			if err != nil {
+				t.Fatalf("buildJob: %v", err)
+			}
+
+			env := map[string]string{}
+			for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+				env[e.Name] = e.Value
+			}
+			if env["KANIKO_DESTINATION"] != tt.wantDest {
+				t.Errorf("KANIKO_DESTINATION = %q, want %q", env["KANIKO_DESTINATION"], tt.wantDest)
+			}
+			if env["KANIKO_MIRRORS"] != tt.wantMirrors {
+				t.Errorf("KANIKO_MIRRORS = %q, want %q", env["KANIKO_MIRRORS"], tt.wantMirrors)
+			}
+		})
+	}
+}
+
+func TestExtraHosts(t *testing.T) {
+	k := NewK8sExecutor(fake.NewSimpleClientset(), "builds", "agent:latest", "http://controller", nil)
+	st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+	ef := config.EffectiveConfig{
+		Arch: "amd64",
+		ExtraHosts: map[string]string{
+			"git.internal":    "10.0.0.5",
+			"api.internal":    "10.0.0.6",
+			"mirror.internal": "10.0.0.5",
+		},
+	}
+
+	job, _, err := k.buildJob(st, "amd64", ef, "bucket", "key", "http://ingest")
+	if err != nil {
+		t.Fatalf("buildJob: %v", err)
+	}
+
+	pod := job.Spec.Template.Spec
+	want := []apiv1.HostAlias{
+		{IP: "10.0.0.5", Hostnames: []string{"git.internal", "mirror.internal"}},
+		{IP: "10.0.0.6", Hostnames: []string{"api.internal"}},
+	}
+	if !reflect.DeepEqual(pod.HostAliases, want) {
+		t.Errorf("HostAliases = %+v, want %+v", pod.HostAliases, want)
+	}
+
+	var env string
+	for _, e := range pod.Containers[0].Env {
+		if e.Name == "EXTRA_HOSTS" {
+			env = e.Value
+		}
+	}
+	if want := "api.internal=10.0.0.6,git.internal=10.0.0.5,mirror.internal=10.0.0.5"; env != want {
+		t.Errorf("EXTRA_HOSTS = %q, want %q", env, want)
+	}
+}
+
+func TestRunTaskCredentialsSecret(t *testing.T) {
+	t.Setenv("S3_SECRET_KEY", "storage-secret")
+
+	client := fake.NewSimpleClientset()
+	k := NewK8sExecutor(client, "builds", "agent:latest", "http://controller", nil)
+	st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+	ef := config.EffectiveConfig{Arch: "amd64", DockerConfigJSON: `{"auths":{}}`}
+
+	// The context is already canceled, so RunTask returns once the job is created.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = k.RunTask(ctx, st, "amd64", ef, "bucket", "key", "http://ingest")
+
+	secrets, err := client.CoreV1().Secrets("builds").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets.Items) != 1 {
+		t.Fatalf("len(secrets) = %d, want 1", len(secrets.Items))
+	}
+	secret := secrets.Items[0]
+	want := map[string]string{"STORAGE_SECRET_KEY": "storage-secret", "KANIKO_CREDENTIALS_JSON": `{"auths":{}}`}
+	if !reflect.DeepEqual(secret.StringData, want) {
+		t.Errorf("secret data = %v, want %v", secret.StringData, want)
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].Kind != "Job" {
+		t.Errorf("secret owners = %+v, want the job", secret.OwnerReferences)
+	}
+
+	jobs, err := client.BatchV1().Jobs("builds").List(context.Background(), metav1.ListOptions{})
+	if err != nil || len(jobs.Items) != 1 {
+		t.Fatalf("list jobs = %d, %v; want 1 job", len(jobs.Items), err)
+	}
+	for _, env := range jobs.Items[0].Spec.Template.Spec.Containers[0].Env {
+		if _, ok := want[env.Name]; !ok {
+			continue
+		}
+		if env.Value != "" {
+			t.Errorf("%s is set as a plain value", env.Name)
+		}
+		if ref := env.ValueFrom; ref == nil || ref.SecretKeyRef == nil || ref.SecretKeyRef.Name != secret.Name || ref.SecretKeyRef.Key != env.Name {
+			t.Errorf("%s valueFrom = %+v, want key %s of secret %s", env.Name, ref, env.Name, secret.Name)
+		}
+		delete(want, env.Name)
+	}
+	if len(want) > 0 {
+		t.Errorf("env has no reference to %v", want)
+	}
+}
+
+func TestCancelTask(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	// The fake clientset does not generate names, so the job gets one here.
+	client.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8stesting.CreateAction).GetObject().(*batchv1.Job)
+		job.Name = job.GenerateName + "x1y2z"
+		return false, nil, nil
+	})
+	k := NewK8sExecutor(client, "builds", "agent:latest", "http://controller", nil)
+	st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = k.RunTask(ctx, st, "amd64", config.EffectiveConfig{Arch: "amd64"}, "bucket", "key", "http://ingest")
+
+	if err := k.CancelTask(context.Background(), st, "amd64"); err != nil {
+		t.Fatalf("CancelTask: %v", err)
+	}
+	jobs, err := client.BatchV1().Jobs("builds").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 0 {
+		t.Errorf("len(jobs) = %d, want the job deleted", len(jobs.Items))
+	}
+
+	// The job is already gone, so canceling again is not an error.
+	if err := k.CancelTask(context.Background(), st, "amd64"); err != nil {
+		t.Errorf("CancelTask of a deleted job: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rayshoo/bakery/internal/agentapi"
+	"github.com/rayshoo/bakery/internal/agentenv"
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+// LocalExecutor runs the agent in a local Docker or podman container.
+// It is meant for development and CI; the build context is fetched from the
+// configured S3 endpoint, typically a local MinIO.
+type LocalExecutor struct {
+	Runtime       string
+	AgentImage    string
+	ControllerURL string
+	Network       string
+}
+
+// NewLocalExecutor creates a new LocalExecutor instance.
+// runtime is the container CLI to invoke, e.g. "docker" or "podman".
+func NewLocalExecutor(runtime, agentImage, controllerURL, network string) *LocalExecutor {
+	if runtime == "" {
+		runtime = "docker"
+	}
+	return &LocalExecutor{
+		Runtime:       runtime,
+		AgentImage:    agentImage,
+		ControllerURL: controllerURL,
+		Network:       network,
+	}
+}
+
+// RunTask runs the agent container and waits for it to exit.
+func (l *LocalExecutor) RunTask(
+	ctx context.Context,
+	st *state.BuildState,
+	taskID string,
+	ef config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	ingestURL string,
+) error {
+	if ef.Arch == "" {
+		return errors.New("LocalExecutor.RunTask: missing arch")
+	}
+
+	env, err := l.agentEnv(st, taskID, ef, contextBucket, contextKey, ingestURL)
+	if err != nil {
+		return err
+	}
+
+	name := containerName(st.ID, taskID)
+	args := l.runArgs(name, ef.Arch, env)
+
+	st.Mu.Lock()
+	st.TaskArnByID[taskID] = name
+	st.IDByTaskArn[name] = taskID
+	st.Mu.Unlock()
+
+	st.AppendLog("info", fmt.Sprintf("[local][%s] starting container: %s (%s)", taskID, name, l.Runtime))
+
+	// Values are passed through the CLI's environment so secrets never appear in argv.
+	// The CLI gets only the host variables it needs, not the Server's own credentials.
+	cmd := exec.Command(l.Runtime, args...)
+	cmd.Env = runtimeEnv(os.Environ())
+	for _, kv := range env {
+		cmd.Env = append(cmd.Env, kv[0]+"="+kv[1])
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("[local] start %s: %w", l.Runtime, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// CancelTask removes the container, which ends the run command.
+		return fmt.Errorf("local container wait cancelled: %w", ctx.Err())
+	}
+
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return fmt.Errorf("[local] run %s: %w", l.Runtime, err)
+		}
+		taskErr := fmt.Errorf("agent exit=%d (%s)", exitErr.ExitCode(), agentapi.ExitPhase(exitErr.ExitCode()))
+		st.SetTaskError(taskID, taskErr)
+		st.AppendLog("error", fmt.Sprintf("[local][%s] %v: %s", taskID, taskErr, lastLines(output.String(), 5)))
+		return taskErr
+	}
+
+	st.AppendLog("info", fmt.Sprintf("[local][%s] exit=0 success", taskID))
+	return nil
+}
+
+// Probe runs the container CLI's version command, which fails when the CLI is
+// missing or cannot reach its daemon.
+func (l *LocalExecutor) Probe(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, l.Runtime, "version")
+	cmd.Env = runtimeEnv(os.Environ())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("[local] %s version: %w: %s", l.Runtime, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// CancelTask removes the container of taskID, if it was started.
+func (l *LocalExecutor) CancelTask(ctx context.Context, st *state.BuildState, taskID string) error {
+	name := st.TaskArn(taskID)
+	if name == "" {
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, l.Runtime, "rm", "-f", name)
+	cmd.Env = runtimeEnv(os.Environ())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("[local] %s rm %s: %w: %s", l.Runtime, name, err, strings.TrimSpace(string(out)))
+	}
+	st.AppendLog("info", fmt.Sprintf("[local][%s] removed container: %s", taskID, name))
+	return nil
+}
+
+func (l *LocalExecutor) runArgs(name, arch string, env [][2]string) []string {
+	args := []string{"run", "--rm", "--name", name, "--platform", "linux/" + arch}
+	if l.Network != "" {
+		args = append(args, "--network", l.Network)
+	}
+	for _, kv := range env {
+		args = append(args, "-e", kv[0])
+	}
+	return append(args, l.AgentImage)
+}
+
+// runtimeEnvNames are the host variables the container CLI is started with, along
+// with those starting with one of runtimeEnvPrefixes.
+var runtimeEnvNames = map[string]bool{
+	"PATH":            true,
+	"HOME":            true,
+	"TMPDIR":          true,
+	"XDG_RUNTIME_DIR": true,
+	"XDG_CONFIG_HOME": true,
+	"XDG_DATA_HOME":   true,
+}
+
+var runtimeEnvPrefixes = []string{"DOCKER_", "CONTAINER_", "CONTAINERS_"}
+
+// runtimeEnv returns the entries of environ the container CLI needs to reach its
+// daemon, e.g. PATH, HOME and DOCKER_HOST.
+func runtimeEnv(environ []string) []string {
+	var env []string
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if runtimeEnvNames[name] {
+			env = append(env, kv)
+			continue
+		}
+		for _, prefix := range runtimeEnvPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	return env
+}
+
+func (l *LocalExecutor) agentEnv(
+	st *state.BuildState,
+	taskID string,
+	ef config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	ingestURL string,
+) ([][2]string, error) {
+	vars, err := agentenv.Build(st, taskID, ef, agentenv.Task{
+		Platform:      "local",
+		ControllerURL: l.ControllerURL,
+		IngestURL:     ingestURL,
+		ContextBucket: contextBucket,
+		ContextKey:    contextKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	env := make([][2]string, 0, len(vars))
+	for _, v := range vars {
+		env = append(env, [2]string{v.Name, v.Value})
+	}
+	return env, nil
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, " | ")
+}
+
+// containerName builds a container name unique to the task.
+func containerName(buildID, taskID string) string {
+	suffix := make([]byte, 3)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("bakery-%s-%s-%s", buildID, taskID, hex.EncodeToString(suffix))
+}
@@ -0,0 +1,120 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+// fakeRuntime writes a script that records its arguments and its BUILD_ID,
+// STORAGE_SECRET_KEY, S3_SECRET_KEY and DOCKER_HOST env, then exits with exit.
+func fakeRuntime(t *testing.T, exit int) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "docker")
+	body := fmt.Sprintf("#!/bin/sh\nout=%q\nprintf '%%s\\n' \"$@\" > \"$out\"\n", out)
+	for _, name := range []string{"BUILD_ID", "STORAGE_SECRET_KEY", "S3_SECRET_KEY", "DOCKER_HOST"} {
+		body += fmt.Sprintf("echo \"%s=$%s\" >> \"$out\"\n", name, name)
+	}
+	body += fmt.Sprintf("echo boom\nexit %d\n", exit)
+	if err := os.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	return script, out
+}
+
+func TestRunTask(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		runtime, out := fakeRuntime(t, 0)
+		t.Setenv("S3_SECRET_KEY", "s3cret")
+		t.Setenv("DOCKER_HOST", "unix:///run/docker.sock")
+
+		l := NewLocalExecutor(runtime, "agent:latest", "http://controller", "host")
+		st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+		if err := l.RunTask(context.Background(), st, "arm64", config.EffectiveConfig{Arch: "arm64"}, "bucket", "key", "http://ingest"); err != nil {
+			t.Fatalf("RunTask: %v", err)
+		}
+
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatalf("read output: %v", err)
+		}
+		got := string(data)
+
+		for _, want := range []string{"run\n--rm\n", "--platform\nlinux/arm64\n", "--network\nhost\n", "-e\nBUILD_ID\n", "agent:latest\n", "BUILD_ID=b-test\n", "STORAGE_SECRET_KEY=s3cret\n", "S3_SECRET_KEY=\n", "DOCKER_HOST=unix:///run/docker.sock\n"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("runtime invocation missing %q:\n%s", want, got)
+			}
+		}
+		if strings.Count(got, "s3cret") != 1 {
+			t.Errorf("secret value leaked into arguments:\n%s", got)
+		}
+	})
+
+	t.Run("non-zero exit", func(t *testing.T) {
+		runtime, _ := fakeRuntime(t, 12)
+
+		l := NewLocalExecutor(runtime, "agent:latest", "http://controller", "")
+		st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+		err := l.RunTask(context.Background(), st, "amd64", config.EffectiveConfig{Arch: "amd64"}, "bucket", "key", "http://ingest")
+		if err == nil || err.Error() != "agent exit=12 (kaniko)" {
+			t.Errorf("RunTask error = %v, want agent exit=12 (kaniko)", err)
+		}
+		if !st.HasError() {
+			t.Error("build state has no error")
+		}
+	})
+}
+
+func TestCancelTask(t *testing.T) {
+	runtime, out := fakeRuntime(t, 0)
+	l := NewLocalExecutor(runtime, "agent:latest", "http://controller", "")
+	st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+
+	if err := l.CancelTask(context.Background(), st, "amd64"); err != nil {
+		t.Fatalf("CancelTask before start: %v", err)
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Fatal("runtime invoked for a task that never started")
+	}
+
+	st.TaskArnByID["amd64"] = "bakery-b-test-amd64-abc123"
+	if err := l.CancelTask(context.Background(), st, "amd64"); err != nil {
+		t.Fatalf("CancelTask: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "rm\n-f\nbakery-b-test-amd64-abc123\n") {
+		t.Errorf("runtime invocation = %q, want rm -f of the container", data)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	runtime, out := fakeRuntime(t, 0)
+	l := NewLocalExecutor(runtime, "agent:latest", "http://controller", "")
+	if err := l.Probe(context.Background()); err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "version\n") {
+		t.Errorf("runtime invocation = %q, want version", data)
+	}
+
+	failing, _ := fakeRuntime(t, 1)
+	l = NewLocalExecutor(failing, "agent:latest", "http://controller", "")
+	if err := l.Probe(context.Background()); err == nil {
+		t.Error("Probe with a failing runtime: want error")
+	}
+}
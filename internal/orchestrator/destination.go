@@ -0,0 +1,193 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+// ErrInvalidDestination is returned when a destination template cannot be expanded.
+var ErrInvalidDestination = errors.New("invalid destination")
+
+// destinationVars holds the build metadata substituted into destination templates.
+type destinationVars struct {
+	BuildID string
+	Service string
+	Date    string
+}
+
+func newDestinationVars(buildID, serviceName string, now time.Time) destinationVars {
+	return destinationVars{
+		BuildID: buildID,
+		Service: sanitizeServiceName(serviceName, maxLabelValueLength),
+		Date:    now.UTC().Format("20060102"),
+	}
+}
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// archPlaceholderPattern matches {arch} together with one separator next to it, which
+// is dropped along with the placeholder in the multi-arch manifest destination.
+var archPlaceholderPattern = regexp.MustCompile(`\{arch\}[-_.]|[-_.]\{arch\}|\{arch\}`)
+
+// hasArchPlaceholder reports whether dest gives every arch its own tag.
+func hasArchPlaceholder(dest string) bool {
+	return strings.Contains(dest, "{arch}")
+}
+
+// tagEnvPrefix is the prefix of the Server env vars that {env:VAR} may read. Destinations
+// come from clients, so any other name is rejected rather than exposing the Server's secrets.
+const tagEnvPrefix = "BAKERY_TAG_"
+
+// expandDestination replaces the {arch}, {build-id}, {date}, {service} and {env:VAR}
+// placeholders in dest, where VAR must start with tagEnvPrefix. With an empty arch,
+// {arch} is removed with an adjacent separator, giving the tag of the multi-arch
+// manifest; a tag left empty is dropped so the manifest goes to latest.
+func expandDestination(dest, arch string, vars destinationVars) (string, error) {
+	if !strings.Contains(dest, "{") {
+		return dest, nil
+	}
+	if arch == "" {
+		dest = strings.TrimSuffix(archPlaceholderPattern.ReplaceAllString(dest, ""), ":")
+	}
+
+	var expandErr error
+	out := placeholderPattern.ReplaceAllStringFunc(dest, func(p string) string {
+		name := p[1 : len(p)-1]
+		switch {
+		case name == "arch":
+			return arch
+		case name == "build-id":
+			return vars.BuildID
+		case name == "date":
+			return vars.Date
+		case name == "service":
+			return vars.Service
+		case strings.HasPrefix(name, "env:"):
+			key := strings.TrimPrefix(name, "env:")
+			if !strings.HasPrefix(key, tagEnvPrefix) {
+				if expandErr == nil {
+					expandErr = fmt.Errorf("%w %q: env %s does not start with %s", ErrInvalidDestination, dest, key, tagEnvPrefix)
+				}
+				return p
+			}
+			v, ok := os.LookupEnv(key)
+			if !ok && expandErr == nil {
+				expandErr = fmt.Errorf("%w %q: env %s is not set", ErrInvalidDestination, dest, key)
+			}
+			return v
+		default:
+			if expandErr == nil {
+				expandErr = fmt.Errorf("%w %q: unknown placeholder %s", ErrInvalidDestination, dest, p)
+			}
+			return p
+		}
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	if strings.ContainsAny(out, "{}") {
+		return "", fmt.Errorf("%w %q: unbalanced braces", ErrInvalidDestination, dest)
+	}
+	return out, nil
+}
+
+// expandDestinations expands the destination templates of every task in list and
+// returns the expanded global destination that multi-arch manifests are created at.
+// A task whose destination contains {arch} gets its own resolved destination, which
+// bypasses the executors' automatic _arch suffix; other destinations keep it.
+func expandDestinations(list []config.EffectiveConfig, global string, vars destinationVars) (string, error) {
+	expandedGlobal, err := expandDestination(global, "", vars)
+	if err != nil {
+		return "", err
+	}
+
+	for i := range list {
+		ef := &list[i]
+
+		dest := ef.Destination
+		if dest == "" && hasArchPlaceholder(global) {
+			dest = global
+		}
+		if dest != "" {
+			if ef.Destination, err = expandDestination(dest, ef.Arch, vars); err != nil {
+				return "", err
+			}
+		}
+
+		for j, m := range ef.Mirrors {
+			if ef.Mirrors[j], err = expandDestination(m, ef.Arch, vars); err != nil {
+				return "", err
+			}
+		}
+
+		if ef.CacheRepo != "" {
+			if ef.CacheRepo, err = expandDestination(ef.CacheRepo, ef.Arch, vars); err != nil {
+				return "", err
+			}
+		}
+	}
+	return expandedGlobal, nil
+}
+
+// expandManifestTags expands the placeholders in tags and returns the references they
+// are written at: each tag on the repository of the expanded global destination.
+func expandManifestTags(destination string, tags []string, vars destinationVars) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	if destination == "" {
+		return nil, fmt.Errorf("%w: manifest-tags require a global destination", ErrInvalidDestination)
+	}
+
+	repo := config.ImageRepository(destination)
+	refs := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		expanded, err := expandDestination(tag, "", vars)
+		if err != nil {
+			return nil, err
+		}
+		if expanded == "" || strings.ContainsAny(expanded, ":/@") {
+			return nil, fmt.Errorf("%w: invalid manifest tag %q", ErrInvalidDestination, tag)
+		}
+		refs = append(refs, repo+":"+expanded)
+	}
+	return refs, nil
+}
+
+// checkDestinations rejects a build in which two pushing tasks resolve to the same
+// destination or mirror, where the last push would silently win, e.g. two tasks
+// without their own destination under manifest: none.
+func checkDestinations(list []config.EffectiveConfig, global string, manifest manifestSpec) error {
+	taskIDs, hasDuplicateArch := assignTaskIDs(list)
+	// TaskDestinations only reads these fields of the build state.
+	st := &state.BuildState{
+		IsSingleArch:      isSingleArch(list, manifest),
+		GlobalDestination: global,
+		HasDuplicateArch:  hasDuplicateArch,
+	}
+
+	pushedBy := make(map[string]string)
+	for i, ef := range list {
+		if isNoPush(ef) {
+			continue
+		}
+		dest, mirrors := st.TaskDestinations(taskIDs[i], ef)
+		for _, ref := range append([]string{dest}, mirrors...) {
+			if ref == "" {
+				continue
+			}
+			if other, ok := pushedBy[ref]; ok && other != taskIDs[i] {
+				return fmt.Errorf("%w: tasks %s and %s both push to %s", ErrInvalidDestination, other, taskIDs[i], ref)
+			}
+			pushedBy[ref] = taskIDs[i]
+		}
+	}
+	return nil
+}
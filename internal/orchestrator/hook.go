@@ -0,0 +1,103 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+// defaultPostBuildHookTimeout bounds a post-build hook when no timeout is configured.
+const defaultPostBuildHookTimeout = 10 * time.Second
+
+// PostBuildHook is run by the controller once per build, after the manifest step and
+// before the build finishes. Unlike the agent's post-script it runs a single time
+// for all arches. Failures are logged and never fail the build.
+type PostBuildHook interface {
+	Run(ctx context.Context, ev BuildEvent) error
+}
+
+// BuildEvent describes a finished build to a PostBuildHook.
+type BuildEvent struct {
+	BuildID        string                      `json:"buildID"`
+	Service        string                      `json:"service,omitempty"`
+	Status         string                      `json:"status"`
+	Error          string                      `json:"error,omitempty"`
+	Destination    string                      `json:"destination,omitempty"`
+	ManifestDigest string                      `json:"manifestDigest,omitempty"`
+	Tasks          map[string]state.TaskResult `json:"tasks"`
+}
+
+// WebhookHook posts the BuildEvent as JSON to URL. Any non-2xx response is an error.
+type WebhookHook struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h *WebhookHook) Run(ctx context.Context, ev BuildEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// runPostBuildHook invokes the configured hook for st, logging the outcome to the build.
+func (o *Orchestrator) runPostBuildHook(st *state.BuildState, serviceName, destination string) {
+	if o.postBuildHook == nil {
+		return
+	}
+
+	sum := st.Summary()
+	ev := BuildEvent{
+		BuildID:        st.ID,
+		Service:        serviceName,
+		Status:         "succeeded",
+		Destination:    destination,
+		ManifestDigest: sum.ManifestDigest,
+		Tasks:          sum.Tasks,
+	}
+	if err := st.GetError(); err != nil {
+		ev.Status = "failed"
+		ev.Error = err.Error()
+	}
+
+	timeout := o.postBuildHookTimeout
+	if timeout <= 0 {
+		timeout = defaultPostBuildHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := o.postBuildHook.Run(ctx, ev); err != nil {
+		st.AppendLog("warn", fmt.Sprintf("post-build hook failed: %v", err))
+		return
+	}
+	st.AppendLog("info", "post-build hook completed")
+}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/rayshoo/bakery/internal/config"
-	"github.com/rayshoo/bakery/internal/ecs"
 	"github.com/rayshoo/bakery/internal/registry"
 	"github.com/rayshoo/bakery/internal/state"
 
@@ -28,26 +31,51 @@ type Executor interface {
 		contextKey string,
 		ingestURL string,
 	) error
+
+	// CancelTask stops the remote work of the task taskID. It is called once RunTask
+	// has returned because the task's context was canceled, e.g. by a purge, FAIL_FAST
+	// or a timeout, and does nothing for a task that never started.
+	CancelTask(ctx context.Context, st *state.BuildState, taskID string) error
+}
+
+// CredentialResolver resolves kaniko credentials that reference an external secret.
+type CredentialResolver interface {
+	ResolveCredentials(ctx context.Context, creds []config.RegistryCredential) ([]config.RegistryCredential, error)
 }
 
 type Deps struct {
 	Store         *state.Store
-	ECS           Executor
-	K8S           Executor
+	Executors     *Registry
+	Credentials   CredentialResolver
 	ControllerURL string
 	S3Endpoint    string
 	S3Bucket      string
 	S3Region      string
 	S3PathStyle   bool
+
+	// PostBuildHook, when set, runs once per build after the manifest step,
+	// bounded by PostBuildHookTimeout.
+	PostBuildHook        PostBuildHook
+	PostBuildHookTimeout time.Duration
+
+	// Reports, when set, receives a report of every finished build in S3Bucket.
+	Reports ReportStore
 }
 
 // Orchestrator distributes build tasks across executors and collects results.
 type Orchestrator struct {
 	store         *state.Store
-	ecs           Executor
-	k8s           Executor
+	executors     *Registry
+	credentials   CredentialResolver
 	controllerURL string
 
+	postBuildHook        PostBuildHook
+	postBuildHookTimeout time.Duration
+
+	reports ReportStore
+
+	queue *buildQueue
+
 	S3Endpoint  string
 	S3Bucket    string
 	S3Region    string
@@ -57,16 +85,29 @@ type Orchestrator struct {
 func New(d Deps) *Orchestrator {
 	return &Orchestrator{
 		store:         d.Store,
-		ecs:           d.ECS,
-		k8s:           d.K8S,
+		executors:     d.Executors,
+		credentials:   d.Credentials,
 		controllerURL: d.ControllerURL,
 		S3Endpoint:    d.S3Endpoint,
 		S3Bucket:      d.S3Bucket,
 		S3Region:      d.S3Region,
 		S3PathStyle:   d.S3PathStyle,
+
+		postBuildHook:        d.PostBuildHook,
+		postBuildHookTimeout: d.PostBuildHookTimeout,
+
+		reports: d.Reports,
+
+		queue: newBuildQueue(getenvInt("MAX_CONCURRENT_BUILDS", 0)),
 	}
 }
 
+// QueuePosition returns the place of buildID among the builds waiting for a
+// MAX_CONCURRENT_BUILDS slot, starting at 1, or 0 when it is not waiting.
+func (o *Orchestrator) QueuePosition(buildID string) int {
+	return o.queue.position(buildID)
+}
+
 // StartBuild accepts a build request, starts tasks, and returns a BuildState.
 func (o *Orchestrator) StartBuild(
 	yamlBytes []byte,
@@ -74,6 +115,28 @@ func (o *Orchestrator) StartBuild(
 	contextKey string,
 	serviceName string,
 ) (string, *state.BuildState, error) {
+	return o.startBuildRequest(yamlBytes, contextBucket, contextKey, serviceName, false)
+}
+
+// StartBuildNoWait is StartBuild for callers that do not wait for the build. Only the
+// config is validated before it returns; registry credentials are resolved and tasks
+// dispatched in the background, and a failure there fails the build instead of the call.
+func (o *Orchestrator) StartBuildNoWait(
+	yamlBytes []byte,
+	contextBucket string,
+	contextKey string,
+	serviceName string,
+) (string, *state.BuildState, error) {
+	return o.startBuildRequest(yamlBytes, contextBucket, contextKey, serviceName, true)
+}
+
+func (o *Orchestrator) startBuildRequest(
+	yamlBytes []byte,
+	contextBucket string,
+	contextKey string,
+	serviceName string,
+	noWait bool,
+) (string, *state.BuildState, error) {
 
 	var cfg config.BuildConfig
 	if err := config.UnmarshalYAML(yamlBytes, &cfg); err != nil {
@@ -84,52 +147,355 @@ func (o *Orchestrator) StartBuild(
 	if err != nil {
 		return "", nil, fmt.Errorf("invalid yaml config: %w", err)
 	}
+	if err := checkArchLimit(effectiveList); err != nil {
+		return "", nil, err
+	}
 
-	var pushTasks []config.EffectiveConfig
-	for _, ef := range effectiveList {
-		if ef.NoPush == nil || !*ef.NoPush {
-			pushTasks = append(pushTasks, ef)
-		}
+	applyBuildArgPassthrough(effectiveList)
+
+	var prepare func() error
+	if noWait {
+		prepare = func() error { return o.resolveCredentials(effectiveList) }
+	} else if err := o.resolveCredentials(effectiveList); err != nil {
+		return "", nil, err
 	}
 
-	taskCount := len(effectiveList)
 	buildID := generateBuildID(serviceName)
+	applyBuildLabels(effectiveList, cfg.Global.Kaniko, buildID)
+	vars := newDestinationVars(buildID, serviceName, time.Now())
+	globalDestination, err := expandDestinations(effectiveList, cfg.Global.Kaniko.CanonicalDestination(), vars)
+	if err != nil {
+		return "", nil, err
+	}
+	manifest, err := newManifestSpec(cfg.Global.Kaniko, globalDestination, vars)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := checkDestinations(effectiveList, globalDestination, manifest); err != nil {
+		return "", nil, err
+	}
+
+	st := o.startBuild(buildID, globalDestination, manifest, effectiveList, contextBucket, contextKey, serviceName, nil, prepare)
+	return buildID, st, nil
+}
+
+// StartBatch starts one child build per service against a shared build context.
+// It returns the ID of a parent build that aggregates the children's logs and
+// finishes once every child has finished, along with the child build IDs keyed by service name.
+func (o *Orchestrator) StartBatch(
+	yamlBytes []byte,
+	contextBucket string,
+	contextKey string,
+) (string, map[string]string, error) {
 
-	archCount := make(map[string]int)
-	for _, ef := range pushTasks {
-		archCount[ef.Arch]++
+	var batch config.BatchConfig
+	if err := config.UnmarshalBatchYAML(yamlBytes, &batch); err != nil {
+		return "", nil, fmt.Errorf("parse yaml: %w", err)
 	}
 
-	hasDuplicateArch := false
-	for _, count := range archCount {
-		if count > 1 {
-			hasDuplicateArch = true
-			break
+	effectiveLists := make([][]config.EffectiveConfig, len(batch.Services))
+	buildIDs := make([]string, len(batch.Services))
+	destinations := make([]string, len(batch.Services))
+	manifests := make([]manifestSpec, len(batch.Services))
+	for i, svc := range batch.Services {
+		list, err := config.BuildEffectiveList(&svc.Config)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid yaml config for service %s: %w", svc.Name, err)
+		}
+		if err := checkArchLimit(list); err != nil {
+			return "", nil, fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		applyBuildArgPassthrough(list)
+		if err := o.resolveCredentials(list); err != nil {
+			return "", nil, fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		name := strings.TrimSpace(svc.Name)
+		buildIDs[i] = generateBuildID(name)
+		applyBuildLabels(list, svc.Config.Global.Kaniko, buildIDs[i])
+		vars := newDestinationVars(buildIDs[i], name, time.Now())
+		dest, err := expandDestinations(list, svc.Config.Global.Kaniko.CanonicalDestination(), vars)
+		if err != nil {
+			return "", nil, fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		manifest, err := newManifestSpec(svc.Config.Global.Kaniko, dest, vars)
+		if err != nil {
+			return "", nil, fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		if err := checkDestinations(list, dest, manifest); err != nil {
+			return "", nil, fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		effectiveLists[i] = list
+		destinations[i] = dest
+		manifests[i] = manifest
+	}
+
+	batchID := generateBuildID("batch")
+	parent := state.NewBuildState(batchID, len(batch.Services), false, "")
+	o.store.Register(batchID, parent)
+
+	parent.AppendLog("info", fmt.Sprintf("batch accepted by orchestrator: %d services", len(batch.Services)))
+
+	childIDs := make(map[string]string, len(batch.Services))
+	children := make(map[string]*state.BuildState, len(batch.Services))
+
+	for i, svc := range batch.Services {
+		name := strings.TrimSpace(svc.Name)
+		childID := buildIDs[i]
+		child := o.startBuild(childID, destinations[i], manifests[i], effectiveLists[i], contextBucket, contextKey, name, parent, nil)
+		childIDs[name] = childID
+		children[name] = child
+
+		parent.AddChild(name, childID)
+
+		parent.AppendLog("info", fmt.Sprintf("[batch] service %s -> build %s", name, childID))
+	}
+
+	go func() {
+		for name, child := range children {
+			<-child.Done
+
+			if err := child.GetError(); err != nil {
+				parent.SetResult(name, "", "", false, err.Error())
+			} else {
+				parent.SetResult(name, "", "", true, "")
+			}
+		}
+
+		o.finishBuild(parent, "", "", nil, nil)
+	}()
+
+	return batchID, childIDs, nil
+}
+
+// applyBuildArgPassthrough injects the controller env vars named in the comma-separated
+// BUILD_ARG_PASSTHROUGH allowlist as build args. Explicit build-args take precedence.
+func applyBuildArgPassthrough(list []config.EffectiveConfig) {
+	for _, name := range strings.Split(os.Getenv("BUILD_ARG_PASSTHROUGH"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		for i := range list {
+			if _, exists := list[i].BuildArgs[name]; exists {
+				continue
+			}
+			if list[i].BuildArgs == nil {
+				list[i].BuildArgs = map[string]string{}
+			}
+			list[i].BuildArgs[name] = value
 		}
 	}
+}
 
-	isSingleArch := len(pushTasks) <= 1
-	globalDestination := cfg.Global.Kaniko.Destination
+// Image labels added by auto-label-build-id.
+const (
+	buildIDLabel  = "org.bakery.build-id"
+	revisionLabel = "org.opencontainers.image.revision"
+)
 
-	st := state.NewBuildState(buildID, taskCount, isSingleArch, globalDestination)
+// applyBuildLabels labels every task's image with buildID and the configured revision
+// when auto-label-build-id is set. Explicit labels take precedence.
+func applyBuildLabels(list []config.EffectiveConfig, k config.KanikoConfig, buildID string) {
+	if !k.AutoLabelBuildID {
+		return
+	}
+	labels := map[string]string{buildIDLabel: buildID}
+	if k.Revision != "" {
+		labels[revisionLabel] = k.Revision
+	}
+	for i := range list {
+		if list[i].Labels == nil {
+			list[i].Labels = map[string]string{}
+		}
+		for name, value := range labels {
+			if _, exists := list[i].Labels[name]; !exists {
+				list[i].Labels[name] = value
+			}
+		}
+	}
+}
+
+// resolveCredentials replaces kaniko credentials that reference a secret with the
+// resolved username/password, so executors only ever see inline credentials.
+func (o *Orchestrator) resolveCredentials(list []config.EffectiveConfig) error {
+	for i := range list {
+		hasSecretRef := false
+		for _, cred := range list[i].KanikoCredentials {
+			if cred.SecretARN != "" {
+				hasSecretRef = true
+				break
+			}
+		}
+		if !hasSecretRef {
+			continue
+		}
+
+		if o.credentials == nil {
+			return fmt.Errorf("kaniko-credentials secret-arn is not supported: no credential resolver configured")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		creds, err := o.credentials.ResolveCredentials(ctx, list[i].KanikoCredentials)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("resolve kaniko credentials: %w", err)
+		}
+		list[i].KanikoCredentials = creds
+	}
+	return nil
+}
+
+// startBuild dispatches the tasks of a single build. globalDestination is the expanded
+// destination multi-arch manifests are created at, with the tags and entry order in
+// manifest. When parent is non-nil, the build's logs are also forwarded to parent,
+// prefixed with the service name. When prepare is non-nil, it runs in the background
+// before any task is dispatched, and an error from it fails the build.
+func (o *Orchestrator) startBuild(
+	buildID string,
+	globalDestination string,
+	manifest manifestSpec,
+	effectiveList []config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	serviceName string,
+	parent *state.BuildState,
+	prepare func() error,
+) *state.BuildState {
+
+	pushCount := 0
+	for _, ef := range effectiveList {
+		if !isNoPush(ef) {
+			pushCount++
+		}
+	}
+
+	taskCount := len(effectiveList)
+
+	taskIDs, hasDuplicateArch := assignTaskIDs(effectiveList)
+
+	singleArch := isSingleArch(effectiveList, manifest)
+
+	st := state.NewBuildState(buildID, taskCount, singleArch, globalDestination)
 	st.HasDuplicateArch = hasDuplicateArch
+	st.SetEffective(taskIDs, effectiveList)
+	st.SetIngestGrace(getenvDuration("INGEST_GRACE_PERIOD", 10*time.Second))
+	st.SetMaxLogBytes(getenvInt("MAX_BUILD_LOG_BYTES", defaultMaxBuildLogBytes))
+	if parent != nil {
+		st.SetParent(parent, fmt.Sprintf("[%s] ", serviceName))
+	}
 	o.store.Register(buildID, st)
 
 	st.AppendLog("info", "build accepted by orchestrator")
 	st.AppendLog("info", fmt.Sprintf("%d build tasks found", taskCount))
+	if manifest.None && pushCount > 1 {
+		st.AppendLog("info", "manifest: none; each task pushes to its destination without an arch suffix or manifest list")
+	}
+	if singleArch && len(manifest.Tags) > 0 {
+		st.AppendLog("warn", "manifest-tags ignored: a single-arch build creates no manifest list")
+	}
+
+	dispatch := func() {
+		o.dispatchTasks(st, taskIDs, globalDestination, manifest, effectiveList, contextBucket, contextKey, serviceName)
+	}
+
+	var queued *queuedBuild
+	if prepare == nil {
+		if queued = o.enqueueBuild(st, serviceName); queued == nil {
+			dispatch()
+			return st
+		}
+	}
 
-	ingestURL := fmt.Sprintf("%s/build/%s/logs/ingest", o.controllerURL, buildID)
+	go func() {
+		if prepare != nil {
+			if err := prepare(); err != nil {
+				st.AppendLog("error", err.Error())
+				o.finishBuild(st, serviceName, globalDestination, manifest.Tags, err)
+				return
+			}
+			if queued = o.enqueueBuild(st, serviceName); queued == nil {
+				dispatch()
+				return
+			}
+		}
+		if err := o.queue.wait(st.Context(), queued); err != nil {
+			st.AppendLog("error", fmt.Sprintf("build left the queue: %v", err))
+			o.finishBuild(st, serviceName, globalDestination, manifest.Tags, err)
+			return
+		}
+		st.AppendLog("info", "build slot acquired")
+		dispatch()
+	}()
+	return st
+}
+
+// finishBuild fails st with err, if non-nil, runs the post-build hook, writes the
+// build report and finishes st. Every build ends here, including builds that fail
+// before their tasks are dispatched, so the hook and report see each of them.
+func (o *Orchestrator) finishBuild(st *state.BuildState, serviceName, destination string, tags []string, err error) {
+	st.SetError(err)
+	o.runPostBuildHook(st, serviceName, destination)
+	o.writeBuildReport(st, serviceName, destination, tags)
+	st.Finish(st.GetError())
+}
+
+// enqueueBuild takes a build slot for st, or queues st under the tenant of
+// serviceName and returns the queued build when every slot is taken.
+func (o *Orchestrator) enqueueBuild(st *state.BuildState, serviceName string) *queuedBuild {
+	tenant := buildTenant(serviceName)
+	queued := o.queue.enqueue(tenant, st.ID)
+	if queued != nil {
+		st.AppendLog("info", fmt.Sprintf("waiting for a build slot: tenant %q, queue position %d", tenant, o.queue.position(st.ID)))
+	}
+	return queued
+}
+
+// dispatchTasks runs every task of st on its executor and, once they are done,
+// creates the multi-arch manifest, runs the post-build hook and finishes the build,
+// freeing the build slot it holds.
+func (o *Orchestrator) dispatchTasks(
+	st *state.BuildState,
+	taskIDs []string,
+	globalDestination string,
+	manifest manifestSpec,
+	effectiveList []config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	serviceName string,
+) {
+	ingestURL := fmt.Sprintf("%s/build/%s/logs/ingest", o.controllerURL, st.ID)
 	var wg sync.WaitGroup
 
+	// With FAIL_FAST, the first failed task cancels the tasks still running, since
+	// the build fails with it and their images would go unused.
+	buildCtx, cancelTasks := context.WithCancelCause(st.Context())
+	failFast := os.Getenv("FAIL_FAST") == "true"
+
+	// BUILD_TOTAL_TIMEOUT bounds everything from here on: the tasks, waiting for their
+	// results, the manifest and waiting for the agents' last log lines. Running tasks
+	// are canceled and stopped on their executor when it passes.
+	if total := getenvDuration("BUILD_TOTAL_TIMEOUT", defaultBuildTotalTimeout); total > 0 {
+		var cancelTotal context.CancelFunc
+		buildCtx, cancelTotal = context.WithTimeoutCause(buildCtx, total,
+			fmt.Errorf("%w: build exceeded BUILD_TOTAL_TIMEOUT of %v", errBuildTimeout, total))
+		if deadline, ok := buildCtx.Deadline(); ok {
+			st.SetIngestDeadline(deadline)
+		}
+		stopTasks := cancelTasks
+		cancelTasks = func(cause error) {
+			stopTasks(cause)
+			cancelTotal()
+		}
+	}
+
 	for idx, ef := range effectiveList {
 		wg.Add(1)
 
-		var taskID string
-		if hasDuplicateArch {
-			taskID = fmt.Sprintf("%s-%d", ef.Arch, idx)
-		} else {
-			taskID = ef.Arch
-		}
+		taskID := taskIDs[idx]
 
 		go func(i int, cfg config.EffectiveConfig, tid string) {
 			defer wg.Done()
@@ -141,39 +507,38 @@ func (o *Orchestrator) StartBuild(
 				}
 			}()
 
-			ctx, cancel := context.WithTimeout(context.Background(), getenvDuration("BUILD_TASK_TIMEOUT", 30*time.Minute))
-			defer cancel()
-
 			st.AppendLog("info", fmt.Sprintf("[task %s] starting (%s / %s)", tid, cfg.Platform, cfg.Arch))
+			for _, w := range cfg.Warnings {
+				st.AppendLog("warn", fmt.Sprintf("[task %s] %s", tid, w))
+			}
+			if len(cfg.Mirrors) > 0 {
+				for _, reg := range missingCredentials(cfg, globalDestination) {
+					st.AppendLog("warn", fmt.Sprintf("[task %s] no kaniko credential for registry %s, relying on ambient auth", tid, reg))
+				}
+			}
+
+			st.SetTaskPlatform(tid, cfg.Platform)
 
+			// TASK_RETRIES dispatches a failed task again, unless the whole build was
+			// canceled. Each dispatch is a new attempt whose result replaces the last one.
+			retries := max(getenvInt("TASK_RETRIES", 0), 0)
 			var execErr error
-			switch cfg.Platform {
-			case "ecs":
-				ecsExec, ok := o.ecs.(*ecs.ECSExecutor)
-				if !ok {
-					execErr = fmt.Errorf("ECS executor type mismatch")
-				} else {
-					execErr = ecsExec.RunTaskForArch(
-						ctx, st, tid, cfg,
-						contextBucket, contextKey,
-						ingestURL,
-						isSingleArch,
-						globalDestination,
-					)
+			for {
+				attempt := st.StartAttempt(tid)
+				execErr = o.runAttempt(buildCtx, st, tid, cfg, contextBucket, contextKey, ingestURL)
+				if execErr == nil || attempt > retries || buildCtx.Err() != nil {
+					break
 				}
-			case "k8s":
-				if o.k8s == nil {
-					execErr = fmt.Errorf("K8s executor not configured")
-				} else {
-					execErr = o.k8s.RunTask(ctx, st, tid, cfg, contextBucket, contextKey, ingestURL)
-				}
-			default:
-				execErr = fmt.Errorf("unknown platform: %s", cfg.Platform)
+				st.AppendLog("warn", fmt.Sprintf("[task %s] attempt %d failed: %v, retrying (%d/%d)", tid, attempt, execErr, attempt, retries))
 			}
 
 			if execErr != nil {
 				st.AppendLog("error", fmt.Sprintf("[task %s] failed: %v", tid, execErr))
-				st.SetError(execErr)
+				st.SetTaskError(tid, execErr)
+				if failFast && buildCtx.Err() == nil {
+					st.AppendLog("warn", fmt.Sprintf("FAIL_FAST: task %s failed, canceling the remaining tasks", tid))
+					cancelTasks(fmt.Errorf("%w: task %s failed", errFailFast, tid))
+				}
 			} else {
 				st.AppendLog("info", fmt.Sprintf("[task %s] executor finished", tid))
 			}
@@ -182,6 +547,7 @@ func (o *Orchestrator) StartBuild(
 
 	go func() {
 		wg.Wait()
+		defer cancelTasks(nil)
 
 		st.Mu.RLock()
 		currentKeys := make([]string, 0, len(st.Results))
@@ -198,7 +564,7 @@ func (o *Orchestrator) StartBuild(
 		startWait := time.Now()
 
 		for {
-			if st.AllResultsReceived() {
+			if st.AllResultsReceived() || buildCtx.Err() != nil {
 				break
 			}
 			if time.Since(startWait) > maxWait {
@@ -218,7 +584,19 @@ func (o *Orchestrator) StartBuild(
 			time.Sleep(1 * time.Second)
 		}
 
-		if !st.AllResultsReceived() {
+		timedOut := func() bool {
+			cause := context.Cause(buildCtx)
+			if !errors.Is(cause, errBuildTimeout) {
+				return false
+			}
+			if !st.HasError() {
+				st.AppendLog("error", cause.Error())
+			}
+			st.SetError(cause)
+			return true
+		}
+
+		if !timedOut() && !st.AllResultsReceived() {
 			st.Mu.RLock()
 			err := fmt.Errorf("timeout waiting for agent results (%d/%d received)", st.ResultsReceived, st.TotalTasks)
 			st.Mu.RUnlock()
@@ -226,29 +604,237 @@ func (o *Orchestrator) StartBuild(
 			st.SetError(err)
 		}
 
-		if !isSingleArch && !st.HasError() {
+		if !st.IsSingleArch && !st.HasError() {
 			st.AppendLog("info", "starting multi-arch manifest creation")
-			ctx := context.Background()
-			if err := o.createManifest(ctx, st, globalDestination, effectiveList); err != nil {
+			if err := o.createManifest(buildCtx, st, globalDestination, manifest, effectiveList, taskIDs); err != nil {
 				st.AppendLog("error", fmt.Sprintf("manifest creation failed: %v", err))
-				st.SetError(err)
+				if !timedOut() {
+					st.SetError(err)
+				}
 			} else {
 				st.AppendLog("info", fmt.Sprintf("multi-arch manifest created: %s", globalDestination))
 			}
 		}
 
-		st.Finish(st.GetError())
+		o.finishBuild(st, serviceName, globalDestination, manifest.Tags, nil)
+		o.queue.release()
 	}()
+}
 
-	return buildID, st, nil
+// runAttempt runs the current attempt of the task tid on its executor, bounded by
+// BUILD_TASK_TIMEOUT and HEARTBEAT_TIMEOUT, and returns why it failed.
+func (o *Orchestrator) runAttempt(
+	buildCtx context.Context,
+	st *state.BuildState,
+	tid string,
+	cfg config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	ingestURL string,
+) error {
+	ctx, cancel := context.WithTimeout(buildCtx, getenvDuration("BUILD_TASK_TIMEOUT", 30*time.Minute))
+	defer cancel()
+
+	ctx, cancelHeartbeat := context.WithCancelCause(ctx)
+	defer cancelHeartbeat(nil)
+	go watchHeartbeat(ctx, st, tid, getenvDuration("HEARTBEAT_TIMEOUT", 2*time.Minute), cancelHeartbeat)
+
+	var execErr error
+	if exec, ok := o.executors.Lookup(cfg.Platform); ok {
+		execErr = exec.RunTask(ctx, st, tid, cfg, contextBucket, contextKey, ingestURL)
+		if ctx.Err() != nil {
+			cancelTask(exec, st, tid)
+		}
+	} else {
+		execErr = fmt.Errorf("no executor configured for platform: %s", cfg.Platform)
+	}
+
+	if cause := context.Cause(ctx); errors.Is(cause, errHeartbeatTimeout) || errors.Is(cause, errFailFast) || errors.Is(cause, errBuildTimeout) {
+		execErr = cause
+
+		attempt := st.TaskAttempt(tid)
+		st.Mu.RLock()
+		result, hasResult := st.Results[tid]
+		st.Mu.RUnlock()
+		if !hasResult || result.Attempt < attempt {
+			st.SetResult(tid, cfg.Arch, "", false, cause.Error())
+		}
+	}
+	if execErr == nil {
+		// Some executors only record a failure, like a non-zero agent exit, in the state.
+		execErr = st.AttemptError(tid)
+	}
+	return execErr
+}
+
+var errHeartbeatTimeout = errors.New("agent heartbeat timeout")
+
+// heartbeatCheckInterval is how often watchHeartbeat looks at a task's last heartbeat.
+var heartbeatCheckInterval = 5 * time.Second
+
+// cancelTaskTimeout bounds how long stopping a canceled task's remote work may take.
+const cancelTaskTimeout = 30 * time.Second
+
+// cancelTask stops the remote work of the canceled task tid, so it does not keep
+// building and pushing after the controller has given up on it.
+func cancelTask(exec Executor, st *state.BuildState, tid string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTaskTimeout)
+	defer cancel()
+	if err := exec.CancelTask(ctx, st, tid); err != nil {
+		st.AppendLog("warn", fmt.Sprintf("[task %s] stop canceled task: %v", tid, err))
+	}
+}
+
+// errFailFast is the cause of tasks canceled by FAIL_FAST after another task failed.
+var errFailFast = errors.New("canceled by FAIL_FAST")
+
+// errBuildTimeout is the cause of builds canceled by BUILD_TOTAL_TIMEOUT.
+var errBuildTimeout = errors.New("build timeout")
+
+// defaultBuildTotalTimeout is the default BUILD_TOTAL_TIMEOUT; 0 leaves builds bounded
+// only by BUILD_TASK_TIMEOUT and BUILD_RESULT_TIMEOUT.
+const defaultBuildTotalTimeout = 0
+
+// ErrTooManyArches is returned for builds with more tasks than MAX_ARCHES_PER_BUILD allows.
+var ErrTooManyArches = errors.New("too many arches")
+
+// defaultMaxArches is the default MAX_ARCHES_PER_BUILD.
+const defaultMaxArches = 8
+
+// defaultManifestFetchAttempts and defaultManifestFetchBackoff are the defaults of
+// MANIFEST_FETCH_ATTEMPTS and MANIFEST_FETCH_BACKOFF, which retry fetching an arch
+// image the registry does not show yet: 1s, 2s, 4s and 8s apart.
+const (
+	defaultManifestFetchAttempts = 5
+	defaultManifestFetchBackoff  = time.Second
+)
+
+// defaultMaxBuildLogBytes is the default MAX_BUILD_LOG_BYTES; 0 keeps every agent log line.
+const defaultMaxBuildLogBytes = 0
+
+// checkArchLimit rejects a build whose bake entries would start more tasks than
+// MAX_ARCHES_PER_BUILD (0 disables the limit), guarding against runaway platform lists.
+func checkArchLimit(list []config.EffectiveConfig) error {
+	limit := getenvInt("MAX_ARCHES_PER_BUILD", defaultMaxArches)
+	if limit > 0 && len(list) > limit {
+		return fmt.Errorf("%w: build has %d tasks, MAX_ARCHES_PER_BUILD is %d", ErrTooManyArches, len(list), limit)
+	}
+	return nil
+}
+
+// watchHeartbeat cancels ctx with errHeartbeatTimeout once the agent of taskID has been
+// silent for longer than timeout. A non-positive timeout disables the check.
+func watchHeartbeat(
+	ctx context.Context,
+	st *state.BuildState,
+	taskID string,
+	timeout time.Duration,
+	cancel context.CancelCauseFunc,
+) {
+	if timeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(heartbeatCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if st.HeartbeatExpired(taskID, timeout) {
+				err := fmt.Errorf("%w: no heartbeat from task %s for %v", errHeartbeatTimeout, taskID, timeout)
+				st.AppendLog("error", fmt.Sprintf("[task %s] %v", taskID, err))
+				cancel(err)
+				return
+			}
+		}
+	}
 }
 
 func (o *Orchestrator) createManifest(
 	ctx context.Context,
 	st *state.BuildState,
 	destination string,
+	manifest manifestSpec,
 	allTasks []config.EffectiveConfig,
+	taskIDs []string,
 ) error {
+	images, err := manifestImages(st, allTasks, taskIDs)
+	if err != nil {
+		return err
+	}
+	sortManifestImages(images, manifest.ArchOrder)
+
+	st.AppendLog("info", fmt.Sprintf("Creating multi-arch manifest with %d images", len(images)))
+	retry := registry.FetchRetry{
+		Attempts: getenvInt("MANIFEST_FETCH_ATTEMPTS", defaultManifestFetchAttempts),
+		Backoff:  getenvDuration("MANIFEST_FETCH_BACKOFF", defaultManifestFetchBackoff),
+	}
+	return registry.CreateManifestList(ctx, st, images, destination, manifest.Mirrors, manifest.Tags, retry)
+}
+
+// manifestSpec holds the global settings of a build's multi-arch manifest.
+type manifestSpec struct {
+	// Tags are the expanded extra references the manifest is tagged with.
+	Tags []string
+	// Mirrors are the expanded mirror destinations the manifest is also pushed to.
+	Mirrors []string
+	// ArchOrder lists the arches whose entries come first in the manifest, in order.
+	ArchOrder []string
+	// None publishes every task as a single image, with no arch suffix or manifest.
+	None bool
+}
+
+// newManifestSpec resolves the manifest settings of k for a build whose expanded
+// global destination is destination.
+func newManifestSpec(k config.KanikoConfig, destination string, vars destinationVars) (manifestSpec, error) {
+	tags, err := expandManifestTags(destination, k.ManifestTags, vars)
+	if err != nil {
+		return manifestSpec{}, err
+	}
+	var mirrors []string
+	for _, m := range k.MirrorDestinations() {
+		expanded, err := expandDestination(m, "", vars)
+		if err != nil {
+			return manifestSpec{}, err
+		}
+		mirrors = append(mirrors, expanded)
+	}
+	return manifestSpec{Tags: tags, Mirrors: mirrors, ArchOrder: k.ManifestArchOrder, None: k.ManifestDisabled()}, nil
+}
+
+// sortManifestImages moves the images of the arches in order to the front, in that
+// order. Other images follow in config order, as do several images of one arch.
+func sortManifestImages(images []registry.PlatformImage, order []string) {
+	if len(order) == 0 {
+		return
+	}
+	rank := make(map[string]int, len(order))
+	for i, arch := range order {
+		if _, ok := rank[arch]; !ok {
+			rank[arch] = i
+		}
+	}
+	key := func(img registry.PlatformImage) int {
+		if r, ok := rank[img.Arch]; ok {
+			return r
+		}
+		return len(order)
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return key(images[i]) < key(images[j])
+	})
+}
+
+// manifestImages resolves the pushed image and digest of every pushed task,
+// looking results up by the same task IDs used at dispatch.
+func manifestImages(
+	st *state.BuildState,
+	allTasks []config.EffectiveConfig,
+	taskIDs []string,
+) ([]registry.PlatformImage, error) {
 	var images []registry.PlatformImage
 
 	st.Mu.RLock()
@@ -272,16 +858,11 @@ func (o *Orchestrator) createManifest(
 		buildID, totalTasks, resultsReceived, mapLen, actualKeys, resultDetails))
 
 	for idx, ef := range allTasks {
-		if ef.NoPush != nil && *ef.NoPush {
+		if isNoPush(ef) {
 			continue
 		}
 
-		var taskID string
-		if st.HasDuplicateArch {
-			taskID = fmt.Sprintf("%s-%d", ef.Arch, idx)
-		} else {
-			taskID = ef.Arch
-		}
+		taskID := taskIDs[idx]
 
 		st.AppendLog("debug", fmt.Sprintf("Looking for result with taskID='%s' (arch=%s, idx=%d, hasDuplicate=%v)",
 			taskID, ef.Arch, idx, st.HasDuplicateArch))
@@ -291,72 +872,176 @@ func (o *Orchestrator) createManifest(
 		st.Mu.RUnlock()
 
 		if !ok {
-			return fmt.Errorf("missing result for task '%s' (buildID=%s, arch=%s, idx=%d). Available keys: %v. Total expected: %d, Received: %d",
+			return nil, fmt.Errorf("missing result for task '%s' (buildID=%s, arch=%s, idx=%d). Available keys: %v. Total expected: %d, Received: %d",
 				taskID, buildID, ef.Arch, idx, actualKeys, totalTasks, resultsReceived)
 		}
 
 		if !result.Success {
-			return fmt.Errorf("task %s build failed: %s", taskID, result.Error)
+			return nil, fmt.Errorf("task %s build failed: %s", taskID, result.Error)
 		}
 
-		var pushedImage string
-		if ef.Destination != "" {
-			pushedImage = ef.Destination
-		} else {
-			if st.HasDuplicateArch {
-				pushedImage = appendTaskSuffix(destination, taskID)
-			} else {
-				pushedImage = appendArchSuffix(destination, ef.Arch)
-			}
-		}
+		pushedImage, _ := st.TaskDestinations(taskID, ef)
 
 		st.AppendLog("debug", fmt.Sprintf("Adding to manifest: taskID=%s, image=%s, digest=%s",
 			taskID, pushedImage, result.ImageDigest))
 
-		images = append(images, registry.PlatformImage{
+		img := registry.PlatformImage{
 			Arch:   ef.Arch,
 			Image:  pushedImage,
 			Digest: result.ImageDigest,
-		})
+		}
+		if ef.CustomPlatform != nil {
+			img.Platform = *ef.CustomPlatform
+		}
+		images = append(images, img)
 	}
 
-	st.AppendLog("info", fmt.Sprintf("Creating multi-arch manifest with %d images", len(images)))
-	return registry.CreateManifestList(ctx, st, images, destination)
+	return images, nil
 }
 
-func appendArchSuffix(destination, arch string) string {
-	if idx := lastIndexByte(destination, ':'); idx != -1 {
-		return fmt.Sprintf("%s:%s_%s", destination[:idx], destination[idx+1:], arch)
+// assignTaskIDs derives the task ID of every entry in list. Pushed tasks are keyed
+// by arch, or by arch-index for all tasks when pushed tasks share an arch. No-push
+// tasks fall back to arch-index whenever their arch is not unique, so they never
+// take the key of a pushed task. The second return value reports whether pushed
+// tasks share an arch.
+func assignTaskIDs(list []config.EffectiveConfig) ([]string, bool) {
+	pushArchCount := make(map[string]int)
+	allArchCount := make(map[string]int)
+	for _, ef := range list {
+		allArchCount[ef.Arch]++
+		if !isNoPush(ef) {
+			pushArchCount[ef.Arch]++
+		}
 	}
-	return fmt.Sprintf("%s:latest_%s", destination, arch)
+
+	hasDuplicateArch := false
+	for _, count := range pushArchCount {
+		if count > 1 {
+			hasDuplicateArch = true
+			break
+		}
+	}
+
+	ids := make([]string, len(list))
+	for idx, ef := range list {
+		if hasDuplicateArch || (isNoPush(ef) && allArchCount[ef.Arch] > 1) {
+			ids[idx] = fmt.Sprintf("%s-%d", ef.Arch, idx)
+		} else {
+			ids[idx] = ef.Arch
+		}
+	}
+	return ids, hasDuplicateArch
+}
+
+func isNoPush(ef config.EffectiveConfig) bool {
+	return ef.NoPush != nil && *ef.NoPush
 }
 
-func appendTaskSuffix(destination, taskID string) string {
-	if idx := lastIndexByte(destination, ':'); idx != -1 {
-		return fmt.Sprintf("%s:%s_%s", destination[:idx], destination[idx+1:], taskID)
+// isSingleArch reports whether the build of list pushes without a manifest list:
+// at most one task pushes, or the manifest is disabled.
+func isSingleArch(list []config.EffectiveConfig, manifest manifestSpec) bool {
+	pushCount := 0
+	for _, ef := range list {
+		if !isNoPush(ef) {
+			pushCount++
+		}
 	}
-	return fmt.Sprintf("%s:latest_%s", destination, taskID)
+	return pushCount <= 1 || manifest.None
 }
 
-func lastIndexByte(s string, c byte) int {
-	for i := len(s) - 1; i >= 0; i-- {
-		if s[i] == c {
-			return i
+// missingCredentials returns the registries ef pushes to that have no entry in ef.KanikoCredentials.
+// A docker-config-json is not inspected, since its credHelpers can cover any registry.
+func missingCredentials(ef config.EffectiveConfig, globalDestination string) []string {
+	if ef.DockerConfigJSON != "" {
+		return nil
+	}
+	dest := ef.Destination
+	if dest == "" {
+		dest = globalDestination
+	}
+
+	have := map[string]bool{}
+	for _, cred := range ef.KanikoCredentials {
+		have[config.CredentialHost(cred.Registry)] = true
+	}
+
+	var missing []string
+	for _, d := range append([]string{dest}, ef.Mirrors...) {
+		if host := config.RegistryHost(d); d != "" && !have[host] {
+			have[host] = true
+			missing = append(missing, host)
 		}
 	}
-	return -1
+	return missing
 }
 
+// maxLabelValueLength is the Kubernetes limit for label values. Build IDs are used
+// as the build-id label on K8s jobs, so they must fit.
+const maxLabelValueLength = 63
+
+// generateBuildID returns a new build ID using the scheme selected by BUILD_ID_SCHEME
+// ("timestamp" by default, "uuid" or "short"), with the sanitized service name appended.
 func generateBuildID(serviceName string) string {
-	b := make([]byte, 2)
+	var base string
+	switch os.Getenv("BUILD_ID_SCHEME") {
+	case "uuid":
+		base = fmt.Sprintf("b-%s", uuid.New().String())
+	case "short":
+		base = fmt.Sprintf("b-%s", randomHex(4))
+	default:
+		ts := time.Now().UnixNano()
+		if serviceName != "" {
+			base = fmt.Sprintf("b-%d-%s", ts, randomHex(2))
+		} else {
+			base = fmt.Sprintf("b-%d-%s", ts, uuid.New().String()[:8])
+		}
+	}
+
+	svc := sanitizeServiceName(serviceName, maxLabelValueLength-len(base)-1)
+	if svc == "" {
+		return base
+	}
+	return fmt.Sprintf("%s-%s", base, svc)
+}
+
+// sanitizeServiceName lowercases name, replaces characters that are not valid in
+// an RFC1123 label with '-', and truncates it to maxLen.
+func sanitizeServiceName(name string, maxLen int) string {
+	var b strings.Builder
+	lastDash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			lastDash = false
+		} else if !lastDash {
+			b.WriteByte('-')
+			lastDash = true
+		}
+	}
+
+	out := strings.Trim(b.String(), "-")
+	if maxLen <= 0 {
+		return ""
+	}
+	if len(out) > maxLen {
+		out = strings.TrimRight(out[:maxLen], "-")
+	}
+	return out
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
 	_, _ = rand.Read(b)
-	randomHex := hex.EncodeToString(b)
+	return hex.EncodeToString(b)
+}
 
-	ts := time.Now().UnixNano()
-	if serviceName != "" {
-		return fmt.Sprintf("b-%d-%s-%s", ts, randomHex, serviceName)
+func getenvInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
 	}
-	return fmt.Sprintf("b-%d-%s", ts, uuid.New().String()[:8])
+	return def
 }
 
 func getenvDuration(key string, def time.Duration) time.Duration {
@@ -0,0 +1,1495 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/ecs"
+	"github.com/rayshoo/bakery/internal/fakeexec"
+	"github.com/rayshoo/bakery/internal/k8s"
+	"github.com/rayshoo/bakery/internal/registry"
+	"github.com/rayshoo/bakery/internal/state"
+
+	"github.com/minio/minio-go/v7"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func boolP(v bool) *bool { return &v }
+
+func TestAssignTaskIDs(t *testing.T) {
+	tests := []struct {
+		name          string
+		list          []config.EffectiveConfig
+		want          []string
+		wantDuplicate bool
+	}{
+		{
+			name: "unique arches",
+			list: []config.EffectiveConfig{{Arch: "amd64"}, {Arch: "arm64"}},
+			want: []string{"amd64", "arm64"},
+		},
+		{
+			name:          "duplicate pushed arches",
+			list:          []config.EffectiveConfig{{Arch: "amd64"}, {Arch: "amd64"}, {Arch: "arm64"}},
+			want:          []string{"amd64-0", "amd64-1", "arm64-2"},
+			wantDuplicate: true,
+		},
+		{
+			name: "no-push shares arch with pushed task",
+			list: []config.EffectiveConfig{{Arch: "amd64", NoPush: boolP(true)}, {Arch: "amd64"}, {Arch: "arm64"}},
+			want: []string{"amd64-0", "amd64", "arm64"},
+		},
+		{
+			name: "no-push with unique arch",
+			list: []config.EffectiveConfig{{Arch: "amd64"}, {Arch: "arm64", NoPush: boolP(true)}},
+			want: []string{"amd64", "arm64"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, dup := assignTaskIDs(tt.list)
+			if dup != tt.wantDuplicate {
+				t.Errorf("hasDuplicateArch = %v, want %v", dup, tt.wantDuplicate)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("len(ids) = %d, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("ids[%d] = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestManifestImagesWithNoPushTask(t *testing.T) {
+	list := []config.EffectiveConfig{
+		{Arch: "amd64", NoPush: boolP(true)},
+		{Arch: "amd64"},
+		{Arch: "arm64"},
+	}
+	taskIDs, hasDuplicateArch := assignTaskIDs(list)
+
+	st := state.NewBuildState("b-test", len(list), false, "registry.example.com/app:1.0")
+	st.HasDuplicateArch = hasDuplicateArch
+
+	st.SetResult(taskIDs[0], "amd64", "no-push", true, "")
+	st.SetResult(taskIDs[1], "amd64", "sha256:amd", true, "")
+	st.SetResult(taskIDs[2], "arm64", "sha256:arm", true, "")
+
+	images, err := manifestImages(st, list, taskIDs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("len(images) = %d, want 2", len(images))
+	}
+
+	want := map[string]string{
+		"amd64": "sha256:amd",
+		"arm64": "sha256:arm",
+	}
+	for _, img := range images {
+		if img.Digest != want[img.Arch] {
+			t.Errorf("%s digest = %q, want %q", img.Arch, img.Digest, want[img.Arch])
+		}
+		if img.Image != "registry.example.com/app:1.0_"+img.Arch {
+			t.Errorf("%s image = %q, want arch-suffixed tag", img.Arch, img.Image)
+		}
+	}
+}
+
+func TestHeterogeneousArchBuild(t *testing.T) {
+	yaml := []byte(`
+global:
+  platform: fake
+  kaniko:
+    context-path: .
+    dockerfile: Dockerfile
+    destination: registry.example.com/app:1.0
+bake:
+- arch: amd64
+- arch: arm64
+  kaniko:
+    context-path: arm64
+    dockerfile: arm64/Dockerfile.arm64
+- arch: arm
+  kaniko:
+    dockerfile: Dockerfile.armv6
+    custom-platform: linux/arm/v6
+`)
+
+	var cfg config.BuildConfig
+	if err := config.UnmarshalYAML(yaml, &cfg); err != nil {
+		t.Fatalf("UnmarshalYAML: %v", err)
+	}
+	list, err := config.BuildEffectiveList(&cfg)
+	if err != nil {
+		t.Fatalf("BuildEffectiveList: %v", err)
+	}
+	global, err := expandDestinations(list, cfg.Global.Kaniko.CanonicalDestination(), destinationVars{})
+	if err != nil {
+		t.Fatalf("expandDestinations: %v", err)
+	}
+	taskIDs, hasDuplicateArch := assignTaskIDs(list)
+
+	st := state.NewBuildState("b-test", len(list), false, global)
+	st.HasDuplicateArch = hasDuplicateArch
+
+	exec := fakeexec.New()
+	for i, ef := range list {
+		if err := exec.RunTask(context.Background(), st, taskIDs[i], ef, "bucket", "key", ""); err != nil {
+			t.Fatalf("RunTask(%s): %v", taskIDs[i], err)
+		}
+	}
+
+	want := map[string][2]string{
+		"amd64": {".", "Dockerfile"},
+		"arm64": {"arm64", "arm64/Dockerfile.arm64"},
+		"arm":   {".", "Dockerfile.armv6"},
+	}
+	for taskID, w := range want {
+		ef, _ := exec.Config(taskID)
+		if ef.ContextPath != w[0] || ef.Dockerfile != w[1] {
+			t.Errorf("task %s context/dockerfile = %q/%q, want %q/%q", taskID, ef.ContextPath, ef.Dockerfile, w[0], w[1])
+		}
+	}
+
+	images, err := manifestImages(st, list, taskIDs)
+	if err != nil {
+		t.Fatalf("manifestImages: %v", err)
+	}
+	if len(images) != len(want) {
+		t.Fatalf("len(images) = %d, want %d", len(images), len(want))
+	}
+	for _, img := range images {
+		if img.Image != "registry.example.com/app:1.0_"+img.Arch {
+			t.Errorf("%s image = %q, want arch-suffixed tag", img.Arch, img.Image)
+		}
+		if img.Digest != fakeexec.Digest(img.Arch) {
+			t.Errorf("%s digest = %q, want %q", img.Arch, img.Digest, fakeexec.Digest(img.Arch))
+		}
+	}
+	if images[2].Platform != "linux/arm/v6" {
+		t.Errorf("arm platform = %q, want linux/arm/v6", images[2].Platform)
+	}
+}
+
+func TestSanitizeServiceName(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		maxLen int
+		want   string
+	}{
+		{"already valid", "api", 36, "api"},
+		{"uppercase underscore dot", "My_Service.v2", 36, "my-service-v2"},
+		{"leading and trailing invalid", "__api__", 36, "api"},
+		{"repeated invalid chars", "a..b__c", 36, "a-b-c"},
+		{"truncate", "abcdefghij", 5, "abcde"},
+		{"truncate trims trailing dash", "abcd_efgh", 5, "abcd"},
+		{"empty", "", 36, ""},
+		{"no room", "api", 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeServiceName(tt.input, tt.maxLen); got != tt.want {
+				t.Errorf("sanitizeServiceName(%q, %d) = %q, want %q", tt.input, tt.maxLen, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateBuildIDIsValidLabelValue(t *testing.T) {
+	labelValue := regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+	for _, scheme := range []string{"", "timestamp", "uuid", "short"} {
+		for _, svc := range []string{"", "My_Service.v2", strings.Repeat("Very.Long_Service", 10)} {
+			t.Run(scheme+"/"+svc, func(t *testing.T) {
+				t.Setenv("BUILD_ID_SCHEME", scheme)
+
+				id := generateBuildID(svc)
+				if len(id) > maxLabelValueLength {
+					t.Errorf("len(%q) = %d, want <= %d", id, len(id), maxLabelValueLength)
+				}
+				if !labelValue.MatchString(id) {
+					t.Errorf("%q is not a valid label value", id)
+				}
+			})
+		}
+	}
+}
+
+func TestStartBuildUsesRegisteredExecutor(t *testing.T) {
+	t.Setenv("BUILD_RESULT_TIMEOUT", "10ms")
+
+	fake := fakeexec.New()
+	executors := NewRegistry()
+	executors.Register("fake", fake)
+
+	o := New(Deps{Store: state.NewStore(), Executors: executors})
+
+	t.Run("custom platform", func(t *testing.T) {
+		yaml := []byte(`
+global:
+  platform: fake
+  arch: amd64
+  kaniko:
+    destination: registry.example.com/app:1.0
+bake:
+  - {}
+`)
+		_, st, err := o.StartBuild(yaml, "bucket", "key", "app")
+		if err != nil {
+			t.Fatalf("StartBuild: %v", err)
+		}
+		<-st.Done
+
+		if err := st.GetError(); err != nil {
+			t.Fatalf("build error: %v", err)
+		}
+		if tasks := fake.Tasks(); len(tasks) != 1 || tasks[0] != "amd64" {
+			t.Errorf("fake executor tasks = %v, want [amd64]", tasks)
+		}
+	})
+
+	t.Run("unregistered platform", func(t *testing.T) {
+		yaml := []byte(`
+global:
+  platform: missing
+  arch: amd64
+bake:
+  - {}
+`)
+		_, st, err := o.StartBuild(yaml, "bucket", "key", "app")
+		if err != nil {
+			t.Fatalf("StartBuild: %v", err)
+		}
+		<-st.Done
+
+		if err := st.GetError(); err == nil || !strings.Contains(err.Error(), "missing") {
+			t.Errorf("build error = %v, want unknown platform error", err)
+		}
+	})
+}
+
+var (
+	_ Executor = (*ecs.ECSExecutor)(nil)
+	_ Executor = (*k8s.K8sExecutor)(nil)
+)
+
+func TestExecutorsInvokedViaInterface(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	executors := NewRegistry()
+	executors.Register("ecs", ecs.NewECSExecutor(nil, "cluster", "agent:latest", "", "", nil, nil, "us-east-1", "", "http://controller"))
+	executors.Register("k8s", k8s.NewK8sExecutor(client, "builds", "agent:latest", "http://controller", nil))
+
+	t.Run("ecs", func(t *testing.T) {
+		exec, ok := executors.Lookup("ecs")
+		if !ok {
+			t.Fatal("ecs executor not registered")
+		}
+		st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+		err := exec.RunTask(context.Background(), st, "amd64", config.EffectiveConfig{}, "bucket", "key", "http://ingest")
+		if err == nil || !strings.Contains(err.Error(), "missing arch") {
+			t.Errorf("RunTask error = %v, want missing arch", err)
+		}
+	})
+
+	t.Run("k8s", func(t *testing.T) {
+		exec, ok := executors.Lookup("k8s")
+		if !ok {
+			t.Fatal("k8s executor not registered")
+		}
+		st := state.NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := exec.RunTask(ctx, st, "amd64", config.EffectiveConfig{Arch: "amd64"}, "bucket", "key", "http://ingest"); err == nil {
+			t.Error("RunTask error = nil, want cancelled wait")
+		}
+
+		jobs, err := client.BatchV1().Jobs("builds").List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("list jobs: %v", err)
+		}
+		if len(jobs.Items) != 1 {
+			t.Errorf("len(jobs) = %d, want 1", len(jobs.Items))
+		}
+	})
+}
+
+func TestApplyBuildArgPassthrough(t *testing.T) {
+	t.Setenv("BUILD_ARG_PASSTHROUGH", "HTTP_PROXY, NO_PROXY,UNSET_VAR")
+	t.Setenv("HTTP_PROXY", "http://proxy:3128")
+	t.Setenv("NO_PROXY", "localhost")
+	t.Setenv("SECRET_TOKEN", "do-not-leak")
+
+	list := []config.EffectiveConfig{
+		{Arch: "amd64"},
+		{Arch: "arm64", BuildArgs: map[string]string{"NO_PROXY": "explicit"}},
+	}
+	applyBuildArgPassthrough(list)
+
+	if got := list[0].BuildArgs["HTTP_PROXY"]; got != "http://proxy:3128" {
+		t.Errorf("HTTP_PROXY = %q, want injected value", got)
+	}
+	if got := list[0].BuildArgs["NO_PROXY"]; got != "localhost" {
+		t.Errorf("NO_PROXY = %q, want injected value", got)
+	}
+	if got := list[1].BuildArgs["NO_PROXY"]; got != "explicit" {
+		t.Errorf("explicit NO_PROXY = %q, want explicit build-arg to win", got)
+	}
+	for i, ef := range list {
+		if _, ok := ef.BuildArgs["SECRET_TOKEN"]; ok {
+			t.Errorf("list[%d]: SECRET_TOKEN injected without being allowlisted", i)
+		}
+		if _, ok := ef.BuildArgs["UNSET_VAR"]; ok {
+			t.Errorf("list[%d]: UNSET_VAR injected although unset", i)
+		}
+	}
+}
+
+func TestApplyBuildLabels(t *testing.T) {
+	yaml := []byte(`
+global:
+  platform: fake
+  kaniko:
+    destination: registry.example.com/app:1.0
+    auto-label-build-id: true
+    revision: 1a2b3c4
+bake:
+  - arch: amd64
+  - arch: arm64
+    labels:
+      org.opencontainers.image.revision: explicit
+`)
+
+	exec := fakeexec.New()
+
+	executors := NewRegistry()
+	executors.Register("fake", exec)
+	o := New(Deps{Store: state.NewStore(), Executors: executors})
+
+	buildID, st, err := o.StartBuild(yaml, "bucket", "key", "app")
+	if err != nil {
+		t.Fatalf("StartBuild: %v", err)
+	}
+	<-st.Done
+
+	for taskID, revision := range map[string]string{"amd64": "1a2b3c4", "arm64": "explicit"} {
+		ef, _ := exec.Config(taskID)
+		labels := ef.Labels
+		if labels[buildIDLabel] != buildID {
+			t.Errorf("%s %s = %q, want %q", taskID, buildIDLabel, labels[buildIDLabel], buildID)
+		}
+		if labels[revisionLabel] != revision {
+			t.Errorf("%s %s = %q, want %q", taskID, revisionLabel, labels[revisionLabel], revision)
+		}
+	}
+
+	list := []config.EffectiveConfig{{Arch: "amd64"}}
+	applyBuildLabels(list, config.KanikoConfig{Revision: "1a2b3c4"}, "b-1")
+	if len(list[0].Labels) != 0 {
+		t.Errorf("labels = %v, want none without auto-label-build-id", list[0].Labels)
+	}
+}
+
+func TestStartBuildLifecycle(t *testing.T) {
+	t.Setenv("BUILD_RESULT_TIMEOUT", "10ms")
+
+	yaml := []byte(`
+global:
+  platform: fake
+  arch: amd64
+  kaniko:
+    destination: registry.example.com/app:1.0
+bake:
+  - {}
+`)
+
+	start := func(t *testing.T, exec *fakeexec.Executor) *state.BuildState {
+		t.Helper()
+		executors := NewRegistry()
+		executors.Register("fake", exec)
+		o := New(Deps{Store: state.NewStore(), Executors: executors})
+
+		_, st, err := o.StartBuild(yaml, "bucket", "key", "app")
+		if err != nil {
+			t.Fatalf("StartBuild: %v", err)
+		}
+		<-st.Done
+		return st
+	}
+
+	t.Run("success", func(t *testing.T) {
+		exec := fakeexec.New()
+		exec.Delay = 20 * time.Millisecond
+
+		st := start(t, exec)
+		if err := st.GetError(); err != nil {
+			t.Fatalf("build error: %v", err)
+		}
+		if got := st.Status(); got != "succeeded" {
+			t.Errorf("status = %q, want succeeded", got)
+		}
+		if got := st.GetResults()["amd64"].ImageDigest; got != fakeexec.Digest("amd64") {
+			t.Errorf("digest = %q, want %q", got, fakeexec.Digest("amd64"))
+		}
+		if !st.IngestDone["amd64"] {
+			t.Error("ingest not marked done")
+		}
+	})
+
+	t.Run("task failure", func(t *testing.T) {
+		exec := fakeexec.New()
+		exec.Fail = func(taskID string, ef config.EffectiveConfig) error {
+			return errors.New("kaniko exit=1")
+		}
+
+		st := start(t, exec)
+		if err := st.GetError(); err == nil || !strings.Contains(err.Error(), "kaniko exit=1") {
+			t.Errorf("build error = %v, want kaniko exit=1", err)
+		}
+		if got := st.Status(); got != "failed" {
+			t.Errorf("status = %q, want failed", got)
+		}
+	})
+
+	t.Run("missing result", func(t *testing.T) {
+		exec := fakeexec.New()
+		exec.SkipResult = func(taskID string) bool { return true }
+
+		st := start(t, exec)
+		if err := st.GetError(); err == nil || !strings.Contains(err.Error(), "timeout waiting for agent results (0/1 received)") {
+			t.Errorf("build error = %v, want result timeout", err)
+		}
+	})
+}
+
+func TestStartBuildWithMirrors(t *testing.T) {
+	t.Setenv("BUILD_RESULT_TIMEOUT", "10ms")
+
+	yaml := []byte(`
+global:
+  platform: fake
+  arch: amd64
+  kaniko-credentials:
+  - registry: us-docker.pkg.dev
+    username: _json_key
+    password: key
+  kaniko:
+    destinations:
+    - 123456789012.dkr.ecr.us-east-1.amazonaws.com/app:1.0
+    - us-docker.pkg.dev/proj/repo/app:1.0
+bake:
+  - {}
+`)
+
+	exec := fakeexec.New()
+
+	executors := NewRegistry()
+	executors.Register("fake", exec)
+	o := New(Deps{Store: state.NewStore(), Executors: executors})
+
+	_, st, err := o.StartBuild(yaml, "bucket", "key", "app")
+	if err != nil {
+		t.Fatalf("StartBuild: %v", err)
+	}
+	<-st.Done
+
+	var warnings []string
+	for len(st.Logs) > 0 {
+		if e := <-st.Logs; e.Level == "warn" {
+			warnings = append(warnings, e.Message)
+		}
+	}
+
+	if err := st.GetError(); err != nil {
+		t.Fatalf("build error: %v", err)
+	}
+	if st.GlobalDestination != "123456789012.dkr.ecr.us-east-1.amazonaws.com/app:1.0" {
+		t.Errorf("GlobalDestination = %q, want the first destination", st.GlobalDestination)
+	}
+	got, ok := exec.Config("amd64")
+	if !ok {
+		t.Fatal("task amd64 did not run")
+	}
+	mirrors := got.Mirrors
+	if len(mirrors) != 1 || mirrors[0] != "us-docker.pkg.dev/proj/repo/app:1.0" {
+		t.Errorf("Mirrors = %v, want the GAR destination", mirrors)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "123456789012.dkr.ecr.us-east-1.amazonaws.com") {
+		t.Errorf("warnings = %v, want one for the ECR registry only", warnings)
+	}
+}
+
+func TestStartBuildManifestNone(t *testing.T) {
+	t.Setenv("BUILD_RESULT_TIMEOUT", "10ms")
+
+	executors := NewRegistry()
+	executors.Register("fake", fakeexec.New())
+	o := New(Deps{Store: state.NewStore(), Executors: executors})
+
+	t.Run("shared destination", func(t *testing.T) {
+		// Both tasks would push registry.example.com/app:1.0, so the last push would win.
+		yaml := []byte(`
+global:
+  platform: fake
+  arch: amd64
+  kaniko:
+    destination: registry.example.com/app:1.0
+    manifest: none
+bake:
+  - {}
+  - kaniko:
+      build-args: {VARIANT: debug}
+`)
+		if _, _, err := o.StartBuild(yaml, "bucket", "key", "app"); !errors.Is(err, ErrInvalidDestination) {
+			t.Fatalf("StartBuild error = %v, want ErrInvalidDestination", err)
+		}
+	})
+
+	t.Run("own destinations", func(t *testing.T) {
+		yaml := []byte(`
+global:
+  platform: fake
+  arch: amd64
+  kaniko:
+    destination: registry.example.com/app:1.0
+    manifest: none
+bake:
+  - {}
+  - kaniko:
+      destination: registry.example.com/app:1.0-debug
+      build-args: {VARIANT: debug}
+`)
+		_, st, err := o.StartBuild(yaml, "bucket", "key", "app")
+		if err != nil {
+			t.Fatalf("StartBuild: %v", err)
+		}
+		<-st.Done
+
+		var messages []string
+		for len(st.Logs) > 0 {
+			messages = append(messages, (<-st.Logs).Message)
+		}
+
+		if err := st.GetError(); err != nil {
+			t.Fatalf("build error: %v", err)
+		}
+		if !st.IsSingleArch {
+			t.Error("IsSingleArch = false, want true with manifest: none")
+		}
+		if !st.HasDuplicateArch {
+			t.Error("HasDuplicateArch = false, want true for two amd64 tasks")
+		}
+		if got := len(st.GetResults()); got != 2 {
+			t.Errorf("results = %d, want 2", got)
+		}
+		for _, m := range messages {
+			if strings.Contains(m, "manifest creation") {
+				t.Errorf("unexpected manifest step: %q", m)
+			}
+		}
+	})
+}
+
+func TestCheckDestinations(t *testing.T) {
+	const global = "registry.example.com/app:1.0"
+	tests := []struct {
+		name    string
+		list    []config.EffectiveConfig
+		wantErr bool
+	}{
+		{"arch suffixes", []config.EffectiveConfig{{Arch: "amd64"}, {Arch: "arm64"}}, false},
+		{"duplicate arch suffixes", []config.EffectiveConfig{{Arch: "amd64"}, {Arch: "amd64"}}, false},
+		{"same own destination", []config.EffectiveConfig{
+			{Arch: "amd64", Destination: "registry.example.com/other:1.0"},
+			{Arch: "arm64", Destination: "registry.example.com/other:1.0"},
+		}, true},
+		{"same mirror", []config.EffectiveConfig{
+			{Arch: "amd64", Destination: "registry.example.com/app:amd64", Mirrors: []string{"mirror.example.com/app:1.0"}},
+			{Arch: "arm64", Destination: "registry.example.com/app:arm64", Mirrors: []string{"mirror.example.com/app:1.0"}},
+		}, true},
+		{"no-push task", []config.EffectiveConfig{
+			{Arch: "amd64", Destination: global},
+			{Arch: "arm64", Destination: global, NoPush: boolP(true)},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDestinations(tt.list, global, manifestSpec{})
+			if gotErr := errors.Is(err, ErrInvalidDestination); gotErr != tt.wantErr {
+				t.Errorf("checkDestinations error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMissingCredentials(t *testing.T) {
+	ef := config.EffectiveConfig{
+		Mirrors: []string{"us-docker.pkg.dev/proj/repo/app:1.0", "library/app:1.0", "localhost:5000/app"},
+		KanikoCredentials: []config.RegistryCredential{
+			{Registry: "https://index.docker.io/v1/"},
+			{Registry: "us-docker.pkg.dev"},
+		},
+	}
+
+	got := missingCredentials(ef, "registry.example.com/app:1.0")
+	want := []string{"registry.example.com", "localhost:5000"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("missingCredentials = %v, want %v", got, want)
+	}
+}
+
+type fakeHook struct {
+	mu     sync.Mutex
+	events []BuildEvent
+	err    error
+}
+
+func (h *fakeHook) Run(ctx context.Context, ev BuildEvent) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, ev)
+	return h.err
+}
+
+func TestPostBuildHook(t *testing.T) {
+	t.Setenv("BUILD_RESULT_TIMEOUT", "10ms")
+
+	yaml := []byte(`
+global:
+  platform: fake
+  arch: amd64
+  kaniko:
+    destination: registry.example.com/app:1.0
+bake:
+  - {}
+`)
+
+	start := func(t *testing.T, exec *fakeexec.Executor, hook *fakeHook) *state.BuildState {
+		t.Helper()
+		executors := NewRegistry()
+		executors.Register("fake", exec)
+		o := New(Deps{Store: state.NewStore(), Executors: executors, PostBuildHook: hook})
+
+		_, st, err := o.StartBuild(yaml, "bucket", "key", "app")
+		if err != nil {
+			t.Fatalf("StartBuild: %v", err)
+		}
+		<-st.Done
+		return st
+	}
+
+	t.Run("success", func(t *testing.T) {
+		hook := &fakeHook{}
+		st := start(t, fakeexec.New(), hook)
+
+		if len(hook.events) != 1 {
+			t.Fatalf("hook ran %d times, want 1", len(hook.events))
+		}
+		ev := hook.events[0]
+		if ev.BuildID != st.ID || ev.Service != "app" || ev.Status != "succeeded" || ev.Destination != "registry.example.com/app:1.0" {
+			t.Errorf("event = %+v", ev)
+		}
+		if got := ev.Tasks["amd64"].ImageDigest; got != fakeexec.Digest("amd64") {
+			t.Errorf("task digest = %q, want %q", got, fakeexec.Digest("amd64"))
+		}
+	})
+
+	t.Run("failed build", func(t *testing.T) {
+		exec := fakeexec.New()
+		exec.Fail = func(taskID string, ef config.EffectiveConfig) error {
+			return errors.New("kaniko exit=1")
+		}
+		hook := &fakeHook{}
+		start(t, exec, hook)
+
+		if len(hook.events) != 1 || hook.events[0].Status != "failed" || !strings.Contains(hook.events[0].Error, "kaniko exit=1") {
+			t.Errorf("events = %+v, want one failed event", hook.events)
+		}
+	})
+
+	t.Run("failed before dispatch", func(t *testing.T) {
+		hook := &fakeHook{}
+		o := New(Deps{Store: state.NewStore(), Executors: NewRegistry(), PostBuildHook: hook})
+
+		// Without a credential resolver, the secret reference fails in the background.
+		_, st, err := o.StartBuildNoWait([]byte(`
+global:
+  platform: fake
+  arch: amd64
+  kaniko-credentials:
+    - registry: registry.example.com
+      secret-arn: arn:aws:secretsmanager:us-east-1:123456789012:secret:registry
+  kaniko:
+    destination: registry.example.com/app:1.0
+bake:
+  - {}
+`), "bucket", "key", "app")
+		if err != nil {
+			t.Fatalf("StartBuildNoWait: %v", err)
+		}
+		<-st.Done
+
+		if len(hook.events) != 1 || hook.events[0].Status != "failed" || !strings.Contains(hook.events[0].Error, "secret-arn") {
+			t.Errorf("events = %+v, want one failed event for the credential error", hook.events)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		hook := &fakeHook{}
+		store := state.NewStore()
+		executors := NewRegistry()
+		executors.Register("fake", fakeexec.New())
+		o := New(Deps{Store: store, Executors: executors, PostBuildHook: hook})
+
+		batchID, builds, err := o.StartBatch([]byte(`
+services:
+  - name: api
+    config:
+      global:
+        platform: fake
+        arch: amd64
+        kaniko:
+          destination: registry.example.com/api:1.0
+      bake:
+        - {}
+  - name: web
+    config:
+      global:
+        platform: fake
+        arch: amd64
+        kaniko:
+          destination: registry.example.com/web:1.0
+      bake:
+        - {}
+`), "bucket", "key")
+		if err != nil {
+			t.Fatalf("StartBatch: %v", err)
+		}
+		parent, ok := store.Get(batchID)
+		if !ok {
+			t.Fatalf("batch %s not registered", batchID)
+		}
+		<-parent.Done
+
+		hook.mu.Lock()
+		defer hook.mu.Unlock()
+		if len(hook.events) != len(builds)+1 {
+			t.Fatalf("hook ran %d times, want %d", len(hook.events), len(builds)+1)
+		}
+		ev := hook.events[len(hook.events)-1]
+		if ev.BuildID != batchID || ev.Service != "" || ev.Status != "succeeded" {
+			t.Errorf("batch event = %+v", ev)
+		}
+	})
+
+	t.Run("hook error does not fail the build", func(t *testing.T) {
+		hook := &fakeHook{err: errors.New("deploy refused")}
+		st := start(t, fakeexec.New(), hook)
+
+		if err := st.GetError(); err != nil {
+			t.Errorf("build error = %v, want nil", err)
+		}
+		if got := st.Status(); got != "succeeded" {
+			t.Errorf("status = %q, want succeeded", got)
+		}
+	})
+}
+
+func TestWebhookHook(t *testing.T) {
+	var got BuildEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		if got.Status == "failed" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	hook := &WebhookHook{URL: srv.URL}
+	if err := hook.Run(context.Background(), BuildEvent{BuildID: "app-1", Status: "succeeded", ManifestDigest: "sha256:abc"}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got.BuildID != "app-1" || got.ManifestDigest != "sha256:abc" {
+		t.Errorf("posted event = %+v", got)
+	}
+
+	if err := hook.Run(context.Background(), BuildEvent{BuildID: "app-2", Status: "failed"}); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("non-2xx response: err = %v", err)
+	}
+}
+
+func TestExpandDestination(t *testing.T) {
+	t.Setenv("BAKERY_TAG_GIT_SHORT_SHA", "abc1234")
+	t.Setenv("STORAGE_SECRET_KEY", "s3cret")
+	vars := newDestinationVars("b-123-app", "My App", time.Date(2024, 6, 1, 23, 0, 0, 0, time.UTC))
+
+	tests := []struct {
+		dest string
+		arch string
+		want string
+	}{
+		{"registry.example.com/app:1.0", "amd64", "registry.example.com/app:1.0"},
+		{"registry.example.com/app:{arch}", "arm64", "registry.example.com/app:arm64"},
+		{"registry.example.com/app:{build-id}", "amd64", "registry.example.com/app:b-123-app"},
+		{"registry.example.com/app:{date}", "amd64", "registry.example.com/app:20240601"},
+		{"registry.example.com/{service}:latest", "amd64", "registry.example.com/my-app:latest"},
+		{"registry.example.com/app:{env:BAKERY_TAG_GIT_SHORT_SHA}", "amd64", "registry.example.com/app:abc1234"},
+		{"registry.example.com/app:{arch}-{env:BAKERY_TAG_GIT_SHORT_SHA}-{date}", "arm64", "registry.example.com/app:arm64-abc1234-20240601"},
+		// Without an arch, {arch} and one adjacent separator are dropped for the manifest tag.
+		{"registry.example.com/app:{arch}-{env:BAKERY_TAG_GIT_SHORT_SHA}-{date}", "", "registry.example.com/app:abc1234-20240601"},
+		{"registry.example.com/app:{date}_{arch}", "", "registry.example.com/app:20240601"},
+		{"registry.example.com:5000/app:{arch}", "", "registry.example.com:5000/app"},
+	}
+	for _, tt := range tests {
+		got, err := expandDestination(tt.dest, tt.arch, vars)
+		if err != nil {
+			t.Errorf("expandDestination(%q, %q): %v", tt.dest, tt.arch, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandDestination(%q, %q) = %q, want %q", tt.dest, tt.arch, got, tt.want)
+		}
+	}
+
+	for _, dest := range []string{
+		"registry.example.com/app:{commit}",
+		"registry.example.com/app:{env:BAKERY_TAG_UNSET_VAR}",
+		"registry.example.com/app:{env:STORAGE_SECRET_KEY}",
+		"registry.example.com/app:{arch",
+	} {
+		if _, err := expandDestination(dest, "amd64", vars); !errors.Is(err, ErrInvalidDestination) {
+			t.Errorf("expandDestination(%q) error = %v, want ErrInvalidDestination", dest, err)
+		}
+	}
+}
+
+func TestExpandManifestTags(t *testing.T) {
+	t.Setenv("BAKERY_TAG_GIT_SHORT_SHA", "abc1234")
+	vars := newDestinationVars("b-1", "app", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	got, err := expandManifestTags("registry.example.com:5000/app:latest", []string{"1.2.3", "{env:BAKERY_TAG_GIT_SHORT_SHA}-{date}"}, vars)
+	if err != nil {
+		t.Fatalf("expandManifestTags: %v", err)
+	}
+	want := []string{"registry.example.com:5000/app:1.2.3", "registry.example.com:5000/app:abc1234-20240601"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandManifestTags = %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		dest string
+		tags []string
+	}{
+		{"", []string{"1.2.3"}},
+		{"registry.example.com/app:latest", []string{"other/app:1.2.3"}},
+		{"registry.example.com/app:latest", []string{"{arch}"}},
+	} {
+		if _, err := expandManifestTags(tc.dest, tc.tags, vars); !errors.Is(err, ErrInvalidDestination) {
+			t.Errorf("expandManifestTags(%q, %v) error = %v, want ErrInvalidDestination", tc.dest, tc.tags, err)
+		}
+	}
+}
+
+func TestSortManifestImages(t *testing.T) {
+	images := []registry.PlatformImage{
+		{Arch: "amd64", Image: "app:amd64"},
+		{Arch: "arm/v7", Image: "app:arm-v7"},
+		{Arch: "arm64", Image: "app:arm64"},
+		{Arch: "amd64", Image: "app:amd64-debug"},
+		{Arch: "s390x", Image: "app:s390x"},
+	}
+
+	sortManifestImages(images, []string{"arm64", "amd64"})
+	var got []string
+	for _, img := range images {
+		got = append(got, img.Image)
+	}
+	want := []string{"app:arm64", "app:amd64", "app:amd64-debug", "app:arm-v7", "app:s390x"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sorted images = %v, want %v", got, want)
+	}
+
+	sortManifestImages(images, nil)
+	if images[0].Image != "app:arm64" {
+		t.Errorf("empty order reordered images: %v", images)
+	}
+}
+
+func TestExpandDestinationsArchSuffix(t *testing.T) {
+	vars := newDestinationVars("b-1", "app", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	manifest := func(t *testing.T, list []config.EffectiveConfig, global string) map[string]string {
+		t.Helper()
+		taskIDs, hasDuplicateArch := assignTaskIDs(list)
+		st := state.NewBuildState("b-test", len(list), false, global)
+		st.HasDuplicateArch = hasDuplicateArch
+		for i, ef := range list {
+			st.SetResult(taskIDs[i], ef.Arch, "sha256:"+ef.Arch, true, "")
+		}
+		images, err := manifestImages(st, list, taskIDs)
+		if err != nil {
+			t.Fatalf("manifestImages: %v", err)
+		}
+		got := map[string]string{}
+		for _, img := range images {
+			got[img.Arch] = img.Image
+		}
+		return got
+	}
+
+	t.Run("arch placeholder replaces the suffix", func(t *testing.T) {
+		list := []config.EffectiveConfig{{Arch: "amd64"}, {Arch: "arm64"}}
+		global, err := expandDestinations(list, "registry.example.com/app:{arch}-{date}", vars)
+		if err != nil {
+			t.Fatalf("expandDestinations: %v", err)
+		}
+		if global != "registry.example.com/app:20240601" {
+			t.Errorf("global = %q, want registry.example.com/app:20240601", global)
+		}
+		images := manifest(t, list, global)
+		for _, arch := range []string{"amd64", "arm64"} {
+			if want := "registry.example.com/app:" + arch + "-20240601"; images[arch] != want {
+				t.Errorf("%s image = %q, want %q", arch, images[arch], want)
+			}
+		}
+	})
+
+	t.Run("no arch placeholder keeps the suffix", func(t *testing.T) {
+		list := []config.EffectiveConfig{{Arch: "amd64"}, {Arch: "arm64"}}
+		global, err := expandDestinations(list, "registry.example.com/app:{date}", vars)
+		if err != nil {
+			t.Fatalf("expandDestinations: %v", err)
+		}
+		if list[0].Destination != "" {
+			t.Errorf("Destination = %q, want inherited", list[0].Destination)
+		}
+		images := manifest(t, list, global)
+		for _, arch := range []string{"amd64", "arm64"} {
+			if want := "registry.example.com/app:20240601_" + arch; images[arch] != want {
+				t.Errorf("%s image = %q, want %q", arch, images[arch], want)
+			}
+		}
+	})
+
+	t.Run("mirrors are expanded per task", func(t *testing.T) {
+		list := []config.EffectiveConfig{{Arch: "arm64", Mirrors: []string{"mirror.example.com/app:{arch}-{build-id}"}}}
+		if _, err := expandDestinations(list, "registry.example.com/app:{arch}", vars); err != nil {
+			t.Fatalf("expandDestinations: %v", err)
+		}
+		if got := list[0].Mirrors[0]; got != "mirror.example.com/app:arm64-b-1" {
+			t.Errorf("mirror = %q, want mirror.example.com/app:arm64-b-1", got)
+		}
+	})
+}
+
+func TestBuildQueueFairness(t *testing.T) {
+	q := newBuildQueue(1)
+	if b := q.enqueue("a", "a-0"); b != nil {
+		t.Fatal("first build queued, want it admitted")
+	}
+
+	var queued []*queuedBuild
+	for _, id := range []string{"a-1", "a-2", "a-3"} {
+		queued = append(queued, q.enqueue("a", id))
+	}
+	queued = append(queued, q.enqueue("b", "b-1"))
+
+	wantPositions := map[string]int{"a-1": 1, "b-1": 2, "a-2": 3, "a-3": 4, "a-0": 0}
+	for id, want := range wantPositions {
+		if got := q.position(id); got != want {
+			t.Errorf("position(%s) = %d, want %d", id, got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.wait(ctx, queued[2]); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait with canceled ctx = %v, want context.Canceled", err)
+	}
+	if got := q.position("a-3"); got != 0 {
+		t.Errorf("position(a-3) after cancel = %d, want 0", got)
+	}
+
+	var admitted []string
+	pending := []*queuedBuild{queued[0], queued[1], queued[3]}
+	for len(pending) > 0 {
+		q.release()
+		for i, b := range pending {
+			select {
+			case <-b.ready:
+				admitted = append(admitted, b.id)
+				pending = append(pending[:i:i], pending[i+1:]...)
+			default:
+				continue
+			}
+			break
+		}
+	}
+	if want := []string{"a-1", "b-1", "a-2"}; !reflect.DeepEqual(admitted, want) {
+		t.Errorf("admission order = %v, want %v", admitted, want)
+	}
+}
+
+func TestStartBuildWaitsForSlot(t *testing.T) {
+	t.Setenv("MAX_CONCURRENT_BUILDS", "1")
+
+	yaml := []byte(`
+global:
+  platform: fake
+  arch: amd64
+  kaniko:
+    destination: registry.example.com/app:1.0
+bake:
+  - {}
+`)
+
+	release := make(chan struct{})
+	exec := fakeexec.New()
+	exec.Fail = func(taskID string, ef config.EffectiveConfig) error {
+		<-release
+		return nil
+	}
+	executors := NewRegistry()
+	executors.Register("fake", exec)
+	o := New(Deps{Store: state.NewStore(), Executors: executors})
+
+	_, first, err := o.StartBuild(yaml, "bucket", "key", "payments-api")
+	if err != nil {
+		t.Fatalf("StartBuild: %v", err)
+	}
+	secondID, second, err := o.StartBuild(yaml, "bucket", "key", "payments-worker")
+	if err != nil {
+		t.Fatalf("StartBuild: %v", err)
+	}
+	if got := o.QueuePosition(secondID); got != 1 {
+		t.Errorf("QueuePosition = %d, want 1 while the first build runs", got)
+	}
+
+	close(release)
+	<-first.Done
+	<-second.Done
+	if err := second.GetError(); err != nil {
+		t.Fatalf("queued build error: %v", err)
+	}
+	if got := o.QueuePosition(secondID); got != 0 {
+		t.Errorf("QueuePosition after finishing = %d, want 0", got)
+	}
+}
+
+type fakeReportStore struct {
+	bucket, key string
+	body        []byte
+}
+
+func (s *fakeReportStore) PutObject(ctx context.Context, bucket, key string, r io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	s.bucket, s.key = bucket, key
+	body, err := io.ReadAll(r)
+	s.body = body
+	return minio.UploadInfo{Bucket: bucket, Key: key, Size: size}, err
+}
+
+func TestWriteBuildReport(t *testing.T) {
+	store := &fakeReportStore{}
+	o := New(Deps{Store: state.NewStore(), Executors: NewRegistry(), S3Bucket: "builds", Reports: store})
+
+	st := state.NewBuildState("b-report", 2, false, "registry.example.com/app:1.0")
+	st.SetEffective([]string{"amd64", "arm64"}, []config.EffectiveConfig{{Arch: "amd64"}, {Arch: "arm64"}})
+	st.SetResult("amd64", "amd64", "sha256:aaa", true, "")
+	st.SetResult("arm64", "arm64", "sha256:bbb", true, "")
+	st.SetManifestDigest("sha256:list")
+
+	o.writeBuildReport(st, "app", "registry.example.com/app:1.0", []string{"registry.example.com/app:latest"})
+
+	if store.bucket != "builds" || store.key != "results/b-report.json" {
+		t.Errorf("object = %s/%s, want builds/results/b-report.json", store.bucket, store.key)
+	}
+	var report BuildReport
+	if err := json.Unmarshal(store.body, &report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if report.BuildID != "b-report" || report.Service != "app" || report.Status != "succeeded" {
+		t.Errorf("report = %+v", report)
+	}
+	if report.ManifestDigest != "sha256:list" {
+		t.Errorf("ManifestDigest = %q, want sha256:list", report.ManifestDigest)
+	}
+	if got := report.Tasks["amd64"].ImageDigest; got != "sha256:aaa" {
+		t.Errorf("amd64 digest = %q, want sha256:aaa", got)
+	}
+	if got := report.Tasks["arm64"].ImageDigest; got != "sha256:bbb" {
+		t.Errorf("arm64 digest = %q, want sha256:bbb", got)
+	}
+	if !reflect.DeepEqual(report.Tags, []string{"registry.example.com/app:latest"}) {
+		t.Errorf("Tags = %v", report.Tags)
+	}
+	if !strings.HasPrefix(report.ConfigHash, "sha256:") {
+		t.Errorf("ConfigHash = %q, want a sha256 digest", report.ConfigHash)
+	}
+	if got := st.Summary().ReportKey; got != "results/b-report.json" {
+		t.Errorf("ReportKey = %q, want results/b-report.json", got)
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	t.Setenv("BUILD_RESULT_TIMEOUT", "10ms")
+
+	yaml := []byte(`
+global:
+  platform: fake
+  kaniko:
+    destination: registry.example.com/app:1.0
+bake:
+  - arch: amd64
+  - arch: arm64
+`)
+
+	// amd64 fails at once while arm64 is still building for armDelay.
+	start := func(t *testing.T, armDelay time.Duration) (*state.BuildState, *fakeexec.Executor, time.Duration) {
+		t.Helper()
+		exec := fakeexec.New()
+		exec.TaskDelay = func(taskID string) time.Duration {
+			if taskID == "arm64" {
+				return armDelay
+			}
+			return 0
+		}
+		exec.Fail = func(taskID string, ef config.EffectiveConfig) error {
+			if taskID == "amd64" {
+				return errors.New("kaniko exit=1")
+			}
+			return nil
+		}
+		executors := NewRegistry()
+		executors.Register("fake", exec)
+		o := New(Deps{Store: state.NewStore(), Executors: executors})
+
+		began := time.Now()
+		_, st, err := o.StartBuild(yaml, "bucket", "key", "app")
+		if err != nil {
+			t.Fatalf("StartBuild: %v", err)
+		}
+		<-st.Done
+		return st, exec, time.Since(began)
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Setenv("FAIL_FAST", "true")
+		st, exec, elapsed := start(t, 5*time.Second)
+
+		if elapsed > 3*time.Second {
+			t.Errorf("build took %s, want arm64 canceled after amd64 failed", elapsed)
+		}
+		if err := st.GetError(); err == nil || !strings.Contains(err.Error(), "kaniko exit=1") {
+			t.Errorf("build error = %v, want the amd64 failure", err)
+		}
+		if r := st.GetResults()["arm64"]; r.Success || !strings.Contains(r.Error, "FAIL_FAST") {
+			t.Errorf("arm64 result = %+v, want canceled by FAIL_FAST", r)
+		}
+		if got := exec.Canceled(); len(got) != 1 || got[0] != "arm64" {
+			t.Errorf("canceled tasks = %v, want arm64 stopped through the executor", got)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("FAIL_FAST", "")
+		st, exec, _ := start(t, 50*time.Millisecond)
+
+		if r := st.GetResults()["arm64"]; !r.Success {
+			t.Errorf("arm64 result = %+v, want it to finish without FAIL_FAST", r)
+		}
+		if got := exec.Canceled(); len(got) != 0 {
+			t.Errorf("canceled tasks = %v, want none", got)
+		}
+	})
+}
+
+func TestWatchHeartbeat(t *testing.T) {
+	defer func(d time.Duration) { heartbeatCheckInterval = d }(heartbeatCheckInterval)
+	heartbeatCheckInterval = 10 * time.Millisecond
+
+	t.Run("silent agent", func(t *testing.T) {
+		st := state.NewBuildState("b-test", 1, true, "")
+		st.MarkHeartbeat("t1")
+		ctx, cancel := context.WithCancelCause(context.Background())
+		defer cancel(nil)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			watchHeartbeat(ctx, st, "t1", 50*time.Millisecond, cancel)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("watchHeartbeat did not cancel a silent task")
+		}
+		if err := context.Cause(ctx); !errors.Is(err, errHeartbeatTimeout) {
+			t.Errorf("cause = %v, want %v", err, errHeartbeatTimeout)
+		}
+	})
+
+	t.Run("live agent", func(t *testing.T) {
+		st := state.NewBuildState("b-test", 1, true, "")
+		st.MarkHeartbeat("t1")
+		ctx, cancel := context.WithCancelCause(context.Background())
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			watchHeartbeat(ctx, st, "t1", time.Minute, cancel)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		cancel(nil)
+		<-done
+		if err := context.Cause(ctx); err != context.Canceled {
+			t.Errorf("cause = %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		st := state.NewBuildState("b-test", 1, true, "")
+		ctx, cancel := context.WithCancelCause(context.Background())
+		defer cancel(nil)
+		watchHeartbeat(ctx, st, "t1", 0, cancel)
+		if ctx.Err() != nil {
+			t.Error("a disabled watch canceled the task")
+		}
+	})
+}
+
+// crashOnceExecutor records an agent exit in the build state on the first task it
+// runs, as the real executors do, and runs later tasks on the embedded fake.
+type crashOnceExecutor struct {
+	*fakeexec.Executor
+	crashed bool
+}
+
+func (e *crashOnceExecutor) RunTask(
+	ctx context.Context,
+	st *state.BuildState,
+	taskID string,
+	ef config.EffectiveConfig,
+	contextBucket string,
+	contextKey string,
+	ingestURL string,
+) error {
+	if !e.crashed {
+		e.crashed = true
+		st.SetTaskError(taskID, errors.New("agent exit=137 (kaniko): OOMKilled"))
+		return nil
+	}
+	return e.Executor.RunTask(ctx, st, taskID, ef, contextBucket, contextKey, ingestURL)
+}
+
+func TestTaskRetries(t *testing.T) {
+	t.Setenv("BUILD_RESULT_TIMEOUT", "10ms")
+	t.Setenv("TASK_RETRIES", "1")
+
+	// run builds a single amd64 task whose first failures attempts fail.
+	run := func(t *testing.T, failures int) (*state.BuildState, *fakeexec.Executor) {
+		t.Helper()
+		var mu sync.Mutex
+		exec := fakeexec.New()
+		exec.Fail = func(taskID string, ef config.EffectiveConfig) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if failures > 0 {
+				failures--
+				return errors.New("kaniko exit=1")
+			}
+			return nil
+		}
+		executors := NewRegistry()
+		executors.Register("fake", exec)
+		o := New(Deps{Store: state.NewStore(), Executors: executors})
+
+		_, st, err := o.StartBuild([]byte(`
+global:
+  platform: fake
+  kaniko:
+    destination: registry.example.com/app:1.0
+bake:
+  - arch: amd64
+`), "bucket", "key", "app")
+		if err != nil {
+			t.Fatalf("StartBuild: %v", err)
+		}
+		<-st.Done
+		return st, exec
+	}
+
+	t.Run("retry succeeds", func(t *testing.T) {
+		st, exec := run(t, 1)
+
+		if got := exec.Tasks(); len(got) != 2 {
+			t.Errorf("tasks run = %v, want amd64 dispatched twice", got)
+		}
+		if err := st.GetError(); err != nil {
+			t.Errorf("build error = %v, want the retry to replace the failed attempt", err)
+		}
+		if r := st.GetResults()["amd64"]; !r.Success || r.Attempt != 2 {
+			t.Errorf("amd64 result = %+v, want attempt 2 succeeded", r)
+		}
+	})
+
+	t.Run("retry after an executor-recorded failure", func(t *testing.T) {
+		// Like an OOM-killed agent on K8s: the executor records the exit code and
+		// returns without the agent ever sending a result.
+		exec := &crashOnceExecutor{Executor: fakeexec.New()}
+		executors := NewRegistry()
+		executors.Register("fake", exec)
+		o := New(Deps{Store: state.NewStore(), Executors: executors})
+
+		_, st, err := o.StartBuild([]byte(`
+global:
+  platform: fake
+  kaniko:
+    destination: registry.example.com/app:1.0
+bake:
+  - arch: amd64
+`), "bucket", "key", "app")
+		if err != nil {
+			t.Fatalf("StartBuild: %v", err)
+		}
+		<-st.Done
+
+		if got := exec.Tasks(); len(got) != 1 || !exec.crashed {
+			t.Errorf("tasks run = %v (crashed %t), want one crash then amd64 on the fake", got, exec.crashed)
+		}
+		if err := st.GetError(); err != nil {
+			t.Errorf("build error = %v, want the retry to clear the crashed attempt", err)
+		}
+		if r := st.GetResults()["amd64"]; !r.Success || r.Attempt != 2 {
+			t.Errorf("amd64 result = %+v, want attempt 2 succeeded", r)
+		}
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		st, exec := run(t, 2)
+
+		if got := exec.Tasks(); len(got) != 2 {
+			t.Errorf("tasks run = %v, want amd64 dispatched twice", got)
+		}
+		if err := st.GetError(); err == nil || !strings.Contains(err.Error(), "kaniko exit=1") {
+			t.Errorf("build error = %v, want the last attempt's failure", err)
+		}
+		if r := st.GetResults()["amd64"]; r.Success || r.Attempt != 2 {
+			t.Errorf("amd64 result = %+v, want attempt 2 failed", r)
+		}
+	})
+}
+
+func TestBuildTotalTimeout(t *testing.T) {
+	t.Setenv("BUILD_TOTAL_TIMEOUT", "200ms")
+	t.Setenv("BUILD_RESULT_TIMEOUT", "10s")
+
+	exec := fakeexec.New()
+	exec.TaskDelay = func(taskID string) time.Duration {
+		if taskID == "arm64" {
+			return 10 * time.Second
+		}
+		return 0
+	}
+	executors := NewRegistry()
+	executors.Register("fake", exec)
+	o := New(Deps{Store: state.NewStore(), Executors: executors})
+
+	began := time.Now()
+	_, st, err := o.StartBuild([]byte(`
+global:
+  platform: fake
+  kaniko:
+    destination: registry.example.com/app:1.0
+bake:
+  - arch: amd64
+  - arch: arm64
+`), "bucket", "key", "app")
+	if err != nil {
+		t.Fatalf("StartBuild: %v", err)
+	}
+	<-st.Done
+
+	if elapsed := time.Since(began); elapsed > 5*time.Second {
+		t.Errorf("build took %s, want it stopped by BUILD_TOTAL_TIMEOUT", elapsed)
+	}
+	if err := st.GetError(); err == nil || !strings.Contains(err.Error(), "BUILD_TOTAL_TIMEOUT") {
+		t.Errorf("build error = %v, want the total timeout", err)
+	}
+	if r := st.GetResults()["arm64"]; r.Success || !strings.Contains(r.Error, "BUILD_TOTAL_TIMEOUT") {
+		t.Errorf("arm64 result = %+v, want canceled by the total timeout", r)
+	}
+	if r := st.GetResults()["amd64"]; !r.Success {
+		t.Errorf("amd64 result = %+v, want it to finish before the timeout", r)
+	}
+	if got := exec.Canceled(); len(got) != 1 || got[0] != "arm64" {
+		t.Errorf("canceled tasks = %v, want arm64 stopped through the executor", got)
+	}
+}
+
+func TestPurgeCancelsTasks(t *testing.T) {
+	exec := fakeexec.New()
+	exec.Delay = 10 * time.Second
+	executors := NewRegistry()
+	executors.Register("fake", exec)
+	store := state.NewStore()
+	o := New(Deps{Store: store, Executors: executors})
+
+	buildID, _, err := o.StartBuild([]byte(`
+global:
+  platform: fake
+  arch: amd64
+  kaniko:
+    destination: registry.example.com/app:1.0
+bake:
+  - {}
+`), "bucket", "key", "app")
+	if err != nil {
+		t.Fatalf("StartBuild: %v", err)
+	}
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitFor("the task to start", func() bool { return len(exec.Tasks()) == 1 })
+	if _, ok := store.Purge(buildID, time.Second); !ok {
+		t.Fatal("Purge: build not found")
+	}
+	waitFor("the task to be canceled", func() bool { return len(exec.Canceled()) == 1 })
+	if got := exec.Canceled(); got[0] != "amd64" {
+		t.Errorf("canceled tasks = %v, want [amd64]", got)
+	}
+}
@@ -0,0 +1,166 @@
+package orchestrator
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// buildQueue caps how many builds dispatch tasks at once (MAX_CONCURRENT_BUILDS).
+// Builds over the limit wait in one queue per tenant, and free slots go to the
+// tenants in turn, so a burst of builds from one tenant cannot starve the others.
+type buildQueue struct {
+	limit int
+
+	mu      sync.Mutex
+	running int
+	tenants []string // tenants with waiting builds, in turn order
+	waiting map[string][]*queuedBuild
+}
+
+// queuedBuild is a build waiting for a slot. ready is closed once it is admitted.
+type queuedBuild struct {
+	id     string
+	tenant string
+	ready  chan struct{}
+}
+
+// newBuildQueue returns a queue admitting limit builds at once. A non-positive
+// limit admits every build immediately.
+func newBuildQueue(limit int) *buildQueue {
+	return &buildQueue{limit: limit, waiting: map[string][]*queuedBuild{}}
+}
+
+// buildTenant returns the tenant a build is queued under: the service name up to
+// its first '-', e.g. "payments" for "payments-api", or the whole name otherwise.
+func buildTenant(serviceName string) string {
+	if i := strings.IndexByte(serviceName, '-'); i > 0 {
+		return serviceName[:i]
+	}
+	return serviceName
+}
+
+// enqueue admits the build at once and returns nil when a slot is free and no
+// other build is waiting. Otherwise it queues the build and returns it for wait.
+func (q *buildQueue) enqueue(tenant, buildID string) *queuedBuild {
+	if q.limit <= 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.running < q.limit && len(q.tenants) == 0 {
+		q.running++
+		return nil
+	}
+
+	b := &queuedBuild{id: buildID, tenant: tenant, ready: make(chan struct{})}
+	if _, ok := q.waiting[tenant]; !ok {
+		q.tenants = append(q.tenants, tenant)
+	}
+	q.waiting[tenant] = append(q.waiting[tenant], b)
+	return b
+}
+
+// wait blocks until b is admitted. If ctx is done first, b leaves the queue.
+func (q *buildQueue) wait(ctx context.Context, b *queuedBuild) error {
+	select {
+	case <-b.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	select {
+	case <-b.ready:
+		// Admitted while ctx was being canceled; hand the slot on.
+		q.running--
+		q.admitLocked()
+	default:
+		q.removeLocked(b)
+	}
+	return context.Cause(ctx)
+}
+
+// release frees the slot of an admitted build and admits the next waiting one.
+func (q *buildQueue) release() {
+	if q.limit <= 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.running--
+	q.admitLocked()
+}
+
+// admitLocked fills free slots with the next build of the tenant whose turn it is,
+// which then moves to the back of the turn order. Callers must hold q.mu.
+func (q *buildQueue) admitLocked() {
+	for q.running < q.limit && len(q.tenants) > 0 {
+		tenant := q.tenants[0]
+		q.tenants = q.tenants[1:]
+
+		builds := q.waiting[tenant]
+		if len(builds) > 1 {
+			q.waiting[tenant] = builds[1:]
+			q.tenants = append(q.tenants, tenant)
+		} else {
+			delete(q.waiting, tenant)
+		}
+
+		q.running++
+		close(builds[0].ready)
+	}
+}
+
+// removeLocked drops b from the queue. Callers must hold q.mu.
+func (q *buildQueue) removeLocked(b *queuedBuild) {
+	builds := q.waiting[b.tenant]
+	for i, w := range builds {
+		if w == b {
+			builds = append(builds[:i:i], builds[i+1:]...)
+			break
+		}
+	}
+	if len(builds) > 0 {
+		q.waiting[b.tenant] = builds
+		return
+	}
+
+	delete(q.waiting, b.tenant)
+	for i, t := range q.tenants {
+		if t == b.tenant {
+			q.tenants = append(q.tenants[:i:i], q.tenants[i+1:]...)
+			break
+		}
+	}
+}
+
+// position returns the 1-based place of buildID in the order builds will be
+// admitted, or 0 when it is not waiting.
+func (q *buildQueue) position(buildID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pos := 0
+	for round, more := 0, true; more; round++ {
+		more = false
+		for _, tenant := range q.tenants {
+			builds := q.waiting[tenant]
+			if round >= len(builds) {
+				continue
+			}
+			more = true
+			pos++
+			if builds[round].id == buildID {
+				return pos
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,36 @@
+package orchestrator
+
+import "sync"
+
+// Registry maps platform names (the `platform` field of a build config) to executors.
+type Registry struct {
+	mu        sync.RWMutex
+	executors map[string]Executor
+}
+
+// NewRegistry creates an empty executor registry.
+func NewRegistry() *Registry {
+	return &Registry{executors: make(map[string]Executor)}
+}
+
+// Register makes e available under platform, replacing any previous executor.
+// A nil executor is ignored so optional backends can be registered unconditionally.
+func (r *Registry) Register(platform string, e Executor) {
+	if e == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.executors[platform] = e
+}
+
+// Lookup returns the executor registered under platform.
+func (r *Registry) Lookup(platform string) (Executor, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.executors[platform]
+	return e, ok
+}
@@ -0,0 +1,113 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/rayshoo/bakery/internal/state"
+)
+
+// buildReportTimeout bounds writing a build report to storage.
+const buildReportTimeout = 30 * time.Second
+
+// ReportStore is the object storage build reports are written to (WRITE_BUILD_REPORT).
+// *minio.Client implements it.
+type ReportStore interface {
+	PutObject(ctx context.Context, bucket, key string, r io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error)
+}
+
+// BuildReport is the machine-readable summary of a finished build, written to
+// results/<buildID>.json for downstream automation.
+type BuildReport struct {
+	BuildID         string                      `json:"buildID"`
+	Service         string                      `json:"service,omitempty"`
+	Status          string                      `json:"status"`
+	Error           string                      `json:"error,omitempty"`
+	Destination     string                      `json:"destination,omitempty"`
+	ManifestDigest  string                      `json:"manifestDigest,omitempty"`
+	Tags            []string                    `json:"tags,omitempty"`
+	StartedAt       time.Time                   `json:"startedAt"`
+	FinishedAt      time.Time                   `json:"finishedAt"`
+	DurationSeconds float64                     `json:"durationSeconds"`
+	ConfigHash      string                      `json:"configHash,omitempty"`
+	Tasks           map[string]state.TaskResult `json:"tasks"`
+}
+
+// buildReportKey returns the storage key of the report of buildID.
+func buildReportKey(buildID string) string {
+	return "results/" + buildID + ".json"
+}
+
+// newBuildReport summarizes st as of finishedAt. tags are the extra manifest list tags.
+func newBuildReport(st *state.BuildState, serviceName, destination string, tags []string, finishedAt time.Time) BuildReport {
+	sum := st.Summary()
+	r := BuildReport{
+		BuildID:         st.ID,
+		Service:         serviceName,
+		Status:          "succeeded",
+		Destination:     destination,
+		ManifestDigest:  sum.ManifestDigest,
+		StartedAt:       sum.StartedAt,
+		FinishedAt:      finishedAt,
+		DurationSeconds: finishedAt.Sub(sum.StartedAt).Seconds(),
+		ConfigHash:      configHash(st.Effective()),
+		Tasks:           sum.Tasks,
+	}
+	if !st.IsSingleArch {
+		r.Tags = tags
+	}
+	if err := st.GetError(); err != nil {
+		r.Status = "failed"
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// configHash returns the sha256 of the redacted configs the tasks ran with, so
+// builds of the same configuration can be matched, or "" when none were recorded.
+func configHash(tasks []state.EffectiveTask) string {
+	if len(tasks) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(tasks)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// writeBuildReport writes the report of st to the report store, when one is
+// configured, and records its key on the build. Failures are logged and never
+// fail the build.
+func (o *Orchestrator) writeBuildReport(st *state.BuildState, serviceName, destination string, tags []string) {
+	if o.reports == nil {
+		return
+	}
+
+	body, err := json.MarshalIndent(newBuildReport(st, serviceName, destination, tags, time.Now()), "", "  ")
+	if err != nil {
+		st.AppendLog("warn", fmt.Sprintf("build report failed: %v", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), buildReportTimeout)
+	defer cancel()
+
+	key := buildReportKey(st.ID)
+	if _, err := o.reports.PutObject(ctx, o.S3Bucket, key, bytes.NewReader(body), int64(len(body)), minio.PutObjectOptions{
+		ContentType: "application/json",
+	}); err != nil {
+		st.AppendLog("warn", fmt.Sprintf("build report failed: %v", err))
+		return
+	}
+	st.SetReportKey(key)
+	st.AppendLog("info", fmt.Sprintf("build report written to s3://%s/%s", o.S3Bucket, key))
+}
@@ -2,8 +2,12 @@ package registry
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"time"
 
+	"github.com/rayshoo/bakery/internal/config"
 	"github.com/rayshoo/bakery/internal/state"
 
 	"github.com/google/go-containerregistry/pkg/authn"
@@ -12,6 +16,7 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
@@ -20,14 +25,31 @@ type PlatformImage struct {
 	Arch   string
 	Image  string
 	Digest string
+
+	// Platform overrides Arch in the manifest list when set, e.g. "linux/arm/v6".
+	Platform string
+}
+
+// FetchRetry bounds the retries of a per-arch image fetch that finds no manifest,
+// as happens on eventually consistent registries right after an agent pushed it.
+type FetchRetry struct {
+	// Attempts is the total number of fetches per image; below 1 means one.
+	Attempts int
+	// Backoff is the wait before the first retry, doubled before each next one.
+	Backoff time.Duration
 }
 
 // CreateManifestList creates a multi-arch manifest list from platform images and pushes it to the registry.
+// The same manifest list is then pushed to each of mirrors, which may be on other registries,
+// and tagged at each of extraTags, so every reference resolves to one digest.
 func CreateManifestList(
 	ctx context.Context,
 	st *state.BuildState,
 	images []PlatformImage,
 	targetTag string,
+	mirrors []string,
+	extraTags []string,
+	retry FetchRetry,
 ) error {
 
 	st.AppendLog("info", fmt.Sprintf("creating manifest list for %s", targetTag))
@@ -42,12 +64,16 @@ func CreateManifestList(
 
 		st.AppendLog("debug", fmt.Sprintf("  fetching %s", ref.String()))
 
-		remoteImg, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		remoteImg, err := fetchImage(ctx, st, ref, retry)
 		if err != nil {
 			return fmt.Errorf("fetch image %s: %w", ref.String(), err)
 		}
 
-		platform, err := getPlatformForArch(img.Arch)
+		platformStr := img.Arch
+		if img.Platform != "" {
+			platformStr = img.Platform
+		}
+		platform, err := getPlatformForArch(platformStr)
 		if err != nil {
 			return err
 		}
@@ -59,7 +85,7 @@ func CreateManifestList(
 			},
 		})
 
-		st.AppendLog("debug", fmt.Sprintf("  added %s/%s", platform.OS, platform.Architecture))
+		st.AppendLog("debug", fmt.Sprintf("  added %s", platform.String()))
 	}
 
 	idx := mutate.AppendManifests(
@@ -83,47 +109,82 @@ func CreateManifestList(
 		return fmt.Errorf("get digest: %w", err)
 	}
 
+	st.SetManifestDigest(digest.String())
 	st.AppendLog("info", fmt.Sprintf("manifest list pushed: %s", digest.String()))
 
+	for _, mirror := range mirrors {
+		mirrorRef, err := name.ParseReference(mirror, name.WeakValidation)
+		if err != nil {
+			return fmt.Errorf("parse mirror %s: %w", mirror, err)
+		}
+		st.AppendLog("info", fmt.Sprintf("pushing manifest list to mirror %s", mirrorRef.String()))
+		if err := remote.WriteIndex(mirrorRef, idx, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
+			return fmt.Errorf("push manifest list to mirror %s: %w", mirrorRef.String(), err)
+		}
+	}
+
+	for _, extra := range extraTags {
+		tag, err := name.NewTag(extra, name.WeakValidation)
+		if err != nil {
+			return fmt.Errorf("parse manifest tag %s: %w", extra, err)
+		}
+		st.AppendLog("info", fmt.Sprintf("tagging manifest list as %s", tag.String()))
+		if err := remote.Tag(tag, idx, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
+			return fmt.Errorf("tag manifest list %s: %w", tag.String(), err)
+		}
+	}
+
 	return nil
 }
 
-// getPlatformForArch converts an architecture string to a v1.Platform struct.
+// fetchImage fetches ref, retrying per retry while the registry reports the
+// manifest as unknown. Other errors are returned at once.
+func fetchImage(ctx context.Context, st *state.BuildState, ref name.Reference, retry FetchRetry) (v1.Image, error) {
+	backoff := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		img, err := remote.Image(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		if err == nil || attempt >= retry.Attempts || !isManifestUnknown(err) {
+			return img, err
+		}
+
+		st.AppendLog("warn", fmt.Sprintf("  %s not found yet (attempt %d/%d), retrying in %v", ref.String(), attempt, retry.Attempts, backoff))
+		select {
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// isManifestUnknown reports whether err is a registry's answer that the manifest
+// does not exist: a MANIFEST_UNKNOWN error or a 404.
+func isManifestUnknown(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	for _, d := range terr.Errors {
+		if d.Code == transport.ManifestUnknownErrorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// getPlatformForArch converts an arch ("arm64", "arm/v6") or an os/arch[/variant]
+// platform string to a v1.Platform struct.
 func getPlatformForArch(arch string) (*v1.Platform, error) {
-	switch arch {
-	case "amd64":
-		return &v1.Platform{
-			OS:           "linux",
-			Architecture: "amd64",
-		}, nil
-	case "arm64":
-		return &v1.Platform{
-			OS:           "linux",
-			Architecture: "arm64",
-			Variant:      "v8",
-		}, nil
-	case "arm":
-		return &v1.Platform{
-			OS:           "linux",
-			Architecture: "arm",
-			Variant:      "v7",
-		}, nil
-	case "386":
-		return &v1.Platform{
-			OS:           "linux",
-			Architecture: "386",
-		}, nil
-	case "ppc64le":
-		return &v1.Platform{
-			OS:           "linux",
-			Architecture: "ppc64le",
-		}, nil
-	case "s390x":
-		return &v1.Platform{
-			OS:           "linux",
-			Architecture: "s390x",
-		}, nil
-	default:
-		return nil, fmt.Errorf("unsupported arch: %s", arch)
+	p, err := config.ParsePlatform(arch)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported arch: %w", err)
 	}
+	return &v1.Platform{
+		OS:           p.OS,
+		Architecture: p.Architecture,
+		Variant:      p.Variant,
+	}, nil
 }
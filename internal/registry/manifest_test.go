@@ -0,0 +1,280 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/state"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestGetPlatformForArch(t *testing.T) {
+	tests := []struct {
+		arch    string
+		os      string
+		want    string
+		variant string
+	}{
+		{"amd64", "linux", "amd64", ""},
+		{"arm64", "linux", "arm64", "v8"},
+		{"arm", "linux", "arm", "v7"},
+		{"arm/v6", "linux", "arm", "v6"},
+		{"riscv64", "linux", "riscv64", ""},
+		{"linux/arm/v6", "linux", "arm", "v6"},
+		{"linux/arm64", "linux", "arm64", "v8"},
+		{"windows/amd64", "windows", "amd64", ""},
+	}
+	for _, tt := range tests {
+		p, err := getPlatformForArch(tt.arch)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.arch, err)
+			continue
+		}
+		if p.OS != tt.os || p.Architecture != tt.want || p.Variant != tt.variant {
+			t.Errorf("%s = %s/%s/%s, want %s/%s/%s", tt.arch, p.OS, p.Architecture, p.Variant, tt.os, tt.want, tt.variant)
+		}
+	}
+
+	for _, arch := range []string{"", "Linux/amd64", "linux/arm/v6/extra", "linux//v6"} {
+		if _, err := getPlatformForArch(arch); err == nil {
+			t.Errorf("%q: expected error", arch)
+		}
+	}
+}
+
+func TestCreateManifestListExtraTags(t *testing.T) {
+	srv := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	var images []PlatformImage
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := fmt.Sprintf("%s/app:1.2.3_%s", host, arch)
+		tag, err := name.NewTag(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(tag, img); err != nil {
+			t.Fatalf("push %s: %v", ref, err)
+		}
+		images = append(images, PlatformImage{Arch: arch, Image: ref})
+	}
+
+	st := state.NewBuildState("b-1", 2, false, host+"/app:latest")
+	extra := []string{host + "/app:1.2.3", host + "/app:stable"}
+	if err := CreateManifestList(context.Background(), st, images, host+"/app:latest", nil, extra, FetchRetry{}); err != nil {
+		t.Fatalf("CreateManifestList: %v", err)
+	}
+
+	want := st.Summary().ManifestDigest
+	if want == "" {
+		t.Fatal("manifest digest not recorded")
+	}
+	for _, ref := range append([]string{host + "/app:latest"}, extra...) {
+		tag, err := name.NewTag(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, err := remote.Head(tag)
+		if err != nil {
+			t.Fatalf("head %s: %v", ref, err)
+		}
+		if desc.Digest.String() != want {
+			t.Errorf("%s resolves to %s, want %s", ref, desc.Digest, want)
+		}
+	}
+}
+
+func TestCreateManifestListMirrors(t *testing.T) {
+	var hosts []string
+	for i := 0; i < 2; i++ {
+		srv := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+		defer srv.Close()
+		hosts = append(hosts, strings.TrimPrefix(srv.URL, "http://"))
+	}
+	canonical, mirror := hosts[0]+"/app:1.0", hosts[1]+"/mirror/app:1.0"
+
+	// Agents push every per-arch image to the canonical destination and each mirror.
+	var images []PlatformImage
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dest := range []string{canonical, mirror} {
+			tag, err := name.NewTag(dest + "_" + arch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := remote.Write(tag, img); err != nil {
+				t.Fatalf("push %s: %v", tag, err)
+			}
+		}
+		images = append(images, PlatformImage{Arch: arch, Image: canonical + "_" + arch})
+	}
+
+	st := state.NewBuildState("b-1", 2, false, canonical)
+	if err := CreateManifestList(context.Background(), st, images, canonical, []string{mirror}, nil, FetchRetry{}); err != nil {
+		t.Fatalf("CreateManifestList: %v", err)
+	}
+
+	want := st.Summary().ManifestDigest
+	for _, ref := range []string{canonical, mirror} {
+		tag, err := name.NewTag(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, err := remote.Head(tag)
+		if err != nil {
+			t.Fatalf("head %s: %v", ref, err)
+		}
+		if desc.Digest.String() != want {
+			t.Errorf("%s resolves to %s, want %s", ref, desc.Digest, want)
+		}
+	}
+}
+
+func TestCreateManifestListKeepsImageOrder(t *testing.T) {
+	srv := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	order := []string{"arm64", "amd64", "arm/v7"}
+	var images []PlatformImage
+	for _, arch := range order {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := fmt.Sprintf("%s/app:%s", host, strings.ReplaceAll(arch, "/", "-"))
+		tag, err := name.NewTag(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(tag, img); err != nil {
+			t.Fatalf("push %s: %v", ref, err)
+		}
+		images = append(images, PlatformImage{Arch: arch, Image: ref})
+	}
+
+	st := state.NewBuildState("b-1", len(images), false, host+"/app:latest")
+	if err := CreateManifestList(context.Background(), st, images, host+"/app:latest", nil, nil, FetchRetry{}); err != nil {
+		t.Fatalf("CreateManifestList: %v", err)
+	}
+
+	tag, err := name.NewTag(host + "/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := remote.Index(tag)
+	if err != nil {
+		t.Fatalf("fetch index: %v", err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Manifests) != len(order) {
+		t.Fatalf("index has %d entries, want %d", len(m.Manifests), len(order))
+	}
+	for i, arch := range order {
+		want, _ := getPlatformForArch(arch)
+		if got := m.Manifests[i].Platform; got == nil || got.Architecture != want.Architecture || got.Variant != want.Variant {
+			t.Errorf("entry %d = %v, want %s", i, got, want)
+		}
+	}
+}
+
+func TestCreateManifestListRetriesUnknownManifest(t *testing.T) {
+	reg := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+	var mu sync.Mutex
+	misses := map[string]bool{}
+	// The first fetch of each arch manifest 404s, as on a registry that has not
+	// made the just-pushed tag visible yet.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/1.0_") {
+			mu.Lock()
+			missed := misses[r.URL.Path]
+			misses[r.URL.Path] = true
+			mu.Unlock()
+			if !missed {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+				return
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	var images []PlatformImage
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := fmt.Sprintf("%s/app:1.0_%s", host, arch)
+		tag, err := name.NewTag(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(tag, img); err != nil {
+			t.Fatalf("push %s: %v", ref, err)
+		}
+		images = append(images, PlatformImage{Arch: arch, Image: ref})
+	}
+
+	t.Run("single attempt fails", func(t *testing.T) {
+		st := state.NewBuildState("b-1", 2, false, host+"/app:1.0")
+		err := CreateManifestList(context.Background(), st, images, host+"/app:1.0", nil, nil, FetchRetry{Attempts: 1})
+		if err == nil || !isManifestUnknown(err) {
+			t.Fatalf("CreateManifestList = %v, want a manifest unknown error", err)
+		}
+	})
+
+	t.Run("retry succeeds", func(t *testing.T) {
+		mu.Lock()
+		clear(misses)
+		mu.Unlock()
+
+		st := state.NewBuildState("b-2", 2, false, host+"/app:1.0")
+		logs, cancel := st.Subscribe()
+		defer cancel()
+
+		retry := FetchRetry{Attempts: 3, Backoff: time.Millisecond}
+		if err := CreateManifestList(context.Background(), st, images, host+"/app:1.0", nil, nil, retry); err != nil {
+			t.Fatalf("CreateManifestList: %v", err)
+		}
+		if st.Summary().ManifestDigest == "" {
+			t.Error("manifest digest not recorded")
+		}
+
+		retries := 0
+		for len(logs) > 0 {
+			if strings.Contains((<-logs).Message, "not found yet") {
+				retries++
+			}
+		}
+		if retries != 2 {
+			t.Errorf("logged %d retries, want one per arch", retries)
+		}
+	})
+}
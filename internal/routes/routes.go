@@ -3,21 +3,54 @@ package routes
 import (
 	"bufio"
 	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/rayshoo/bakery/internal/agentapi"
 	"github.com/rayshoo/bakery/internal/orchestrator"
 	"github.com/rayshoo/bakery/internal/state"
 
 	"github.com/gofiber/fiber/v2"
 )
 
+// defaultMaxLogLine is the default cap on a single ingested log line, in bytes.
+const defaultMaxLogLine = 64 * 1024
+
+// truncatedMarker is appended to ingested log lines cut at the line limit.
+const truncatedMarker = "…[truncated]"
+
+// buildModeNoWait is the /build mode that returns before credentials are resolved
+// and tasks are dispatched.
+const buildModeNoWait = "async-no-wait"
+
+// purgeStreamTimeout bounds how long a purge waits for open log streams to flush.
+const purgeStreamTimeout = 5 * time.Second
+
 type Dependencies struct {
-	Orch  *orchestrator.Orchestrator
-	Store *state.Store
+	Orch    *orchestrator.Orchestrator
+	Store   *state.Store
+	Version VersionInfo
+
+	// AdminToken guards the /admin endpoints. They are disabled when it is empty.
+	AdminToken string
+}
+
+// VersionInfo describes the running controller build and the agent image it launches.
+type VersionInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+	BuildDate  string `json:"buildDate"`
+	AgentImage string `json:"agentImage,omitempty"`
 }
 
 type AgentResult struct {
@@ -26,6 +59,12 @@ type AgentResult struct {
 	ImageDigest string `json:"imageDigest"`
 	Success     bool   `json:"success"`
 	Error       string `json:"error,omitempty"`
+	Version     string `json:"version,omitempty"`
+	Attempt     int    `json:"attempt,omitempty"`
+
+	PeakMemoryMiB int64   `json:"peakMemoryMiB,omitempty"`
+	CPUSeconds    float64 `json:"cpuSeconds,omitempty"`
+	OCILayoutKey  string  `json:"ociLayoutKey,omitempty"`
 }
 
 // Setup registers build-related routes on the Fiber app.
@@ -35,6 +74,10 @@ func Setup(app *fiber.App, deps Dependencies) {
 		return c.SendString("build controller is running")
 	})
 
+	app.Get("/version", func(c *fiber.Ctx) error {
+		return c.JSON(deps.Version)
+	})
+
 	app.Post("/build", func(c *fiber.Ctx) error {
 		body := c.Body()
 		if len(body) == 0 {
@@ -53,14 +96,111 @@ func Setup(app *fiber.App, deps Dependencies) {
 
 		serviceName := c.Query("service_name", "")
 
-		buildID, _, err := deps.Orch.StartBuild(body, contextBucket, contextKey, serviceName)
+		// mode=async-no-wait returns once the config is validated, leaving credential
+		// resolution and dispatch to the background for callers that only poll status.
+		startBuild, startedStatus := deps.Orch.StartBuild, "started"
+		switch mode := c.Query("mode"); mode {
+		case "":
+		case buildModeNoWait:
+			startBuild, startedStatus = deps.Orch.StartBuildNoWait, "accepted"
+		default:
+			return fiber.NewError(400, fmt.Sprintf("unknown mode %q", mode))
+		}
+
+		start := func() (string, error) {
+			buildID, _, err := startBuild(body, contextBucket, contextKey, serviceName)
+			return buildID, err
+		}
+
+		idempotencyKey := c.Get("Idempotency-Key", c.Query("idempotency_key"))
+		if idempotencyKey == "" {
+			buildID, err := start()
+			if err != nil {
+				return fiber.NewError(startErrorStatus(err), err.Error())
+			}
+			return c.JSON(fiber.Map{
+				"buildID": buildID,
+				"status":  startedStatus,
+			})
+		}
+
+		buildID, existing, err := deps.Store.StartOnce(idempotencyKey, getenvDuration("IDEMPOTENCY_TTL", 10*time.Minute), start)
 		if err != nil {
-			return fiber.NewError(500, err.Error())
+			return fiber.NewError(startErrorStatus(err), err.Error())
+		}
+
+		status := startedStatus
+		if existing {
+			status = "unknown"
+			if st, ok := deps.Store.Get(buildID); ok {
+				status = st.Status()
+			}
 		}
 
 		return c.JSON(fiber.Map{
-			"buildID": buildID,
+			"buildID":   buildID,
+			"status":    status,
+			"duplicate": existing,
+		})
+	})
+
+	app.Post("/build/batch", func(c *fiber.Ctx) error {
+		body := c.Body()
+		if len(body) == 0 {
+			return fiber.NewError(400, "empty body")
+		}
+
+		contextKey := c.Query("context_key")
+		if contextKey == "" {
+			return fiber.NewError(400, "missing context_key")
+		}
+
+		contextBucket := os.Getenv("S3_BUCKET")
+		if contextBucket == "" {
+			return fiber.NewError(500, "S3_BUCKET not configured")
+		}
+
+		batchID, builds, err := deps.Orch.StartBatch(body, contextBucket, contextKey)
+		if err != nil {
+			return fiber.NewError(startErrorStatus(err), err.Error())
+		}
+
+		return c.JSON(fiber.Map{
+			"buildID": batchID,
 			"status":  "started",
+			"builds":  builds,
+		})
+	})
+
+	app.Get("/build/:id/status", func(c *fiber.Ctx) error {
+		buildID := string([]byte(c.Params("id")))
+
+		st, ok := deps.Store.Get(buildID)
+		if !ok {
+			return fiber.NewError(404, "unknown build id")
+		}
+
+		sum := st.Summary()
+		sum.QueuePosition = deps.Orch.QueuePosition(buildID)
+		return c.JSON(sum)
+	})
+
+	app.Get("/build/:id/effective", func(c *fiber.Ctx) error {
+		buildID := string([]byte(c.Params("id")))
+
+		st, ok := deps.Store.Get(buildID)
+		if !ok {
+			return fiber.NewError(404, "unknown build id")
+		}
+
+		tasks := st.Effective()
+		if tasks == nil {
+			return fiber.NewError(404, "no effective config recorded for build")
+		}
+
+		return c.JSON(fiber.Map{
+			"buildID": buildID,
+			"tasks":   tasks,
 		})
 	})
 
@@ -72,11 +212,29 @@ func Setup(app *fiber.App, deps Dependencies) {
 			return fiber.NewError(fiber.StatusNotFound, "unknown build id")
 		}
 
+		// ?envelope=1 wraps every line with its build and task for shared log indexes.
+		var encode func(state.LogEntry) interface{}
+		if c.QueryBool("envelope") {
+			encode = func(e state.LogEntry) interface{} { return newLogEnvelope(buildID, e) }
+		} else {
+			encode = func(e state.LogEntry) interface{} { return e }
+		}
+
 		c.Set("Content-Type", "application/json")
 		c.Set("Transfer-Encoding", "chunked")
 		c.Set("X-Content-Type-Options", "nosniff")
 
+		streamDone := st.TrackStream()
 		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer streamDone()
+			// Lines a previous stream took but failed to send go out first.
+			unread := st.TakeUnread()
+			for i, e := range unread {
+				if err := writeJSON(w, encode(e)); err != nil {
+					st.UnreadLog(unread[i:]...)
+					return
+				}
+			}
 			for {
 				select {
 				case logEntry, ok := <-st.Logs:
@@ -85,24 +243,17 @@ func Setup(app *fiber.App, deps Dependencies) {
 						finalErr := st.GetError()
 						st.Mu.RUnlock()
 
-						var finalMsg state.LogEntry
-						if finalErr != nil {
-							finalMsg = state.LogEntry{
-								TS:      time.Now(),
-								Level:   "error",
-								Message: "BUILD FAILED",
-							}
-						} else {
-							finalMsg = state.LogEntry{
-								TS:      time.Now(),
-								Level:   "info",
-								Message: "BUILD SUCCEEDED",
-							}
+						for _, e := range state.ResultEntries(finalErr) {
+							_ = writeJSON(w, encode(e))
 						}
-						_ = writeJSON(w, finalMsg)
 						return
 					}
-					_ = writeJSON(w, logEntry)
+					if err := writeJSON(w, encode(logEntry)); err != nil {
+						// The client went away; keep the line and stop draining so a
+						// reconnecting client receives it and the remaining lines.
+						st.UnreadLog(logEntry)
+						return
+					}
 
 				case <-st.Done:
 				}
@@ -112,6 +263,116 @@ func Setup(app *fiber.App, deps Dependencies) {
 		return nil
 	})
 
+	app.Get("/batch/:id/logs", func(c *fiber.Ctx) error {
+		batchID := string([]byte(c.Params("id")))
+
+		parent, ok := deps.Store.Get(batchID)
+		if !ok {
+			return fiber.NewError(fiber.StatusNotFound, "unknown build id")
+		}
+		children := parent.Children()
+		if len(children) == 0 {
+			return fiber.NewError(fiber.StatusNotFound, "not a batch build")
+		}
+
+		var encode func(state.LogEntry) interface{}
+		if c.QueryBool("envelope") {
+			encode = func(e state.LogEntry) interface{} { return newLogEnvelope(batchID, e) }
+		} else {
+			encode = func(e state.LogEntry) interface{} { return e }
+		}
+
+		names := make([]string, 0, len(children))
+		for name := range children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		// Subscribe before streaming starts so lines logged in between are not lost.
+		type service struct {
+			name   string
+			st     *state.BuildState
+			logs   <-chan state.LogEntry
+			cancel func()
+		}
+		services := make([]service, 0, len(names))
+		for _, name := range names {
+			child, ok := deps.Store.Get(children[name])
+			if !ok {
+				continue
+			}
+			logs, cancel := child.Subscribe()
+			services = append(services, service{name: name, st: child, logs: logs, cancel: cancel})
+		}
+
+		c.Set("Content-Type", "application/json")
+		c.Set("Transfer-Encoding", "chunked")
+		c.Set("X-Content-Type-Options", "nosniff")
+
+		streamDone := parent.TrackStream()
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			done := make(chan struct{})
+			defer func() {
+				streamDone()
+				close(done)
+				for _, svc := range services {
+					svc.cancel()
+				}
+			}()
+
+			merged := make(chan state.LogEntry)
+			var wg sync.WaitGroup
+			for _, svc := range services {
+				wg.Add(1)
+				go func(svc service) {
+					defer wg.Done()
+					for e := range svc.logs {
+						e.Message = fmt.Sprintf("[%s] %s", svc.name, e.Message)
+						select {
+						case merged <- e:
+						case <-done:
+							return
+						}
+					}
+				}(svc)
+			}
+			go func() {
+				wg.Wait()
+				close(merged)
+			}()
+
+			for e := range merged {
+				if err := writeJSON(w, encode(e)); err != nil {
+					return
+				}
+			}
+
+			failed := false
+			for _, svc := range services {
+				entry := state.LogEntry{TS: time.Now(), Level: "info", BuildID: svc.st.ID}
+				if err := svc.st.GetError(); err != nil {
+					failed = true
+					entry.Level = "error"
+					entry.Message = fmt.Sprintf("[%s] %s (build %s): %v", svc.name, svc.st.Status(), svc.st.ID, err)
+				} else {
+					entry.Message = fmt.Sprintf("[%s] %s (build %s)", svc.name, svc.st.Status(), svc.st.ID)
+				}
+				if err := writeJSON(w, encode(entry)); err != nil {
+					return
+				}
+			}
+
+			final := state.LogEntry{TS: time.Now(), Level: "info", Message: "BATCH SUCCEEDED"}
+			if failed {
+				final.Level = "error"
+				final.Message = "BATCH FAILED"
+			}
+			_ = writeJSON(w, encode(final))
+		})
+
+		return nil
+	})
+
 	app.Post("/build/:id/logs/ingest", func(c *fiber.Ctx) error {
 		buildID := string([]byte(c.Params("id")))
 		st, ok := deps.Store.Get(buildID)
@@ -130,11 +391,21 @@ func Setup(app *fiber.App, deps Dependencies) {
 		}
 		st.AppendLog("debug", fmt.Sprintf("ingest from task=%s", taskID))
 
-		stream := c.Context().RequestBodyStream()
-		var reader *bufio.Reader
+		if agentVersion := strings.TrimSpace(c.Get("X-Agent-Version")); agentVersion != "" && st.SetAgentVersion(taskID, agentVersion) {
+			if err := checkAgentVersion(st, taskID, agentVersion, deps.Version.Version); err != nil {
+				st.SetResult(taskID, "", "", false, err.Error())
+				return fiber.NewError(409, err.Error())
+			}
+		}
+
+		maxLine := getenvInt("INGEST_MAX_LINE_BYTES", defaultMaxLogLine)
+		if maxLine <= 0 {
+			maxLine = defaultMaxLogLine
+		}
 
-		if stream != nil {
-			reader = bufio.NewReader(stream)
+		var reader io.Reader
+		if stream := c.Context().RequestBodyStream(); stream != nil {
+			reader = stream
 		} else {
 			body := c.Body()
 			if len(body) == 0 {
@@ -142,23 +413,12 @@ func Setup(app *fiber.App, deps Dependencies) {
 				st.MarkIngestDone(taskID)
 				return c.SendStatus(200)
 			}
-			reader = bufio.NewReader(bytes.NewReader(body))
+			reader = bytes.NewReader(body)
 		}
 
-		for {
-			line, err := reader.ReadString('\n')
-
-			if len(line) > 0 {
-				st.MarkIngestStarted(taskID)
-				st.AppendLog("info", strings.TrimRight(line, "\r\n"))
-			}
-
-			if err != nil {
-				st.AppendLog("debug", fmt.Sprintf("ingest closed for task=%s (EOF)", taskID))
-				st.MarkIngestDone(taskID)
-				break
-			}
-		}
+		ingestLines(reader, st, taskID, maxLine, getenvDuration("INGEST_PARTIAL_FLUSH", 0))
+		st.AppendLog("debug", fmt.Sprintf("ingest closed for task=%s (EOF)", taskID))
+		st.MarkIngestDone(taskID)
 
 		return c.SendStatus(200)
 	})
@@ -194,65 +454,137 @@ func Setup(app *fiber.App, deps Dependencies) {
 		st.AppendLog("debug", fmt.Sprintf("[result] Received: buildID=%s, query_task=%s, body_taskID=%s, final_taskID=%s, arch=%s",
 			buildID, queryTaskID, result.TaskID, taskID, result.Arch))
 
-		st.Mu.Lock()
-
-		beforeKeys := make([]string, 0, len(st.Results))
-		for k := range st.Results {
-			beforeKeys = append(beforeKeys, k)
+		if st.IsStaleAttempt(taskID, result.Attempt) {
+			st.AppendLog("info", fmt.Sprintf("[result] Ignoring stale result for task '%s' from attempt %d (current attempt %d)",
+				taskID, result.Attempt, st.TaskAttempt(taskID)))
+			return c.SendStatus(200)
 		}
-		beforeCount := st.ResultsReceived
-
-		if _, exists := st.Results[taskID]; exists {
-			existingResult := st.Results[taskID]
-
-			var logMsg string
-			if existingResult.ImageDigest == result.ImageDigest {
-				logMsg = fmt.Sprintf("[result] Duplicate result for task '%s' with same digest - ignoring", taskID)
-			} else {
-				logMsg = fmt.Sprintf("[result] CRITICAL: Duplicate result for task '%s' with DIFFERENT digest! (existing=%s, new=%s) - REJECTING NEW",
-					taskID, existingResult.ImageDigest, result.ImageDigest)
-			}
-
-			st.Mu.Unlock()
 
-			if existingResult.ImageDigest == result.ImageDigest {
-				st.AppendLog("debug", logMsg)
-			} else {
-				st.AppendLog("error", logMsg)
+		if result.Version != "" && st.SetAgentVersion(taskID, result.Version) {
+			if err := checkAgentVersion(st, taskID, result.Version, deps.Version.Version); err != nil {
+				result.Success = false
+				result.Error = err.Error()
 			}
-			return c.SendStatus(200)
 		}
 
-		st.Results[taskID] = state.TaskResult{
-			Arch:        result.Arch,
-			ImageDigest: result.ImageDigest,
-			Success:     result.Success,
-			Error:       result.Error,
+		if result.PeakMemoryMiB > 0 || result.CPUSeconds > 0 {
+			st.SetTaskUsage(taskID, state.TaskUsage{PeakMemoryMiB: result.PeakMemoryMiB, CPUSeconds: result.CPUSeconds})
 		}
-		st.ResultsReceived++
-
-		if !result.Success && st.FirstError == nil {
-			st.FirstError = fmt.Errorf("task %s failed: %s", taskID, result.Error)
+		if result.OCILayoutKey != "" {
+			st.SetTaskOCILayout(taskID, result.OCILayoutKey)
 		}
 
-		afterKeys := make([]string, 0, len(st.Results))
-		for k := range st.Results {
-			afterKeys = append(afterKeys, k)
+		if !st.SetAttemptResult(taskID, result.Attempt, result.Arch, result.ImageDigest, result.Success, result.Error) {
+			return c.SendStatus(200)
 		}
-		afterCount := st.ResultsReceived
-		stateID := st.ID
+
 		digestShort := result.ImageDigest
 		if len(digestShort) > 12 {
 			digestShort = digestShort[:12]
 		}
 
-		st.Mu.Unlock()
-
-		st.AppendLog("info", fmt.Sprintf("[result] Saved: stateID=%s, taskID='%s', arch=%s, digest=%s, before=%v(%d), after=%v(%d)",
-			stateID, taskID, result.Arch, digestShort, beforeKeys, beforeCount, afterKeys, afterCount))
+		st.AppendLog("info", fmt.Sprintf("[result] Saved: stateID=%s, taskID='%s', arch=%s, digest=%s",
+			st.ID, taskID, result.Arch, digestShort))
 
 		return c.SendStatus(200)
 	})
+
+	// A purge cancels in-flight tasks and evicts the build from the store, so operators
+	// can clear a wedged build without restarting the controller.
+	app.Post("/admin/build/:id/purge", requireAdmin(deps.AdminToken), func(c *fiber.Ctx) error {
+		buildID := string([]byte(c.Params("id")))
+
+		report, ok := deps.Store.Purge(buildID, purgeStreamTimeout)
+		if !ok {
+			return fiber.NewError(404, "unknown build id")
+		}
+		return c.JSON(report)
+	})
+}
+
+// requireAdmin rejects requests without the admin bearer token. With no token
+// configured, the admin endpoints are disabled.
+func requireAdmin(token string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if token == "" {
+			return fiber.NewError(fiber.StatusForbidden, "admin endpoints disabled: ADMIN_TOKEN not set")
+		}
+		got, ok := strings.CutPrefix(c.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid admin token")
+		}
+		return c.Next()
+	}
+}
+
+// startErrorStatus maps an error from starting a build to an HTTP status.
+func startErrorStatus(err error) int {
+	if errors.Is(err, orchestrator.ErrTooManyArches) || errors.Is(err, orchestrator.ErrInvalidDestination) {
+		return 400
+	}
+	return 500
+}
+
+// checkAgentVersion logs a warning when the agent's major version differs from the controller's.
+// With STRICT_VERSION_MATCH=true the mismatch is returned as an error instead.
+// Versions without a major number, such as "dev" builds, are not compared.
+func checkAgentVersion(st *state.BuildState, taskID, agentVersion, controllerVersion string) error {
+	agentMajor, ok1 := majorVersion(agentVersion)
+	controllerMajor, ok2 := majorVersion(controllerVersion)
+	if !ok1 || !ok2 || agentMajor == controllerMajor {
+		return nil
+	}
+
+	msg := fmt.Sprintf("agent version %s does not match controller version %s", agentVersion, controllerVersion)
+	if os.Getenv("STRICT_VERSION_MATCH") == "true" {
+		st.AppendLog("error", fmt.Sprintf("[task %s] %s", taskID, msg))
+		return fmt.Errorf("%s", msg)
+	}
+	st.AppendLog("warn", fmt.Sprintf("[task %s] %s", taskID, msg))
+	return nil
+}
+
+// majorVersion returns the major number of a version such as "v1.4.2" or "2.0.0-rc.1".
+func majorVersion(v string) (int, bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	major, _, _ := strings.Cut(v, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// logEnvelope is a log line wrapped with the build and task it came from.
+type logEnvelope struct {
+	BuildID string    `json:"buildID"`
+	TaskID  string    `json:"taskID,omitempty"`
+	TS      time.Time `json:"ts"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	Partial bool      `json:"partial,omitempty"`
+	Event   string    `json:"event,omitempty"`
+	Status  string    `json:"status,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// newLogEnvelope wraps e, falling back to buildID for entries not tied to a build,
+// like the final status line.
+func newLogEnvelope(buildID string, e state.LogEntry) logEnvelope {
+	if e.BuildID != "" {
+		buildID = e.BuildID
+	}
+	return logEnvelope{
+		BuildID: buildID,
+		TaskID:  e.TaskID,
+		TS:      e.TS,
+		Level:   e.Level,
+		Message: e.Message,
+		Partial: e.Partial,
+		Event:   e.Event,
+		Status:  e.Status,
+		Error:   e.Error,
+	}
 }
 
 func writeJSON(w *bufio.Writer, v interface{}) error {
@@ -262,6 +594,150 @@ func writeJSON(w *bufio.Writer, v interface{}) error {
 	}
 	_, _ = w.Write(b)
 	_, _ = w.Write([]byte("\n"))
-	_ = w.Flush()
-	return nil
+	return w.Flush()
+}
+
+// ingestChunkSize is the most an ingest read hands to ingestLines at once.
+const ingestChunkSize = 32 * 1024
+
+// ingestLines appends the lines read from r to st as taskID's log until r ends.
+// Lines are cut at max bytes with truncatedMarker. A line that has waited
+// partialFlush for its newline is flushed as it stands in an entry marked partial,
+// and the rest of the line follows in later entries, the last one unmarked;
+// concatenating them reassembles the line. A non-positive partialFlush waits for
+// whole lines.
+func ingestLines(r io.Reader, st *state.BuildState, taskID string, max int, partialFlush time.Duration) {
+	type chunk struct {
+		data []byte
+		err  error
+	}
+	chunks := make(chan chunk)
+	go func() {
+		for {
+			buf := make([]byte, ingestChunkSize)
+			n, err := r.Read(buf)
+			chunks <- chunk{buf[:n], err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var (
+		pending   []byte // bytes of the current line not yet appended to st
+		lineLen   int    // bytes of the current line kept so far, flushed or not
+		truncated bool
+		continued bool // part of the current line was already flushed
+	)
+	flush := func(partial bool) {
+		msg := pending
+		if partial {
+			// Hold back a rune split across reads until the rest of it arrives.
+			msg = msg[:completeRunes(msg)]
+			if len(msg) == 0 {
+				return
+			}
+		} else {
+			msg = bytes.TrimSuffix(msg, []byte("\r"))
+		}
+		text := string(msg)
+		if !partial && truncated {
+			text = strings.ToValidUTF8(text, "") + truncatedMarker
+		}
+		pending = pending[len(msg):]
+		if partial || continued || text != agentapi.HeartbeatLine {
+			st.AppendTaskLogPart(taskID, "info", text, partial)
+		}
+		continued = partial
+		if !partial {
+			pending, lineLen, truncated = pending[:0], 0, false
+		}
+	}
+	add := func(part []byte) {
+		if truncated {
+			return
+		}
+		if room := max - lineLen; len(part) > room {
+			part = part[:room]
+			truncated = true
+		}
+		pending = append(pending, part...)
+		lineLen += len(part)
+	}
+
+	// idle is armed when a line starts waiting for its newline, so a line that keeps
+	// growing, like a progress bar, is still shown every partialFlush.
+	idle := time.NewTimer(partialFlush)
+	idle.Stop()
+	defer idle.Stop()
+	armed := false
+
+	for {
+		select {
+		case c := <-chunks:
+			if len(c.data) > 0 {
+				st.MarkIngestStarted(taskID)
+				st.MarkHeartbeat(taskID)
+			}
+			for data := c.data; len(data) > 0; {
+				i := bytes.IndexByte(data, '\n')
+				if i < 0 {
+					add(data)
+					break
+				}
+				add(data[:i])
+				flush(false)
+				data = data[i+1:]
+			}
+			if c.err != nil {
+				if len(pending) > 0 || continued || truncated {
+					flush(false)
+				}
+				return
+			}
+			switch {
+			case len(pending) > 0 && partialFlush > 0 && !armed:
+				idle.Reset(partialFlush)
+				armed = true
+			case len(pending) == 0 && armed:
+				idle.Stop()
+				armed = false
+			}
+		case <-idle.C:
+			armed = false
+			flush(true)
+		}
+	}
+}
+
+// completeRunes returns the length of the longest prefix of b that does not end
+// in the middle of a UTF-8 encoded rune.
+func completeRunes(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+func getenvInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func getenvDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
 }
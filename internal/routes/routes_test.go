@@ -0,0 +1,832 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/agentapi"
+	"github.com/rayshoo/bakery/internal/config"
+	"github.com/rayshoo/bakery/internal/fakeexec"
+	"github.com/rayshoo/bakery/internal/orchestrator"
+	"github.com/rayshoo/bakery/internal/state"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func newTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+	t.Setenv("S3_BUCKET", "bucket")
+	t.Setenv("BUILD_RESULT_TIMEOUT", "10ms")
+
+	executors := orchestrator.NewRegistry()
+	executors.Register("fake", fakeexec.New())
+	executors.Register("fake-k8s", fakeexec.New())
+
+	store := state.NewStore()
+	app := fiber.New()
+	Setup(app, Dependencies{
+		Orch:  orchestrator.New(orchestrator.Deps{Store: store, Executors: executors}),
+		Store: store,
+	})
+	return app
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	app := newTestApp(t)
+
+	body := `
+global:
+  platform: fake
+  arch: amd64
+  kaniko-credentials:
+  - registry: registry.example.com
+    username: ci
+    password: s3cret
+  kaniko:
+    destination: registry.example.com/app:1.0
+    no-push: true
+    cache:
+      enable: true
+      repo: cache.example.com/global
+bake:
+- {}
+- arch: arm64
+  kaniko:
+    cache:
+      repo: cache.example.com/arm
+`
+	resp, err := app.Test(httptest.NewRequest("POST", "/build?context_key=key", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("POST /build: %v", err)
+	}
+	var started struct {
+		BuildID string `json:"buildID"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&started); err != nil || started.BuildID == "" {
+		t.Fatalf("POST /build response: %v (%+v)", err, started)
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/build/"+started.BuildID+"/effective", nil))
+	if err != nil {
+		t.Fatalf("GET effective: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET effective status = %d, want 200", resp.StatusCode)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+
+	if strings.Contains(string(raw), "s3cret") {
+		t.Errorf("response leaks registry password: %s", raw)
+	}
+
+	var got struct {
+		Tasks []state.EffectiveTask `json:"tasks"`
+	}
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got.Tasks) != 2 {
+		t.Fatalf("got %d tasks, want 2: %s", len(got.Tasks), raw)
+	}
+	if got.Tasks[0].TaskID != "amd64" || got.Tasks[0].Config.CacheRepo != "cache.example.com/global" {
+		t.Errorf("task 0 = %s / %q, want amd64 / cache.example.com/global", got.Tasks[0].TaskID, got.Tasks[0].Config.CacheRepo)
+	}
+	if got.Tasks[1].TaskID != "arm64" || got.Tasks[1].Config.CacheRepo != "cache.example.com/arm" {
+		t.Errorf("task 1 = %s / %q, want arm64 / cache.example.com/arm", got.Tasks[1].TaskID, got.Tasks[1].Config.CacheRepo)
+	}
+	if creds := got.Tasks[1].Config.KanikoCredentials; len(creds) != 1 || creds[0].Username != "ci" || creds[0].Password != "***" {
+		t.Errorf("credentials = %+v, want ci with redacted password", creds)
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/build/missing/effective", nil))
+	if err != nil {
+		t.Fatalf("GET effective: %v", err)
+	}
+	if resp.StatusCode != 404 {
+		t.Errorf("unknown build status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestBuildStatus(t *testing.T) {
+	app := newTestApp(t)
+
+	body := `
+global:
+  platform: fake
+  arch: amd64
+  kaniko:
+    destination: registry.example.com/app:1.0
+bake:
+- {}
+- arch: arm64
+  platform: fake-k8s
+  kaniko:
+    no-push: true
+`
+	resp, err := app.Test(httptest.NewRequest("POST", "/build?context_key=key", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("POST /build: %v", err)
+	}
+	var started struct {
+		BuildID string `json:"buildID"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&started); err != nil || started.BuildID == "" {
+		t.Fatalf("POST /build response: %v (%+v)", err, started)
+	}
+
+	var got state.Summary
+	for i := 0; i < 100; i++ {
+		resp, err = app.Test(httptest.NewRequest("GET", "/build/"+started.BuildID+"/status", nil))
+		if err != nil {
+			t.Fatalf("GET status: %v", err)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if got.Status != "running" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if got.Status != "succeeded" || got.FinishedAt == nil {
+		t.Fatalf("status = %+v, want finished success", got)
+	}
+	if task := got.Tasks["amd64"]; !task.Success || task.ImageDigest != fakeexec.Digest("amd64") || task.Platform != "fake" {
+		t.Errorf("task amd64 = %+v, want fake digest on platform fake", task)
+	}
+	if task := got.Tasks["arm64"]; task.Platform != "fake-k8s" {
+		t.Errorf("task arm64 platform = %q, want fake-k8s", task.Platform)
+	}
+	if got.Destination != "registry.example.com/app:1.0" {
+		t.Errorf("destination = %q", got.Destination)
+	}
+}
+
+func TestIngestLines(t *testing.T) {
+	giant := strings.Repeat("x", 1<<20)
+	st := state.NewBuildState("build-1", 1, true, "")
+	ingestLines(strings.NewReader("short\n"+giant+"\nnext"), st, "t1", 64, 0)
+
+	var got []state.LogEntry
+	for len(st.Logs) > 0 {
+		if e := <-st.Logs; e.TaskID == "t1" {
+			got = append(got, e)
+		}
+	}
+	want := []string{"short", strings.Repeat("x", 64) + truncatedMarker, "next"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(got), len(want))
+	}
+	for i, e := range got {
+		if e.Message != want[i] || e.Partial {
+			t.Errorf("line %d = %.80q (partial %t), want %.80q", i, e.Message, e.Partial, want[i])
+		}
+	}
+}
+
+func TestIngestLinesDropsHeartbeats(t *testing.T) {
+	st := state.NewBuildState("build-1", 1, true, "")
+	in := agentapi.HeartbeatLine + "\nbuilding\n" + agentapi.HeartbeatLine + "\r\nx" + agentapi.HeartbeatLine + "\n"
+	ingestLines(strings.NewReader(in), st, "t1", 1024, 0)
+
+	var got []string
+	for len(st.Logs) > 0 {
+		if e := <-st.Logs; e.TaskID == "t1" {
+			got = append(got, e.Message)
+		}
+	}
+	want := []string{"building", "x" + agentapi.HeartbeatLine}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+	if st.HeartbeatExpired("t1", time.Hour) || st.LastHeartbeat["t1"].IsZero() {
+		t.Error("ingested heartbeats did not mark the task alive")
+	}
+}
+
+func TestIngestLinesFlushesPartialLine(t *testing.T) {
+	st := state.NewBuildState("build-1", 1, true, "")
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestLines(pr, st, "t1", 1024, 20*time.Millisecond)
+	}()
+
+	next := func(t *testing.T) state.LogEntry {
+		t.Helper()
+		for {
+			select {
+			case e := <-st.Logs:
+				if e.TaskID == "t1" {
+					return e
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for a log entry")
+			}
+		}
+	}
+
+	// "é" is split across writes; the partial flush must not cut the rune.
+	fmt.Fprint(pw, "downloading 10% \xc3")
+	if e := next(t); e.Message != "downloading 10% " || !e.Partial {
+		t.Fatalf("first entry = %q (partial %t), want the partial line so far", e.Message, e.Partial)
+	}
+
+	fmt.Fprint(pw, "\xa9 100%\r\nnext\n")
+	if e := next(t); e.Message != "é 100%" || e.Partial {
+		t.Errorf("second entry = %q (partial %t), want the rest of the line", e.Message, e.Partial)
+	}
+	if e := next(t); e.Message != "next" || e.Partial {
+		t.Errorf("third entry = %q (partial %t), want next", e.Message, e.Partial)
+	}
+
+	pw.Close()
+	<-done
+}
+
+func TestIngestTruncatesLongLines(t *testing.T) {
+	t.Setenv("INGEST_MAX_LINE_BYTES", "1024")
+
+	store := state.NewStore()
+	st := state.NewBuildState("build-1", 1, true, "")
+	store.Register(st.ID, st)
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	Setup(app, Dependencies{Store: store})
+
+	// A line far longer than the limit, without a trailing newline.
+	body := "before\n" + strings.Repeat("y", 8<<20)
+	resp, err := app.Test(httptest.NewRequest("POST", "/build/build-1/logs/ingest?task=t1", strings.NewReader(body)), -1)
+	if err != nil {
+		t.Fatalf("POST ingest: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	st.Mu.RLock()
+	started, done := st.IngestStarted["t1"], st.IngestDone["t1"]
+	st.Mu.RUnlock()
+	if !started || !done {
+		t.Errorf("IngestStarted = %v, IngestDone = %v, want both true", started, done)
+	}
+
+	var lines []string
+	for len(st.Logs) > 0 {
+		if e := <-st.Logs; e.Level == "info" {
+			lines = append(lines, e.Message)
+		}
+	}
+	if len(lines) != 2 || lines[0] != "before" {
+		t.Fatalf("info lines = %d, want [before, <truncated>]", len(lines))
+	}
+	if want := strings.Repeat("y", 1024) + truncatedMarker; lines[1] != want {
+		t.Errorf("truncated line has len %d, want %d", len(lines[1]), len(want))
+	}
+}
+
+func TestLogsEnvelope(t *testing.T) {
+	store := state.NewStore()
+	app := fiber.New()
+	Setup(app, Dependencies{Store: store})
+
+	stream := func(t *testing.T, id, query string) []map[string]any {
+		t.Helper()
+		st := state.NewBuildState(id, 1, true, "")
+		store.Register(id, st)
+		st.AppendLog("info", "build accepted")
+		st.AppendTaskLog("arm64", "info", "RUN make")
+		st.Finish(nil)
+
+		resp, err := app.Test(httptest.NewRequest("GET", "/build/"+id+"/logs"+query, nil), -1)
+		if err != nil {
+			t.Fatalf("GET logs: %v", err)
+		}
+		var lines []map[string]any
+		dec := json.NewDecoder(resp.Body)
+		for dec.More() {
+			var line map[string]any
+			if err := dec.Decode(&line); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+
+	t.Run("lean by default", func(t *testing.T) {
+		for _, line := range stream(t, "build-lean", "") {
+			if _, ok := line["buildID"]; ok {
+				t.Errorf("lean line has buildID: %v", line)
+			}
+			if _, ok := line["taskID"]; ok {
+				t.Errorf("lean line has taskID: %v", line)
+			}
+		}
+	})
+
+	t.Run("envelope", func(t *testing.T) {
+		var sawTask bool
+		for _, line := range stream(t, "build-env", "?envelope=1") {
+			if line["buildID"] != "build-env" {
+				t.Errorf("buildID = %v, want build-env: %v", line["buildID"], line)
+			}
+			if line["message"] == "RUN make" {
+				sawTask = true
+				if line["taskID"] != "arm64" {
+					t.Errorf("taskID = %v, want arm64", line["taskID"])
+				}
+			} else if _, ok := line["taskID"]; ok {
+				t.Errorf("controller line has taskID: %v", line)
+			}
+		}
+		if !sawTask {
+			t.Error("agent line missing from stream")
+		}
+	})
+}
+
+func TestLogsResendsUnreadLines(t *testing.T) {
+	store := state.NewStore()
+	app := fiber.New()
+	Setup(app, Dependencies{Store: store})
+
+	st := state.NewBuildState("build-resume", 1, true, "")
+	store.Register("build-resume", st)
+	st.AppendLog("info", "first")
+	st.AppendLog("info", "second")
+	// A previous stream took "first" from Logs but failed to write it.
+	st.UnreadLog(<-st.Logs)
+	st.Finish(nil)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/build/build-resume/logs", nil), -1)
+	if err != nil {
+		t.Fatalf("GET logs: %v", err)
+	}
+	var got []string
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var e state.LogEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		got = append(got, e.Message)
+	}
+	if len(got) < 2 || got[0] != "first" || got[1] != "second" {
+		t.Errorf("messages = %q, want first and second in order", got)
+	}
+	if unread := st.TakeUnread(); len(unread) != 0 {
+		t.Errorf("unread after a complete stream = %v, want none", unread)
+	}
+}
+
+func TestBatchLogs(t *testing.T) {
+	store := state.NewStore()
+	app := fiber.New()
+	Setup(app, Dependencies{Store: store})
+
+	parent := state.NewBuildState("batch-1", 2, false, "")
+	store.Register(parent.ID, parent)
+	api := state.NewBuildState("build-api", 1, true, "")
+	web := state.NewBuildState("build-web", 1, true, "")
+	for name, child := range map[string]*state.BuildState{"api": api, "web": web} {
+		store.Register(child.ID, child)
+		child.SetParent(parent, "["+name+"] ")
+		parent.AddChild(name, child.ID)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		api.AppendTaskLog("amd64", "info", "RUN make")
+		api.Finish(nil)
+		web.Finish(errors.New("kaniko exit=1"))
+	}()
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/batch/batch-1/logs", nil), -1)
+	if err != nil {
+		t.Fatalf("GET batch logs: %v", err)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	out := string(raw)
+
+	for _, want := range []string{
+		`"message":"[api] RUN make"`,
+		`"message":"[web] BUILD FAILED"`,
+		`"message":"[api] succeeded (build build-api)"`,
+		`"message":"[web] failed (build build-web): kaniko exit=1"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("stream missing %s:\n%s", want, out)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if last := lines[len(lines)-1]; !strings.Contains(last, `"BATCH FAILED"`) {
+		t.Errorf("last line = %s, want BATCH FAILED", last)
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/batch/build-api/logs", nil))
+	if err != nil {
+		t.Fatalf("GET non-batch logs: %v", err)
+	}
+	if resp.StatusCode != 404 {
+		t.Errorf("non-batch status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	store := state.NewStore()
+	app := fiber.New()
+	Setup(app, Dependencies{
+		Orch:  orchestrator.New(orchestrator.Deps{Store: store, Executors: orchestrator.NewRegistry()}),
+		Store: store,
+		Version: VersionInfo{
+			Version:    "v1.2.3",
+			Commit:     "abc1234",
+			BuildDate:  "2026-01-02T03:04:05Z",
+			AgentImage: "registry.example.com/bakery-agent:v1.2.3",
+		},
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/version", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var got VersionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != "v1.2.3" || got.Commit != "abc1234" || got.BuildDate != "2026-01-02T03:04:05Z" ||
+		got.AgentImage != "registry.example.com/bakery-agent:v1.2.3" {
+		t.Errorf("version = %+v", got)
+	}
+}
+
+func TestMajorVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		ok   bool
+	}{
+		{"v1.4.2", 1, true},
+		{"2.0.0-rc.1", 2, true},
+		{"v3", 3, true},
+		{"dev", 0, false},
+		{"latest", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := majorVersion(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("majorVersion(%q) = %d, %v, want %d, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAgentVersionCheck(t *testing.T) {
+	newApp := func() (*fiber.App, *state.BuildState) {
+		store := state.NewStore()
+		st := state.NewBuildState("build-1", 1, true, "")
+		store.Register(st.ID, st)
+		app := fiber.New(fiber.Config{StreamRequestBody: true})
+		Setup(app, Dependencies{Store: store, Version: VersionInfo{Version: "v2.1.0"}})
+		return app, st
+	}
+	postResult := func(t *testing.T, app *fiber.App, version string) {
+		t.Helper()
+		body := `{"taskId":"t1","arch":"amd64","imageDigest":"sha256:abc","success":true,"version":"` + version + `"}`
+		req := httptest.NewRequest("POST", "/build/build-1/result?task=t1", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+	}
+	hasLog := func(st *state.BuildState, level, substr string) bool {
+		for len(st.Logs) > 0 {
+			if e := <-st.Logs; e.Level == level && strings.Contains(e.Message, substr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("major mismatch warns", func(t *testing.T) {
+		app, st := newApp()
+		postResult(t, app, "v1.9.0")
+
+		res := st.GetResults()["t1"]
+		if !res.Success || res.AgentVersion != "v1.9.0" {
+			t.Errorf("result = %+v, want success with agentVersion v1.9.0", res)
+		}
+		if !hasLog(st, "warn", "agent version v1.9.0 does not match controller version v2.1.0") {
+			t.Error("missing version mismatch warning")
+		}
+	})
+
+	t.Run("same major passes", func(t *testing.T) {
+		app, st := newApp()
+		postResult(t, app, "v2.3.1")
+		if hasLog(st, "warn", "does not match") {
+			t.Error("unexpected version mismatch warning")
+		}
+	})
+
+	t.Run("strict fails result", func(t *testing.T) {
+		t.Setenv("STRICT_VERSION_MATCH", "true")
+		app, st := newApp()
+		postResult(t, app, "v1.9.0")
+
+		if res := st.GetResults()["t1"]; res.Success || !strings.Contains(res.Error, "does not match") {
+			t.Errorf("result = %+v, want failure for version mismatch", res)
+		}
+	})
+
+	t.Run("strict rejects ingest handshake", func(t *testing.T) {
+		t.Setenv("STRICT_VERSION_MATCH", "true")
+		app, st := newApp()
+		req := httptest.NewRequest("POST", "/build/build-1/logs/ingest?task=t1", strings.NewReader("hello\n"))
+		req.Header.Set("X-Agent-Version", "v1.9.0")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 409 {
+			t.Fatalf("status = %d, want 409", resp.StatusCode)
+		}
+		if res, ok := st.GetResults()["t1"]; !ok || res.Success || res.AgentVersion != "v1.9.0" {
+			t.Errorf("result = %+v (ok=%v), want failed result with agentVersion", res, ok)
+		}
+	})
+}
+
+func TestResultUsage(t *testing.T) {
+	store := state.NewStore()
+	st := state.NewBuildState("build-1", 2, false, "")
+	store.Register(st.ID, st)
+	app := fiber.New()
+	Setup(app, Dependencies{Store: store})
+
+	post := func(body string) {
+		req := httptest.NewRequest("POST", "/build/build-1/result", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+	}
+	post(`{"taskId":"amd64","arch":"amd64","success":false,"error":"build failed","peakMemoryMiB":3980,"cpuSeconds":421.5}`)
+	post(`{"taskId":"arm64","arch":"arm64","success":true}`)
+
+	results := st.GetResults()
+	if r := results["amd64"]; r.PeakMemoryMiB != 3980 || r.CPUSeconds != 421.5 {
+		t.Errorf("amd64 usage = %d MiB, %.1fs, want 3980 MiB, 421.5s", r.PeakMemoryMiB, r.CPUSeconds)
+	}
+	if r := results["arm64"]; r.PeakMemoryMiB != 0 || r.CPUSeconds != 0 {
+		t.Errorf("arm64 usage = %d MiB, %.1fs, want none", r.PeakMemoryMiB, r.CPUSeconds)
+	}
+
+	b, _ := json.Marshal(results["arm64"])
+	if strings.Contains(string(b), "peakMemoryMiB") {
+		t.Errorf("result without usage = %s, want peakMemoryMiB omitted", b)
+	}
+}
+
+func TestMaxArchesPerBuild(t *testing.T) {
+	t.Setenv("MAX_ARCHES_PER_BUILD", "2")
+	app := newTestApp(t)
+
+	build := func(arches ...string) int {
+		t.Helper()
+		body := "global:\n  platform: fake\n  kaniko:\n    no-push: true\nbake:\n"
+		for _, arch := range arches {
+			body += "- arch: " + arch + "\n"
+		}
+		resp, err := app.Test(httptest.NewRequest("POST", "/build?context_key=key", strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("POST /build: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := build("amd64", "arm64"); status != 200 {
+		t.Errorf("2-arch build status = %d, want 200", status)
+	}
+	if status := build("amd64", "arm64", "riscv64"); status != 400 {
+		t.Errorf("3-arch build status = %d, want 400", status)
+	}
+
+	batch := `
+services:
+- name: api
+  config:
+    global: {platform: fake}
+    bake: [{arch: amd64}, {arch: arm64}, {arch: riscv64}]
+`
+	resp, err := app.Test(httptest.NewRequest("POST", "/build/batch?context_key=key", strings.NewReader(batch)))
+	if err != nil {
+		t.Fatalf("POST /build/batch: %v", err)
+	}
+	if resp.StatusCode != 400 {
+		t.Errorf("batch status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	t.Setenv("S3_BUCKET", "bucket")
+
+	exec := fakeexec.New()
+	exec.Delay = time.Minute
+	executors := orchestrator.NewRegistry()
+	executors.Register("fake", exec)
+
+	store := state.NewStore()
+	app := fiber.New()
+	Setup(app, Dependencies{
+		Orch:       orchestrator.New(orchestrator.Deps{Store: store, Executors: executors}),
+		Store:      store,
+		AdminToken: "s3cret",
+	})
+
+	body := "global:\n  platform: fake\n  kaniko:\n    destination: registry.example.com/app:1.0\nbake:\n- arch: amd64\n"
+	resp, err := app.Test(httptest.NewRequest("POST", "/build?context_key=key", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("POST /build: %v", err)
+	}
+	var started struct {
+		BuildID string `json:"buildID"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&started); err != nil || started.BuildID == "" {
+		t.Fatalf("POST /build response: %v (%+v)", err, started)
+	}
+	st, _ := store.Get(started.BuildID)
+
+	purge := func(id, token string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/admin/build/"+id+"/purge", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req, 10000)
+		if err != nil {
+			t.Fatalf("POST purge: %v", err)
+		}
+		return resp
+	}
+
+	if resp := purge(started.BuildID, ""); resp.StatusCode != 401 {
+		t.Errorf("purge without token = %d, want 401", resp.StatusCode)
+	}
+	if resp := purge(started.BuildID, "wrong"); resp.StatusCode != 401 {
+		t.Errorf("purge with wrong token = %d, want 401", resp.StatusCode)
+	}
+
+	resp = purge(started.BuildID, "s3cret")
+	if resp.StatusCode != 200 {
+		t.Fatalf("purge = %d, want 200", resp.StatusCode)
+	}
+	var report state.PurgeReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if report.PreviousStatus != "running" || len(report.CanceledTasks) != 1 || report.CanceledTasks[0] != "amd64" || !report.StreamsDrained {
+		t.Errorf("report = %+v, want running build with amd64 canceled", report)
+	}
+
+	select {
+	case <-st.Done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("purged build did not finish")
+	}
+	if err := st.GetError(); !errors.Is(err, state.ErrPurged) {
+		t.Errorf("build error = %v, want ErrPurged", err)
+	}
+	if _, ok := store.Get(started.BuildID); ok {
+		t.Error("purged build still in store")
+	}
+	if resp := purge(started.BuildID, "s3cret"); resp.StatusCode != 404 {
+		t.Errorf("second purge = %d, want 404", resp.StatusCode)
+	}
+
+	disabled := fiber.New()
+	Setup(disabled, Dependencies{Store: store})
+	resp, err = disabled.Test(httptest.NewRequest("POST", "/admin/build/x/purge", nil))
+	if err != nil {
+		t.Fatalf("POST purge: %v", err)
+	}
+	if resp.StatusCode != 403 {
+		t.Errorf("purge without ADMIN_TOKEN = %d, want 403", resp.StatusCode)
+	}
+}
+
+// blockingResolver holds credential resolution until release is closed.
+type blockingResolver struct {
+	release chan struct{}
+	err     error
+}
+
+func (r *blockingResolver) ResolveCredentials(ctx context.Context, creds []config.RegistryCredential) ([]config.RegistryCredential, error) {
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return []config.RegistryCredential{{Registry: "registry.example.com", Username: "u", Password: "p"}}, nil
+}
+
+func TestBuildNoWait(t *testing.T) {
+	t.Setenv("S3_BUCKET", "bucket")
+	t.Setenv("BUILD_RESULT_TIMEOUT", "10ms")
+
+	exec := fakeexec.New()
+	executors := orchestrator.NewRegistry()
+	executors.Register("fake", exec)
+
+	resolver := &blockingResolver{release: make(chan struct{})}
+	store := state.NewStore()
+	app := fiber.New()
+	Setup(app, Dependencies{
+		Orch:  orchestrator.New(orchestrator.Deps{Store: store, Executors: executors, Credentials: resolver}),
+		Store: store,
+	})
+
+	body := "global:\n  platform: fake\n  kaniko-credentials:\n  - registry: registry.example.com\n    secret-arn: arn:aws:secretsmanager:us-east-1:123456789012:secret:reg\n" +
+		"  kaniko:\n    destination: registry.example.com/app:1.0\nbake:\n- arch: amd64\n"
+	submit := func(mode string) (int, map[string]interface{}) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("POST", "/build?context_key=key&mode="+mode, strings.NewReader(body)), 2000)
+		if err != nil {
+			t.Fatalf("POST /build: %v", err)
+		}
+		var out map[string]interface{}
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	code, out := submit("async-no-wait")
+	if code != 200 || out["status"] != "accepted" {
+		t.Fatalf("POST /build = %d %v, want 200 accepted", code, out)
+	}
+	buildID, _ := out["buildID"].(string)
+	st, ok := store.Get(buildID)
+	if !ok {
+		t.Fatalf("build %q not registered", buildID)
+	}
+	if got := st.Status(); got != "running" {
+		t.Errorf("status before dispatch = %q, want running", got)
+	}
+	if n := len(exec.Tasks()); n != 0 {
+		t.Errorf("%d tasks dispatched before credentials resolved, want 0", n)
+	}
+
+	close(resolver.release)
+	select {
+	case <-st.Done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("build did not finish")
+	}
+	if err := st.GetError(); err != nil {
+		t.Errorf("build error = %v", err)
+	}
+	if n := len(exec.Tasks()); n != 1 {
+		t.Errorf("%d tasks dispatched, want 1", n)
+	}
+
+	t.Run("background failure fails the build", func(t *testing.T) {
+		resolver.err = errors.New("secret not found")
+		_, out := submit("async-no-wait")
+		st, _ := store.Get(out["buildID"].(string))
+		select {
+		case <-st.Done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("build did not finish")
+		}
+		if err := st.GetError(); err == nil || !strings.Contains(err.Error(), "secret not found") {
+			t.Errorf("build error = %v, want the credential failure", err)
+		}
+	})
+
+	if code, _ := submit("later"); code != 400 {
+		t.Errorf("unknown mode = %d, want 400", code)
+	}
+}
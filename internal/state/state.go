@@ -1,6 +1,8 @@
 package state
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -8,6 +10,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/rayshoo/bakery/internal/config"
 )
 
 func debugLog(format string, v ...interface{}) {
@@ -20,13 +24,94 @@ type LogEntry struct {
 	TS      time.Time `json:"ts"`
 	Level   string    `json:"level"`
 	Message string    `json:"message"`
+
+	// Partial marks a piece of a task's log line whose rest follows in the task's
+	// next entries; the line ends with the first entry not marked partial.
+	Partial bool `json:"partial,omitempty"`
+
+	// BuildID and TaskID identify where the line came from. They are left out of
+	// the lean stream format and only sent in the envelope format.
+	BuildID string `json:"-"`
+	TaskID  string `json:"-"`
+
+	// Event, Status and Error are only set on structured lines such as the
+	// build_result line sent before the final BUILD SUCCEEDED/FAILED marker.
+	Event  string `json:"event,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// EventBuildResult is the event of the machine-readable line that reports how a build ended.
+const EventBuildResult = "build_result"
+
+// ResultEntries returns the terminal lines of a build that finished with err: a structured
+// build_result event, followed by the BUILD SUCCEEDED/FAILED marker older clients match on.
+func ResultEntries(err error) []LogEntry {
+	now := time.Now()
+	if err != nil {
+		return []LogEntry{
+			{TS: now, Level: "error", Message: "build result: failed", Event: EventBuildResult, Status: "failed", Error: err.Error()},
+			{TS: now, Level: "error", Message: "BUILD FAILED"},
+		}
+	}
+	return []LogEntry{
+		{TS: now, Level: "info", Message: "build result: succeeded", Event: EventBuildResult, Status: "succeeded"},
+		{TS: now, Level: "info", Message: "BUILD SUCCEEDED"},
+	}
+}
+
+// EffectiveTask is the resolved configuration a task was dispatched with.
+type EffectiveTask struct {
+	TaskID string                 `json:"taskID"`
+	Config config.EffectiveConfig `json:"config"`
 }
 
 type TaskResult struct {
-	Arch        string
-	ImageDigest string
-	Success     bool
-	Error       string
+	Arch         string `json:"arch"`
+	Platform     string `json:"platform,omitempty"`
+	AgentVersion string `json:"agentVersion,omitempty"`
+	ImageDigest  string `json:"imageDigest,omitempty"`
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"`
+
+	// Attempt is the dispatch attempt of the task the result came from.
+	Attempt int `json:"attempt,omitempty"`
+
+	// TaskArn identifies the task on its executor: the ECS task ARN, or the name of
+	// the Kubernetes job, ACI container group, Cloud Run execution or local container.
+	TaskArn string `json:"taskArn,omitempty"`
+
+	// PeakMemoryMiB and CPUSeconds are the resource usage reported by the agent, when available.
+	PeakMemoryMiB int64   `json:"peakMemoryMiB,omitempty"`
+	CPUSeconds    float64 `json:"cpuSeconds,omitempty"`
+
+	// OCILayoutKey is the storage key of the tarred OCI layout uploaded by the agent.
+	OCILayoutKey string `json:"ociLayoutKey,omitempty"`
+}
+
+// TaskUsage is the resource usage an agent measured for its task.
+type TaskUsage struct {
+	PeakMemoryMiB int64
+	CPUSeconds    float64
+}
+
+// Summary is a point-in-time view of a build, served by the status endpoint.
+type Summary struct {
+	BuildID        string                `json:"buildID"`
+	Status         string                `json:"status"`
+	StartedAt      time.Time             `json:"startedAt"`
+	FinishedAt     *time.Time            `json:"finishedAt,omitempty"`
+	Destination    string                `json:"destination,omitempty"`
+	ManifestDigest string                `json:"manifestDigest,omitempty"`
+	Error          string                `json:"error,omitempty"`
+	Tasks          map[string]TaskResult `json:"tasks"`
+
+	// QueuePosition is the build's place among builds waiting for a build slot,
+	// starting at 1. It is set by the status endpoint and omitted once dispatched.
+	QueuePosition int `json:"queuePosition,omitempty"`
+
+	// ReportKey is the storage key of the build report, once it is written.
+	ReportKey string `json:"reportKey,omitempty"`
 }
 
 // BuildState manages the state of a single build.
@@ -42,11 +127,16 @@ type BuildState struct {
 	IDByTaskArn   map[string]string
 	IngestStarted map[string]bool
 	IngestDone    map[string]bool
+	LastHeartbeat map[string]time.Time
 	TotalTasks    int
 
 	IngestDoneCt int
 	finished     bool
 	FirstError   error
+	// errs lists the build's errors in the order they were recorded, each tagged with
+	// the task whose current attempt it belongs to, or no task for build-level errors.
+	// FirstError is the first of them; a task's entries go away when it is retried.
+	errs []recordedError
 
 	Results         map[string]TaskResult
 	ResultsReceived int
@@ -54,17 +144,105 @@ type BuildState struct {
 	IsSingleArch      bool
 	GlobalDestination string
 	HasDuplicateArch  bool
+	ManifestDigest    string
+	reportKey         string
+
+	CreatedAt  time.Time
+	finishedAt time.Time
+
+	effective     []EffectiveTask
+	taskPlatforms map[string]string
+	agentVersions map[string]string
+	taskUsage     map[string]TaskUsage
+	ociLayouts    map[string]string
+	taskAttempts  map[string]int
+	subscribers   map[chan LogEntry]struct{}
+	children      map[string]string
+	streams       int
+	streamsIdle   chan struct{}
+	unread        []LogEntry
+	ingestGrace   time.Duration
+	ingestUntil   time.Time
+	maxLogBytes   int
+	logBytes      int
+	logCapped     bool
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	parent    *BuildState
+	logPrefix string
 }
 
 // Store is a thread-safe store for build states.
 type Store struct {
 	mu     sync.RWMutex
 	states map[string]*BuildState
+
+	idemMu      sync.Mutex
+	idempotency map[string]idempotencyEntry
+	now         func() time.Time
+}
+
+type idempotencyEntry struct {
+	buildID string
+	expires time.Time
+	// pending is closed once the start reserving the key returns; it is nil after that.
+	pending chan struct{}
 }
 
 func NewStore() *Store {
 	return &Store{
-		states: make(map[string]*BuildState),
+		states:      make(map[string]*BuildState),
+		idempotency: make(map[string]idempotencyEntry),
+		now:         time.Now,
+	}
+}
+
+// StartOnce deduplicates build submissions by idempotency key. If key was recorded
+// within ttl, the recorded build ID is returned with existing=true and start is not called.
+// Otherwise start is called and, on success, its build ID is recorded under key.
+// start runs without holding the store's lock, so slow starts under different keys
+// proceed in parallel; callers with the same key wait for the one that reserved it.
+func (s *Store) StartOnce(key string, ttl time.Duration, start func() (string, error)) (buildID string, existing bool, err error) {
+	for {
+		s.idemMu.Lock()
+		now := s.now()
+		for k, e := range s.idempotency {
+			if e.pending == nil && !now.Before(e.expires) {
+				delete(s.idempotency, k)
+			}
+		}
+
+		e, ok := s.idempotency[key]
+		if !ok {
+			pending := make(chan struct{})
+			s.idempotency[key] = idempotencyEntry{pending: pending}
+			s.idemMu.Unlock()
+
+			buildID, err = start()
+
+			s.idemMu.Lock()
+			if err != nil {
+				delete(s.idempotency, key)
+			} else {
+				s.idempotency[key] = idempotencyEntry{buildID: buildID, expires: now.Add(ttl)}
+			}
+			s.idemMu.Unlock()
+			close(pending)
+			if err != nil {
+				return "", false, err
+			}
+			return buildID, false, nil
+		}
+		s.idemMu.Unlock()
+
+		if e.pending == nil {
+			return e.buildID, true, nil
+		}
+		// Another submission with this key is starting; use its build, or start
+		// one ourselves if it failed.
+		<-e.pending
 	}
 }
 
@@ -115,6 +293,57 @@ func (s *Store) Delete(id string) {
 	debugLog("[Store.Delete] id=%s, remaining=%d", id, len(s.states))
 }
 
+// ErrPurged is the error a build finishes with when it is evicted by Store.Purge.
+var ErrPurged = errors.New("build purged by admin")
+
+// PurgeReport describes what Store.Purge cleaned up.
+type PurgeReport struct {
+	BuildID        string   `json:"buildID"`
+	PreviousStatus string   `json:"previousStatus"`
+	CanceledTasks  []string `json:"canceledTasks"`
+	Children       []string `json:"children,omitempty"`
+	StreamsDrained bool     `json:"streamsDrained"`
+}
+
+// Purge forcibly evicts a build: it cancels the build's context, which stops its
+// in-flight tasks, finishes it with ErrPurged, waits up to streamTimeout for log
+// streams to finish writing, and deletes it from the store. The children of a batch
+// build are purged with it. It returns false if id is unknown.
+func (s *Store) Purge(id string, streamTimeout time.Duration) (PurgeReport, bool) {
+	st, ok := s.Get(id)
+	if !ok {
+		return PurgeReport{}, false
+	}
+
+	report := PurgeReport{
+		BuildID:        id,
+		PreviousStatus: st.Status(),
+		CanceledTasks:  st.pendingTasks(),
+	}
+
+	st.cancel(ErrPurged)
+	st.SetIngestGrace(0)
+	st.AppendLog("warn", "build purged by admin")
+	st.Finish(ErrPurged)
+	report.StreamsDrained = st.waitStreams(streamTimeout)
+	s.Delete(id)
+
+	children := st.Children()
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if child, ok := s.Purge(children[name], streamTimeout); ok {
+			report.Children = append(report.Children, child.BuildID)
+		}
+	}
+
+	log.Printf("[Store.Purge] id=%s, status=%s, canceled=%v", id, report.PreviousStatus, report.CanceledTasks)
+	return report, true
+}
+
 func (s *Store) ListIDs() []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -140,26 +369,279 @@ func NewBuildState(id string, totalTasks int, isSingleArch bool, globalDest stri
 		IDByTaskArn:       make(map[string]string),
 		IngestStarted:     make(map[string]bool),
 		IngestDone:        make(map[string]bool),
+		LastHeartbeat:     make(map[string]time.Time),
+		taskPlatforms:     make(map[string]string),
+		agentVersions:     make(map[string]string),
+		taskUsage:         make(map[string]TaskUsage),
+		ociLayouts:        make(map[string]string),
+		taskAttempts:      make(map[string]int),
+		subscribers:       make(map[chan LogEntry]struct{}),
+		children:          make(map[string]string),
 		TotalTasks:        totalTasks,
 		Results:           make(map[string]TaskResult),
 		IsSingleArch:      isSingleArch,
 		GlobalDestination: globalDest,
 		HasDuplicateArch:  false,
+		CreatedAt:         time.Now(),
 	}
+	st.ctx, st.cancel = context.WithCancelCause(context.Background())
 
 	debugLog("[NewBuildState] Created: id=%s, totalTasks=%d", id, totalTasks)
 	return st
 }
 
+// SetParent forwards every log entry of this build to parent, prefixed with prefix.
+// Used by batch builds to aggregate child logs into one stream.
+func (s *BuildState) SetParent(parent *BuildState, prefix string) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.parent = parent
+	s.logPrefix = prefix
+}
+
+// SetEffective records the config each task was dispatched with. Credentials are redacted.
+func (s *BuildState) SetEffective(taskIDs []string, list []config.EffectiveConfig) {
+	effective := make([]EffectiveTask, len(list))
+	for i, ef := range list {
+		effective[i] = EffectiveTask{TaskID: taskIDs[i], Config: ef.Redacted()}
+	}
+
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.effective = effective
+}
+
+// Effective returns the configs recorded by SetEffective, or nil if none were recorded.
+func (s *BuildState) Effective() []EffectiveTask {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	return s.effective
+}
+
+// TaskDestinations returns the destination and mirrors the task taskID pushes to.
+// In a multi-arch build, a task without its own destination pushes to the global
+// destination and the mirrors with its arch (or, with duplicate arches, its task ID)
+// appended to the tag, leaving the untagged references to the manifest list.
+func (s *BuildState) TaskDestinations(taskID string, ef config.EffectiveConfig) (string, []string) {
+	if s.IsSingleArch {
+		if ef.Destination != "" {
+			return ef.Destination, ef.Mirrors
+		}
+		return s.GlobalDestination, ef.Mirrors
+	}
+	if ef.Destination != "" && ef.Destination != s.GlobalDestination {
+		return ef.Destination, ef.Mirrors
+	}
+
+	suffix := ef.Arch
+	if s.HasDuplicateArch {
+		suffix = taskID
+	}
+	mirrors := make([]string, 0, len(ef.Mirrors))
+	for _, m := range ef.Mirrors {
+		mirrors = append(mirrors, config.AppendTagSuffix(m, suffix, ef.ArchTagSeparator))
+	}
+	return config.AppendTagSuffix(s.GlobalDestination, suffix, ef.ArchTagSeparator), mirrors
+}
+
+// Context returns the build's context, which is canceled with ErrPurged when the
+// build is purged. Task contexts derive from it.
+func (s *BuildState) Context() context.Context {
+	return s.ctx
+}
+
+// UnreadLog keeps entries taken from Logs that a log stream failed to send, so the
+// next stream sends them first.
+func (s *BuildState) UnreadLog(entries ...LogEntry) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.unread = append(s.unread, entries...)
+}
+
+// TakeUnread returns and clears the entries kept by UnreadLog, oldest first.
+func (s *BuildState) TakeUnread() []LogEntry {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	entries := s.unread
+	s.unread = nil
+	return entries
+}
+
+// TrackStream registers a log stream writer until the returned func is called, so
+// a purge waits for the writer to flush the final lines before evicting the build.
+func (s *BuildState) TrackStream() func() {
+	s.Mu.Lock()
+	if s.streams == 0 {
+		s.streamsIdle = make(chan struct{})
+	}
+	s.streams++
+	s.Mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.Mu.Lock()
+			s.streams--
+			if s.streams == 0 {
+				close(s.streamsIdle)
+			}
+			s.Mu.Unlock()
+		})
+	}
+}
+
+// waitStreams waits up to timeout for every tracked log stream to finish.
+func (s *BuildState) waitStreams(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.Mu.RLock()
+		active, idle := s.streams, s.streamsIdle
+		s.Mu.RUnlock()
+
+		if active == 0 {
+			return true
+		}
+		select {
+		case <-idle:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// SetIngestGrace sets how long Finish waits for agents' ingest streams, so the log
+// lines of an agent that connected late are not dropped once the build is finished.
+// Finish waits for every task that has opened its stream or reported a result.
+func (s *BuildState) SetIngestGrace(d time.Duration) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.ingestGrace = d
+}
+
+// SetIngestDeadline stops Finish waiting for ingest streams at t, even when the
+// ingest grace period would run past it, so a build deadline also bounds the wait.
+func (s *BuildState) SetIngestDeadline(t time.Time) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.ingestUntil = t
+}
+
+// SetMaxLogBytes caps the bytes of agent log lines kept for the build. Once the cap
+// is reached a single notice is logged and later agent lines are dropped, while the
+// build itself keeps running. A non-positive max disables the cap.
+func (s *BuildState) SetMaxLogBytes(max int) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.maxLogBytes = max
+}
+
+// pendingIngests returns the tasks known to have run whose ingest stream is not done:
+// tasks that started streaming, and tasks that reported a result without streaming yet.
+func (s *BuildState) pendingIngests() []string {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	var pending []string
+	for taskID := range s.Results {
+		if !s.IngestDone[taskID] {
+			pending = append(pending, taskID)
+		}
+	}
+	for taskID := range s.IngestStarted {
+		if _, ok := s.Results[taskID]; !ok && !s.IngestDone[taskID] {
+			pending = append(pending, taskID)
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+// waitIngests waits up to the ingest grace period, or the ingest deadline when it
+// is earlier, for pending ingest streams and returns the tasks still pending.
+func (s *BuildState) waitIngests() []string {
+	s.Mu.RLock()
+	grace := s.ingestGrace
+	until := s.ingestUntil
+	finished := s.finished
+	s.Mu.RUnlock()
+	if grace <= 0 || finished {
+		return nil
+	}
+
+	deadline := time.Now().Add(grace)
+	if !until.IsZero() && until.Before(deadline) {
+		deadline = until
+	}
+	for {
+		pending := s.pendingIngests()
+		if len(pending) == 0 || time.Now().After(deadline) {
+			return pending
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pendingTasks returns the IDs of dispatched tasks that have not reported a result.
+func (s *BuildState) pendingTasks() []string {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	pending := []string{}
+	for _, t := range s.effective {
+		if _, ok := s.Results[t.TaskID]; !ok {
+			pending = append(pending, t.TaskID)
+		}
+	}
+	return pending
+}
+
 func (s *BuildState) AppendLog(level, msg string) {
 	s.appendLog(level, msg, false)
 }
 
+// AppendTaskLog appends a log line produced by the agent of taskID.
+func (s *BuildState) AppendTaskLog(taskID, level, msg string) {
+	s.AppendTaskLogPart(taskID, level, msg, false)
+}
+
+// AppendTaskLogPart is AppendTaskLog for a piece of a line, marked partial when the
+// rest of the line follows in later entries.
+func (s *BuildState) AppendTaskLogPart(taskID, level, msg string, partial bool) {
+	keep, capped := s.countLogBytes(len(msg))
+	if capped > 0 {
+		s.appendLog("warn", fmt.Sprintf("log output capped at %d bytes; further agent log lines are dropped", capped), false)
+	}
+	if !keep {
+		return
+	}
+	s.appendEntry(LogEntry{TS: time.Now(), Level: level, Message: msg, TaskID: taskID, Partial: partial}, false)
+}
+
+// countLogBytes adds n bytes of agent log to the build's total. keep reports whether
+// the line fits under the cap; capped is the cap, set only for the line that reached it.
+func (s *BuildState) countLogBytes(n int) (keep bool, capped int) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	if s.logCapped {
+		return false, 0
+	}
+	if s.maxLogBytes > 0 && s.logBytes+n > s.maxLogBytes {
+		s.logCapped = true
+		return false, s.maxLogBytes
+	}
+	s.logBytes += n
+	return true, 0
+}
+
 func (s *BuildState) appendLog(level, msg string, fromFinish bool) {
-	entry := LogEntry{
-		TS:      time.Now(),
-		Level:   level,
-		Message: msg,
+	s.appendEntry(LogEntry{TS: time.Now(), Level: level, Message: msg}, fromFinish)
+}
+
+func (s *BuildState) appendEntry(entry LogEntry, fromFinish bool) {
+	if entry.BuildID == "" {
+		entry.BuildID = s.ID
 	}
 
 	s.Mu.RLock()
@@ -168,8 +650,23 @@ func (s *BuildState) appendLog(level, msg string, fromFinish bool) {
 		return
 	}
 	ch := s.Logs
+	parent := s.parent
+	prefix := s.logPrefix
+	for sub := range s.subscribers {
+		select {
+		case sub <- entry:
+		default:
+		}
+	}
 	s.Mu.RUnlock()
 
+	// A child's build_result would read as the end of the parent build, so it stays with the child.
+	if parent != nil && entry.Event == "" {
+		forwarded := entry
+		forwarded.Message = prefix + entry.Message
+		parent.appendEntry(forwarded, false)
+	}
+
 	defer func() { recover() }()
 
 	select {
@@ -184,6 +681,26 @@ func (s *BuildState) MarkIngestStarted(taskID string) {
 	s.IngestStarted[taskID] = true
 }
 
+// MarkHeartbeat records that the agent of taskID was alive just now.
+func (s *BuildState) MarkHeartbeat(taskID string) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.LastHeartbeat[taskID] = time.Now()
+}
+
+// HeartbeatExpired reports whether the agent of taskID has been silent for longer than timeout.
+// Tasks whose agent has not connected yet, or whose ingest stream is already closed, never expire.
+func (s *BuildState) HeartbeatExpired(taskID string, timeout time.Duration) bool {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	last, ok := s.LastHeartbeat[taskID]
+	if !ok || s.IngestDone[taskID] {
+		return false
+	}
+	return time.Since(last) > timeout
+}
+
 func (s *BuildState) MarkIngestDone(taskID string) bool {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
@@ -198,30 +715,232 @@ func (s *BuildState) MarkIngestDone(taskID string) bool {
 	return s.IngestDoneCt == s.TotalTasks
 }
 
-func (s *BuildState) SetResult(taskID, arch, digest string, success bool, errMsg string) {
+// TaskArn returns the handle the executor recorded for the task taskID, such as
+// its ECS task ARN or Kubernetes Job name, or "" if the task has not started.
+func (s *BuildState) TaskArn(taskID string) string {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	return s.TaskArnByID[taskID]
+}
+
+// AddChild records the child build of service name in a batch build.
+// The task summary lists each child with its build ID.
+func (s *BuildState) AddChild(name, childID string) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.children[name] = childID
+}
+
+// Children returns the child build IDs of a batch build, keyed by service name.
+func (s *BuildState) Children() map[string]string {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	children := make(map[string]string, len(s.children))
+	for name, id := range s.children {
+		children[name] = id
+	}
+	return children
+}
+
+// SetTaskPlatform records the executor platform taskID was dispatched to.
+// Results set for the task afterwards carry it, whichever path reports them.
+func (s *BuildState) SetTaskPlatform(taskID, platform string) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.taskPlatforms[strings.TrimSpace(taskID)] = platform
+}
+
+// SetAgentVersion records the version reported by the agent running taskID.
+// It returns false when a version was already recorded, so callers check it only once.
+func (s *BuildState) SetAgentVersion(taskID, version string) bool {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
 	taskID = strings.TrimSpace(taskID)
+	if _, ok := s.agentVersions[taskID]; ok {
+		return false
+	}
+	s.agentVersions[taskID] = version
+	return true
+}
+
+// SetTaskUsage records the resource usage reported for taskID, carried by its result.
+func (s *BuildState) SetTaskUsage(taskID string, usage TaskUsage) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.taskUsage[strings.TrimSpace(taskID)] = usage
+}
 
+// SetTaskOCILayout records the storage key of the OCI layout uploaded for taskID,
+// carried by its result.
+func (s *BuildState) SetTaskOCILayout(taskID, key string) {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
+	s.ociLayouts[strings.TrimSpace(taskID)] = key
+}
+
+// StartAttempt records a new dispatch of taskID and returns its attempt number,
+// starting at 1. Results from earlier attempts are ignored from then on, and the
+// heartbeat and ingest state and the errors of the previous attempt are reset.
+func (s *BuildState) StartAttempt(taskID string) int {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	taskID = strings.TrimSpace(taskID)
+	s.clearTaskErrors(taskID)
+	delete(s.LastHeartbeat, taskID)
+	if s.IngestDone[taskID] {
+		delete(s.IngestDone, taskID)
+		s.IngestDoneCt--
+	}
+	s.taskAttempts[taskID]++
+	return s.taskAttempts[taskID]
+}
+
+// TaskAttempt returns the current attempt of taskID, or 0 if it was never dispatched.
+func (s *BuildState) TaskAttempt(taskID string) int {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	return s.taskAttempts[strings.TrimSpace(taskID)]
+}
+
+// IsStaleAttempt reports whether attempt is older than the current attempt of taskID.
+// Attempt 0, from an agent that predates attempts, counts as the current attempt.
+func (s *BuildState) IsStaleAttempt(taskID string, attempt int) bool {
+	return attempt != 0 && attempt < s.TaskAttempt(taskID)
+}
+
+// SetResult records the result of the current attempt of a task and reports whether
+// it was stored. A repeated result for the same attempt is ignored; if it carries a
+// different digest it is rejected and logged as an error so the first result wins.
+func (s *BuildState) SetResult(taskID, arch, digest string, success bool, errMsg string) bool {
+	return s.SetAttemptResult(taskID, s.TaskAttempt(taskID), arch, digest, success, errMsg)
+}
+
+// SetAttemptResult records the result of taskID reported by the given attempt. Results
+// from older attempts, such as a late one from an agent that was replaced by a retry,
+// are ignored, and a result from a newer attempt replaces the one already recorded.
+// Attempt 0, from an agent that predates attempts, is taken as the current attempt.
+func (s *BuildState) SetAttemptResult(taskID string, attempt int, arch, digest string, success bool, errMsg string) bool {
+	taskID = strings.TrimSpace(taskID)
+
+	s.Mu.Lock()
 
-	if existing, exists := s.Results[taskID]; exists {
-		debugLog("[SetResult] WARNING: state=%s overwriting taskID='%s' (old_arch=%s, new_arch=%s)",
-			s.ID, taskID, existing.Arch, arch)
+	current := s.taskAttempts[taskID]
+	if attempt == 0 {
+		attempt = current
+	}
+	if attempt < current {
+		s.Mu.Unlock()
+		s.AppendLog("info", fmt.Sprintf("[result] Ignoring stale result for task '%s' from attempt %d (current attempt %d)",
+			taskID, attempt, current))
+		return false
+	}
+
+	replacing := false
+	if existing, exists := s.Results[taskID]; exists && existing.Attempt < attempt {
+		replacing = true
+		s.clearTaskErrors(taskID)
+	} else if exists {
+		s.Mu.Unlock()
+
+		if existing.ImageDigest == digest {
+			s.AppendLog("debug", fmt.Sprintf("[result] Duplicate result for task '%s' with same digest - ignoring", taskID))
+		} else {
+			s.AppendLog("error", fmt.Sprintf("[result] CRITICAL: Duplicate result for task '%s' with DIFFERENT digest! (existing=%s, new=%s) - REJECTING NEW",
+				taskID, existing.ImageDigest, digest))
+		}
+		return false
 	}
 
 	s.Results[taskID] = TaskResult{
-		Arch:        arch,
-		ImageDigest: digest,
-		Success:     success,
-		Error:       errMsg,
+		Arch:         arch,
+		Platform:     s.taskPlatforms[taskID],
+		AgentVersion: s.agentVersions[taskID],
+		ImageDigest:  digest,
+		Success:      success,
+		Error:        errMsg,
+		Attempt:      attempt,
+
+		PeakMemoryMiB: s.taskUsage[taskID].PeakMemoryMiB,
+		CPUSeconds:    s.taskUsage[taskID].CPUSeconds,
+		OCILayoutKey:  s.ociLayouts[taskID],
+	}
+	if !replacing {
+		s.ResultsReceived++
 	}
-	s.ResultsReceived++
 
-	if !success && s.FirstError == nil {
-		s.FirstError = fmt.Errorf("task %s failed: %s", taskID, errMsg)
+	if !success {
+		s.recordError(taskID, errors.New(taskFailure(taskID, errMsg)))
 	}
 
 	debugLog("[SetResult] state=%s, taskID='%s', count=%d/%d", s.ID, taskID, s.ResultsReceived, s.TotalTasks)
+	s.Mu.Unlock()
+
+	return true
+}
+
+// recordedError is an error of the build, or of the current attempt of taskID.
+type recordedError struct {
+	taskID string
+	err    error
+}
+
+// recordError records err for taskID's current attempt, or for the build when taskID
+// is empty. Only the first error of each attempt and of the build is kept. s.Mu must be held.
+func (s *BuildState) recordError(taskID string, err error) {
+	for _, e := range s.errs {
+		if e.taskID == taskID {
+			return
+		}
+	}
+	s.errs = append(s.errs, recordedError{taskID: taskID, err: err})
+	if s.FirstError == nil {
+		s.FirstError = err
+	}
+}
+
+// clearTaskErrors drops the errors of taskID's previous attempt, so a retry that
+// succeeds leaves the build without them. s.Mu must be held.
+func (s *BuildState) clearTaskErrors(taskID string) {
+	kept := s.errs[:0]
+	for _, e := range s.errs {
+		if e.taskID != taskID {
+			kept = append(kept, e)
+		}
+	}
+	s.errs = kept
+	s.FirstError = nil
+	if len(kept) > 0 {
+		s.FirstError = kept[0].err
+	}
+}
+
+// SetTaskError records err as the failure of taskID's current attempt. Unlike SetError,
+// it is dropped when the task is dispatched again, so a retry can still succeed.
+func (s *BuildState) SetTaskError(taskID string, err error) {
+	if err == nil {
+		return
+	}
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.recordError(strings.TrimSpace(taskID), err)
+}
+
+// AttemptError returns the error recorded for taskID's current attempt, or nil.
+func (s *BuildState) AttemptError(taskID string) error {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	taskID = strings.TrimSpace(taskID)
+	for _, e := range s.errs {
+		if e.taskID == taskID {
+			return e.err
+		}
+	}
+	return nil
+}
+
+// taskFailure is the build error recorded for a failed task result.
+func taskFailure(taskID, errMsg string) string {
+	return fmt.Sprintf("task %s failed: %s", taskID, errMsg)
 }
 
 func (s *BuildState) AllResultsReceived() bool {
@@ -252,15 +971,22 @@ func (s *BuildState) logTaskSummary() {
 	for k, v := range s.TaskArnByID {
 		taskArnByID[k] = v
 	}
+	children := make(map[string]string, len(s.children))
+	for k, v := range s.children {
+		children[k] = v
+	}
 	s.Mu.RUnlock()
 
-	keys := make(map[string]struct{}, len(results)+len(taskArnByID))
+	keys := make(map[string]struct{}, len(results)+len(taskArnByID)+len(children))
 	for k := range results {
 		keys[k] = struct{}{}
 	}
 	for k := range taskArnByID {
 		keys[k] = struct{}{}
 	}
+	for k := range children {
+		keys[k] = struct{}{}
+	}
 
 	taskIDs := make([]string, 0, len(keys))
 	for k := range keys {
@@ -285,14 +1011,100 @@ func (s *BuildState) logTaskSummary() {
 			errMsg = "result missing"
 		}
 
+		if childID, ok := children[taskID]; ok {
+			s.appendLog("info", fmt.Sprintf("[task-summary] task=%s build=%s status=%s err=%s",
+				taskID, childID, status, errMsg), true)
+			continue
+		}
 		taskArn := taskArnByID[taskID]
 		s.appendLog("info", fmt.Sprintf("[task-summary] task=%s arn=%s status=%s err=%s",
 			taskID, taskArn, status, errMsg), true)
 	}
 }
 
+// Status reports "running" until the build finishes, then "succeeded" or "failed".
+func (s *BuildState) Status() string {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	switch {
+	case !s.finished:
+		return "running"
+	case s.FirstError != nil:
+		return "failed"
+	default:
+		return "succeeded"
+	}
+}
+
+// SetManifestDigest records the digest of the pushed multi-arch manifest list.
+func (s *BuildState) SetManifestDigest(digest string) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.ManifestDigest = digest
+}
+
+// SetReportKey records the storage key of the build report.
+func (s *BuildState) SetReportKey(key string) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.reportKey = key
+}
+
+// Summary returns the current status, timing and task results of the build.
+func (s *BuildState) Summary() Summary {
+	status := s.Status()
+
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	sum := Summary{
+		BuildID:        s.ID,
+		Status:         status,
+		StartedAt:      s.CreatedAt,
+		Destination:    s.GlobalDestination,
+		ManifestDigest: s.ManifestDigest,
+		ReportKey:      s.reportKey,
+		Tasks:          make(map[string]TaskResult, len(s.Results)),
+	}
+	if s.finished {
+		finishedAt := s.finishedAt
+		sum.FinishedAt = &finishedAt
+	}
+	if s.FirstError != nil {
+		sum.Error = s.FirstError.Error()
+	}
+	for k, v := range s.Results {
+		v.TaskArn = s.TaskArnByID[k]
+		sum.Tasks[k] = v
+	}
+	// Running tasks have no result yet but are listed with their executor task,
+	// so operators can find a hanging one.
+	for k, arn := range s.TaskArnByID {
+		if _, ok := sum.Tasks[k]; ok {
+			continue
+		}
+		sum.Tasks[k] = TaskResult{Arch: s.taskArch(k), Platform: s.taskPlatforms[k], TaskArn: arn}
+	}
+	return sum
+}
+
+// taskArch returns the arch taskID was dispatched for. Callers must hold s.Mu.
+func (s *BuildState) taskArch(taskID string) string {
+	for _, t := range s.effective {
+		if t.TaskID == taskID {
+			return t.Config.Arch
+		}
+	}
+	return ""
+}
+
 // Finish finalizes the build and closes the log channel.
 func (s *BuildState) Finish(err error) {
+	if pending := s.waitIngests(); len(pending) > 0 {
+		s.AppendLog("warn", fmt.Sprintf("finishing with ingest streams still open for tasks %v; later log lines are dropped", pending))
+	}
+
 	s.Mu.Lock()
 
 	if s.finished {
@@ -301,11 +1113,12 @@ func (s *BuildState) Finish(err error) {
 	}
 
 	s.finished = true
+	s.finishedAt = time.Now()
 
 	if s.FirstError != nil {
 		err = s.FirstError
 	} else if err != nil {
-		s.FirstError = err
+		s.recordError("", err)
 	}
 
 	debugLog("[Finish] state=%s, err=%v, count=%d/%d", s.ID, err, s.ResultsReceived, s.TotalTasks)
@@ -316,21 +1129,55 @@ func (s *BuildState) Finish(err error) {
 
 	if err != nil {
 		s.appendLog("error", fmt.Sprintf("build finished with error: %v", err), true)
-		s.appendLog("error", "BUILD FAILED", true)
 	} else {
 		s.appendLog("info", "build finished successfully", true)
-		s.appendLog("info", "BUILD SUCCEEDED", true)
+	}
+	for _, e := range ResultEntries(err) {
+		s.appendEntry(e, true)
 	}
 
 	s.Mu.Lock()
 	if !s.closed {
 		close(s.Logs)
 		close(s.Done)
+		for sub := range s.subscribers {
+			close(sub)
+		}
+		s.subscribers = nil
 		s.closed = true
 	}
 	s.Mu.Unlock()
 }
 
+// Subscribe returns a channel that receives every log entry appended from now on,
+// independently of the Logs channel and of other subscribers. The channel is closed
+// when the build finishes or when cancel is called. A slow subscriber misses entries
+// rather than blocking the build.
+func (s *BuildState) Subscribe() (<-chan LogEntry, func()) {
+	ch := make(chan LogEntry, 1000)
+
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if s.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	s.subscribers[ch] = struct{}{}
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			s.Mu.Lock()
+			defer s.Mu.Unlock()
+			if _, ok := s.subscribers[ch]; ok {
+				delete(s.subscribers, ch)
+				close(ch)
+			}
+		})
+	}
+	return ch, cancel
+}
+
 func (s *BuildState) IsFinished() bool {
 	s.Mu.RLock()
 	defer s.Mu.RUnlock()
@@ -341,8 +1188,8 @@ func (s *BuildState) SetError(err error) {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 
-	if s.FirstError == nil && err != nil {
-		s.FirstError = err
+	if err != nil {
+		s.recordError("", err)
 	}
 }
 
@@ -0,0 +1,626 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rayshoo/bakery/internal/config"
+)
+
+func TestStoreStartOnce(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s := NewStore()
+	s.now = func() time.Time { return now }
+
+	calls := 0
+	start := func() (string, error) {
+		calls++
+		return fmt.Sprintf("b-%d", calls), nil
+	}
+
+	t.Run("duplicate within window", func(t *testing.T) {
+		id1, existing, err := s.StartOnce("key-1", time.Minute, start)
+		if err != nil || existing || id1 != "b-1" {
+			t.Fatalf("first StartOnce = (%q, %v, %v), want (b-1, false, nil)", id1, existing, err)
+		}
+
+		now = now.Add(30 * time.Second)
+
+		id2, existing, err := s.StartOnce("key-1", time.Minute, start)
+		if err != nil || !existing || id2 != "b-1" {
+			t.Fatalf("duplicate StartOnce = (%q, %v, %v), want (b-1, true, nil)", id2, existing, err)
+		}
+		if calls != 1 {
+			t.Errorf("start called %d times, want 1", calls)
+		}
+	})
+
+	t.Run("expired key", func(t *testing.T) {
+		now = now.Add(time.Minute)
+
+		id, existing, err := s.StartOnce("key-1", time.Minute, start)
+		if err != nil || existing || id != "b-2" {
+			t.Fatalf("StartOnce after expiry = (%q, %v, %v), want (b-2, false, nil)", id, existing, err)
+		}
+		if calls != 2 {
+			t.Errorf("start called %d times, want 2", calls)
+		}
+	})
+
+	t.Run("failed start is not recorded", func(t *testing.T) {
+		_, _, err := s.StartOnce("key-2", time.Minute, func() (string, error) {
+			return "", errors.New("boom")
+		})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+
+		id, existing, err := s.StartOnce("key-2", time.Minute, start)
+		if err != nil || existing || id != "b-3" {
+			t.Fatalf("StartOnce after failure = (%q, %v, %v), want (b-3, false, nil)", id, existing, err)
+		}
+	})
+}
+
+func TestStoreStartOnceConcurrent(t *testing.T) {
+	s := NewStore()
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	var calls atomic.Int32
+	slow := func() (string, error) {
+		calls.Add(1)
+		close(started)
+		<-release
+		return "b-slow", nil
+	}
+
+	type outcome struct {
+		id       string
+		existing bool
+	}
+	first := make(chan outcome)
+	go func() {
+		id, existing, _ := s.StartOnce("key-a", time.Minute, slow)
+		first <- outcome{id, existing}
+	}()
+	<-started
+
+	// A different key is not held up by the slow start.
+	done := make(chan string)
+	go func() {
+		id, _, _ := s.StartOnce("key-b", time.Minute, func() (string, error) { return "b-fast", nil })
+		done <- id
+	}()
+	select {
+	case id := <-done:
+		if id != "b-fast" {
+			t.Errorf("key-b build = %q, want b-fast", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartOnce with another key waited for the slow start")
+	}
+
+	// The same key waits for the slow start and reuses its build.
+	second := make(chan outcome)
+	go func() {
+		id, existing, _ := s.StartOnce("key-a", time.Minute, slow)
+		second <- outcome{id, existing}
+	}()
+	select {
+	case <-second:
+		t.Fatal("StartOnce with the same key returned before the first start finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	if got := <-first; got != (outcome{"b-slow", false}) {
+		t.Errorf("first = %+v, want b-slow started", got)
+	}
+	if got := <-second; got != (outcome{"b-slow", true}) {
+		t.Errorf("second = %+v, want the existing b-slow", got)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("slow start called %d times, want 1", n)
+	}
+}
+
+func TestSetResultConcurrent(t *testing.T) {
+	const tasks = 8
+	const senders = 16
+
+	st := NewBuildState("b-test", tasks, false, "")
+
+	var wg sync.WaitGroup
+	var recorded atomic.Int32
+	for i := 0; i < tasks; i++ {
+		taskID := fmt.Sprintf("task-%d", i)
+		for j := 0; j < senders; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				if st.SetResult(taskID, "amd64", fmt.Sprintf("sha256:%d", j), true, "") {
+					recorded.Add(1)
+				}
+			}(j)
+		}
+	}
+	wg.Wait()
+
+	if got := recorded.Load(); got != tasks {
+		t.Errorf("recorded %d results, want %d", got, tasks)
+	}
+	if st.ResultsReceived != tasks {
+		t.Errorf("ResultsReceived = %d, want %d", st.ResultsReceived, tasks)
+	}
+	if !st.AllResultsReceived() {
+		t.Error("AllResultsReceived = false, want true")
+	}
+
+	first := st.GetResults()["task-0"].ImageDigest
+	if st.SetResult("task-0", "amd64", "sha256:other", true, "") {
+		t.Error("SetResult accepted a result with a different digest")
+	}
+	if got := st.GetResults()["task-0"].ImageDigest; got != first {
+		t.Errorf("digest = %q, want first result %q to be kept", got, first)
+	}
+}
+
+func TestAppendTaskLogForwardsToParent(t *testing.T) {
+	parent := NewBuildState("batch", 1, true, "")
+	child := NewBuildState("child", 1, true, "")
+	child.SetParent(parent, "[api] ")
+
+	child.AppendTaskLog("amd64", "info", "RUN make")
+
+	got := <-parent.Logs
+	if got.Message != "[api] RUN make" || got.BuildID != "child" || got.TaskID != "amd64" {
+		t.Errorf("forwarded entry = %+v, want child build, amd64 task, prefixed message", got)
+	}
+}
+
+func TestSetResultPlatform(t *testing.T) {
+	st := NewBuildState("b-test", 2, false, "")
+	st.SetTaskPlatform("amd64", "ecs")
+	st.SetTaskPlatform("arm64", "k8s")
+
+	st.SetResult("amd64", "amd64", "sha256:amd", true, "")
+	// A result synthesized by the controller, e.g. on heartbeat timeout.
+	st.SetResult("arm64", "arm64", "", false, "agent heartbeat timeout")
+
+	sum := st.Summary()
+	if got := sum.Tasks["amd64"].Platform; got != "ecs" {
+		t.Errorf("amd64 platform = %q, want ecs", got)
+	}
+	if got := sum.Tasks["arm64"].Platform; got != "k8s" {
+		t.Errorf("arm64 platform = %q, want k8s", got)
+	}
+}
+
+func TestSummaryTaskArn(t *testing.T) {
+	st := NewBuildState("b-test", 2, false, "")
+	st.SetEffective([]string{"amd64", "arm64"}, []config.EffectiveConfig{{Arch: "amd64"}, {Arch: "arm64"}})
+	st.SetTaskPlatform("amd64", "ecs")
+	st.SetTaskPlatform("arm64", "ecs")
+	st.Mu.Lock()
+	st.TaskArnByID["amd64"] = "arn:aws:ecs:us-east-1:123456789012:task/bakery/amd"
+	st.TaskArnByID["arm64"] = "arn:aws:ecs:us-east-1:123456789012:task/bakery/arm"
+	st.Mu.Unlock()
+
+	st.SetResult("amd64", "amd64", "sha256:amd", true, "")
+
+	sum := st.Summary()
+	if got := sum.Tasks["amd64"]; got.TaskArn != "arn:aws:ecs:us-east-1:123456789012:task/bakery/amd" || !got.Success {
+		t.Errorf("amd64 = %+v, want finished task with its ARN", got)
+	}
+	// arm64 is still running: it has no result but is listed with its ARN.
+	if got := sum.Tasks["arm64"]; got.TaskArn != "arn:aws:ecs:us-east-1:123456789012:task/bakery/arm" || got.Arch != "arm64" || got.Platform != "ecs" {
+		t.Errorf("arm64 = %+v, want running task with its ARN", got)
+	}
+}
+
+func TestAddChild(t *testing.T) {
+	parent := NewBuildState("batch-test", 1, false, "")
+	parent.AddChild("api", "api-1a2b")
+
+	if got := parent.Children(); got["api"] != "api-1a2b" {
+		t.Errorf("Children() = %v, want api -> api-1a2b", got)
+	}
+	parent.Mu.RLock()
+	arns := len(parent.TaskArnByID) + len(parent.IDByTaskArn)
+	parent.Mu.RUnlock()
+	if arns != 0 {
+		t.Error("AddChild recorded the child as an executor task")
+	}
+
+	parent.SetResult("api", "", "", true, "")
+	if got := parent.Summary().Tasks["api"]; got.TaskArn != "" || !got.Success {
+		t.Errorf("api = %+v, want a succeeded child without a task ARN", got)
+	}
+}
+
+func TestTaskDestinations(t *testing.T) {
+	global := "registry.example.com/app:1.0"
+	mirrors := []string{"mirror.example.com/app:1.0"}
+
+	tests := []struct {
+		name              string
+		singleArch, dupes bool
+		ef                config.EffectiveConfig
+		wantDest          string
+		wantMirrors       []string
+	}{
+		{"single arch", true, false, config.EffectiveConfig{Arch: "amd64", Mirrors: mirrors}, global, mirrors},
+		{"multi arch", false, false, config.EffectiveConfig{Arch: "arm64", Mirrors: mirrors},
+			"registry.example.com/app:1.0_arm64", []string{"mirror.example.com/app:1.0_arm64"}},
+		{"duplicate arch", false, true, config.EffectiveConfig{Arch: "amd64", Mirrors: mirrors, ArchTagSeparator: "-"},
+			"registry.example.com/app:1.0-task-1", []string{"mirror.example.com/app:1.0-task-1"}},
+		{"own destination", false, false, config.EffectiveConfig{Arch: "arm64", Destination: "other.example.com/app:arm"},
+			"other.example.com/app:arm", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := NewBuildState("b-1", 2, tt.singleArch, global)
+			st.HasDuplicateArch = tt.dupes
+			dest, got := st.TaskDestinations("task-1", tt.ef)
+			if dest != tt.wantDest {
+				t.Errorf("destination = %q, want %q", dest, tt.wantDest)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantMirrors) {
+				t.Errorf("mirrors = %v, want %v", got, tt.wantMirrors)
+			}
+		})
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	st := NewBuildState("b-test", 1, true, "")
+
+	a, cancelA := st.Subscribe()
+	b, cancelB := st.Subscribe()
+	defer cancelA()
+
+	st.AppendLog("info", "first")
+	cancelB()
+	cancelB()
+	st.AppendLog("info", "second")
+
+	if e := <-a; e.Message != "first" {
+		t.Errorf("a got %q, want first", e.Message)
+	}
+	if e := <-a; e.Message != "second" {
+		t.Errorf("a got %q, want second", e.Message)
+	}
+	if e := <-b; e.Message != "first" {
+		t.Errorf("b got %q, want first", e.Message)
+	}
+	if _, ok := <-b; ok {
+		t.Error("b still open after cancel")
+	}
+
+	// The Logs channel is unaffected by subscribers.
+	if e := <-st.Logs; e.Message != "first" {
+		t.Errorf("Logs got %q, want first", e.Message)
+	}
+
+	st.Finish(nil)
+	var last LogEntry
+	for e := range a {
+		last = e
+	}
+	if last.Message != "BUILD SUCCEEDED" {
+		t.Errorf("last entry = %q, want BUILD SUCCEEDED", last.Message)
+	}
+
+	late, _ := st.Subscribe()
+	if _, ok := <-late; ok {
+		t.Error("subscription after finish is open")
+	}
+}
+
+func TestFinishEmitsBuildResult(t *testing.T) {
+	parent := NewBuildState("batch-1", 1, false, "")
+	st := NewBuildState("b-test", 1, true, "")
+	st.SetParent(parent, "[api] ")
+
+	st.Finish(errors.New("task amd64 failed: exit=1"))
+
+	var entries []LogEntry
+	for e := range st.Logs {
+		entries = append(entries, e)
+	}
+	if len(entries) < 2 {
+		t.Fatalf("got %d entries, want at least 2", len(entries))
+	}
+	result, marker := entries[len(entries)-2], entries[len(entries)-1]
+	if result.Event != EventBuildResult || result.Status != "failed" || result.Error != "task amd64 failed: exit=1" {
+		t.Errorf("result entry = %+v", result)
+	}
+	if marker.Message != "BUILD FAILED" || marker.Event != "" {
+		t.Errorf("marker entry = %+v, want plain BUILD FAILED", marker)
+	}
+
+	// The child's build_result must not look like the end of the parent build.
+	for len(parent.Logs) > 0 {
+		if e := <-parent.Logs; e.Event != "" {
+			t.Errorf("parent received structured entry %+v", e)
+		}
+	}
+}
+
+func TestSetAttemptResultUnnumbered(t *testing.T) {
+	st := NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+	st.StartAttempt("amd64")
+	st.StartAttempt("amd64")
+
+	if !st.SetAttemptResult("amd64", 0, "amd64", "sha256:old-agent", true, "") {
+		t.Fatal("result from an agent without attempts rejected")
+	}
+	if res := st.GetResults()["amd64"]; res.Attempt != 2 || res.ImageDigest != "sha256:old-agent" {
+		t.Errorf("result = %+v, want it recorded for the current attempt 2", res)
+	}
+}
+
+func TestSetAttemptResultIgnoresStaleAttempt(t *testing.T) {
+	st := NewBuildState("b-test", 1, true, "registry.example.com/app:1.0")
+
+	if got := st.StartAttempt("amd64"); got != 1 {
+		t.Fatalf("first attempt = %d, want 1", got)
+	}
+	if !st.SetAttemptResult("amd64", 1, "amd64", "", false, "agent lost") {
+		t.Fatal("attempt 1 result rejected")
+	}
+
+	// The task is retried and the new agent succeeds.
+	if got := st.StartAttempt("amd64"); got != 2 {
+		t.Fatalf("retry attempt = %d, want 2", got)
+	}
+	if !st.SetAttemptResult("amd64", 2, "amd64", "sha256:retry", true, "") {
+		t.Fatal("attempt 2 result rejected")
+	}
+	if st.HasError() {
+		t.Errorf("build error = %v, want the failed attempt cleared", st.GetError())
+	}
+
+	// The zombie agent of attempt 1 reports late with a different digest.
+	if st.SetAttemptResult("amd64", 1, "amd64", "sha256:stale", true, "") {
+		t.Error("stale attempt 1 result accepted")
+	}
+	if !st.IsStaleAttempt("amd64", 1) || st.IsStaleAttempt("amd64", 2) {
+		t.Error("IsStaleAttempt does not match the current attempt")
+	}
+
+	// An agent that predates attempts reports attempt 0, taken as the current attempt,
+	// so it cannot replace the result attempt 2 already recorded.
+	if st.IsStaleAttempt("amd64", 0) {
+		t.Error("IsStaleAttempt(0) = true, want attempt 0 taken as current")
+	}
+	if st.SetAttemptResult("amd64", 0, "amd64", "sha256:retry", true, "") {
+		t.Error("duplicate attempt 0 result accepted after attempt 2")
+	}
+
+	res := st.GetResults()["amd64"]
+	if res.ImageDigest != "sha256:retry" || res.Attempt != 2 {
+		t.Errorf("result = %+v, want attempt 2 with sha256:retry", res)
+	}
+	if st.ResultsReceived != 1 || !st.AllResultsReceived() {
+		t.Errorf("ResultsReceived = %d, want 1", st.ResultsReceived)
+	}
+
+	for len(st.Logs) > 0 {
+		if e := <-st.Logs; strings.Contains(e.Message, "CRITICAL") {
+			t.Errorf("stale result logged as critical: %s", e.Message)
+		}
+	}
+}
+
+func TestPurgeWaitsForLogStreams(t *testing.T) {
+	s := NewStore()
+	st := NewBuildState("b1", 1, true, "")
+	s.Register("b1", st)
+
+	logs, cancel := st.Subscribe()
+	defer cancel()
+	streamDone := st.TrackStream()
+
+	// A log stream is still writing the entries it drained from the subscription.
+	written := make(chan struct{})
+	go func() {
+		for range logs {
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(written)
+		streamDone()
+	}()
+
+	report, ok := s.Purge("b1", 5*time.Second)
+	if !ok {
+		t.Fatal("Purge: build not found")
+	}
+	select {
+	case <-written:
+	default:
+		t.Error("Purge returned before the log stream finished writing")
+	}
+	if !report.StreamsDrained {
+		t.Error("StreamsDrained = false, want true")
+	}
+	if !errors.Is(st.Context().Err(), context.Canceled) || !errors.Is(context.Cause(st.Context()), ErrPurged) {
+		t.Errorf("context cause = %v, want ErrPurged", context.Cause(st.Context()))
+	}
+	if _, ok := s.Get("b1"); ok {
+		t.Error("purged build still in store")
+	}
+
+	stuck := NewBuildState("b2", 1, true, "")
+	s.Register("b2", stuck)
+	stuck.TrackStream()
+	if report, _ := s.Purge("b2", 20*time.Millisecond); report.StreamsDrained {
+		t.Error("StreamsDrained = true for a stream that never finished")
+	}
+}
+
+func TestFinishWaitsForLateIngest(t *testing.T) {
+	t.Run("late stream", func(t *testing.T) {
+		st := NewBuildState("b1", 1, true, "")
+		st.SetIngestGrace(5 * time.Second)
+		logs, cancel := st.Subscribe()
+		defer cancel()
+
+		// The agent reported its result before its ingest stream connected.
+		st.SetResult("amd64", "amd64", "sha256:abc", true, "")
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			st.MarkIngestStarted("amd64")
+			st.AppendTaskLog("amd64", "info", "late kaniko line")
+			st.MarkIngestDone("amd64")
+		}()
+		st.Finish(nil)
+
+		var messages []string
+		for e := range logs {
+			messages = append(messages, e.Message)
+		}
+		late, done := -1, -1
+		for i, m := range messages {
+			switch m {
+			case "late kaniko line":
+				late = i
+			case "BUILD SUCCEEDED":
+				done = i
+			}
+		}
+		if late == -1 || late > done {
+			t.Errorf("late line at %d, BUILD SUCCEEDED at %d, want the late line first: %v", late, done, messages)
+		}
+	})
+
+	t.Run("grace deadline", func(t *testing.T) {
+		st := NewBuildState("b2", 1, true, "")
+		st.SetIngestGrace(30 * time.Millisecond)
+		st.MarkIngestStarted("amd64")
+
+		start := time.Now()
+		st.Finish(nil)
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Finish took %s, want it bounded by the grace period", elapsed)
+		}
+		if !st.IsFinished() {
+			t.Error("build not finished after the grace period")
+		}
+	})
+
+	t.Run("build deadline", func(t *testing.T) {
+		st := NewBuildState("b3", 1, true, "")
+		st.SetIngestGrace(10 * time.Second)
+		st.SetIngestDeadline(time.Now().Add(30 * time.Millisecond))
+		st.MarkIngestStarted("amd64")
+
+		start := time.Now()
+		st.Finish(nil)
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Finish took %s, want it bounded by the ingest deadline", elapsed)
+		}
+	})
+}
+
+func TestMaxLogBytes(t *testing.T) {
+	st := NewBuildState("b1", 1, true, "")
+	st.SetMaxLogBytes(10)
+	logs, cancel := st.Subscribe()
+	defer cancel()
+
+	st.AppendTaskLog("amd64", "info", "12345")
+	st.AppendTaskLog("amd64", "info", "67890")
+	st.AppendTaskLog("amd64", "info", "over")
+	st.AppendTaskLog("amd64", "info", "dropped")
+	st.AppendLog("info", "controller line")
+	st.Finish(nil)
+
+	var messages []string
+	for e := range logs {
+		messages = append(messages, e.Message)
+	}
+
+	notices := 0
+	for _, m := range messages {
+		switch {
+		case m == "over" || m == "dropped":
+			t.Errorf("line %q kept past the cap", m)
+		case strings.HasPrefix(m, "log output capped"):
+			notices++
+		}
+	}
+	if notices != 1 {
+		t.Errorf("got %d cap notices, want 1: %v", notices, messages)
+	}
+	if len(messages) < 4 || messages[0] != "12345" || messages[1] != "67890" || messages[3] != "controller line" {
+		t.Errorf("messages = %v, want the lines under the cap, the notice, then controller lines", messages)
+	}
+	if st.logBytes != 10 {
+		t.Errorf("logBytes = %d, want 10", st.logBytes)
+	}
+}
+
+func TestHeartbeatExpired(t *testing.T) {
+	st := NewBuildState("b-test", 1, true, "")
+
+	if st.HeartbeatExpired("t1", time.Millisecond) {
+		t.Error("expired before the agent connected")
+	}
+
+	st.MarkHeartbeat("t1")
+	if st.HeartbeatExpired("t1", time.Hour) {
+		t.Error("expired right after a heartbeat")
+	}
+
+	st.Mu.Lock()
+	st.LastHeartbeat["t1"] = time.Now().Add(-time.Minute)
+	st.Mu.Unlock()
+	if !st.HeartbeatExpired("t1", time.Second) {
+		t.Error("not expired after a minute of silence")
+	}
+
+	st.MarkIngestDone("t1")
+	if st.HeartbeatExpired("t1", time.Second) {
+		t.Error("expired after the ingest stream closed")
+	}
+}
+
+func TestSetTaskErrorClearedByRetry(t *testing.T) {
+	st := NewBuildState("b-test", 2, false, "registry.example.com/app:1.0")
+	st.StartAttempt("amd64")
+	st.StartAttempt("arm64")
+
+	st.SetTaskError("amd64", errors.New("agent exit=137"))
+	st.SetTaskError("arm64", errors.New("pod never started"))
+	if err := st.GetError(); err == nil || err.Error() != "agent exit=137" {
+		t.Fatalf("build error = %v, want the first task error", err)
+	}
+	if err := st.AttemptError("arm64"); err == nil || err.Error() != "pod never started" {
+		t.Errorf("AttemptError(arm64) = %v, want pod never started", err)
+	}
+
+	// Retrying amd64 drops its error; the arm64 failure still fails the build.
+	st.StartAttempt("amd64")
+	if err := st.AttemptError("amd64"); err != nil {
+		t.Errorf("AttemptError(amd64) after a retry = %v, want nil", err)
+	}
+	if err := st.GetError(); err == nil || err.Error() != "pod never started" {
+		t.Errorf("build error = %v, want the arm64 failure", err)
+	}
+
+	// Build-level errors are never dropped by a retry.
+	st.SetError(errors.New("manifest failed"))
+	st.StartAttempt("arm64")
+	if err := st.GetError(); err == nil || err.Error() != "manifest failed" {
+		t.Errorf("build error = %v, want the build-level error", err)
+	}
+}